@@ -0,0 +1,142 @@
+package main
+
+import (
+	"chatapp/internal/crypto"
+	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: go run cmd/import-users/main.go <users.csv | ->")
+		os.Exit(2)
+	}
+	// Imported usernames and passwords follow the length bounds the server
+	// enforces.
+	if err := limits.ConfigureFromEnv(os.Getenv); err != nil {
+		log.Fatal(err)
+	}
+	input := os.Stdin
+	if os.Args[1] != "-" {
+		file, err := os.Open(os.Args[1])
+		if err != nil {
+			log.Fatal("Failed to open CSV:", err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	users, err := readUsers(input)
+	if err != nil {
+		log.Fatal("Nothing imported: ", err)
+	}
+
+	databasePath := os.Getenv("DB_PATH")
+	if databasePath == "" {
+		databasePath = "chatapp.db"
+	}
+	database, err := db.InitDB(databasePath)
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer database.Close()
+
+	skipped, err := db.ImportUsers(context.Background(), users)
+	if err != nil {
+		log.Fatal("Nothing imported: ", err)
+	}
+	fmt.Printf("Imported %d of %d users.\n", len(users)-len(skipped), len(users))
+	if len(skipped) > 0 {
+		fmt.Printf("Skipped %d existing usernames: %s\n", len(skipped), strings.Join(skipped, ", "))
+	}
+}
+
+// csvHeader is the optional first row of an import file.
+var csvHeader = []string{"username", "password", "public_key"}
+
+// readUsers parses rows of username,password,public_key and returns the users
+// to create. The password column holds either a plaintext password, which is
+// hashed, or an existing bcrypt hash, which is kept. Public keys are base64 as
+// the registration API takes them. Any invalid row fails the whole file before
+// anything is hashed.
+func readUsers(input io.Reader) ([]db.ImportedUser, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = len(csvHeader)
+
+	type row struct {
+		line     int
+		user     db.ImportedUser
+		password string
+	}
+	rows := make([]row, 0)
+	seen := make(map[string]int)
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if first && isHeader(record) {
+			continue
+		}
+
+		username := strings.TrimSpace(record[0])
+		if !limits.ValidUsername(username) {
+			return nil, fmt.Errorf("line %d: invalid username %q", line, username)
+		}
+		if previous, ok := seen[username]; ok {
+			return nil, fmt.Errorf("line %d: username %q already appears on line %d", line, username, previous)
+		}
+		seen[username] = line
+
+		password := record[1]
+		if _, err := bcrypt.Cost([]byte(password)); err != nil && !limits.ValidPassword(password) {
+			return nil, fmt.Errorf("line %d: %s, or a bcrypt hash", line, limits.PasswordError())
+		}
+
+		publicKey, err := crypto.DecodeKey(strings.TrimSpace(record[2]))
+		if err != nil || !crypto.ValidPublicKey(publicKey) {
+			return nil, fmt.Errorf("line %d: invalid public key for %q", line, username)
+		}
+		rows = append(rows, row{line: line, user: db.ImportedUser{Username: username, PublicKey: publicKey}, password: password})
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no users to import")
+	}
+
+	users := make([]db.ImportedUser, 0, len(rows))
+	for _, row := range rows {
+		row.user.PasswordHash = row.password
+		if _, err := bcrypt.Cost([]byte(row.password)); err != nil {
+			hash, err := db.HashPassword(row.password)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: hash password: %w", row.line, err)
+			}
+			row.user.PasswordHash = hash
+		}
+		users = append(users, row.user)
+	}
+	return users, nil
+}
+
+func isHeader(record []string) bool {
+	for index, name := range csvHeader {
+		if !strings.EqualFold(strings.TrimSpace(record[index]), name) {
+			return false
+		}
+	}
+	return true
+}
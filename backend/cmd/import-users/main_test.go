@@ -0,0 +1,59 @@
+package main
+
+import (
+	"chatapp/internal/crypto"
+	"chatapp/internal/db"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReadUsersHashesPasswordsAndKeepsHashes(t *testing.T) {
+	key := crypto.EncodeKey(make([]byte, crypto.X25519PublicKeySize))
+	existingHash, err := bcrypt.GenerateFromPassword([]byte("migrated-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "username,password,public_key\n" +
+		"alice,plain-password," + key + "\n" +
+		"bob," + string(existingHash) + "," + key + "\n"
+
+	users, err := readUsers(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Username != "alice" || users[1].Username != "bob" {
+		t.Fatalf("users = %+v", users)
+	}
+	if !db.CheckPassword("plain-password", users[0].PasswordHash) {
+		t.Fatal("plaintext password was not hashed")
+	}
+	if users[1].PasswordHash != string(existingHash) {
+		t.Fatal("existing bcrypt hash was not kept")
+	}
+}
+
+func TestReadUsersRejectsMalformedFiles(t *testing.T) {
+	key := crypto.EncodeKey(make([]byte, crypto.X25519PublicKeySize))
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "username,password,public_key\n", "no users"},
+		{"missing column", "alice,plain-password\n", "wrong number of fields"},
+		{"short password", "alice,short," + key + "\n", "line 1: password"},
+		{"invalid key", "alice,plain-password,AAAA\n", "line 1: invalid public key"},
+		{"invalid username", "a,plain-password," + key + "\n", "line 1: invalid username"},
+		{"duplicate", "alice,plain-password," + key + "\nalice,other-password," + key + "\n", "line 2: username \"alice\" already appears on line 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users, err := readUsers(strings.NewReader(test.input))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("readUsers() = %v, %v; want error containing %q", users, err, test.want)
+			}
+		})
+	}
+}
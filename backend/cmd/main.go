@@ -4,6 +4,8 @@ import (
 	"chatapp/internal/api"
 	"chatapp/internal/auth"
 	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"chatapp/internal/push"
 	"chatapp/internal/ws"
 	"context"
 	"encoding/json"
@@ -20,15 +22,66 @@ func main() {
 	if err := auth.Configure(os.Getenv("JWT_SECRET")); err != nil {
 		log.Fatal(err)
 	}
+	if err := auth.ConfigureTokenLifetimes(os.Getenv("ACCESS_TOKEN_TTL"), os.Getenv("REFRESH_TOKEN_TTL")); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ConfigureRefreshTokenTransport(os.Getenv("REFRESH_TOKEN_TRANSPORT")); err != nil {
+		log.Fatal(err)
+	}
 	if err := api.ConfigureAllowedOrigins(os.Getenv("ALLOWED_ORIGINS")); err != nil {
 		log.Fatal(err)
 	}
+	if err := api.ConfigureWebSocketOrigins(os.Getenv("WEBSOCKET_ORIGINS")); err != nil {
+		log.Fatal(err)
+	}
 	if err := api.ConfigureBootstrapSecret(os.Getenv("BOOTSTRAP_SECRET")); err != nil {
 		log.Fatal(err)
 	}
+	if err := api.ConfigureBootstrapInvite(os.Getenv("BOOTSTRAP_INVITE")); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ConfigureOpenRegistration(os.Getenv("OPEN_REGISTRATION"), os.Getenv("REGISTRATION_POW_BITS")); err != nil {
+		log.Fatal(err)
+	}
+	if err := limits.ConfigureFromEnv(os.Getenv); err != nil {
+		log.Fatal(err)
+	}
+	if err := limits.ConfigureUsernamePolicy(os.Getenv("RESERVED_USERNAMES"), os.Getenv("USERNAME_PATTERN")); err != nil {
+		log.Fatal(err)
+	}
 	if err := api.ConfigureTrustedProxyHeaders(os.Getenv("TRUST_PROXY_HEADERS")); err != nil {
 		log.Fatal("Invalid TRUST_PROXY_HEADERS value:", err)
 	}
+	if err := api.ConfigureWelcomeMessage(os.Getenv("WELCOME_SYSTEM_USER_ID"), os.Getenv("WELCOME_MESSAGE")); err != nil {
+		log.Fatal(err)
+	}
+	if err := push.Configure(os.Getenv("PUSH_PROVIDER"), os.Getenv("PUSH_GATEWAY_URL")); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ConfigureWebSocketHandshakeRate(os.Getenv("WEBSOCKET_HANDSHAKE_RATE")); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ConfigureEscrow(os.Getenv("ESCROW_PUBLIC_KEY")); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.ConfigureKeyUpdateInterval(os.Getenv("KEY_UPDATE_MIN_INTERVAL")); err != nil {
+		log.Fatal(err)
+	}
+	if err := ws.ConfigureReauthGracePeriod(os.Getenv("WS_REAUTH_GRACE_PERIOD")); err != nil {
+		log.Fatal(err)
+	}
+	if err := ws.ConfigureSignalingLimits(os.Getenv("WS_SIGNALING_RATE"), os.Getenv("WS_SIGNALING_PEER_RATE")); err != nil {
+		log.Fatal(err)
+	}
+	if err := ws.ConfigureIdleTimeout(os.Getenv("WS_IDLE_TIMEOUT")); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.ConfigureMessageEditWindow(os.Getenv("MESSAGE_EDIT_WINDOW")); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.ConfigureStorageQuota(os.Getenv("STORAGE_QUOTA_BYTES"), os.Getenv("STORAGE_QUOTA_POLICY")); err != nil {
+		log.Fatal(err)
+	}
 
 	// Initialize database
 	databasePath := os.Getenv("DB_PATH")
@@ -40,6 +93,9 @@ func main() {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer database.Close()
+	if err := api.IssueBootstrapInvite(); err != nil {
+		log.Fatal("Failed to issue bootstrap invite:", err)
+	}
 
 	// Set up routes
 	mux := http.NewServeMux()
@@ -48,6 +104,7 @@ func main() {
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
@@ -85,6 +142,7 @@ func main() {
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	go api.PruneRevokedTokens(ctx)
 
 	serverErrors := make(chan error, 1)
 	go func() {
@@ -104,6 +162,7 @@ func main() {
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Printf("Graceful shutdown failed: %v", err)
 		}
+		push.Shutdown()
 	}
 }
 
@@ -111,15 +170,22 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
 		if origin != "" {
-			if !api.IsOriginAllowed(r) {
+			allowed := api.IsOriginAllowed(r)
+			if !allowed && r.URL.Path == "/api/ws" {
+				allowed = api.IsWebSocketOriginAllowed(r)
+			}
+			if !allowed {
 				http.Error(w, "origin not allowed", http.StatusForbidden)
 				return
 			} else {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 				w.Header().Add("Vary", "Origin")
+				if api.RefreshTokensInCookie() {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
 			}
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
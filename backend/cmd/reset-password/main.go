@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"chatapp/internal/db"
+	"chatapp/internal/limits"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"golang.org/x/term"
@@ -24,12 +26,16 @@ func main() {
 		log.Fatal("Username is required")
 	}
 
+	if err := limits.ConfigureFromEnv(os.Getenv); err != nil {
+		log.Fatal(err)
+	}
+
 	password, err := readPassword()
 	if err != nil {
 		log.Fatal("Failed to read password:", err)
 	}
-	if len(password) < 8 || len(password) > 72 {
-		log.Fatal("Password must be between 8 and 72 characters")
+	if !limits.ValidPassword(password) {
+		log.Fatal("Invalid password: ", limits.PasswordError())
 	}
 
 	databasePath := os.Getenv("DB_PATH")
@@ -60,6 +66,12 @@ func main() {
 	fmt.Printf("Password updated for user %q.\n", username)
 }
 
+// defaultPromptAttempts is how many times the interactive prompt may be
+// retried after a mismatched or invalid entry before giving up.
+const defaultPromptAttempts = 3
+
+var errPasswordRejected = errors.New("password rejected")
+
 func readPassword() (string, error) {
 	if password := os.Getenv("CHATAPP_RESET_PASSWORD"); password != "" {
 		return password, nil
@@ -74,6 +86,39 @@ func readPassword() (string, error) {
 		return strings.TrimRight(password, "\r\n"), nil
 	}
 
+	attempts, err := promptAttempts(os.Getenv("RESET_PASSWORD_ATTEMPTS"))
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		password, err := promptPassword(stdin)
+		if err == nil {
+			return password, nil
+		}
+		if !errors.Is(err, errPasswordRejected) {
+			return "", err
+		}
+		if attempt >= attempts {
+			return "", fmt.Errorf("%w after %d attempts", err, attempts)
+		}
+		fmt.Fprintf(os.Stderr, "%v, try again (%d attempts left)\n", err, attempts-attempt)
+	}
+}
+
+func promptAttempts(value string) (int, error) {
+	if value == "" {
+		return defaultPromptAttempts, nil
+	}
+	attempts, err := strconv.Atoi(value)
+	if err != nil || attempts < 1 || attempts > 10 {
+		return 0, fmt.Errorf("RESET_PASSWORD_ATTEMPTS must be between 1 and 10")
+	}
+	return attempts, nil
+}
+
+// promptPassword reads the new password twice without echo. Typos and
+// passwords that fail validation are reported as errPasswordRejected.
+func promptPassword(stdin int) (string, error) {
 	fmt.Fprint(os.Stderr, "New password: ")
 	password, err := term.ReadPassword(stdin)
 	fmt.Fprintln(os.Stderr)
@@ -87,7 +132,10 @@ func readPassword() (string, error) {
 		return "", err
 	}
 	if !bytes.Equal(password, confirmation) {
-		return "", errors.New("passwords do not match")
+		return "", fmt.Errorf("%w: passwords do not match", errPasswordRejected)
+	}
+	if !limits.ValidPassword(string(password)) {
+		return "", fmt.Errorf("%w: %s", errPasswordRejected, limits.PasswordError())
 	}
 	return string(password), nil
 }
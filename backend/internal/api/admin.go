@@ -0,0 +1,91 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"chatapp/internal/ws"
+	"log"
+	"net/http"
+	"time"
+)
+
+// adminMiddleware restricts an authenticated route to administrators.
+// It must be wrapped by authMiddleware.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := db.GetUserByID(getUserID(r))
+		if err != nil {
+			log.Printf("Failed to load user %d for admin check: %v", getUserID(r), err)
+			errorResponse(w, http.StatusInternalServerError, "failed to authorize request")
+			return
+		}
+		if user == nil || !user.IsAdmin {
+			errorResponse(w, http.StatusForbidden, "admin access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func handleGetReferrals(w http.ResponseWriter, r *http.Request) {
+	referrals, err := db.GetReferrals()
+	if err != nil {
+		log.Printf("Failed to load referrals: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load referrals")
+		return
+	}
+	jsonResponse(w, http.StatusOK, referrals)
+}
+
+func handleGetInviteUsage(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	if code == "" || len(code) > limits.Current().InviteCodeMaxLength {
+		errorResponse(w, http.StatusBadRequest, "invalid invite code")
+		return
+	}
+	usage, err := db.GetInviteUsage(code)
+	if err != nil {
+		log.Printf("Failed to load usage of invite: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load invite usage")
+		return
+	}
+	if usage == nil {
+		errorResponse(w, http.StatusNotFound, "invite not found")
+		return
+	}
+	jsonResponse(w, http.StatusOK, usage)
+}
+
+// handleGetHubStats shows connected sessions with their send buffer use and
+// drop counts, to diagnose "send buffer full" drops without reading logs.
+func handleGetHubStats(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, ws.GetHub().Stats(time.Now()))
+}
+
+// handleGetConversationActivity pages through who talks to whom, how much and
+// how recently, for abuse investigations. Content stays end-to-end encrypted
+// and is never included; every access is logged.
+func handleGetConversationActivity(w http.ResponseWriter, r *http.Request) {
+	limit, beforeID, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("AUDIT: admin %d listed conversation activity (limit=%d, before_id=%d)", getUserID(r), limit, beforeID)
+
+	conversations, err := db.GetConversationActivity(limit+1, beforeID)
+	if err != nil {
+		log.Printf("Failed to load conversation activity: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load conversations")
+		return
+	}
+	var nextCursor *int64
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		cursor := conversations[len(conversations)-1].LastMessageID
+		nextCursor = &cursor
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"conversations": conversations,
+		"next_cursor":   nextCursor,
+	})
+}
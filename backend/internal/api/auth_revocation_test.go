@@ -4,10 +4,16 @@ import (
 	"chatapp/internal/auth"
 	"chatapp/internal/db"
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestPasswordResetRevokesExistingToken(t *testing.T) {
@@ -68,3 +74,284 @@ func TestPasswordResetRevokesExistingToken(t *testing.T) {
 		t.Fatalf("replacement token was rejected with status %d", recorder.Code)
 	}
 }
+
+func TestVerifyTokenReturnsClaimsOnly(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		db.DB = nil
+	})
+	if err := auth.Configure("0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := authMiddleware(handleVerifyToken)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/auth/verify", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var claims map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["username"] != "alice" || claims["user_id"] != float64(user.ID) || claims["expires_at"] == nil || len(claims) != 4 {
+		t.Fatalf("unexpected claims %v", claims)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/api/auth/verify", nil)
+	request.Header.Set("Authorization", "Bearer "+token[:len(token)-2])
+	recorder = httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("tampered token status = %d, want 401", recorder.Code)
+	}
+}
+
+func TestRefreshRotatesTokensAndRejectsRevokedOnes(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		db.DB = nil
+	})
+	const secret = "0123456789abcdef0123456789abcdef"
+	if err := auth.Configure(secret); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func(body string) (int, map[string]string) {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handleRefresh(recorder, request)
+		var response map[string]string
+		_ = json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response
+	}
+	issued := 0
+	expiredToken := func(age time.Duration) string {
+		t.Helper()
+		issued++
+		claims := auth.Claims{UserID: user.ID, Username: user.Username, Version: user.AuthVersion, RegisteredClaims: jwt.RegisteredClaims{
+			ID:        fmt.Sprintf("expired-token-%d", issued),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-age)),
+		}}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	renewable := expiredToken(time.Minute)
+	status, response := refresh(fmt.Sprintf(`{"token":%q}`, renewable))
+	if status != http.StatusOK || response["token"] == "" || response["refresh_token"] != "" {
+		t.Fatalf("expired but refreshable token = %d %v", status, response)
+	}
+	if claims, err := auth.ValidateToken(response["token"]); err != nil || claims.UserID != user.ID || claims.Username != "alice" {
+		t.Fatalf("refreshed token claims = %+v, %v", claims, err)
+	}
+	if status, _ := refresh(fmt.Sprintf(`{"token":%q}`, renewable)); status != http.StatusUnauthorized {
+		t.Fatalf("renewed access token was renewed again with status %d", status)
+	}
+	if status, _ := refresh(fmt.Sprintf(`{"token":%q}`, expiredToken(time.Hour))); status != http.StatusUnauthorized {
+		t.Fatalf("fully expired token status = %d, want 401", status)
+	}
+
+	_, first, err := sessionTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response = refresh(fmt.Sprintf(`{"refresh_token":%q}`, first))
+	if status != http.StatusOK || response["token"] == "" || response["refresh_token"] == "" || response["refresh_token"] == first {
+		t.Fatalf("rotation = %d %v", status, response)
+	}
+	second := response["refresh_token"]
+	if status, _ := refresh(fmt.Sprintf(`{"refresh_token":%q}`, first)); status != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token status = %d, want 401", status)
+	}
+
+	if err := db.UpdatePasswordHash(user.ID, "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := refresh(fmt.Sprintf(`{"refresh_token":%q}`, second)); status != http.StatusUnauthorized {
+		t.Fatalf("refresh token survived a password reset with status %d", status)
+	}
+	if status, _ := refresh(fmt.Sprintf(`{"token":%q}`, expiredToken(time.Minute))); status != http.StatusUnauthorized {
+		t.Fatalf("access token survived a password reset with status %d", status)
+	}
+}
+
+func TestLogoutRevokesOnlyThatToken(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		db.DB = nil
+	})
+	if err := auth.Configure("0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost, refreshToken, err := sessionTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(handler http.HandlerFunc, token, body string) int {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		if body != "" {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		recorder := httptest.NewRecorder()
+		authMiddleware(handler)(recorder, request)
+		return recorder.Code
+	}
+	protected := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	if status := call(handleLogout, lost, fmt.Sprintf(`{"refresh_token":%q}`, refreshToken)); status != http.StatusOK {
+		t.Fatalf("logout status = %d", status)
+	}
+	if status := call(protected, lost, ""); status != http.StatusUnauthorized {
+		t.Fatalf("logged out token status = %d, want 401", status)
+	}
+	if status := call(protected, other, ""); status != http.StatusNoContent {
+		t.Fatalf("another token of the user was rejected with %d", status)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(fmt.Sprintf(`{"refresh_token":%q}`, refreshToken)))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handleRefresh(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh token survived logout with status %d", recorder.Code)
+	}
+	request = httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(fmt.Sprintf(`{"token":%q}`, lost)))
+	request.Header.Set("Content-Type", "application/json")
+	recorder = httptest.NewRecorder()
+	handleRefresh(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("logged out token was refreshed with status %d", recorder.Code)
+	}
+}
+
+func TestRefreshTokenCookieTransport(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		db.DB = nil
+	})
+	if err := auth.Configure("0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureRefreshTokenTransport("cookie"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureRefreshTokenTransport("") })
+	user, err := db.RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, first, err := sessionTokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func(body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/api/refresh", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		handleRefresh(recorder, request)
+		return recorder
+	}
+	cookieOf := func(recorder *httptest.ResponseRecorder) *http.Cookie {
+		t.Helper()
+		for _, cookie := range recorder.Result().Cookies() {
+			if cookie.Name == refreshTokenCookie {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	if recorder := refresh(fmt.Sprintf(`{"refresh_token":%q}`, first), nil); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("refresh token in the body status = %d, want 400", recorder.Code)
+	}
+	recorder := refresh("", &http.Cookie{Name: refreshTokenCookie, Value: first})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("cookie refresh status = %d", recorder.Code)
+	}
+	if strings.Contains(recorder.Body.String(), "refresh_token") {
+		t.Fatalf("refresh token leaked into the body: %s", recorder.Body.String())
+	}
+	next := cookieOf(recorder)
+	if next == nil || next.Value == "" || next.Value == first || !next.HttpOnly || !next.Secure ||
+		next.SameSite != http.SameSiteStrictMode || next.Path != refreshTokenCookiePath || next.MaxAge <= 0 {
+		t.Fatalf("rotated cookie = %+v", next)
+	}
+
+	recorder = refresh("", &http.Cookie{Name: refreshTokenCookie, Value: first})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("reused cookie status = %d, want 401", recorder.Code)
+	}
+	if cleared := cookieOf(recorder); cleared == nil || cleared.MaxAge >= 0 {
+		t.Fatalf("rejected cookie was not cleared: %+v", cleared)
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: next.Value})
+	recorder = httptest.NewRecorder()
+	authMiddleware(handleLogout)(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("logout status = %d", recorder.Code)
+	}
+	if cleared := cookieOf(recorder); cleared == nil || cleared.MaxAge >= 0 {
+		t.Fatalf("logout did not clear the cookie: %+v", cleared)
+	}
+	if recorder := refresh("", &http.Cookie{Name: refreshTokenCookie, Value: next.Value}); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("cookie survived logout with status %d", recorder.Code)
+	}
+}
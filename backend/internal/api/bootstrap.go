@@ -1,15 +1,19 @@
 package api
 
 import (
+	"chatapp/internal/db"
 	"crypto/sha256"
 	"crypto/subtle"
 	"fmt"
+	"log"
+	"strconv"
 	"sync"
 )
 
 var bootstrapConfiguration struct {
 	sync.RWMutex
 	secretHash []byte
+	invite     bool
 }
 
 func ConfigureBootstrapSecret(secret string) error {
@@ -35,3 +39,38 @@ func validBootstrapSecret(candidate string) bool {
 	bootstrapConfiguration.RUnlock()
 	return valid
 }
+
+// ConfigureBootstrapInvite enables issuing a one-time invite for the first
+// account when the server starts with an empty database.
+func ConfigureBootstrapInvite(value string) error {
+	enabled := false
+	if value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("BOOTSTRAP_INVITE must be true or false")
+		}
+		enabled = parsed
+	}
+	bootstrapConfiguration.Lock()
+	bootstrapConfiguration.invite = enabled
+	bootstrapConfiguration.Unlock()
+	return nil
+}
+
+// IssueBootstrapInvite creates and logs the first-account invite when enabled.
+// The invite is only created while the database has no users and no invites,
+// so it is logged once rather than on every restart.
+func IssueBootstrapInvite() error {
+	bootstrapConfiguration.RLock()
+	enabled := bootstrapConfiguration.invite
+	bootstrapConfiguration.RUnlock()
+	if !enabled {
+		return nil
+	}
+	code, err := db.CreateBootstrapInvite()
+	if err != nil || code == "" {
+		return err
+	}
+	log.Printf("BOOTSTRAP INVITE: register the first (admin) account with invite code %s. It is shown only once and stops working after one use.", code)
+	return nil
+}
@@ -0,0 +1,378 @@
+package api
+
+import (
+	"chatapp/internal/crypto"
+	"chatapp/internal/db"
+	"chatapp/internal/ws"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// conversationUser parses the {userID} path value and checks that it names
+// another existing user, writing an error response and returning 0 otherwise.
+func conversationUser(w http.ResponseWriter, r *http.Request) int64 {
+	otherID, err := strconv.ParseInt(r.PathValue("userID"), 10, 64)
+	if err != nil || otherID < 1 || otherID == getUserID(r) {
+		errorResponse(w, http.StatusBadRequest, "invalid user ID")
+		return 0
+	}
+	otherUser, err := db.GetUserByID(otherID)
+	if err != nil {
+		log.Printf("Failed to fetch conversation user %d: %v", otherID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
+		return 0
+	}
+	if otherUser == nil {
+		errorResponse(w, http.StatusNotFound, "user not found")
+		return 0
+	}
+	return otherID
+}
+
+var handleConversationPrefs = methods(map[string]http.HandlerFunc{
+	http.MethodGet: handleGetConversationPrefs,
+	http.MethodPut: handleUpdateConversationPrefs,
+})
+
+func handleGetConversationPrefs(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID := conversationUser(w, r)
+	if otherID == 0 {
+		return
+	}
+	prefs, err := db.GetConversationPrefs(userID, otherID)
+	if err != nil {
+		log.Printf("Failed to load conversation prefs of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load preferences")
+		return
+	}
+	jsonResponse(w, http.StatusOK, prefs)
+}
+
+func handleUpdateConversationPrefs(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID := conversationUser(w, r)
+	if otherID == 0 {
+		return
+	}
+	var update db.ConversationPrefsUpdate
+	if err := decodeJSON(w, r, &update, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	prefs, err := db.UpdateConversationPrefs(userID, otherID, update)
+	if err != nil {
+		log.Printf("Failed to update conversation prefs of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to update preferences")
+		return
+	}
+	notifyPrefsUpdated(userID, prefs)
+	jsonResponse(w, http.StatusOK, prefs)
+}
+
+var handleConversationAppearance = methods(map[string]http.HandlerFunc{
+	http.MethodGet: handleGetConversationAppearance,
+	http.MethodPut: handleSetConversationAppearance,
+})
+
+func handleGetConversationAppearance(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID := conversationUser(w, r)
+	if otherID == 0 {
+		return
+	}
+	appearance, err := db.GetConversationAppearance(userID, otherID)
+	if err != nil {
+		log.Printf("Failed to load conversation appearance of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load appearance")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"other_user_id": otherID, "appearance": appearance})
+}
+
+func handleSetConversationAppearance(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID := conversationUser(w, r)
+	if otherID == 0 {
+		return
+	}
+	var req struct {
+		Appearance string `json:"appearance"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if len(req.Appearance) > db.MaximumAppearanceSize {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("appearance must not exceed %d bytes", db.MaximumAppearanceSize))
+		return
+	}
+	if err := db.SetConversationAppearance(userID, otherID, req.Appearance); err != nil {
+		log.Printf("Failed to save conversation appearance of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to save appearance")
+		return
+	}
+	response := map[string]interface{}{"other_user_id": otherID, "appearance": req.Appearance}
+	data, _ := json.Marshal(response)
+	ws.GetHub().SendMessage(userID, ws.Message{
+		Type:      "appearance_updated",
+		From:      otherID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+	jsonResponse(w, http.StatusOK, response)
+}
+
+func handleGetConversations(w http.ResponseWriter, r *http.Request) {
+	includeArchived := false
+	if value := r.URL.Query().Get("include_archived"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, "include_archived must be true or false")
+			return
+		}
+		includeArchived = parsed
+	}
+	preview := false
+	if value := r.URL.Query().Get("preview"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, "preview must be true or false")
+			return
+		}
+		preview = parsed
+	}
+	var activeSince time.Time
+	if value := r.URL.Query().Get("active_since"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, "active_since must be an RFC 3339 timestamp")
+			return
+		}
+		activeSince = parsed
+	}
+
+	userID := getUserID(r)
+	if preview {
+		previews, err := db.GetConversationPreviews(userID, includeArchived, activeSince)
+		if err != nil {
+			log.Printf("Failed to list conversation previews of user %d: %v", userID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to list conversations")
+			return
+		}
+		hub := ws.GetHub()
+		for index := range previews {
+			previews[index].Online = hub.IsOnline(previews[index].OtherUserID)
+		}
+		jsonResponse(w, http.StatusOK, map[string]interface{}{"conversations": previews})
+		return
+	}
+	conversations, err := db.GetConversations(userID, includeArchived, activeSince)
+	if err != nil {
+		log.Printf("Failed to list conversations of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to list conversations")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"conversations": conversations})
+}
+
+func handleGetConversationVersion(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID := conversationUser(w, r)
+	if otherID == 0 {
+		return
+	}
+	version, err := db.GetConversationVersion(userID, otherID)
+	if err != nil {
+		log.Printf("Failed to load conversation version of users %d and %d: %v", userID, otherID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load conversation version")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]int64{"other_user_id": otherID, "version": version})
+}
+
+// validNickname reports whether a trimmed nickname can be stored. An empty
+// nickname clears the current one.
+func validNickname(nickname string) bool {
+	if !utf8.ValidString(nickname) || utf8.RuneCountInString(nickname) > db.MaximumNicknameLength {
+		return false
+	}
+	for _, r := range nickname {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func handleSetNickname(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	contactID := conversationUser(w, r)
+	if contactID == 0 {
+		return
+	}
+
+	var req struct {
+		Nickname string `json:"nickname"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	nickname := strings.TrimSpace(req.Nickname)
+	if !validNickname(nickname) {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("nickname must be at most %d printable characters", db.MaximumNicknameLength))
+		return
+	}
+	if err := db.SetNickname(userID, contactID, nickname); err != nil {
+		log.Printf("Failed to save nickname of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to save nickname")
+		return
+	}
+
+	// Only the owner's own sessions learn about the change.
+	response := map[string]interface{}{"user_id": contactID, "nickname": nickname}
+	data, _ := json.Marshal(response)
+	ws.GetHub().SendMessage(userID, ws.Message{
+		Type:      "nickname_updated",
+		From:      contactID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// handleSetArchived returns a handler that archives or unarchives the
+// conversation named by {userID}. Archiving only changes the requester's list
+// view; no message is touched.
+func handleSetArchived(archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserID(r)
+		otherID := conversationUser(w, r)
+		if otherID == 0 {
+			return
+		}
+		prefs, err := db.UpdateConversationPrefs(userID, otherID, db.ConversationPrefsUpdate{Archived: &archived})
+		if err != nil {
+			log.Printf("Failed to update archive state of user %d: %v", userID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to update conversation")
+			return
+		}
+		notifyPrefsUpdated(userID, prefs)
+		jsonResponse(w, http.StatusOK, prefs)
+	}
+}
+
+// notifyPrefsUpdated syncs changed conversation preferences to the owner's
+// connected devices.
+func notifyPrefsUpdated(userID int64, prefs db.ConversationPrefs) {
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		log.Printf("Failed to encode conversation prefs: %v", err)
+		return
+	}
+	ws.GetHub().SendMessage(userID, ws.Message{
+		Type:      "prefs_updated",
+		From:      prefs.OtherUserID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// readReceiptsEnabled reports whether userID lets otherUserID see when their
+// messages are read. Lookup failures fall back to the default of sending them.
+func readReceiptsEnabled(userID, otherUserID int64) bool {
+	prefs, err := db.GetConversationPrefs(userID, otherUserID)
+	if err != nil {
+		log.Printf("Failed to load conversation prefs of user %d: %v", userID, err)
+		return true
+	}
+	return prefs.ReadReceipts
+}
+
+// conversationVersion returns the version to attach to a WebSocket event, or
+// 0, which leaves it out, when it cannot be read.
+func conversationVersion(userID, otherUserID int64) int64 {
+	version, err := db.GetConversationVersion(userID, otherUserID)
+	if err != nil {
+		log.Printf("Failed to load conversation version of users %d and %d: %v", userID, otherUserID, err)
+		return 0
+	}
+	return version
+}
+
+// conversationArchiveFormat and conversationArchiveVersion identify the first
+// line of a conversation archive so that restoring clients can reject files
+// they do not understand.
+const (
+	conversationArchiveFormat  = "ring-conversation"
+	conversationArchiveVersion = 1
+)
+
+// archiveParticipant is a conversation participant's identity as of export.
+// Only current public keys are stored on the server, so messages encrypted to
+// an earlier key_epoch need the private key that was current at the time.
+type archiveParticipant struct {
+	ID          int64  `json:"id"`
+	Username    string `json:"username"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+	KeyEpoch    int64  `json:"key_epoch"`
+}
+
+// conversationArchive is the header line of a conversation archive. The
+// messages follow one per line, oldest first, as returned by the message
+// endpoints.
+type conversationArchive struct {
+	Format       string               `json:"format"`
+	Version      int                  `json:"version"`
+	ExportedAt   time.Time            `json:"exported_at"`
+	UserID       int64                `json:"user_id"`
+	OtherUserID  int64                `json:"other_user_id"`
+	Participants []archiveParticipant `json:"participants"`
+}
+
+// handleExportConversation streams the requester's visible history with
+// {userID} as an NDJSON download, with a header carrying both participants'
+// public keys. Content stays encrypted; the client decrypts on restore.
+func handleExportConversation(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID := conversationUser(w, r)
+	if otherID == 0 {
+		return
+	}
+	archive := conversationArchive{
+		Format:      conversationArchiveFormat,
+		Version:     conversationArchiveVersion,
+		ExportedAt:  time.Now().UTC(),
+		UserID:      userID,
+		OtherUserID: otherID,
+	}
+	var otherName string
+	for _, id := range []int64{userID, otherID} {
+		user, err := db.GetUserByID(id)
+		if err != nil || user == nil {
+			log.Printf("Failed to fetch conversation participant %d: %v", id, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
+			return
+		}
+		archive.Participants = append(archive.Participants, archiveParticipant{
+			ID:          user.ID,
+			Username:    user.Username,
+			PublicKey:   crypto.EncodeKey(user.PublicKey),
+			Fingerprint: crypto.Fingerprint(user.PublicKey),
+			KeyEpoch:    user.KeyEpoch,
+		})
+		otherName = user.Username
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "conversation-"+otherName+".ndjson"))
+	streamMessages(w, r, userID, otherID, archive)
+}
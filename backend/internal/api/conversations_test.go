@@ -0,0 +1,360 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConversationPrefsDefaultAndPartialUpdate(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+
+	request := func(method, target, pathValue, body string) (int, db.ConversationPrefs) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		r := requestForUser(method, target, body, aliceID)
+		r.SetPathValue("userID", pathValue)
+		handleConversationPrefs(recorder, r)
+		var prefs db.ConversationPrefs
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&prefs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, prefs
+	}
+	target := fmt.Sprintf("/api/conversations/%d/prefs", bobID)
+	bob := strconv.FormatInt(bobID, 10)
+
+	status, prefs := request(http.MethodGet, target, bob, "")
+	if status != http.StatusOK || prefs.Muted || prefs.Archived || !prefs.ReadReceipts || prefs.UpdatedAt != nil {
+		t.Fatalf("defaults: status = %d, prefs = %+v", status, prefs)
+	}
+
+	status, prefs = request(http.MethodPut, target, bob, `{"muted":true}`)
+	if status != http.StatusOK || !prefs.Muted || !prefs.ReadReceipts || prefs.UpdatedAt == nil {
+		t.Fatalf("mute: status = %d, prefs = %+v", status, prefs)
+	}
+	status, prefs = request(http.MethodPut, target, bob, `{"read_receipts":false}`)
+	if status != http.StatusOK || !prefs.Muted || prefs.ReadReceipts {
+		t.Fatalf("partial update lost a field: status = %d, prefs = %+v", status, prefs)
+	}
+	if readReceiptsEnabled(aliceID, bobID) {
+		t.Fatal("read receipts still enabled")
+	}
+	if other, err := db.GetConversationPrefs(bobID, aliceID); err != nil || other.Muted {
+		t.Fatalf("prefs leaked to the other participant: %+v, err = %v", other, err)
+	}
+
+	tests := []struct {
+		method, pathValue, body string
+		status                  int
+	}{
+		{method: http.MethodGet, pathValue: strconv.FormatInt(aliceID, 10), status: http.StatusBadRequest},
+		{method: http.MethodGet, pathValue: "999", status: http.StatusNotFound},
+		{method: http.MethodPut, pathValue: bob, body: `{"muted":"yes"}`, status: http.StatusBadRequest},
+		{method: http.MethodPost, pathValue: bob, body: `{}`, status: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		if status, _ := request(test.method, "/api/conversations/x/prefs", test.pathValue, test.body); status != test.status {
+			t.Fatalf("%s %s %s: status = %d, want %d", test.method, test.pathValue, test.body, status, test.status)
+		}
+	}
+}
+
+func TestArchiveHidesConversationFromList(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if _, _, err := db.SaveMessage(bobID, aliceID, "archive-list-message", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) []db.Conversation {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetConversations(recorder, requestForUser(http.MethodGet, "/api/conversations"+query, "", aliceID))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("list status = %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Conversations []db.Conversation `json:"conversations"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Conversations
+	}
+	setArchived := func(archived bool) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		request := requestForUser(http.MethodPost, "/api/conversations/x/archive", "", aliceID)
+		request.SetPathValue("userID", strconv.FormatInt(bobID, 10))
+		handleSetArchived(archived)(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("archive status = %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if conversations := list(""); len(conversations) != 1 {
+		t.Fatalf("conversations = %+v", conversations)
+	}
+	setArchived(true)
+	if conversations := list(""); len(conversations) != 0 {
+		t.Fatalf("archived conversation listed: %+v", conversations)
+	}
+	if conversations := list("?include_archived=true"); len(conversations) != 1 || !conversations[0].Archived {
+		t.Fatalf("include_archived: %+v", conversations)
+	}
+	setArchived(false)
+	if conversations := list(""); len(conversations) != 1 {
+		t.Fatalf("unarchived conversation missing: %+v", conversations)
+	}
+}
+
+func TestConversationsCanBeFilteredByRecentActivity(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	old, _, err := db.SaveMessage(bobID, aliceID, "active-since-old", "text", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.Exec("UPDATE messages SET timestamp = datetime('now', '-2 days') WHERE id = ?", old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.SaveMessage(aliceID, aliceID, "active-since-note", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	list := func(query string) (int, []db.Conversation) {
+		recorder := httptest.NewRecorder()
+		handleGetConversations(recorder, requestForUser(http.MethodGet, "/api/conversations"+query, "", aliceID))
+		var response struct {
+			Conversations []db.Conversation `json:"conversations"`
+		}
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, response.Conversations
+	}
+
+	if code, conversations := list("?active_since=" + since); code != http.StatusOK || len(conversations) != 1 || conversations[0].OtherUserID != aliceID {
+		t.Fatalf("active conversations = %d %+v, want only the note to self", code, conversations)
+	}
+	if _, _, err := db.SaveMessage(bobID, aliceID, "active-since-new", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	code, conversations := list("?preview=true&active_since=" + since)
+	if code != http.StatusOK || len(conversations) != 2 || conversations[0].OtherUserID != bobID {
+		t.Fatalf("active conversations = %d %+v, want bob first", code, conversations)
+	}
+	if conversations[0].UnreadCount != 2 {
+		t.Fatalf("unread count = %d, want 2 including older messages", conversations[0].UnreadCount)
+	}
+	if code, _ := list("?active_since=yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("invalid active_since status = %d, want 400", code)
+	}
+}
+
+func TestConversationPreviewsCarrySidebarState(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if _, _, err := db.SaveMessage(bobID, aliceID, "preview-message-1", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	last, _, err := db.SaveMessage(aliceID, bobID, "preview-message-2", "file", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muted := true
+	if _, err := db.UpdateConversationPrefs(aliceID, bobID, db.ConversationPrefsUpdate{Muted: &muted}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetConversationAppearance(aliceID, bobID, `{"theme":"dark"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetNickname(aliceID, bobID, "Bobby"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handleGetConversations(recorder, requestForUser(http.MethodGet, "/api/conversations?preview=true", "", aliceID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var response struct {
+		Conversations []db.ConversationPreview `json:"conversations"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Conversations) != 1 {
+		t.Fatalf("previews = %+v", response.Conversations)
+	}
+	preview := response.Conversations[0]
+	if preview.OtherUserID != bobID || preview.Username != "bob" || preview.Nickname != "Bobby" || len(preview.PublicKey) != 32 {
+		t.Fatalf("profile = %+v", preview)
+	}
+	if preview.LastMessageID != last.ID || preview.LastMessageSenderID != aliceID || preview.LastMessageType != "file" || preview.LastMessageRead {
+		t.Fatalf("last message = %+v", preview)
+	}
+	if preview.UnreadCount != 1 || !preview.Muted || preview.Archived || !preview.ReadReceipts || preview.Appearance != `{"theme":"dark"}` {
+		t.Fatalf("settings = %+v", preview)
+	}
+	if preview.Online {
+		t.Fatal("bob is reported online without a session")
+	}
+
+	recorder = httptest.NewRecorder()
+	handleGetConversations(recorder, requestForUser(http.MethodGet, "/api/conversations?preview=maybe", "", aliceID))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("invalid preview status = %d, want 400", recorder.Code)
+	}
+}
+
+func TestConversationVersionEndpoint(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	version := func() int64 {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		r := requestForUser(http.MethodGet, fmt.Sprintf("/api/conversations/%d/version", bobID), "", aliceID)
+		r.SetPathValue("userID", strconv.FormatInt(bobID, 10))
+		handleGetConversationVersion(recorder, r)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Version int64 `json:"version"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Version
+	}
+
+	if got := version(); got != 0 {
+		t.Fatalf("empty conversation version = %d, want 0", got)
+	}
+	if _, _, err := db.SaveMessage(bobID, aliceID, "conversation-version-api", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := version(); got != 1 {
+		t.Fatalf("version after a message = %d, want 1", got)
+	}
+}
+
+func TestNicknamesArePrivateToTheOwner(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	bob := strconv.FormatInt(bobID, 10)
+	setNickname := func(body string) int {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		r := requestForUser(http.MethodPut, "/api/users/"+bob+"/nickname", body, aliceID)
+		r.SetPathValue("userID", bob)
+		handleSetNickname(recorder, r)
+		return recorder.Code
+	}
+	nicknameIn := func(viewerID int64) (interface{}, bool) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetUsers(recorder, requestForUser(http.MethodGet, "/api/users", "", viewerID))
+		var users []map[string]interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&users); err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			if int64(user["id"].(float64)) == bobID {
+				nickname, ok := user["nickname"]
+				return nickname, ok
+			}
+		}
+		t.Fatal("bob missing from the roster")
+		return nil, false
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{body: `{"nickname":"  Bobby  "}`, status: http.StatusOK},
+		{body: `{"nickname":"line\nbreak"}`, status: http.StatusBadRequest},
+		{body: fmt.Sprintf(`{"nickname":%q}`, strings.Repeat("é", db.MaximumNicknameLength+1)), status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if status := setNickname(test.body); status != test.status {
+			t.Fatalf("%s: status = %d, want %d", test.body, status, test.status)
+		}
+	}
+
+	if nickname, ok := nicknameIn(aliceID); !ok || nickname != "Bobby" {
+		t.Fatalf("alice sees nickname %v, want Bobby", nickname)
+	}
+	if nickname, ok := nicknameIn(bobID); ok {
+		t.Fatalf("nickname leaked to bob: %v", nickname)
+	}
+	if _, _, err := db.SaveMessage(bobID, aliceID, "nickname-conversation", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	conversations, err := db.GetConversations(aliceID, false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 1 || conversations[0].Nickname != "Bobby" {
+		t.Fatalf("conversations = %+v, want bob nicknamed Bobby", conversations)
+	}
+
+	if status := setNickname(`{"nickname":""}`); status != http.StatusOK {
+		t.Fatalf("clear status = %d", status)
+	}
+	if nickname, ok := nicknameIn(aliceID); ok {
+		t.Fatalf("cleared nickname still shown: %v", nickname)
+	}
+}
+
+func TestConversationAppearanceIsOpaqueAndCapped(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	bob := strconv.FormatInt(bobID, 10)
+	request := func(method, body string) (int, string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		r := requestForUser(method, "/api/conversations/"+bob+"/appearance", body, aliceID)
+		r.SetPathValue("userID", bob)
+		handleConversationAppearance(recorder, r)
+		var response struct {
+			Appearance string `json:"appearance"`
+		}
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, response.Appearance
+	}
+
+	if status, appearance := request(http.MethodGet, ""); status != http.StatusOK || appearance != "" {
+		t.Fatalf("default appearance: status = %d, appearance = %q", status, appearance)
+	}
+	muted := true
+	if _, err := db.UpdateConversationPrefs(aliceID, bobID, db.ConversationPrefsUpdate{Muted: &muted}); err != nil {
+		t.Fatal(err)
+	}
+	blob := `{"theme":"dusk","wallpaper":"w-12"}`
+	if status, _ := request(http.MethodPut, fmt.Sprintf(`{"appearance":%q}`, blob)); status != http.StatusOK {
+		t.Fatalf("save status = %d", status)
+	}
+	if status, appearance := request(http.MethodGet, ""); status != http.StatusOK || appearance != blob {
+		t.Fatalf("saved appearance: status = %d, appearance = %q", status, appearance)
+	}
+	if prefs, err := db.GetConversationPrefs(aliceID, bobID); err != nil || !prefs.Muted {
+		t.Fatalf("saving appearance changed prefs: %+v, err = %v", prefs, err)
+	}
+	oversized := fmt.Sprintf(`{"appearance":%q}`, strings.Repeat("x", db.MaximumAppearanceSize+1))
+	if status, _ := request(http.MethodPut, oversized); status != http.StatusBadRequest {
+		t.Fatalf("oversized appearance status = %d, want 400", status)
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"chatapp/internal/push"
+	"log"
+	"net/http"
+)
+
+const maximumDeviceTokenLength = 512
+
+type deviceRequest struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+func validDeviceToken(token string) bool {
+	if token == "" || len(token) > maximumDeviceTokenLength {
+		return false
+	}
+	for index := 0; index < len(token); index++ {
+		if token[index] <= ' ' || token[index] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	var req deviceRequest
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if !validDeviceToken(req.Token) {
+		errorResponse(w, http.StatusBadRequest, "invalid device token")
+		return
+	}
+	if !push.ValidPlatform(req.Platform) {
+		errorResponse(w, http.StatusBadRequest, "platform must be ios or android")
+		return
+	}
+
+	userID := getUserID(r)
+	if err := db.SaveDeviceToken(userID, req.Token, req.Platform); err != nil {
+		log.Printf("Failed to save device token for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to register device")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"status": "ok", "push_enabled": push.Enabled()})
+}
+
+func handleRemoveDevice(w http.ResponseWriter, r *http.Request) {
+	var req deviceRequest
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if !validDeviceToken(req.Token) {
+		errorResponse(w, http.StatusBadRequest, "invalid device token")
+		return
+	}
+
+	userID := getUserID(r)
+	if err := db.DeleteDeviceToken(userID, req.Token); err != nil {
+		log.Printf("Failed to delete device token for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to remove device")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+var handleNotificationPreview = methods(map[string]http.HandlerFunc{
+	http.MethodGet:  handleGetNotificationPreview,
+	http.MethodPost: handleSetNotificationPreview,
+})
+
+func handleSetNotificationPreview(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	var req struct {
+		Preview string `json:"preview"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil || !db.ValidNotificationPreview(req.Preview) {
+		errorResponse(w, http.StatusBadRequest, "preview must be none, sender or full")
+		return
+	}
+	if err := db.SetNotificationPreview(userID, req.Preview); err != nil {
+		log.Printf("Failed to update notification preview for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to update notification preview")
+		return
+	}
+	handleGetNotificationPreview(w, r)
+}
+
+func handleGetNotificationPreview(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	preview, err := db.GetNotificationPreview(userID)
+	if err != nil {
+		log.Printf("Failed to read notification preview for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to read notification preview")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"preview": preview})
+}
+
+// notificationFor builds the push notification for one of the recipient's
+// devices, revealing only as much about the message as their preview setting
+// allows. Content stays on the server either way.
+func notificationFor(device db.DeviceToken, msg *db.Message, preview, senderName string) push.Notification {
+	notification := push.Notification{
+		Token:     device.Token,
+		Platform:  device.Platform,
+		MessageID: msg.ID,
+	}
+	if preview == db.NotificationPreviewSender || preview == db.NotificationPreviewFull {
+		notification.SenderID = msg.SenderID
+		notification.SenderName = senderName
+	}
+	if preview == db.NotificationPreviewFull {
+		notification.MessageType = msg.Type
+	}
+	return notification
+}
+
+// notifyDevices wakes the recipient's registered devices about a message they
+// could not receive over the WebSocket.
+func notifyDevices(msg *db.Message) {
+	if !push.Enabled() {
+		return
+	}
+	prefs, err := db.GetConversationPrefs(msg.ReceiverID, msg.SenderID)
+	if err != nil {
+		log.Printf("Failed to load conversation prefs of user %d: %v", msg.ReceiverID, err)
+		return
+	}
+	if prefs.Muted {
+		return
+	}
+	devices, err := db.GetDeviceTokens(msg.ReceiverID)
+	if err != nil {
+		log.Printf("Failed to load device tokens for user %d: %v", msg.ReceiverID, err)
+		return
+	}
+	if len(devices) == 0 {
+		return
+	}
+	preview, err := db.GetNotificationPreview(msg.ReceiverID)
+	if err != nil {
+		// Fall back to the most private preview rather than dropping the push.
+		log.Printf("Failed to read notification preview of user %d: %v", msg.ReceiverID, err)
+		preview = db.NotificationPreviewNone
+	}
+	var senderName string
+	if preview != db.NotificationPreviewNone {
+		sender, err := db.GetUserByID(msg.SenderID)
+		if err != nil || sender == nil {
+			log.Printf("Failed to fetch message sender %d: %v", msg.SenderID, err)
+			preview = db.NotificationPreviewNone
+		} else {
+			senderName = sender.Username
+		}
+	}
+	notifications := make([]push.Notification, 0, len(devices))
+	for _, device := range devices {
+		notifications = append(notifications, notificationFor(device, msg, preview, senderName))
+	}
+	push.Notify(notifications...)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterDeviceValidatesTokenAndPlatform(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{body: `{"token":"apns-token","platform":"ios"}`, status: http.StatusOK},
+		{body: `{"token":"fcm:token-1","platform":"android"}`, status: http.StatusOK},
+		{body: `{"token":"","platform":"ios"}`, status: http.StatusBadRequest},
+		{body: `{"token":"has space","platform":"ios"}`, status: http.StatusBadRequest},
+		{body: `{"token":"` + strings.Repeat("a", maximumDeviceTokenLength+1) + `","platform":"ios"}`, status: http.StatusBadRequest},
+		{body: `{"token":"web-token","platform":"web"}`, status: http.StatusBadRequest},
+		{body: `{"token":"apns-token",`, status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handleRegisterDevice(recorder, requestForUser(http.MethodPost, "/api/devices", test.body, aliceID))
+		if recorder.Code != test.status {
+			t.Fatalf("%s: status = %d, want %d", test.body, recorder.Code, test.status)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handleRemoveDevice(recorder, requestForUser(http.MethodPost, "/api/devices/remove", `{"token":`, aliceID))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid request") {
+		t.Fatalf("malformed remove = %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	handleRemoveDevice(recorder, requestForUser(http.MethodPost, "/api/devices/remove", `{"token":"apns-token"}`, aliceID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("remove status = %d", recorder.Code)
+	}
+	devices, err := db.GetDeviceTokens(aliceID)
+	if err != nil || len(devices) != 1 || devices[0].Token != "fcm:token-1" {
+		t.Fatalf("devices = %+v, err = %v", devices, err)
+	}
+}
+
+func TestNotificationPreviewControlsPushPayload(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	message := &db.Message{ID: 9, SenderID: aliceID, ReceiverID: bobID, Type: "text"}
+	device := db.DeviceToken{Token: "apns-token", Platform: "ios"}
+
+	tests := []struct {
+		body     string
+		status   int
+		preview  string
+		senderID int64
+		msgType  string
+	}{
+		{body: "", status: http.StatusOK, preview: db.NotificationPreviewNone},
+		{body: `{"preview":"everything"}`, status: http.StatusBadRequest},
+		{body: `{"preview":"sender"}`, status: http.StatusOK, preview: db.NotificationPreviewSender, senderID: aliceID},
+		{body: `{"preview":"full"}`, status: http.StatusOK, preview: db.NotificationPreviewFull, senderID: aliceID, msgType: "text"},
+		{body: `{"preview":"none"}`, status: http.StatusOK, preview: db.NotificationPreviewNone},
+	}
+	for _, test := range tests {
+		method := http.MethodPost
+		if test.body == "" {
+			method = http.MethodGet
+		}
+		recorder := httptest.NewRecorder()
+		handleNotificationPreview(recorder, requestForUser(method, "/api/users/me/notification-preview", test.body, bobID))
+		if recorder.Code != test.status {
+			t.Fatalf("%s %s: status = %d, want %d", method, test.body, recorder.Code, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response struct {
+			Preview string `json:"preview"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Preview != test.preview {
+			t.Fatalf("%s %s: preview = %q, %v", method, test.body, response.Preview, err)
+		}
+		notification := notificationFor(device, message, response.Preview, "alice")
+		if notification.MessageID != message.ID || notification.SenderID != test.senderID || notification.MessageType != test.msgType ||
+			(test.senderID == 0) != (notification.SenderName == "") {
+			t.Fatalf("%s: notification = %+v", test.preview, notification)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"chatapp/internal/ws"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleEditMessage replaces the content of a message the requester sent, for
+// PUT /api/messages/{id}. The recipient's live sessions and the sender's other
+// sessions get a message_edited event with the new content.
+func handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/messages/"), 10, 64)
+	if err != nil || messageID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid message ID")
+		return
+	}
+	userID := getUserID(r)
+
+	var req struct {
+		Content  string `json:"content"`
+		Nonce    string `json:"nonce"`
+		KeyEpoch *int64 `json:"key_epoch"`
+		Escrow   string `json:"escrow_envelope"` // copy of the new content in compliance mode
+	}
+	maximumSize := limits.Current().MessageMaxBytes
+	if err := decodeJSON(w, r, &req, sendRequestLimit(maximumSize, 1)); err != nil || req.Content == "" || req.Nonce == "" {
+		errorResponse(w, http.StatusBadRequest, "content and nonce required")
+		return
+	}
+	content, nonce, ok := decodeMessageCiphertext(w, req.Content, req.Nonce, maximumSize)
+	if !ok {
+		return
+	}
+	// The escrow copy has to follow the edit, or the operator would keep
+	// only the replaced text.
+	escrow, err := decodeEscrowEnvelope(req.Escrow)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.KeyEpoch != nil {
+		// The new content has to be readable with the recipient's current key.
+		message, err := db.GetMessageByID(messageID)
+		if err != nil {
+			log.Printf("Failed to fetch message %d: %v", messageID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to edit message")
+			return
+		}
+		if message != nil && message.SenderID == userID {
+			receiver, err := db.GetUserByID(message.ReceiverID)
+			if err != nil || receiver == nil {
+				log.Printf("Failed to fetch message recipient %d: %v", message.ReceiverID, err)
+				errorResponse(w, http.StatusInternalServerError, "failed to edit message")
+				return
+			}
+			if receiver.KeyEpoch != *req.KeyEpoch {
+				errorResponse(w, http.StatusConflict, "recipient public key has changed")
+				return
+			}
+		}
+	}
+
+	message, err := db.EditMessage(messageID, userID, content, nonce, escrow)
+	switch {
+	case errors.Is(err, db.ErrMessageNotFound):
+		errorResponse(w, http.StatusNotFound, "message not found")
+		return
+	case errors.Is(err, db.ErrNotMessageSender):
+		errorResponse(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, db.ErrEditWindowClosed):
+		errorResponse(w, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, db.ErrStorageQuotaExceeded):
+		errorResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to edit message %d of user %d: %v", messageID, userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to edit message")
+		return
+	}
+
+	event := ws.MessageEvent(message)
+	event.Type = "message_edited"
+	event.Version = conversationVersion(message.ReceiverID, message.SenderID)
+	if message.ReceiverID != userID {
+		ws.GetHub().SendMessage(message.ReceiverID, event)
+	}
+	ws.GetHub().SendMessage(userID, event)
+	jsonResponse(w, http.StatusOK, message)
+}
+
+// handleDeleteMessage deletes a message the requester sent for both sides, for
+// DELETE /api/messages/{id}. History keeps a tombstone, and the recipient's
+// live sessions and the sender's other sessions get a message_deleted event.
+func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/messages/"), 10, 64)
+	if err != nil || messageID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid message ID")
+		return
+	}
+	userID := getUserID(r)
+
+	message, err := db.DeleteMessage(messageID, userID)
+	switch {
+	case errors.Is(err, db.ErrMessageNotFound):
+		errorResponse(w, http.StatusNotFound, "message not found")
+		return
+	case errors.Is(err, db.ErrNotMessageSender):
+		errorResponse(w, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to delete message %d of user %d: %v", messageID, userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to delete message")
+		return
+	}
+
+	event := ws.Message{
+		ID:        message.ID,
+		Type:      "message_deleted",
+		From:      message.SenderID,
+		To:        message.ReceiverID,
+		Timestamp: time.Now().Unix(),
+		Version:   conversationVersion(message.ReceiverID, message.SenderID),
+	}
+	if message.ReceiverID != userID {
+		ws.GetHub().SendMessage(message.ReceiverID, event)
+		notifyUnreadTotal(message.ReceiverID)
+	}
+	ws.GetHub().SendMessage(userID, event)
+	jsonResponse(w, http.StatusOK, message)
+}
+
+// handleGetMessageEdits returns the versions a message had before its edits,
+// oldest first, to either participant.
+func handleGetMessageEdits(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || messageID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid message ID")
+		return
+	}
+	userID := getUserID(r)
+	message, err := db.GetMessageByID(messageID)
+	if err != nil {
+		log.Printf("Failed to fetch message %d: %v", messageID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch message")
+		return
+	}
+	if message == nil || (message.SenderID != userID && message.ReceiverID != userID) {
+		errorResponse(w, http.StatusNotFound, "message not found")
+		return
+	}
+	edits, err := db.GetMessageEdits(messageID)
+	if err != nil {
+		log.Printf("Failed to fetch edits of message %d: %v", messageID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch edits")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"message_id": messageID, "edits": edits})
+}
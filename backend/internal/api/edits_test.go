@@ -0,0 +1,80 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestEditMessageThroughMessagesRoute(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	message, _, err := db.SaveMessage(aliceID, bobID, "edit-route-message-1", "text", []byte("ciphertext and tag"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/messages/%d", message.ID)
+	edit := func(userID int64, keyEpoch int64) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"content":%q,"nonce":%q,"key_epoch":%d}`,
+			base64.StdEncoding.EncodeToString([]byte("edited ciphertext and tag")), base64.StdEncoding.EncodeToString(make([]byte, 12)), keyEpoch)
+		recorder := httptest.NewRecorder()
+		handleMessages(recorder, requestForUser(http.MethodPut, target, body, userID))
+		return recorder
+	}
+
+	if recorder := edit(bobID, 0); recorder.Code != http.StatusForbidden {
+		t.Fatalf("recipient edit = %d, want 403", recorder.Code)
+	}
+	if recorder := edit(aliceID, 7); recorder.Code != http.StatusConflict {
+		t.Fatalf("edit for a stale key epoch = %d, want 409", recorder.Code)
+	}
+	recorder := edit(aliceID, 0)
+	var edited db.Message
+	if err := json.NewDecoder(recorder.Body).Decode(&edited); err != nil || recorder.Code != http.StatusOK ||
+		string(edited.Content) != "edited ciphertext and tag" || edited.EditedAt == nil {
+		t.Fatalf("edit = %d %+v, %v", recorder.Code, edited, err)
+	}
+
+	request := requestForUser(http.MethodGet, target+"/edits", "", bobID)
+	request.SetPathValue("id", strconv.FormatInt(message.ID, 10))
+	recorder = httptest.NewRecorder()
+	handleGetMessageEdits(recorder, request)
+	var history struct {
+		Edits []db.MessageEdit `json:"edits"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&history); err != nil || recorder.Code != http.StatusOK ||
+		len(history.Edits) != 1 || string(history.Edits[0].Content) != "ciphertext and tag" {
+		t.Fatalf("edit history = %d %+v, %v", recorder.Code, history, err)
+	}
+}
+
+func TestDeleteMessageThroughMessagesRoute(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	message, _, err := db.SaveMessage(aliceID, bobID, "delete-route-message", "text", []byte("ciphertext and tag"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/messages/%d", message.ID)
+
+	recorder := httptest.NewRecorder()
+	handleMessages(recorder, requestForUser(http.MethodDelete, target, "", bobID))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("recipient delete = %d, want 403", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	handleMessages(recorder, requestForUser(http.MethodDelete, target, "", aliceID))
+	var deleted db.Message
+	if err := json.NewDecoder(recorder.Body).Decode(&deleted); err != nil || recorder.Code != http.StatusOK ||
+		!deleted.IsDeleted || len(deleted.Content) != 0 {
+		t.Fatalf("delete = %d %+v, %v", recorder.Code, deleted, err)
+	}
+	recorder = httptest.NewRecorder()
+	handleMessages(recorder, requestForUser(http.MethodDelete, target, "", aliceID))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("second delete = %d, want 404", recorder.Code)
+	}
+}
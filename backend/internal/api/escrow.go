@@ -0,0 +1,87 @@
+package api
+
+import (
+	"chatapp/internal/crypto"
+	"chatapp/internal/limits"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maximumEscrowOverhead leaves room in an escrow envelope for the
+	// ephemeral key, nonce and tag around a copy of the message content.
+	maximumEscrowOverhead = 256
+
+	escrowNotice = "This server runs in compliance mode: a copy of every message is also encrypted to an operator-held escrow key, so the operator can recover message contents."
+)
+
+var escrowConfiguration struct {
+	sync.RWMutex
+	publicKey []byte
+}
+
+// ConfigureEscrow turns on compliance mode when publicKey, a base64 operator
+// public key, is set. Clients must then send every message with a second
+// envelope encrypted to that key, which the server keeps alongside the
+// end-to-end encrypted content. An empty value leaves compliance mode off.
+func ConfigureEscrow(publicKey string) error {
+	escrowConfiguration.Lock()
+	defer escrowConfiguration.Unlock()
+	escrowConfiguration.publicKey = nil
+	if publicKey == "" {
+		return nil
+	}
+	key, err := crypto.DecodeKey(publicKey)
+	if err != nil || !crypto.ValidPublicKey(key) {
+		return fmt.Errorf("ESCROW_PUBLIC_KEY must be a base64 X25519 or P-256 public key")
+	}
+	escrowConfiguration.publicKey = key
+	log.Printf("WARNING: compliance mode is on; messages are escrowed to the operator key and are not end-to-end private")
+	return nil
+}
+
+func escrowPublicKey() []byte {
+	escrowConfiguration.RLock()
+	defer escrowConfiguration.RUnlock()
+	return escrowConfiguration.publicKey
+}
+
+// decodeEscrowEnvelope validates the escrow envelope of a message against the
+// compliance mode: it is required when escrow is on and refused otherwise.
+func decodeEscrowEnvelope(encoded string) ([]byte, error) {
+	if escrowPublicKey() == nil {
+		if encoded != "" {
+			return nil, fmt.Errorf("message escrow is not enabled")
+		}
+		return nil, nil
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("escrow envelope required in compliance mode")
+	}
+	envelope, err := crypto.DecodeStrict(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("escrow envelope %w", err)
+	}
+	if maximumSize := limits.Current().MessageMaxBytes + maximumEscrowOverhead; len(envelope) > maximumSize {
+		return nil, fmt.Errorf("escrow envelope must not exceed %d bytes", maximumSize)
+	}
+	return envelope, nil
+}
+
+// handleGetEscrow tells clients whether compliance mode is on, so that they
+// can warn users and encrypt the escrow copy of each message.
+func handleGetEscrow(w http.ResponseWriter, r *http.Request) {
+	key := escrowPublicKey()
+	if key == nil {
+		jsonResponse(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"enabled":    true,
+		"public_key": base64.StdEncoding.EncodeToString(key),
+		"notice":     escrowNotice,
+	})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"chatapp/internal/db"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestComplianceModeRequiresEscrowEnvelope(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	t.Cleanup(func() { _ = ConfigureEscrow("") })
+	if err := ConfigureEscrow(base64.StdEncoding.EncodeToString(make([]byte, 16))); err == nil {
+		t.Fatal("short escrow key was accepted")
+	}
+
+	escrowState := func() map[string]interface{} {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetEscrow(recorder, httptest.NewRequest(http.MethodGet, "/api/escrow", nil))
+		var state map[string]interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	send := func(clientID, envelope string) *httptest.ResponseRecorder {
+		t.Helper()
+		body := fmt.Sprintf(`{"receiver_id":%d,"client_id":%q,"content":%q,"nonce":%q,"escrow_envelope":%q}`, bobID, clientID,
+			base64.StdEncoding.EncodeToString([]byte("ciphertext and tag")), base64.StdEncoding.EncodeToString(make([]byte, 12)), envelope)
+		recorder := httptest.NewRecorder()
+		handleSendMessage(recorder, requestForUser(http.MethodPost, "/api/messages", body, aliceID))
+		return recorder
+	}
+
+	envelope := base64.StdEncoding.EncodeToString([]byte("escrowed copy"))
+	if state := escrowState(); state["enabled"] != false {
+		t.Fatalf("escrow state without a key = %v", state)
+	}
+	if recorder := send("escrow-message-off", envelope); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("envelope without compliance mode = %d, want 400", recorder.Code)
+	}
+
+	if err := ConfigureEscrow(base64.StdEncoding.EncodeToString(make([]byte, 32))); err != nil {
+		t.Fatal(err)
+	}
+	if state := escrowState(); state["enabled"] != true || state["public_key"] == "" || state["notice"] == "" {
+		t.Fatalf("escrow state in compliance mode = %v", state)
+	}
+	if recorder := send("escrow-message-missing", ""); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("message without envelope = %d, want 400", recorder.Code)
+	}
+	recorder := send("escrow-message-on", envelope)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("escrowed message = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if bytes.Contains(recorder.Body.Bytes(), []byte(envelope)) {
+		t.Fatalf("response exposes the escrow envelope: %s", recorder.Body.String())
+	}
+	var stored []byte
+	if err := db.DB.QueryRow("SELECT escrow_envelope FROM messages WHERE client_id = ?", "escrow-message-on").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "escrowed copy" {
+		t.Fatalf("stored envelope = %q", stored)
+	}
+}
+
+func TestEditInComplianceModeReplacesEscrowEnvelope(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if err := ConfigureEscrow(base64.StdEncoding.EncodeToString(make([]byte, 32))); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureEscrow("") })
+	message, _, err := db.SaveEscrowedMessage(aliceID, bobID, "escrow-edit-message", "text",
+		[]byte("ciphertext and tag"), make([]byte, 12), 0, []byte("escrowed copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(envelope string) *httptest.ResponseRecorder {
+		t.Helper()
+		body := fmt.Sprintf(`{"content":%q,"nonce":%q,"escrow_envelope":%q}`,
+			base64.StdEncoding.EncodeToString([]byte("edited ciphertext and tag")), base64.StdEncoding.EncodeToString(make([]byte, 12)), envelope)
+		recorder := httptest.NewRecorder()
+		handleMessages(recorder, requestForUser(http.MethodPut, fmt.Sprintf("/api/messages/%d", message.ID), body, aliceID))
+		return recorder
+	}
+
+	if recorder := edit(""); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("edit without envelope = %d, want 400", recorder.Code)
+	}
+	if recorder := edit(base64.StdEncoding.EncodeToString([]byte("escrowed edit"))); recorder.Code != http.StatusOK {
+		t.Fatalf("escrowed edit = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var stored []byte
+	if err := db.DB.QueryRow("SELECT escrow_envelope FROM messages WHERE id = ?", message.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "escrowed edit" {
+		t.Fatalf("stored envelope = %q", stored)
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeyUpdateInterval = time.Hour
+	maximumKeyUpdateInterval = 30 * 24 * time.Hour
+)
+
+var keyUpdateConfiguration = struct {
+	sync.RWMutex
+	interval time.Duration
+}{interval: defaultKeyUpdateInterval}
+
+// ConfigureKeyUpdateInterval sets how long a user must wait between public key
+// changes, which notify every contact. An empty value keeps the default and 0
+// disables the limit.
+func ConfigureKeyUpdateInterval(value string) error {
+	interval := defaultKeyUpdateInterval
+	if value == "0" {
+		interval = 0
+	} else if value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 || parsed > maximumKeyUpdateInterval {
+			return fmt.Errorf("KEY_UPDATE_MIN_INTERVAL must be 0 or a duration up to %s", maximumKeyUpdateInterval)
+		}
+		interval = parsed
+	}
+	keyUpdateConfiguration.Lock()
+	keyUpdateConfiguration.interval = interval
+	keyUpdateConfiguration.Unlock()
+	return nil
+}
+
+func keyUpdateInterval() time.Duration {
+	keyUpdateConfiguration.RLock()
+	defer keyUpdateConfiguration.RUnlock()
+	return keyUpdateConfiguration.interval
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"chatapp/internal/auth"
+	"chatapp/internal/db"
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// revokedTokenPrunePeriod is how often revocations of tokens that have since
+// expired, and refresh tokens that can no longer be used, are deleted.
+const revokedTokenPrunePeriod = time.Hour
+
+// handleLogout revokes the access token the request was made with, which also
+// closes WebSocket sessions opened with it, and the refresh token presented
+// with it, if any. Other devices stay signed in.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+	}
+
+	userID := getUserID(r)
+	expiresAt := getTokenExpiry(r)
+	if expiresAt.IsZero() {
+		// Tokens issued by this server always expire; keep the revocation
+		// for a full token lifetime otherwise.
+		expiresAt = time.Now().Add(auth.AccessTokenTTL())
+	}
+	// An expired token can still be refreshed for a while, so remember the
+	// revocation until that is over too.
+	if err := db.RevokeToken(getTokenID(r), expiresAt.Add(auth.RefreshGracePeriod)); err != nil {
+		log.Printf("Failed to revoke token of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to log out")
+		return
+	}
+	if refreshToken := presentedRefreshToken(r, req.RefreshToken); refreshToken != "" {
+		if err := db.RevokeRefreshToken(userID, refreshToken); err != nil {
+			log.Printf("Failed to revoke refresh token of user %d: %v", userID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to log out")
+			return
+		}
+	}
+	clearRefreshToken(w)
+	jsonResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// PruneRevokedTokens periodically deletes revocations that no longer matter
+// because the tokens have expired, and expired or long revoked refresh
+// tokens, until ctx is done.
+func PruneRevokedTokens(ctx context.Context) {
+	ticker := time.NewTicker(revokedTokenPrunePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := db.PruneRevokedTokens(now); err != nil {
+				log.Printf("Failed to prune revoked tokens: %v", err)
+			}
+			if _, err := db.PruneRefreshTokens(now); err != nil {
+				log.Printf("Failed to prune refresh tokens: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// methods dispatches a request to the handler registered for its method.
+// Other methods get a 405 response whose Allow header lists the supported
+// ones.
+func methods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	allowed := slices.Sorted(maps.Keys(handlers))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := handlers[r.Method]; ok {
+			handler(w, r)
+			return
+		}
+		methodNotAllowed(w, allowed...)
+	}
+}
+
+// only restricts a handler to a single method.
+func only(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return methods(map[string]http.HandlerFunc{method: handler})
+}
+
+// methodNotAllowed answers with 405 and the Allow header HTTP requires.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnsupportedMethodsListAllowedMethods(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+	mux := http.NewServeMux()
+	SetupRoutes(mux)
+
+	tests := []struct {
+		name    string
+		serve   func(http.ResponseWriter, *http.Request)
+		request *http.Request
+		allow   string
+	}{
+		{"public route", mux.ServeHTTP, httptest.NewRequest(http.MethodDelete, "/api/time", nil), "GET"},
+		{"rate limited route", mux.ServeHTTP, httptest.NewRequest(http.MethodGet, "/api/login", nil), "POST"},
+		{"messages", handleMessages, requestForUser(http.MethodPatch, "/api/messages", "", aliceID), "DELETE, GET, POST, PUT"},
+		{"conversation prefs", handleConversationPrefs, requestForUser(http.MethodPost, "/api/conversations/2/prefs", "", aliceID), "GET, PUT"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		test.serve(recorder, test.request)
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != test.allow {
+			t.Errorf("%s: status = %d, Allow = %q; want 405 and %q", test.name, recorder.Code, recorder.Header().Get("Allow"), test.allow)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/time", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Allow") != "" {
+		t.Fatalf("allowed method: status = %d, Allow = %q", recorder.Code, recorder.Header().Get("Allow"))
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -10,26 +11,57 @@ import (
 
 var originPolicy = struct {
 	sync.RWMutex
-	allowed map[string]struct{}
+	allowed   map[string]struct{}
+	wildcards []originWildcard
 }{allowed: make(map[string]struct{})}
 
+// originWildcard is an ALLOWED_ORIGINS entry such as https://*.example.com. It
+// matches any subdomain at any depth, but not example.com itself.
+type originWildcard struct {
+	scheme string
+	suffix string // ".example.com", including the port if the entry has one
+}
+
+func (w originWildcard) matches(origin *url.URL) bool {
+	host := strings.ToLower(origin.Host)
+	return origin.Scheme == w.scheme && len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix)
+}
+
+// ConfigureAllowedOrigins sets the cross-origin HTTP origins accepted in
+// addition to the server's own. An entry may start its host with "*." to
+// allow every subdomain of a domain. An empty value is logged as a warning,
+// since a production deployment should list its origins explicitly.
 func ConfigureAllowedOrigins(value string) error {
 	allowed := make(map[string]struct{})
+	var wildcards []originWildcard
 	for _, item := range strings.Split(value, ",") {
 		origin := strings.TrimSpace(strings.TrimRight(item, "/"))
 		if origin == "" {
 			continue
 		}
+		scheme, host, wildcard := strings.Cut(origin, "://*.")
+		if wildcard {
+			origin = scheme + "://" + host
+		}
 		parsed, err := url.Parse(origin)
-		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil ||
+			strings.Contains(parsed.Host, "*") || (wildcard && !strings.Contains(parsed.Hostname(), ".")) {
 			return fmt.Errorf("invalid allowed origin %q", item)
 		}
+		if wildcard {
+			wildcards = append(wildcards, originWildcard{scheme: parsed.Scheme, suffix: "." + strings.ToLower(parsed.Host)})
+			continue
+		}
 		allowed[origin] = struct{}{}
 	}
 
 	originPolicy.Lock()
 	originPolicy.allowed = allowed
+	originPolicy.wildcards = wildcards
 	originPolicy.Unlock()
+	if len(allowed) == 0 && len(wildcards) == 0 {
+		log.Printf("WARNING: ALLOWED_ORIGINS is empty; only same-origin requests are allowed, so set it if the web client is served from another origin")
+	}
 	return nil
 }
 
@@ -55,7 +87,95 @@ func IsOriginAllowed(r *http.Request) bool {
 	}
 
 	originPolicy.RLock()
-	_, ok := originPolicy.allowed[origin]
-	originPolicy.RUnlock()
+	defer originPolicy.RUnlock()
+	if _, ok := originPolicy.allowed[origin]; ok {
+		return true
+	}
+	for _, wildcard := range originPolicy.wildcards {
+		if wildcard.matches(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyWebSocketOrigin is the WEBSOCKET_ORIGINS entry that admits upgrades
+// carrying no Origin header, as sent by some native clients.
+const emptyWebSocketOrigin = "empty"
+
+var webSocketOriginPolicy = struct {
+	sync.RWMutex
+	allowed    map[string]struct{}
+	allowEmpty bool
+}{allowed: make(map[string]struct{})}
+
+// ConfigureWebSocketOrigins sets origins accepted for WebSocket upgrades in
+// addition to the HTTP allowlist. Entries may use any scheme, such as
+// capacitor://localhost or file://, and may be "null" for opaque origins or
+// "empty" for clients that send no Origin header at all.
+func ConfigureWebSocketOrigins(value string) error {
+	allowed := make(map[string]struct{})
+	allowEmpty := false
+	for _, item := range strings.Split(value, ",") {
+		origin := strings.TrimSpace(item)
+		switch origin {
+		case "":
+			continue
+		case emptyWebSocketOrigin:
+			allowEmpty = true
+			continue
+		case "null":
+			allowed[origin] = struct{}{}
+			continue
+		}
+		normalized, ok := normalizeWebSocketOrigin(origin)
+		if !ok {
+			return fmt.Errorf("invalid WebSocket origin %q", item)
+		}
+		allowed[normalized] = struct{}{}
+	}
+
+	webSocketOriginPolicy.Lock()
+	webSocketOriginPolicy.allowed = allowed
+	webSocketOriginPolicy.allowEmpty = allowEmpty
+	webSocketOriginPolicy.Unlock()
+	return nil
+}
+
+// normalizeWebSocketOrigin reduces an origin to scheme://host so that
+// "file://" and "file:///" compare equal.
+func normalizeWebSocketOrigin(origin string) (string, bool) {
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Scheme == "" || parsed.Opaque != "" || strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+		return "", false
+	}
+	if (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host == "" {
+		return "", false
+	}
+	return strings.ToLower(parsed.Scheme) + "://" + strings.ToLower(parsed.Host), true
+}
+
+// IsWebSocketOriginAllowed checks a WebSocket upgrade against the HTTP origin
+// policy and the WebSocket-only list. Unlike plain HTTP requests, upgrades
+// without an Origin header are refused unless "empty" is configured.
+func IsWebSocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	webSocketOriginPolicy.RLock()
+	defer webSocketOriginPolicy.RUnlock()
+	if origin == "" {
+		return webSocketOriginPolicy.allowEmpty
+	}
+	if IsOriginAllowed(r) {
+		return true
+	}
+	if origin == "null" {
+		_, ok := webSocketOriginPolicy.allowed[origin]
+		return ok
+	}
+	normalized, ok := normalizeWebSocketOrigin(origin)
+	if !ok {
+		return false
+	}
+	_, ok = webSocketOriginPolicy.allowed[normalized]
 	return ok
 }
@@ -138,10 +138,12 @@ func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
 }
 
 var (
-	loginIPLimiter          = newRateLimiter(10, time.Minute)
-	loginAccountLimiter     = newRateLimiter(10, 10*time.Minute)
-	registrationIPLimiter   = newRateLimiter(5, 10*time.Minute)
-	inviteValidationLimiter = newRateLimiter(20, time.Minute)
-	webSocketTicketLimiter  = newRateLimiter(30, time.Minute)
-	inviteCreationLimiter   = newRateLimiter(10, time.Hour)
+	loginIPLimiter               = newRateLimiter(10, time.Minute)
+	loginAccountLimiter          = newRateLimiter(10, 10*time.Minute)
+	tokenRefreshLimiter          = newRateLimiter(30, time.Minute)
+	registrationIPLimiter        = newRateLimiter(5, 10*time.Minute)
+	inviteValidationLimiter      = newRateLimiter(20, time.Minute)
+	registrationChallengeLimiter = newRateLimiter(20, 10*time.Minute)
+	webSocketTicketLimiter       = newRateLimiter(30, time.Minute)
+	inviteCreationLimiter        = newRateLimiter(10, time.Hour)
 )
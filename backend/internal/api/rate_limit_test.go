@@ -1,8 +1,11 @@
 package api
 
 import (
+	"chatapp/internal/db"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -78,3 +81,44 @@ func TestRateLimiterSeparatesKeysAndCanReset(t *testing.T) {
 		t.Fatal("reset key remained limited")
 	}
 }
+
+func TestLoginAccountLimitResetsOnSuccess(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+	hash, err := db.HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, aliceID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loginAccountLimiter.reset("alice") })
+	login := func(password string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"username":"alice","password":%q}`, password)
+		request := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handleLogin(recorder, request)
+		return recorder
+	}
+
+	// Guesses up to one short of the limit, then the right password.
+	for attempt := 1; attempt < int(loginAccountLimiter.capacity); attempt++ {
+		if recorder := login("wrong guess"); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d = %d, want 401", attempt, recorder.Code)
+		}
+	}
+	if recorder := login("correct horse battery"); recorder.Code != http.StatusOK {
+		t.Fatalf("login = %d, want 200", recorder.Code)
+	}
+
+	// The success cleared the count, so a full run of guesses is allowed again.
+	for attempt := 1; attempt <= int(loginAccountLimiter.capacity); attempt++ {
+		if recorder := login("wrong guess"); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d after login = %d, want 401", attempt, recorder.Code)
+		}
+	}
+	recorder := login("correct horse battery")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("login after too many guesses = %d, Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
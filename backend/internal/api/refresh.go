@@ -0,0 +1,102 @@
+package api
+
+import (
+	"chatapp/internal/auth"
+	"chatapp/internal/db"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// sessionTokens signs an access token for user and issues the refresh token
+// that renews it.
+func sessionTokens(user *db.User) (string, string, error) {
+	token, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := db.CreateRefreshToken(user.ID, auth.RefreshTokenTTL())
+	if err != nil {
+		return "", "", err
+	}
+	return token, refreshToken, nil
+}
+
+// handleRefresh renews a session without the password. A refresh token is
+// exchanged for a new access token and a new refresh token, and stops working.
+// An access token that is still valid, or expired within the grace period, is
+// exchanged for a new access token only, and is revoked in the same step so
+// that it cannot be renewed twice. With cookie transport the refresh
+// token comes from, and its successor goes to, the refresh token cookie.
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+	}
+	presented := presentedRefreshToken(r, req.RefreshToken)
+	if req.Token != "" && RefreshTokensInCookie() {
+		// Browsers send the cookie along with every request under /api.
+		presented = ""
+	}
+	if (req.Token == "") == (presented == "") {
+		errorResponse(w, http.StatusBadRequest, "token or refresh_token required")
+		return
+	}
+
+	if presented != "" {
+		user, refreshToken, err := db.RotateRefreshToken(presented, auth.RefreshTokenTTL())
+		if errors.Is(err, db.ErrInvalidRefreshToken) {
+			clearRefreshToken(w)
+			errorResponse(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to rotate refresh token: %v", err)
+			errorResponse(w, http.StatusInternalServerError, "failed to refresh session")
+			return
+		}
+		token, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to generate token")
+			return
+		}
+		response := map[string]interface{}{"token": token}
+		deliverRefreshToken(w, response, refreshToken)
+		jsonResponse(w, http.StatusOK, response)
+		return
+	}
+
+	claims, err := auth.ValidateRefreshable(req.Token)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	currentVersion, revoked, err := db.GetTokenState(claims.UserID, claims.ID)
+	if err != nil || currentVersion != claims.Version || revoked {
+		log.Printf("Refresh refused: revoked token for user %d", claims.UserID)
+		errorResponse(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	consumed, err := db.ConsumeToken(claims.ID, claims.ExpiresAt.Add(auth.RefreshGracePeriod))
+	if err != nil {
+		log.Printf("Failed to revoke renewed token of user %d: %v", claims.UserID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to refresh session")
+		return
+	}
+	if !consumed {
+		errorResponse(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	token, err := auth.GenerateToken(claims.UserID, claims.Username, claims.Version)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"token": token})
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"chatapp/internal/auth"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// refreshTokenCookie names the cookie carrying the refresh token when
+	// REFRESH_TOKEN_TRANSPORT is cookie. Its path covers /api/refresh and
+	// /api/logout, the only endpoints that read it.
+	refreshTokenCookie     = "refresh_token"
+	refreshTokenCookiePath = "/api"
+)
+
+var refreshTransport struct {
+	sync.RWMutex
+	cookie bool
+}
+
+// ConfigureRefreshTokenTransport sets how refresh tokens travel: "body", the
+// default, returns them in JSON responses and reads them from request bodies;
+// "cookie" keeps them in an HttpOnly, Secure, SameSite=Strict cookie that
+// scripts cannot read.
+func ConfigureRefreshTokenTransport(value string) error {
+	var cookie bool
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "body":
+	case "cookie":
+		cookie = true
+	default:
+		return fmt.Errorf("REFRESH_TOKEN_TRANSPORT must be body or cookie")
+	}
+	refreshTransport.Lock()
+	refreshTransport.cookie = cookie
+	refreshTransport.Unlock()
+	return nil
+}
+
+// RefreshTokensInCookie reports whether refresh tokens are sent as cookies,
+// which cross-origin clients can only use with credentialed requests.
+func RefreshTokensInCookie() bool {
+	refreshTransport.RLock()
+	defer refreshTransport.RUnlock()
+	return refreshTransport.cookie
+}
+
+// deliverRefreshToken hands a newly issued refresh token to the client, either
+// as the refresh_token field of response or as a cookie.
+func deliverRefreshToken(w http.ResponseWriter, response map[string]interface{}, token string) {
+	if !RefreshTokensInCookie() {
+		response["refresh_token"] = token
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    token,
+		Path:     refreshTokenCookiePath,
+		MaxAge:   int(auth.RefreshTokenTTL().Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// presentedRefreshToken returns the refresh token a request carries: the one
+// from the body in body transport, or the cookie in cookie transport. A token
+// in the wrong place is ignored.
+func presentedRefreshToken(r *http.Request, fromBody string) string {
+	if !RefreshTokensInCookie() {
+		return fromBody
+	}
+	cookie, err := r.Cookie(refreshTokenCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// clearRefreshToken tells the browser to drop the refresh token cookie. It does
+// nothing in body transport.
+func clearRefreshToken(w http.ResponseWriter) {
+	if !RefreshTokensInCookie() {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    "",
+		Path:     refreshTokenCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRegistrationPoWBits = 20
+	maximumRegistrationPoWBits = 32
+	registrationChallengeTTL   = 5 * time.Minute
+	maximumPendingChallenges   = 10000
+	maximumPoWNonceLength      = 64
+)
+
+var (
+	errTooManyPendingChallenges = errors.New("too many pending registration challenges")
+	errProofOfWorkRequired      = errors.New("proof of work required")
+	errInvalidProofOfWork       = errors.New("invalid or expired proof of work")
+)
+
+var registrationConfiguration = struct {
+	sync.RWMutex
+	open    bool
+	powBits int
+}{powBits: defaultRegistrationPoWBits}
+
+// ConfigureOpenRegistration lets users register without an invite once the
+// server has been bootstrapped. Open signups must solve a hashcash-style
+// challenge of powBits leading zero bits; an empty value keeps the default
+// and 0 turns the challenge off.
+func ConfigureOpenRegistration(open, powBits string) error {
+	enabled := false
+	if open != "" {
+		parsed, err := strconv.ParseBool(open)
+		if err != nil {
+			return fmt.Errorf("OPEN_REGISTRATION must be true or false")
+		}
+		enabled = parsed
+	}
+	difficulty := defaultRegistrationPoWBits
+	if powBits != "" {
+		parsed, err := strconv.Atoi(powBits)
+		if err != nil || parsed < 0 || parsed > maximumRegistrationPoWBits {
+			return fmt.Errorf("REGISTRATION_POW_BITS must be between 0 and %d", maximumRegistrationPoWBits)
+		}
+		difficulty = parsed
+	}
+	registrationConfiguration.Lock()
+	registrationConfiguration.open = enabled
+	registrationConfiguration.powBits = difficulty
+	registrationConfiguration.Unlock()
+	return nil
+}
+
+func openRegistration() (open bool, powBits int) {
+	registrationConfiguration.RLock()
+	defer registrationConfiguration.RUnlock()
+	return registrationConfiguration.open, registrationConfiguration.powBits
+}
+
+type registrationChallenge struct {
+	Bits      int
+	ExpiresAt time.Time
+}
+
+// registrationChallengeStore holds issued proof-of-work challenges until they
+// are solved once or expire. All challenges live for the same TTL, so issue
+// order is expiry order and expired ones are dropped from the front of the
+// queue.
+type registrationChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]*list.Element // of *pendingChallenge, in order
+	order      *list.List
+}
+
+type pendingChallenge struct {
+	token string
+	registrationChallenge
+}
+
+func newRegistrationChallengeStore() *registrationChallengeStore {
+	return &registrationChallengeStore{challenges: make(map[string]*list.Element), order: list.New()}
+}
+
+func (s *registrationChallengeStore) issue(powBits int, now time.Time) (string, registrationChallenge, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", registrationChallenge{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+	challenge := registrationChallenge{Bits: powBits, ExpiresAt: now.Add(registrationChallengeTTL)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteExpired(now)
+	if len(s.challenges) >= maximumPendingChallenges {
+		return "", registrationChallenge{}, errTooManyPendingChallenges
+	}
+	s.challenges[token] = s.order.PushBack(&pendingChallenge{token: token, registrationChallenge: challenge})
+	return token, challenge, nil
+}
+
+// redeem consumes the challenge and reports whether nonce solves it. A wrong
+// nonce still burns the challenge so that it cannot be brute-forced online.
+func (s *registrationChallengeStore) redeem(token, nonce string, now time.Time) bool {
+	s.mu.Lock()
+	element, ok := s.challenges[token]
+	var challenge registrationChallenge
+	if ok {
+		challenge = s.order.Remove(element).(*pendingChallenge).registrationChallenge
+		delete(s.challenges, token)
+	}
+	s.mu.Unlock()
+	if !ok || !challenge.ExpiresAt.After(now) || nonce == "" || len(nonce) > maximumPoWNonceLength {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(token+":"+nonce))) >= challenge.Bits
+}
+
+func (s *registrationChallengeStore) deleteExpired(now time.Time) {
+	for element := s.order.Front(); element != nil; element = s.order.Front() {
+		pending := element.Value.(*pendingChallenge)
+		if pending.ExpiresAt.After(now) {
+			return
+		}
+		s.order.Remove(element)
+		delete(s.challenges, pending.token)
+	}
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+var registrationChallenges = newRegistrationChallengeStore()
+
+// verifyRegistrationProof checks the proof of work an open signup must carry.
+func verifyRegistrationProof(challenge, nonce string, powBits int) error {
+	if powBits == 0 {
+		return nil
+	}
+	if challenge == "" {
+		return errProofOfWorkRequired
+	}
+	if !registrationChallenges.redeem(challenge, nonce, time.Now()) {
+		return errInvalidProofOfWork
+	}
+	return nil
+}
+
+func handleRegistrationChallenge(w http.ResponseWriter, r *http.Request) {
+	open, powBits := openRegistration()
+	if !open || powBits == 0 {
+		errorResponse(w, http.StatusNotFound, "registration challenges are disabled")
+		return
+	}
+
+	token, challenge, err := registrationChallenges.issue(powBits, time.Now())
+	if errors.Is(err, errTooManyPendingChallenges) {
+		errorResponse(w, http.StatusServiceUnavailable, "registration is busy; try again later")
+		return
+	}
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to create challenge")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"challenge":  token,
+		"difficulty": challenge.Bits,
+		"expires_at": challenge.ExpiresAt.Unix(),
+	})
+}
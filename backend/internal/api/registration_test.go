@@ -0,0 +1,272 @@
+package api
+
+import (
+	"chatapp/internal/auth"
+	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func solveChallenge(t *testing.T, challenge string, powBits int) string {
+	t.Helper()
+	for nonce := 0; nonce < 1<<24; nonce++ {
+		candidate := strconv.Itoa(nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+candidate))) >= powBits {
+			return candidate
+		}
+	}
+	t.Fatal("no proof of work found")
+	return ""
+}
+
+func TestOpenRegistrationConfiguration(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureOpenRegistration("", "") })
+	tests := []struct {
+		open, bits string
+		valid      bool
+	}{
+		{"", "", true},
+		{"true", "0", true},
+		{"true", "32", true},
+		{"maybe", "", false},
+		{"true", "-1", false},
+		{"true", "33", false},
+	}
+	for _, test := range tests {
+		err := ConfigureOpenRegistration(test.open, test.bits)
+		if (err == nil) != test.valid {
+			t.Errorf("ConfigureOpenRegistration(%q, %q) error = %v", test.open, test.bits, err)
+		}
+	}
+	if err := ConfigureOpenRegistration("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if open, bits := openRegistration(); open || bits != defaultRegistrationPoWBits {
+		t.Fatalf("default configuration = %v, %d", open, bits)
+	}
+}
+
+func TestRegistrationChallengeIsSingleUse(t *testing.T) {
+	store := newRegistrationChallengeStore()
+	now := time.Now()
+	token, challenge, err := store.issue(8, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := solveChallenge(t, token, challenge.Bits)
+	if !store.redeem(token, nonce, now) {
+		t.Fatal("valid proof of work was rejected")
+	}
+	if store.redeem(token, nonce, now) {
+		t.Fatal("challenge was redeemed twice")
+	}
+
+	token, _, err = store.issue(8, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce = solveChallenge(t, token, 8)
+	if store.redeem(token, nonce, now.Add(registrationChallengeTTL)) {
+		t.Fatal("expired challenge was redeemed")
+	}
+
+	for range 3 {
+		if _, _, err := store.issue(8, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.issue(8, now.Add(registrationChallengeTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.challenges) != 1 || store.order.Len() != 1 {
+		t.Fatalf("pending challenges = %d, queued %d; want only the unexpired one", len(store.challenges), store.order.Len())
+	}
+}
+
+func TestHandleRegisterRequiresProofOfWorkWhenOpen(t *testing.T) {
+	initAPITestDB(t)
+	if err := auth.Configure("0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureOpenRegistration("true", "8"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureOpenRegistration("", "") })
+
+	register := func(username, challenge, nonce string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{
+			"username":      username,
+			"password":      "correct horse battery staple",
+			"public_key":    base64.StdEncoding.EncodeToString(make([]byte, 32)),
+			"pow_challenge": challenge,
+			"pow_nonce":     nonce,
+		})
+		request := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(string(body)))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handleRegister(recorder, request)
+		return recorder
+	}
+
+	if recorder := register("carol", "", ""); recorder.Code != http.StatusBadRequest ||
+		!strings.Contains(recorder.Body.String(), errProofOfWorkRequired.Error()) {
+		t.Fatalf("registration without proof = %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	handleRegistrationChallenge(recorder, httptest.NewRequest(http.MethodPost, "/api/register/challenge", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("challenge status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var issued struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.Difficulty != 8 {
+		t.Fatalf("difficulty = %d, want 8", issued.Difficulty)
+	}
+	nonce := solveChallenge(t, issued.Challenge, issued.Difficulty)
+	if recorder := register("carol", issued.Challenge, nonce); recorder.Code != http.StatusOK {
+		t.Fatalf("registration with proof = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := register("dave", issued.Challenge, nonce); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("reused proof status = %d, want 400", recorder.Code)
+	}
+
+	user, err := db.GetUserByUsername("carol")
+	if err != nil || user == nil {
+		t.Fatalf("registered user not found: %v", err)
+	}
+	if user.IsAdmin {
+		t.Fatal("openly registered user became an admin")
+	}
+}
+
+func TestHandleRegisterRefusesReservedUsernames(t *testing.T) {
+	initAPITestDB(t)
+	if err := limits.ConfigureUsernamePolicy("admin,support", "[a-z0-9_]+"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = limits.ConfigureUsernamePolicy("", "") })
+
+	for _, test := range []struct {
+		username string
+		message  string
+	}{
+		{username: "admin", message: limits.ErrReservedUsername.Error()},
+		{username: "Admin", message: limits.ErrReservedUsername.Error()},
+		{username: "support", message: limits.ErrReservedUsername.Error()},
+		{username: "Carol.Smith", message: limits.ErrUsernameNotAllowed.Error()},
+	} {
+		body, _ := json.Marshal(map[string]string{
+			"username":   test.username,
+			"password":   "correct horse battery staple",
+			"public_key": base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		})
+		request := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(string(body)))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handleRegister(recorder, request)
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), test.message) {
+			t.Errorf("register %q = %d %s", test.username, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestBootstrapSecretMayTakeAReservedUsername(t *testing.T) {
+	database, err := db.InitDB(t.TempDir() + "/bootstrap-reserved.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := auth.Configure("0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	const secret = "fedcba9876543210fedcba9876543210"
+	if err := ConfigureBootstrapSecret(secret); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureBootstrapSecret("") })
+	if err := limits.ConfigureUsernamePolicy("admin", "[a-z0-9_]+"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = limits.ConfigureUsernamePolicy("", "") })
+
+	register := func(username, bootstrapSecret string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{
+			"username":         username,
+			"password":         "correct horse battery staple",
+			"public_key":       base64.StdEncoding.EncodeToString(make([]byte, 32)),
+			"bootstrap_secret": bootstrapSecret,
+		})
+		request := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(string(body)))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handleRegister(recorder, request)
+		return recorder
+	}
+
+	if recorder := register("admin", ""); recorder.Code != http.StatusBadRequest ||
+		!strings.Contains(recorder.Body.String(), limits.ErrReservedUsername.Error()) {
+		t.Fatalf("reserved name without the secret = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := register("Admin.Root", secret); recorder.Code != http.StatusBadRequest ||
+		!strings.Contains(recorder.Body.String(), limits.ErrUsernameNotAllowed.Error()) {
+		t.Fatalf("name outside the pattern with the secret = %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := register("admin", secret); recorder.Code != http.StatusOK {
+		t.Fatalf("reserved name with the secret = %d %s", recorder.Code, recorder.Body.String())
+	}
+	user, err := db.GetUserByUsername("admin")
+	if err != nil || user == nil || !user.IsAdmin {
+		t.Fatalf("bootstrap admin = %+v, err = %v", user, err)
+	}
+}
+
+func TestHandleRegisterProtectsSystemAccountNames(t *testing.T) {
+	_, bobID := initAPITestDB(t)
+	if _, err := db.DB.Exec(
+		"INSERT INTO users (username, password_hash, public_key, is_admin) VALUES ('admin', 'hash', ?, TRUE)", make([]byte, 32),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureWelcomeMessage(strconv.FormatInt(bobID, 10), "Welcome!"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureWelcomeMessage("", "") })
+
+	for _, test := range []struct {
+		username string
+		reserved bool
+	}{
+		{username: "admin", reserved: true},
+		{username: "ADMIN", reserved: true},
+		{username: "Bob", reserved: true},
+		{username: "Alice", reserved: false},
+	} {
+		body, _ := json.Marshal(map[string]string{
+			"username":   test.username,
+			"password":   "correct horse battery staple",
+			"public_key": base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		})
+		request := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(string(body)))
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handleRegister(recorder, request)
+		reserved := recorder.Code == http.StatusBadRequest && strings.Contains(recorder.Body.String(), limits.ErrReservedUsername.Error())
+		if reserved != test.reserved {
+			t.Errorf("register %q = %d %s, want reserved %v", test.username, recorder.Code, recorder.Body.String(), test.reserved)
+		}
+	}
+}
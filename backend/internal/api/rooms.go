@@ -0,0 +1,424 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"chatapp/internal/ws"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// roomMessageCopy is the content of a room message encrypted to one member,
+// as sent by clients.
+type roomMessageCopy struct {
+	RecipientID int64  `json:"recipient_id"`
+	Content     string `json:"content"`
+	Nonce       string `json:"nonce"`
+	KeyEpoch    *int64 `json:"key_epoch"`
+}
+
+var handleRooms = methods(map[string]http.HandlerFunc{
+	http.MethodGet:  handleGetRooms,
+	http.MethodPost: handleCreateRoom,
+})
+
+var handleRoomMessages = methods(map[string]http.HandlerFunc{
+	http.MethodGet:  handleGetRoomMessages,
+	http.MethodPost: handleSendRoomMessage,
+})
+
+var handleRoomMembers = methods(map[string]http.HandlerFunc{
+	http.MethodGet:  handleGetRoomMembers,
+	http.MethodPost: handleAddRoomMember,
+})
+
+func validRoomName(name string) bool {
+	if name == "" || !utf8.ValidString(name) || utf8.RuneCountInString(name) > db.MaximumRoomNameLength {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathRoomID parses the {roomID} path value, writing an error response if it
+// is not a valid ID.
+func pathRoomID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	roomID, err := strconv.ParseInt(r.PathValue("roomID"), 10, 64)
+	if err != nil || roomID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid room ID")
+		return 0, false
+	}
+	return roomID, true
+}
+
+// memberRoom parses the {roomID} path value and loads the room, writing an
+// error response and returning nil unless the requester is a member. Rooms
+// of other users are reported as not found.
+func memberRoom(w http.ResponseWriter, r *http.Request) *db.Room {
+	roomID, ok := pathRoomID(w, r)
+	if !ok {
+		return nil
+	}
+	member, err := db.IsRoomMember(roomID, getUserID(r))
+	if err != nil {
+		log.Printf("Failed to check membership of room %d: %v", roomID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch room")
+		return nil
+	}
+	if !member {
+		errorResponse(w, http.StatusNotFound, "room not found")
+		return nil
+	}
+	room, err := db.GetRoom(roomID)
+	if err != nil || room == nil {
+		log.Printf("Failed to fetch room %d: %v", roomID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch room")
+		return nil
+	}
+	return room
+}
+
+func handleGetRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := db.GetRoomsForUser(getUserID(r))
+	if err != nil {
+		log.Printf("Failed to load rooms of user %d: %v", getUserID(r), err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load rooms")
+		return
+	}
+	jsonResponse(w, http.StatusOK, rooms)
+}
+
+func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if !validRoomName(name) {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d printable characters", db.MaximumRoomNameLength))
+		return
+	}
+	room, err := db.CreateRoom(name, getUserID(r))
+	if err != nil {
+		log.Printf("Failed to create room for user %d: %v", getUserID(r), err)
+		errorResponse(w, http.StatusInternalServerError, "failed to create room")
+		return
+	}
+	jsonResponse(w, http.StatusOK, room)
+}
+
+func handleGetRoomMembers(w http.ResponseWriter, r *http.Request) {
+	room := memberRoom(w, r)
+	if room == nil {
+		return
+	}
+	memberIDs, err := db.GetRoomMemberIDs(room.ID)
+	if err != nil {
+		log.Printf("Failed to load members of room %d: %v", room.ID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load members")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"member_ids": memberIDs})
+}
+
+// handleAddRoomMember lets any member invite another user to the room. The
+// user joins once they accept the invitation.
+func handleAddRoomMember(w http.ResponseWriter, r *http.Request) {
+	room := memberRoom(w, r)
+	if room == nil {
+		return
+	}
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil || req.UserID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	user, err := db.GetUserByID(req.UserID)
+	if err != nil {
+		log.Printf("Failed to fetch user %d: %v", req.UserID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
+		return
+	}
+	if user == nil {
+		errorResponse(w, http.StatusNotFound, "user not found")
+		return
+	}
+	invited, err := db.InviteRoomMember(room.ID, req.UserID, getUserID(r))
+	if errors.Is(err, db.ErrRoomFull) {
+		errorResponse(w, http.StatusConflict, fmt.Sprintf("rooms are limited to %d members", db.MaximumRoomMembers))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to invite user %d to room %d: %v", req.UserID, room.ID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to invite member")
+		return
+	}
+	if invited {
+		data, _ := json.Marshal(map[string]interface{}{"room_name": room.Name})
+		ws.GetHub().SendMessage(req.UserID, ws.Message{
+			Type: "room_invite", From: getUserID(r), Data: data, Timestamp: time.Now().Unix(), RoomID: room.ID,
+		})
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"room_id": room.ID, "user_id": req.UserID, "invited": invited})
+}
+
+func handleGetRoomInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := db.GetRoomInvitesForUser(getUserID(r))
+	if err != nil {
+		log.Printf("Failed to load room invitations of user %d: %v", getUserID(r), err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load invitations")
+		return
+	}
+	jsonResponse(w, http.StatusOK, invites)
+}
+
+// handleAcceptRoomInvite makes the requester a member of a room they were
+// invited to.
+func handleAcceptRoomInvite(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := pathRoomID(w, r)
+	if !ok {
+		return
+	}
+	userID := getUserID(r)
+	accepted, err := db.AcceptRoomInvite(roomID, userID)
+	if errors.Is(err, db.ErrRoomFull) {
+		errorResponse(w, http.StatusConflict, fmt.Sprintf("rooms are limited to %d members", db.MaximumRoomMembers))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to accept invitation of user %d to room %d: %v", userID, roomID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to accept invitation")
+		return
+	}
+	if !accepted {
+		errorResponse(w, http.StatusNotFound, "invitation not found")
+		return
+	}
+	notifyRoomMembership(roomID, "room_member_added", userID, userID)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"room_id": roomID, "user_id": userID})
+}
+
+func handleDeclineRoomInvite(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := pathRoomID(w, r)
+	if !ok {
+		return
+	}
+	declined, err := db.DeclineRoomInvite(roomID, getUserID(r))
+	if err != nil {
+		log.Printf("Failed to decline invitation of user %d to room %d: %v", getUserID(r), roomID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to decline invitation")
+		return
+	}
+	if !declined {
+		errorResponse(w, http.StatusNotFound, "invitation not found")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"room_id": roomID, "user_id": getUserID(r)})
+}
+
+// handleRemoveRoomMember lets a member leave a room, and its creator remove
+// anyone. A creator who leaves hands the room over to the longest-standing
+// member.
+func handleRemoveRoomMember(w http.ResponseWriter, r *http.Request) {
+	room := memberRoom(w, r)
+	if room == nil {
+		return
+	}
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil || req.UserID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	userID := getUserID(r)
+	if req.UserID != userID && room.CreatorID != userID {
+		errorResponse(w, http.StatusForbidden, "only the room creator can remove other members")
+		return
+	}
+	removed, err := db.RemoveRoomMember(room.ID, req.UserID)
+	if err != nil {
+		log.Printf("Failed to remove user %d from room %d: %v", req.UserID, room.ID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to remove member")
+		return
+	}
+	if !removed {
+		errorResponse(w, http.StatusNotFound, "member not found")
+		return
+	}
+	notifyRoomMembership(room.ID, "room_member_removed", userID, req.UserID)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"room_id": room.ID, "user_id": req.UserID})
+}
+
+// notifyRoomMembership tells the room's online members, and the affected user
+// who may no longer be one, that memberID joined or left. Senders need this
+// to encrypt the next message for the right members.
+func notifyRoomMembership(roomID int64, eventType string, actorID, memberID int64) {
+	data, _ := json.Marshal(map[string]int64{"user_id": memberID})
+	event := ws.Message{Type: eventType, From: actorID, Data: data, Timestamp: time.Now().Unix(), RoomID: roomID}
+	hub := ws.GetHub()
+	if eventType == "room_member_removed" {
+		hub.SendMessage(memberID, event)
+	}
+	hub.SendToRoom(roomID, event)
+}
+
+func handleGetRoomMessages(w http.ResponseWriter, r *http.Request) {
+	room := memberRoom(w, r)
+	if room == nil {
+		return
+	}
+	limit, beforeID, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	messages, err := db.GetRoomMessages(room.ID, getUserID(r), limit+1, beforeID)
+	if err != nil {
+		log.Printf("Failed to load messages of room %d: %v", room.ID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to load messages")
+		return
+	}
+	var nextCursor *int64
+	if len(messages) > limit {
+		messages = messages[:limit]
+		cursor := messages[len(messages)-1].ID
+		nextCursor = &cursor
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"messages":    messages,
+		"next_cursor": nextCursor,
+	})
+}
+
+// handleSendRoomMessage stores a message to a room, encrypted once per
+// member, and delivers each member's copy to their online sessions. The
+// sender gets their own copy back. POST /api/messages with room_id does the
+// same.
+func handleSendRoomMessage(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := pathRoomID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ClientID string            `json:"client_id"`
+		Type     string            `json:"type"`
+		Copies   []roomMessageCopy `json:"copies"`
+		Escrow   string            `json:"escrow_envelope"` // copy encrypted to the escrow key in compliance mode
+	}
+	maximumSize := limits.Current().MessageMaxBytes
+	if err := decodeJSON(w, r, &req, sendRequestLimit(maximumSize, db.MaximumRoomMembers)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("content must not exceed %d bytes", maximumSize))
+			return
+		}
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if !limits.ValidClientID(req.ClientID) {
+		errorResponse(w, http.StatusBadRequest, "missing required fields")
+		return
+	}
+	escrow, err := decodeEscrowEnvelope(req.Escrow)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	msgType, ok := sendableMessageType(w, req.Type)
+	if !ok {
+		return
+	}
+	sendRoomMessage(w, roomID, getUserID(r), req.ClientID, msgType, req.Copies, escrow)
+}
+
+// sendRoomMessage checks the copies of a room message against the members,
+// stores them and delivers each member's copy.
+func sendRoomMessage(w http.ResponseWriter, roomID, senderID int64, clientID, msgType string, requested []roomMessageCopy, escrow []byte) {
+	member, err := db.IsRoomMember(roomID, senderID)
+	if err != nil {
+		log.Printf("Failed to check membership of room %d: %v", roomID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch room")
+		return
+	}
+	if !member {
+		errorResponse(w, http.StatusNotFound, "room not found")
+		return
+	}
+	if len(requested) == 0 || len(requested) > db.MaximumRoomMembers {
+		errorResponse(w, http.StatusBadRequest, "missing required fields")
+		return
+	}
+
+	maximumSize := limits.Current().MessageMaxBytes
+	copies := make([]db.RoomMessageCopy, 0, len(requested))
+	for _, c := range requested {
+		if c.RecipientID < 1 || c.Content == "" || c.Nonce == "" {
+			errorResponse(w, http.StatusBadRequest, "missing required fields")
+			return
+		}
+		content, nonce, ok := decodeMessageCiphertext(w, c.Content, c.Nonce, maximumSize)
+		if !ok {
+			return
+		}
+		recipient, err := db.GetUserByID(c.RecipientID)
+		if err != nil {
+			log.Printf("Failed to fetch message recipient %d: %v", c.RecipientID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to fetch recipient")
+			return
+		}
+		if recipient == nil {
+			errorResponse(w, http.StatusConflict, db.ErrRoomMembersChanged.Error())
+			return
+		}
+		if c.KeyEpoch != nil && *c.KeyEpoch != recipient.KeyEpoch {
+			errorResponse(w, http.StatusConflict, "recipient public key has changed")
+			return
+		}
+		copies = append(copies, db.RoomMessageCopy{RecipientID: c.RecipientID, Content: content, Nonce: nonce, KeyEpoch: recipient.KeyEpoch})
+	}
+
+	stored, created, err := db.SaveRoomMessage(roomID, senderID, clientID, msgType, copies, escrow)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotRoomMember):
+			errorResponse(w, http.StatusNotFound, "room not found")
+		case errors.Is(err, db.ErrRoomMembersChanged), errors.Is(err, db.ErrIdempotencyConflict):
+			errorResponse(w, http.StatusConflict, err.Error())
+		case errors.Is(err, db.ErrStorageQuotaExceeded):
+			errorResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+		default:
+			log.Printf("Failed to save message to room %d: %v", roomID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to save message")
+		}
+		return
+	}
+
+	var own *db.RoomMessage
+	for i := range stored {
+		if stored[i].RecipientID == senderID {
+			own = &stored[i]
+		}
+		if created {
+			// The sender's copy reaches their other sessions.
+			ws.GetHub().SendMessage(stored[i].RecipientID, ws.RoomMessageEvent(&stored[i]))
+		}
+	}
+	jsonResponse(w, http.StatusOK, own)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRoomMessagesAreEncryptedPerMember(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	call := func(handler http.HandlerFunc, method, target, body string, userID, roomID int64) *httptest.ResponseRecorder {
+		t.Helper()
+		request := requestForUser(method, target, body, userID)
+		if roomID != 0 {
+			request.SetPathValue("roomID", strconv.FormatInt(roomID, 10))
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder
+	}
+
+	recorder := call(handleRooms, http.MethodPost, "/api/rooms", `{"name":"  Team  "}`, aliceID, 0)
+	var room db.Room
+	if err := json.NewDecoder(recorder.Body).Decode(&room); err != nil || recorder.Code != http.StatusOK || room.Name != "Team" {
+		t.Fatalf("create room = %d %+v, %v", recorder.Code, room, err)
+	}
+	if recorder := call(handleRoomMembers, http.MethodPost, "/", fmt.Sprintf(`{"user_id":%d}`, bobID), aliceID, room.ID); recorder.Code != http.StatusOK {
+		t.Fatalf("invite member = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := call(handleGetRoomMessages, http.MethodGet, "/", "", bobID, room.ID); recorder.Code != http.StatusNotFound {
+		t.Fatalf("history before accepting = %d, want 404", recorder.Code)
+	}
+	recorder = call(handleGetRoomInvites, http.MethodGet, "/api/rooms/invites", "", bobID, 0)
+	var invites []db.RoomInvite
+	if err := json.NewDecoder(recorder.Body).Decode(&invites); err != nil || len(invites) != 1 || invites[0].RoomName != "Team" || invites[0].InvitedBy != aliceID {
+		t.Fatalf("invitations = %d %+v, %v", recorder.Code, invites, err)
+	}
+	if recorder := call(handleAcceptRoomInvite, http.MethodPost, "/", "", bobID, room.ID); recorder.Code != http.StatusOK {
+		t.Fatalf("accept = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := call(handleAcceptRoomInvite, http.MethodPost, "/", "", bobID, room.ID); recorder.Code != http.StatusNotFound {
+		t.Fatalf("accept twice = %d, want 404", recorder.Code)
+	}
+
+	encoded := func(text string) string { return base64.StdEncoding.EncodeToString([]byte(text)) }
+	nonce := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	send := func(clientID string, recipients ...int64) *httptest.ResponseRecorder {
+		t.Helper()
+		copies := make([]roomMessageCopy, 0, len(recipients))
+		for _, recipient := range recipients {
+			copies = append(copies, roomMessageCopy{RecipientID: recipient, Content: encoded(fmt.Sprintf("ciphertext for user %d", recipient)), Nonce: nonce})
+		}
+		body, _ := json.Marshal(map[string]interface{}{"client_id": clientID, "copies": copies})
+		return call(handleRoomMessages, http.MethodPost, "/", string(body), aliceID, room.ID)
+	}
+	viaMessages, _ := json.Marshal(map[string]interface{}{"room_id": room.ID, "client_id": "room-message-0000", "copies": []roomMessageCopy{
+		{RecipientID: aliceID, Content: encoded("via /api/messages"), Nonce: nonce},
+		{RecipientID: bobID, Content: encoded("via /api/messages"), Nonce: nonce},
+	}})
+	if recorder := call(handleSendMessage, http.MethodPost, "/api/messages", string(viaMessages), aliceID, 0); recorder.Code != http.StatusOK {
+		t.Fatalf("send with room_id = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := send("room-message-0001", aliceID); recorder.Code != http.StatusConflict {
+		t.Fatalf("copies missing a member = %d, want 409", recorder.Code)
+	}
+	recorder = send("room-message-0001", aliceID, bobID)
+	var own db.RoomMessage
+	if err := json.NewDecoder(recorder.Body).Decode(&own); err != nil || recorder.Code != http.StatusOK || own.RecipientID != aliceID || own.RoomID != room.ID {
+		t.Fatalf("send = %d %+v, %v", recorder.Code, own, err)
+	}
+
+	// Every copy may be as large as a 1:1 message, so room sends accept
+	// larger bodies.
+	large := base64.StdEncoding.EncodeToString(make([]byte, limits.Current().MessageMaxBytes))
+	body, _ := json.Marshal(map[string]interface{}{"client_id": "room-message-large", "copies": []roomMessageCopy{
+		{RecipientID: aliceID, Content: large, Nonce: nonce},
+		{RecipientID: bobID, Content: large, Nonce: nonce},
+	}})
+	if recorder := call(handleRoomMessages, http.MethodPost, "/", string(body), aliceID, room.ID); recorder.Code != http.StatusOK {
+		t.Fatalf("copies at the size limit = %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = call(handleGetRoomMessages, http.MethodGet, "/", "", bobID, room.ID)
+	var page struct {
+		Messages []db.RoomMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("history = %d, %v", recorder.Code, err)
+	}
+	if len(page.Messages) != 3 || string(page.Messages[1].Content) != fmt.Sprintf("ciphertext for user %d", bobID) {
+		t.Fatalf("bob's history = %+v, want his own copy", page.Messages)
+	}
+
+	if recorder := call(handleRemoveRoomMember, http.MethodPost, "/", fmt.Sprintf(`{"user_id":%d}`, aliceID), bobID, room.ID); recorder.Code != http.StatusForbidden {
+		t.Fatalf("member removing the creator = %d, want 403", recorder.Code)
+	}
+	if recorder := call(handleRemoveRoomMember, http.MethodPost, "/", fmt.Sprintf(`{"user_id":%d}`, bobID), bobID, room.ID); recorder.Code != http.StatusOK {
+		t.Fatalf("leave = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := call(handleGetRoomMessages, http.MethodGet, "/", "", bobID, room.ID); recorder.Code != http.StatusNotFound {
+		t.Fatalf("former member history = %d, want 404", recorder.Code)
+	}
+	if recorder := send("room-message-0002", aliceID); recorder.Code != http.StatusOK {
+		t.Fatalf("send after leave = %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -4,19 +4,24 @@ import (
 	"chatapp/internal/auth"
 	"chatapp/internal/crypto"
 	"chatapp/internal/db"
+	"chatapp/internal/limits"
 	"chatapp/internal/ws"
 	"context"
-	"crypto/elliptic"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -27,14 +32,15 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize:  1024,
 	HandshakeTimeout: 10 * time.Second,
 	CheckOrigin: func(r *http.Request) bool {
-		return IsOriginAllowed(r)
+		return IsWebSocketOriginAllowed(r)
 	},
 }
 
 const (
 	standardRequestLimit = 16 << 10
-	messageRequestLimit  = 128 << 10
-	maximumMessageSize   = 64 << 10
+	maximumLastSeenIDs   = 100
+	maximumActivityDays  = 365
+	maskedInvitePrefix   = 8
 )
 
 // JSON response helper
@@ -69,17 +75,6 @@ func decodeJSON(w http.ResponseWriter, r *http.Request, destination interface{},
 	return nil
 }
 
-func validPublicKey(key []byte) bool {
-	if len(key) == 32 {
-		return true
-	}
-	if len(key) != 65 {
-		return false
-	}
-	x, y := elliptic.Unmarshal(elliptic.P256(), key)
-	return x != nil && y != nil
-}
-
 func spaFileHandler(staticDir string) http.Handler {
 	fileServer := http.FileServer(http.Dir(staticDir))
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -88,6 +83,7 @@ func spaFileHandler(staticDir string) http.Handler {
 			return
 		}
 		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
@@ -128,18 +124,25 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			errorResponse(w, http.StatusUnauthorized, "invalid token")
 			return
 		}
-		currentVersion, err := db.GetAuthVersion(claims.UserID)
-		if err != nil || currentVersion != claims.Version {
+		currentVersion, revoked, err := db.GetTokenState(claims.UserID, claims.ID)
+		if err != nil || currentVersion != claims.Version || revoked {
 			log.Printf("Auth failed: revoked token for user %d", claims.UserID)
 			errorResponse(w, http.StatusUnauthorized, "invalid token")
 			return
 		}
 
+		var tokenExpiry time.Time
+		if claims.ExpiresAt != nil {
+			tokenExpiry = claims.ExpiresAt.Time
+		}
+
 		// Add to context
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, "userID", claims.UserID)
 		ctx = context.WithValue(ctx, "username", claims.Username)
 		ctx = context.WithValue(ctx, "authVersion", claims.Version)
+		ctx = context.WithValue(ctx, "tokenExpiry", tokenExpiry)
+		ctx = context.WithValue(ctx, "tokenID", claims.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
@@ -158,40 +161,115 @@ func getAuthVersion(r *http.Request) int64 {
 	return r.Context().Value("authVersion").(int64)
 }
 
+// getTokenExpiry returns when the request's JWT expires.
+func getTokenExpiry(r *http.Request) time.Time {
+	expiry, _ := r.Context().Value("tokenExpiry").(time.Time)
+	return expiry
+}
+
+// getTokenID returns the jti of the request's JWT, empty for tokens issued
+// without one.
+func getTokenID(r *http.Request) string {
+	id, _ := r.Context().Value("tokenID").(string)
+	return id
+}
+
 // SetupRoutes configures all HTTP routes
 func SetupRoutes(mux *http.ServeMux) {
 	// Static files
 	mux.Handle("/", spaFileHandler("./static"))
 
 	// API routes
-	mux.HandleFunc("/api/register", rateLimitByIP(registrationIPLimiter, handleRegister))
-	mux.HandleFunc("/api/login", rateLimitByIP(loginIPLimiter, handleLogin))
-	mux.HandleFunc("/api/invite/validate", rateLimitByIP(inviteValidationLimiter, handleValidateInvite))
+	mux.HandleFunc("/api/register", rateLimitByIP(registrationIPLimiter, only(http.MethodPost, handleRegister)))
+	mux.HandleFunc("/api/register/challenge", rateLimitByIP(registrationChallengeLimiter, only(http.MethodPost, handleRegistrationChallenge)))
+	mux.HandleFunc("/api/login", rateLimitByIP(loginIPLimiter, only(http.MethodPost, handleLogin)))
+	mux.HandleFunc("/api/refresh", rateLimitByIP(tokenRefreshLimiter, only(http.MethodPost, handleRefresh)))
+	mux.HandleFunc("/api/invite/validate", rateLimitByIP(inviteValidationLimiter, only(http.MethodPost, handleValidateInvite)))
+	mux.HandleFunc("/api/time", only(http.MethodGet, handleGetServerTime))
+	mux.HandleFunc("/api/escrow", only(http.MethodGet, handleGetEscrow))
+	mux.HandleFunc("/api/crypto/params", only(http.MethodGet, handleGetCryptoParams))
 
 	// Protected routes
-	mux.HandleFunc("/api/users", authMiddleware(handleGetUsers))
-	mux.HandleFunc("/api/users/me", authMiddleware(handleGetMe))
-	mux.HandleFunc("/api/users/update-key", authMiddleware(handleUpdatePublicKey))
+	mux.HandleFunc("/api/auth/verify", authMiddleware(only(http.MethodGet, handleVerifyToken)))
+	mux.HandleFunc("/api/logout", authMiddleware(only(http.MethodPost, handleLogout)))
+	mux.HandleFunc("/api/users", authMiddleware(only(http.MethodGet, handleGetUsers)))
+	mux.HandleFunc("/api/users/last-seen", authMiddleware(only(http.MethodGet, handleGetLastSeen)))
+	mux.HandleFunc("/api/users/me", authMiddleware(only(http.MethodGet, handleGetMe)))
+	mux.HandleFunc("/api/users/me/usage", authMiddleware(only(http.MethodGet, handleGetUsage)))
+	mux.HandleFunc("/api/users/me/activity", authMiddleware(only(http.MethodGet, handleGetActivity)))
+	mux.HandleFunc("/api/users/me/provenance", authMiddleware(only(http.MethodGet, handleGetProvenance)))
+	mux.HandleFunc("/api/users/me/dnd", authMiddleware(handleDoNotDisturb))
+	mux.HandleFunc("/api/users/me/notification-preview", authMiddleware(handleNotificationPreview))
+	mux.HandleFunc("/api/users/me/call-stats", authMiddleware(only(http.MethodGet, handleGetCallStats)))
+	mux.HandleFunc("/api/users/update-key", authMiddleware(only(http.MethodPost, handleUpdatePublicKey)))
+	mux.HandleFunc("/api/users/{id}/key.txt", authMiddleware(only(http.MethodGet, handleGetPublicKeyFile)))
+	mux.HandleFunc("/api/users/{userID}/nickname", authMiddleware(only(http.MethodPut, handleSetNickname)))
 	mux.HandleFunc("/api/messages", authMiddleware(handleMessages))
 	mux.HandleFunc("/api/messages/", authMiddleware(handleMessages))
-	mux.HandleFunc("/api/messages/clear", authMiddleware(handleClearMessages))
-	mux.HandleFunc("/api/ws-ticket", authMiddleware(rateLimitByUser(webSocketTicketLimiter, handleCreateWebSocketTicket)))
-	mux.HandleFunc("/api/ws", handleWebSocket)
-	mux.HandleFunc("/api/invites", authMiddleware(rateLimitByUser(inviteCreationLimiter, handleCreateInvite)))
+	mux.HandleFunc("/api/messages/clear", authMiddleware(only(http.MethodPost, handleClearMessages)))
+	mux.HandleFunc("/api/messages/cleanup", authMiddleware(only(http.MethodPost, handleCleanupMessages)))
+	mux.HandleFunc("/api/messages/delete-mine", authMiddleware(only(http.MethodPost, handleDeleteMyMessages)))
+	mux.HandleFunc("/api/messages/unread-total", authMiddleware(only(http.MethodGet, handleGetUnreadTotal)))
+	mux.HandleFunc("/api/messages/by-type", authMiddleware(only(http.MethodGet, handleGetMessagesByType)))
+	mux.HandleFunc("/api/messages/by-client-id", authMiddleware(only(http.MethodGet, handleGetMessageByClientID)))
+	mux.HandleFunc("/api/messages/{id}/status", authMiddleware(only(http.MethodGet, handleGetMessageStatus)))
+	mux.HandleFunc("/api/messages/{id}/edits", authMiddleware(only(http.MethodGet, handleGetMessageEdits)))
+	mux.HandleFunc("/api/messages/{id}/unread", authMiddleware(only(http.MethodPost, handleMarkMessageUnread)))
+	mux.HandleFunc("/api/messages/{userID}/media", authMiddleware(only(http.MethodGet, handleGetMediaMessages)))
+	mux.HandleFunc("/api/rooms", authMiddleware(handleRooms))
+	mux.HandleFunc("/api/rooms/invites", authMiddleware(only(http.MethodGet, handleGetRoomInvites)))
+	mux.HandleFunc("/api/rooms/{roomID}/accept", authMiddleware(only(http.MethodPost, handleAcceptRoomInvite)))
+	mux.HandleFunc("/api/rooms/{roomID}/decline", authMiddleware(only(http.MethodPost, handleDeclineRoomInvite)))
+	mux.HandleFunc("/api/rooms/{roomID}/members", authMiddleware(handleRoomMembers))
+	mux.HandleFunc("/api/rooms/{roomID}/members/remove", authMiddleware(only(http.MethodPost, handleRemoveRoomMember)))
+	mux.HandleFunc("/api/rooms/{roomID}/messages", authMiddleware(handleRoomMessages))
+	mux.HandleFunc("/api/devices", authMiddleware(only(http.MethodPost, handleRegisterDevice)))
+	mux.HandleFunc("/api/devices/remove", authMiddleware(only(http.MethodPost, handleRemoveDevice)))
+	mux.HandleFunc("/api/typing", authMiddleware(only(http.MethodGet, handleGetTyping)))
+	mux.HandleFunc("/api/presence/count", authMiddleware(only(http.MethodGet, handleGetOnlineCount)))
+	mux.HandleFunc("/api/calls/{sessionID}/end", authMiddleware(only(http.MethodPost, handleEndCall)))
+	mux.HandleFunc("/api/conversations", authMiddleware(only(http.MethodGet, handleGetConversations)))
+	mux.HandleFunc("/api/conversations/{userID}/prefs", authMiddleware(handleConversationPrefs))
+	mux.HandleFunc("/api/conversations/{userID}/appearance", authMiddleware(handleConversationAppearance))
+	mux.HandleFunc("/api/conversations/{userID}/version", authMiddleware(only(http.MethodGet, handleGetConversationVersion)))
+	mux.HandleFunc("/api/conversations/{userID}/archive", authMiddleware(only(http.MethodPost, handleSetArchived(true))))
+	mux.HandleFunc("/api/conversations/{userID}/unarchive", authMiddleware(only(http.MethodPost, handleSetArchived(false))))
+	mux.HandleFunc("/api/conversations/{userID}/export", authMiddleware(only(http.MethodGet, handleExportConversation)))
+	mux.HandleFunc("/api/notifications/state", authMiddleware(handleNotificationState))
+	mux.HandleFunc("/api/ws-ticket", authMiddleware(rateLimitByUser(webSocketTicketLimiter, only(http.MethodPost, handleCreateWebSocketTicket))))
+	mux.HandleFunc("/api/ws", only(http.MethodGet, handleWebSocket))
+	mux.HandleFunc("/api/invites", authMiddleware(rateLimitByUser(inviteCreationLimiter, only(http.MethodPost, handleCreateInvite))))
+	mux.HandleFunc("/api/admin/referrals", authMiddleware(adminMiddleware(only(http.MethodGet, handleGetReferrals))))
+	mux.HandleFunc("/api/admin/invites/{code}/usage", authMiddleware(adminMiddleware(only(http.MethodGet, handleGetInviteUsage))))
+	mux.HandleFunc("/api/admin/hub", authMiddleware(adminMiddleware(only(http.MethodGet, handleGetHubStats))))
+	mux.HandleFunc("/api/admin/conversations", authMiddleware(adminMiddleware(only(http.MethodGet, handleGetConversationActivity))))
 }
 
-func handleRegister(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
+// handleGetServerTime lets clients correct for clock skew when rendering
+// relative times.
+func handleGetServerTime(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	jsonResponse(w, http.StatusOK, map[string]int64{
+		"unix":    now.Unix(),
+		"unix_ms": now.UnixMilli(),
+	})
+}
+
+// handleGetCryptoParams describes the message encryption scheme so clients
+// can configure themselves instead of hardcoding it.
+func handleGetCryptoParams(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, crypto.MessageParams())
+}
 
+func handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Username   string `json:"username"`
 		Password   string `json:"password"`
 		InviteCode string `json:"invite_code"`
 		Bootstrap  string `json:"bootstrap_secret"`
 		PublicKey  string `json:"public_key"`
+		Challenge  string `json:"pow_challenge"`
+		Nonce      string `json:"pow_nonce"`
 	}
 
 	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
@@ -199,13 +277,41 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Username == "" || len(req.Username) < 3 || len(req.Username) > 32 {
+	if !limits.ValidUsername(req.Username) {
 		errorResponse(w, http.StatusBadRequest, "invalid username")
 		return
 	}
+	// The operator holding the bootstrap secret may give the first admin a
+	// reserved name such as admin; the username pattern still applies.
+	bootstrapAuthorized := validBootstrapSecret(req.Bootstrap)
+	checkUsername := limits.CheckUsernamePolicy
+	if bootstrapAuthorized {
+		checkUsername = limits.CheckUsernamePattern
+	}
+	if err := checkUsername(req.Username); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Names of administrators and the welcome system account stay protected
+	// in any capitalization, so that nobody can register a lookalike of staff.
+	// Such accounts come from the bootstrap invite or make import-users.
+	system, err := db.IsSystemUsername(req.Username, welcomeSenderID())
+	if err != nil {
+		log.Printf("Failed to check username against system accounts: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "failed to create user")
+		return
+	}
+	if system {
+		errorResponse(w, http.StatusBadRequest, limits.ErrReservedUsername.Error())
+		return
+	}
 
-	if len(req.Password) < 8 || len(req.Password) > 72 {
-		errorResponse(w, http.StatusBadRequest, "password must be between 8 and 72 characters")
+	if !limits.ValidPassword(req.Password) {
+		errorResponse(w, http.StatusBadRequest, limits.PasswordError())
+		return
+	}
+	if len(req.InviteCode) > limits.Current().InviteCodeMaxLength {
+		errorResponse(w, http.StatusBadRequest, db.ErrInvalidInvite.Error())
 		return
 	}
 
@@ -216,11 +322,22 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 
 	// Decode public key
 	pubKey, err := crypto.DecodeKey(req.PublicKey)
-	if err != nil || !validPublicKey(pubKey) {
+	if err != nil || !crypto.ValidPublicKey(pubKey) {
 		errorResponse(w, http.StatusBadRequest, "invalid public key")
 		return
 	}
 
+	// Signups without an invite or bootstrap secret pay for themselves with a
+	// proof of work, checked before the expensive password hash.
+	open, powBits := openRegistration()
+	openSignup := open && req.InviteCode == "" && !bootstrapAuthorized
+	if openSignup {
+		if err := verifyRegistrationProof(req.Challenge, req.Nonce, powBits); err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
 	// Hash password
 	passwordHash, err := db.HashPassword(req.Password)
 	if err != nil {
@@ -229,9 +346,12 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// User creation and invite consumption must commit together.
-	user, err := db.RegisterUser(
-		r.Context(), req.Username, passwordHash, pubKey, req.InviteCode, validBootstrapSecret(req.Bootstrap),
-	)
+	var user *db.User
+	if openSignup {
+		user, err = db.RegisterOpenUser(r.Context(), req.Username, passwordHash, pubKey)
+	} else {
+		user, err = db.RegisterUser(r.Context(), req.Username, passwordHash, pubKey, req.InviteCode, bootstrapAuthorized)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrBootstrapAuth):
@@ -244,26 +364,25 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	sendWelcomeMessage(user.ID)
 
-	// Generate token
-	token, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+	// Generate tokens
+	token, refreshToken, err := sessionTokens(user)
 	if err != nil {
+		log.Printf("Failed to issue tokens for user %d: %v", user.ID, err)
 		errorResponse(w, http.StatusInternalServerError, "failed to generate token")
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"token": token,
 		"user":  user,
-	})
+	}
+	deliverRefreshToken(w, response, refreshToken)
+	jsonResponse(w, http.StatusOK, response)
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
-
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
@@ -283,7 +402,7 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		errorResponse(w, http.StatusBadRequest, "password required")
 		return
 	}
-	if len(req.Password) > 72 {
+	if len(req.Password) > limits.Current().PasswordMaxLength {
 		errorResponse(w, http.StatusBadRequest, "invalid credentials")
 		return
 	}
@@ -313,24 +432,22 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	loginAccountLimiter.reset(accountKey)
 
-	token, err := auth.GenerateToken(user.ID, user.Username, user.AuthVersion)
+	token, refreshToken, err := sessionTokens(user)
 	if err != nil {
+		log.Printf("Failed to issue tokens for user %d: %v", user.ID, err)
 		errorResponse(w, http.StatusInternalServerError, "failed to generate token")
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"token": token,
 		"user":  user,
-	})
+	}
+	deliverRefreshToken(w, response, refreshToken)
+	jsonResponse(w, http.StatusOK, response)
 }
 
 func handleValidateInvite(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
-
 	var req struct {
 		Code string `json:"code"`
 	}
@@ -340,6 +457,10 @@ func handleValidateInvite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Code == "" || len(req.Code) > limits.Current().InviteCodeMaxLength {
+		errorResponse(w, http.StatusBadRequest, "invalid or used invite code")
+		return
+	}
 	if err := db.ValidateInvite(req.Code); err != nil {
 		errorResponse(w, http.StatusBadRequest, "invalid or used invite code")
 		return
@@ -349,13 +470,14 @@ func handleValidateInvite(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGetUsers(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	users, err := db.GetAllUsers()
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch users")
 		return
 	}
-
-	users, err := db.GetAllUsers()
+	nicknames, err := db.GetNicknames(getUserID(r))
 	if err != nil {
+		log.Printf("Failed to load nicknames of user %d: %v", getUserID(r), err)
 		errorResponse(w, http.StatusInternalServerError, "failed to fetch users")
 		return
 	}
@@ -364,25 +486,72 @@ func handleGetUsers(w http.ResponseWriter, r *http.Request) {
 	hub := ws.GetHub()
 	response := make([]map[string]interface{}, 0, len(users))
 	for _, u := range users {
-		response = append(response, map[string]interface{}{
+		entry := map[string]interface{}{
 			"id":         u.ID,
 			"username":   u.Username,
 			"public_key": crypto.EncodeKey(u.PublicKey),
+			"key_epoch":  u.KeyEpoch,
 			"created_at": u.CreatedAt,
 			"last_seen":  u.LastSeen,
 			"online":     hub.IsOnline(u.ID),
-		})
+		}
+		if nickname, ok := nicknames[u.ID]; ok {
+			entry["nickname"] = nickname
+		}
+		response = append(response, entry)
 	}
 
 	jsonResponse(w, http.StatusOK, response)
 }
 
-func handleGetMe(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+func handleGetLastSeen(w http.ResponseWriter, r *http.Request) {
+	var ids []int64
+	seen := make(map[int64]struct{})
+	for _, value := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 1 {
+			errorResponse(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+		if _, duplicate := seen[id]; duplicate {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || len(ids) > maximumLastSeenIDs {
+		errorResponse(w, http.StatusBadRequest, "ids must list between 1 and 100 user IDs")
+		return
+	}
+
+	lastSeen, err := db.GetLastSeen(ids)
+	if err != nil {
+		log.Printf("Failed to fetch last seen times: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch last seen")
 		return
 	}
+	jsonResponse(w, http.StatusOK, lastSeen)
+}
+
+// handleVerifyToken reports the claims of a token that authMiddleware has
+// already accepted, so clients can check a stored token at startup.
+func handleVerifyToken(w http.ResponseWriter, r *http.Request) {
+	var expiresAt *time.Time
+	if expiry := getTokenExpiry(r); !expiry.IsZero() {
+		expiresAt = &expiry
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"valid":      true,
+		"user_id":    getUserID(r),
+		"username":   getUsername(r),
+		"expires_at": expiresAt,
+	})
+}
 
+func handleGetMe(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r)
 	user, err := db.GetUserByID(userID)
 	if err != nil {
@@ -399,18 +568,115 @@ func handleGetMe(w http.ResponseWriter, r *http.Request) {
 		"id":         user.ID,
 		"username":   user.Username,
 		"public_key": crypto.EncodeKey(user.PublicKey),
+		"key_epoch":  user.KeyEpoch,
 		"created_at": user.CreatedAt,
 		"last_seen":  user.LastSeen,
 		"online":     true,
 	})
 }
 
-func handleUpdatePublicKey(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+func handleGetPublicKeyFile(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || userID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid user ID")
+		return
+	}
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Failed to fetch user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
+		return
+	}
+	if user == nil {
+		errorResponse(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user.Username+"-key.txt"))
+	fmt.Fprintf(w, "user: %s\nid: %d\nkey_epoch: %d\npublic_key: %s\nfingerprint: %s\n",
+		user.Username, user.ID, user.KeyEpoch, crypto.EncodeKey(user.PublicKey), crypto.Fingerprint(user.PublicKey))
+}
+
+func handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	used, err := db.GetStorageUsage(userID)
+	if err != nil {
+		log.Printf("Failed to fetch storage usage for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch usage")
+		return
+	}
+
+	// A nil quota and remainder mean storage is unlimited.
+	var quota, remaining *int64
+	if limit := db.StorageQuota(); limit > 0 {
+		left := max(0, limit-used)
+		quota, remaining = &limit, &left
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"stored_bytes":    used,
+		"quota_bytes":     quota,
+		"remaining_bytes": remaining,
+	})
+}
+
+// handleGetProvenance shows the requester which invite they joined with and
+// who created it. Only a prefix of the code is returned.
+func handleGetProvenance(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	provenance, err := db.GetProvenance(userID)
+	if err != nil {
+		log.Printf("Failed to fetch provenance of user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch provenance")
+		return
+	}
+	if provenance == nil {
+		errorResponse(w, http.StatusNotFound, "registered without an invite")
+		return
+	}
+	if len(provenance.InviteCode) > maskedInvitePrefix {
+		provenance.InviteCode = provenance.InviteCode[:maskedInvitePrefix] + "…"
+	}
+	jsonResponse(w, http.StatusOK, provenance)
+}
+
+func handleGetActivity(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maximumActivityDays {
+			errorResponse(w, http.StatusBadRequest, "days must be between 1 and 365")
+			return
+		}
+		days = parsed
+	}
+
+	userID := getUserID(r)
+	since := time.Now().UTC().AddDate(0, 0, 1-days)
+	activity, err := db.GetMessageActivity(userID, since)
+	if err != nil {
+		log.Printf("Failed to fetch message activity for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch activity")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"since": since.Format("2006-01-02"),
+		"days":  activity,
+	})
+}
+
+func handleGetCallStats(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	stats, err := db.GetCallStats(userID)
+	if err != nil {
+		log.Printf("Failed to fetch call stats for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch call stats")
 		return
 	}
+	jsonResponse(w, http.StatusOK, stats)
+}
 
+func handleUpdatePublicKey(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r)
 
 	var req struct {
@@ -429,12 +695,19 @@ func handleUpdatePublicKey(w http.ResponseWriter, r *http.Request) {
 
 	// Decode public key
 	pubKey, err := crypto.DecodeKey(req.PublicKey)
-	if err != nil || !validPublicKey(pubKey) {
+	if err != nil || !crypto.ValidPublicKey(pubKey) {
 		errorResponse(w, http.StatusBadRequest, "invalid public key")
 		return
 	}
 
-	if err := db.UpdatePublicKey(userID, pubKey); err != nil {
+	wait, err := db.UpdatePublicKey(userID, pubKey, keyUpdateInterval())
+	if errors.Is(err, db.ErrKeyUpdateTooSoon) {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		errorResponse(w, http.StatusTooManyRequests, "public key was changed recently; try again later")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update public key of user %d: %v", userID, err)
 		errorResponse(w, http.StatusInternalServerError, "failed to update public key")
 		return
 	}
@@ -442,16 +715,12 @@ func handleUpdatePublicKey(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, http.StatusOK, map[string]bool{"success": true})
 }
 
-func handleMessages(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		handleGetMessages(w, r)
-	case http.MethodPost:
-		handleSendMessage(w, r)
-	default:
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-	}
-}
+var handleMessages = methods(map[string]http.HandlerFunc{
+	http.MethodGet:    handleGetMessages,
+	http.MethodPost:   handleSendMessage,
+	http.MethodPut:    handleEditMessage,
+	http.MethodDelete: handleDeleteMessage,
+})
 
 func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r)
@@ -476,40 +745,107 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 		errorResponse(w, http.StatusNotFound, "user not found")
 		return
 	}
+	if acceptsNDJSON(r) {
+		streamMessages(w, r, userID, otherID, nil)
+		return
+	}
 
-	limit := 50
-	if value := r.URL.Query().Get("limit"); value != "" {
-		parsed, err := strconv.Atoi(value)
-		if err != nil || parsed < 1 || parsed > 100 {
-			errorResponse(w, http.StatusBadRequest, "limit must be between 1 and 100")
+	limit, beforeID, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	unreadFirst := r.URL.Query().Get("anchor") == "first_unread"
+	if value := r.URL.Query().Get("anchor"); value != "" && !unreadFirst {
+		errorResponse(w, http.StatusBadRequest, "anchor must be first_unread")
+		return
+	}
+	if unreadFirst && beforeID != 0 {
+		errorResponse(w, http.StatusBadRequest, "anchor cannot be combined with before_id")
+		return
+	}
+	fromStart := false
+	if value := r.URL.Query().Get("from_start"); value != "" {
+		if fromStart, err = strconv.ParseBool(value); err != nil {
+			errorResponse(w, http.StatusBadRequest, "from_start must be true or false")
 			return
 		}
-		limit = parsed
 	}
-
-	var beforeID int64
-	if value := r.URL.Query().Get("before_id"); value != "" {
+	if fromStart && (unreadFirst || beforeID != 0) {
+		errorResponse(w, http.StatusBadRequest, "from_start cannot be combined with anchor or before_id")
+		return
+	}
+	// after_id pages forward from a page reached with from_start, an anchor
+	// or an earlier after_id: the next page starts after its newest message.
+	var afterID int64
+	if value := r.URL.Query().Get("after_id"); value != "" {
 		parsed, err := strconv.ParseInt(value, 10, 64)
 		if err != nil || parsed < 1 {
 			errorResponse(w, http.StatusBadRequest, "invalid message cursor")
 			return
 		}
-		beforeID = parsed
+		afterID = parsed
+	}
+	if afterID != 0 && (fromStart || unreadFirst || beforeID != 0) {
+		errorResponse(w, http.StatusBadRequest, "after_id cannot be combined with from_start, anchor or before_id")
+		return
+	}
+	order := r.URL.Query().Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		errorResponse(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	oldestFirst := order == "asc"
+	// Background prefetches pass mark_read=false so that fetching history
+	// does not count as reading it.
+	markRead := true
+	if value := r.URL.Query().Get("mark_read"); value != "" {
+		if markRead, err = strconv.ParseBool(value); err != nil {
+			errorResponse(w, http.StatusBadRequest, "mark_read must be true or false")
+			return
+		}
+	}
+
+	var firstUnreadID int64
+	if unreadFirst {
+		if firstUnreadID, err = db.GetFirstUnreadID(userID, otherID); err != nil {
+			log.Printf("Failed to locate first unread message from %d to %d: %v", otherID, userID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to fetch messages")
+			return
+		}
 	}
 
-	messages, err := db.GetMessagesBetween(userID, otherID, limit+1, beforeID)
+	var messages []db.Message
+	var hasMore, hasNewer bool
+	if firstUnreadID > 0 {
+		messages, hasMore, hasNewer, err = messageWindow(userID, otherID, firstUnreadID, limit, oldestFirst)
+	} else if fromStart || afterID != 0 {
+		// The first page of the conversation, or the page after afterID.
+		messages, err = db.GetMessagesFrom(userID, otherID, limit+1, afterID+1)
+		hasNewer = len(messages) > limit
+		if hasNewer {
+			messages = messages[:limit]
+		}
+		if !oldestFirst {
+			slices.Reverse(messages)
+		}
+	} else {
+		messages, err = db.GetMessagesBetweenOrdered(userID, otherID, limit+1, beforeID, oldestFirst)
+		hasMore = len(messages) > limit
+		if hasMore && oldestFirst {
+			messages = messages[1:]
+		} else if hasMore {
+			messages = messages[:limit]
+		}
+	}
 	if err != nil {
 		errorResponse(w, http.StatusInternalServerError, "failed to fetch messages")
 		return
 	}
-	hasMore := len(messages) > limit
-	if hasMore {
-		messages = messages[:limit]
-	}
 
 	var minReadID, maxReadID int64
 	for _, message := range messages {
-		if message.SenderID != otherID || message.ReceiverID != userID || message.Read {
+		if !markRead || message.SenderID != otherID || message.ReceiverID != userID || message.Read {
 			continue
 		}
 		if minReadID == 0 || message.ID < minReadID {
@@ -522,13 +858,15 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 
 	// Only mark incoming messages from the returned page as read.
 	if maxReadID > 0 {
-		updated, err := db.MarkMessagesAsReadRange(otherID, userID, minReadID, maxReadID)
+		updated, firstRead, err := db.MarkMessagesAsReadRange(otherID, userID, minReadID, maxReadID)
 		if err != nil {
 			log.Printf("Failed to mark messages as read: %v", err)
 			errorResponse(w, http.StatusInternalServerError, "failed to update messages")
 			return
 		}
-		if updated > 0 && ws.GetHub().IsOnline(otherID) {
+		// Messages read again after being marked unread were already
+		// receipted, so only first reads send one.
+		if firstRead > 0 && ws.GetHub().IsOnline(otherID) && readReceiptsEnabled(userID, otherID) {
 			// Send read receipt via WebSocket
 			readReceiptData, _ := json.Marshal(map[string]int64{
 				"from_id":    minReadID,
@@ -540,126 +878,675 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 				To:        otherID,
 				Data:      readReceiptData,
 				Timestamp: time.Now().Unix(),
+				Version:   conversationVersion(userID, otherID),
 			})
 		}
+		if updated > 0 {
+			notifyUnreadTotal(userID)
+		}
 	}
 
 	var nextCursor *int64
 	if hasMore {
+		// The cursor is always the oldest message on the page.
 		cursor := messages[len(messages)-1].ID
+		if oldestFirst {
+			cursor = messages[0].ID
+		}
 		nextCursor = &cursor
 	}
-	jsonResponse(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"messages":    messages,
 		"next_cursor": nextCursor,
-	})
+	}
+	if unreadFirst {
+		// A zero first_unread_id means the page is the newest one.
+		response["first_unread_id"] = firstUnreadID
+		response["has_newer"] = hasNewer
+	}
+	if fromStart || afterID != 0 {
+		response["has_newer"] = hasNewer
+	}
+	jsonResponse(w, http.StatusOK, response)
 }
 
-func handleSendMessage(w http.ResponseWriter, r *http.Request) {
-	senderID := getUserID(r)
+// Page sizes accepted by pageParams.
+const (
+	defaultPageSize = 50
+	maximumPageSize = 200
+)
 
-	var req struct {
-		ReceiverID int64  `json:"receiver_id"`
-		ClientID   string `json:"client_id"`
-		Type       string `json:"type"`
-		Content    string `json:"content"`
-		Nonce      string `json:"nonce"`
+// pageParams parses the limit and before_id history cursor, writing a 400
+// response and returning false when either is invalid. Limits above the
+// maximum page size are clamped to it.
+func pageParams(w http.ResponseWriter, r *http.Request) (int, int64, bool) {
+	limit := defaultPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if errors.Is(err, strconv.ErrRange) && parsed > 0 {
+			err = nil // too large for an int, so clamped like any other large limit
+		}
+		if err != nil || parsed < 1 {
+			errorResponse(w, http.StatusBadRequest, "limit must be a positive number")
+			return 0, 0, false
+		}
+		limit = min(parsed, maximumPageSize)
 	}
 
-	if err := decodeJSON(w, r, &req, messageRequestLimit); err != nil {
-		errorResponse(w, http.StatusBadRequest, "invalid request")
-		return
+	var beforeID int64
+	if value := r.URL.Query().Get("before_id"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			errorResponse(w, http.StatusBadRequest, "invalid message cursor")
+			return 0, 0, false
+		}
+		beforeID = parsed
 	}
+	return limit, beforeID, true
+}
 
-	if req.ReceiverID < 1 || !validClientMessageID(req.ClientID) || req.Content == "" || req.Nonce == "" {
-		errorResponse(w, http.StatusBadRequest, "missing required fields")
-		return
-	}
-	if req.ReceiverID == senderID {
-		errorResponse(w, http.StatusBadRequest, "cannot message yourself")
+func handleGetMediaMessages(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	otherID, err := strconv.ParseInt(r.PathValue("userID"), 10, 64)
+	if err != nil || otherID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid user ID")
 		return
 	}
-	receiver, err := db.GetUserByID(req.ReceiverID)
+	otherUser, err := db.GetUserByID(otherID)
 	if err != nil {
-		log.Printf("Failed to fetch message recipient %d: %v", req.ReceiverID, err)
-		errorResponse(w, http.StatusInternalServerError, "failed to fetch recipient")
+		log.Printf("Failed to fetch conversation user %d: %v", otherID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
 		return
 	}
-	if receiver == nil {
-		errorResponse(w, http.StatusNotFound, "recipient not found")
+	if otherUser == nil {
+		errorResponse(w, http.StatusNotFound, "user not found")
 		return
 	}
-
-	// Decode content and nonce
-	content, err := crypto.DecodeKey(req.Content)
-	if err != nil || len(content) > maximumMessageSize {
-		errorResponse(w, http.StatusBadRequest, "invalid content encoding")
+	limit, beforeID, ok := pageParams(w, r)
+	if !ok {
 		return
 	}
 
-	nonce, err := crypto.DecodeKey(req.Nonce)
-	if err != nil || len(nonce) != 12 {
-		errorResponse(w, http.StatusBadRequest, "invalid nonce encoding")
+	messages, err := db.GetMediaMessagesBetween(userID, otherID, limit+1, beforeID)
+	if err != nil {
+		log.Printf("Failed to fetch media between %d and %d: %v", userID, otherID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch messages")
 		return
 	}
+	var nextCursor *int64
+	if len(messages) > limit {
+		messages = messages[:limit]
+		cursor := messages[len(messages)-1].ID
+		nextCursor = &cursor
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"messages":    messages,
+		"next_cursor": nextCursor,
+	})
+}
 
-	msgType := req.Type
-	if msgType == "" {
-		msgType = "text"
+// handleGetMessagesByType pages through the requester's messages of the type
+// given by the type query parameter, across all conversations.
+func handleGetMessagesByType(w http.ResponseWriter, r *http.Request) {
+	messageType := r.URL.Query().Get("type")
+	if !slices.Contains(db.ListableMessageTypes, messageType) {
+		errorResponse(w, http.StatusBadRequest, "invalid message type")
+		return
 	}
-	if msgType != "text" {
-		errorResponse(w, http.StatusBadRequest, "unsupported message type")
+	limit, beforeID, ok := pageParams(w, r)
+	if !ok {
 		return
 	}
 
-	// Save to database
-	msg, created, err := db.SaveMessage(senderID, req.ReceiverID, req.ClientID, msgType, content, nonce)
+	userID := getUserID(r)
+	messages, err := db.GetMessagesByType(userID, messageType, limit+1, beforeID)
 	if err != nil {
-		if errors.Is(err, db.ErrIdempotencyConflict) {
-			errorResponse(w, http.StatusConflict, err.Error())
-			return
-		}
-		errorResponse(w, http.StatusInternalServerError, "failed to save message")
+		log.Printf("Failed to fetch %s messages of user %d: %v", messageType, userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch messages")
 		return
 	}
-
-	// Send via WebSocket if user is online
-	hub := ws.GetHub()
-	if created && hub.IsOnline(req.ReceiverID) {
-		hub.SendMessage(req.ReceiverID, ws.Message{
-			ID:        msg.ID,
-			Type:      "message",
-			From:      senderID,
-			To:        req.ReceiverID,
-			Content:   content,
-			Nonce:     nonce,
-			Timestamp: msg.Timestamp.Unix(),
-		})
+	var nextCursor *int64
+	if len(messages) > limit {
+		messages = messages[:limit]
+		cursor := messages[len(messages)-1].ID
+		nextCursor = &cursor
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"messages":    messages,
+		"next_cursor": nextCursor,
+	})
+}
+
+// messageWindow returns up to limit messages, newest first unless oldestFirst
+// is set, with about a quarter of the page before anchorID for context and
+// the rest from anchorID on.
+func messageWindow(userID, otherID, anchorID int64, limit int, oldestFirst bool) (messages []db.Message, hasOlder, hasNewer bool, err error) {
+	newer, err := db.GetMessagesFrom(userID, otherID, limit+1, anchorID)
+	if err != nil {
+		return nil, false, false, err
+	}
+	olderLimit := limit / 4
+	if len(newer) > limit-olderLimit {
+		hasNewer = true
+		newer = newer[:limit-olderLimit]
+	} else {
+		// Fill the page from older history when the unread tail is short.
+		olderLimit = limit - len(newer)
+	}
+	older, err := db.GetMessagesBetween(userID, otherID, olderLimit+1, anchorID)
+	if err != nil {
+		return nil, false, false, err
+	}
+	hasOlder = len(older) > olderLimit
+	if hasOlder {
+		older = older[:olderLimit]
+	}
+
+	messages = make([]db.Message, 0, len(newer)+len(older))
+	for index := len(newer) - 1; index >= 0; index-- {
+		messages = append(messages, newer[index])
+	}
+	messages = append(messages, older...)
+	if oldestFirst {
+		slices.Reverse(messages)
+	}
+	return messages, hasOlder, hasNewer, nil
+}
+
+// messageRequestOverhead leaves room in a send request body for everything
+// around the content: the nonce, IDs, type and JSON syntax.
+const messageRequestOverhead = 1 << 10
+
+// messageRequestLimit bounds the part of a send request body carrying one copy
+// of the content: its base64 at the size limit plus the fields around it.
+func messageRequestLimit(maximumSize int) int64 {
+	return int64(base64.StdEncoding.EncodedLen(maximumSize)) + messageRequestOverhead
+}
+
+// sendRequestLimit bounds a request carrying copies of the content of one
+// message, plus its escrow envelope in compliance mode.
+func sendRequestLimit(maximumSize, copies int) int64 {
+	limit := messageRequestLimit(maximumSize) * int64(copies)
+	if escrowPublicKey() != nil {
+		limit += messageRequestLimit(maximumSize + maximumEscrowOverhead)
+	}
+	return limit
+}
+
+// decodeMessageCiphertext decodes the content and nonce of a message to send,
+// which are padded standard base64, writing an error response and reporting
+// false when they are malformed or the content is too large.
+func decodeMessageCiphertext(w http.ResponseWriter, encodedContent, encodedNonce string, maximumSize int) ([]byte, []byte, bool) {
+	content, err := crypto.DecodeStrict(encodedContent)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "content "+err.Error())
+		return nil, nil, false
+	}
+	if len(content) > maximumSize {
+		errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("content must not exceed %d bytes", maximumSize))
+		return nil, nil, false
+	}
+
+	nonce, err := crypto.DecodeStrict(encodedNonce)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "nonce "+err.Error())
+		return nil, nil, false
+	}
+	if err := crypto.ValidateCiphertext(content, nonce); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	return content, nonce, true
+}
+
+// sendableMessageType returns the type of a message to send, text when
+// unset, writing an error response and reporting false for types clients
+// cannot send.
+func sendableMessageType(w http.ResponseWriter, msgType string) (string, bool) {
+	if msgType == "" {
+		msgType = "text"
+	}
+	if len(msgType) > limits.Current().MessageTypeMaxLength {
+		errorResponse(w, http.StatusBadRequest, "invalid message type")
+		return "", false
+	}
+	if msgType != "text" {
+		errorResponse(w, http.StatusBadRequest, "unsupported message type")
+		return "", false
+	}
+	return msgType, true
+}
+
+func handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	senderID := getUserID(r)
+
+	var req struct {
+		ReceiverID int64             `json:"receiver_id"`
+		RoomID     int64             `json:"room_id"` // instead of receiver_id, with copies
+		ClientID   string            `json:"client_id"`
+		Type       string            `json:"type"`
+		Content    string            `json:"content"`
+		Nonce      string            `json:"nonce"`
+		KeyEpoch   *int64            `json:"key_epoch"`
+		Copies     []roomMessageCopy `json:"copies"`
+		Escrow     string            `json:"escrow_envelope"` // copy encrypted to the escrow key in compliance mode
+	}
+
+	maximumSize := limits.Current().MessageMaxBytes
+	tooLarge := func() {
+		errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("content must not exceed %d bytes", maximumSize))
+	}
+	// The body may hold a copy of the content for every member of a room.
+	if err := decodeJSON(w, r, &req, sendRequestLimit(maximumSize, db.MaximumRoomMembers)); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			tooLarge()
+			return
+		}
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if req.RoomID != 0 {
+		if req.RoomID < 0 || req.ReceiverID != 0 || req.Content != "" || req.Nonce != "" || !limits.ValidClientID(req.ClientID) {
+			errorResponse(w, http.StatusBadRequest, "missing required fields")
+			return
+		}
+		escrow, err := decodeEscrowEnvelope(req.Escrow)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		msgType, ok := sendableMessageType(w, req.Type)
+		if !ok {
+			return
+		}
+		sendRoomMessage(w, req.RoomID, senderID, req.ClientID, msgType, req.Copies, escrow)
+		return
+	}
+	if r.ContentLength > sendRequestLimit(maximumSize, 1) {
+		tooLarge()
+		return
+	}
+
+	if len(req.Copies) > 0 || req.ReceiverID < 1 || !limits.ValidClientID(req.ClientID) || req.Content == "" || req.Nonce == "" {
+		errorResponse(w, http.StatusBadRequest, "missing required fields")
+		return
+	}
+	receiver, err := db.GetUserByID(req.ReceiverID)
+	if err != nil {
+		log.Printf("Failed to fetch message recipient %d: %v", req.ReceiverID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch recipient")
+		return
+	}
+	if receiver == nil {
+		errorResponse(w, http.StatusNotFound, "recipient not found")
+		return
+	}
+
+	content, nonce, ok := decodeMessageCiphertext(w, req.Content, req.Nonce, maximumSize)
+	if !ok {
+		return
+	}
+	escrow, err := decodeEscrowEnvelope(req.Escrow)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	msgType, ok := sendableMessageType(w, req.Type)
+	if !ok {
+		return
+	}
+
+	// Content encrypted to a replaced key would be unreadable by the recipient.
+	keyEpoch := receiver.KeyEpoch
+	if req.KeyEpoch != nil && *req.KeyEpoch != keyEpoch {
+		errorResponse(w, http.StatusConflict, "recipient public key has changed")
+		return
+	}
+
+	// Save to database
+	msg, created, err := db.SaveEscrowedMessage(senderID, req.ReceiverID, req.ClientID, msgType, content, nonce, keyEpoch, escrow)
+	if err != nil {
+		if errors.Is(err, db.ErrIdempotencyConflict) {
+			errorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		if errors.Is(err, db.ErrStorageQuotaExceeded) {
+			errorResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		errorResponse(w, http.StatusInternalServerError, "failed to save message")
+		return
+	}
+
+	// Send via WebSocket if user is online, otherwise wake their devices,
+	// unless they are in do-not-disturb mode. Notes to self only need to
+	// reach the sender's other sessions.
+	if created && req.ReceiverID == senderID {
+		ws.GetHub().SendMessage(senderID, ws.MessageEvent(msg))
+	} else if created {
+		paused, err := db.GetDoNotDisturb(req.ReceiverID)
+		if err != nil {
+			log.Printf("Failed to read do-not-disturb state of user %d: %v", req.ReceiverID, err)
+		}
+		if !paused {
+			if ws.GetHub().IsOnline(req.ReceiverID) {
+				pushMessage(msg)
+			} else {
+				notifyDevices(msg)
+			}
+		}
+		notifyUnreadTotal(req.ReceiverID)
 	}
 
 	jsonResponse(w, http.StatusOK, msg)
 }
 
-func validClientMessageID(value string) bool {
-	if len(value) < 16 || len(value) > 64 {
-		return false
+// pushMessage sends a stored message to the recipient's live sessions and
+// records its delivery. Delivery is recorded first because it bumps the
+// conversation version, which the event has to carry.
+func pushMessage(msg *db.Message) {
+	hub := ws.GetHub()
+	if !hub.IsOnline(msg.ReceiverID) {
+		return
 	}
-	for _, char := range value {
-		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
-			(char >= '0' && char <= '9') || char == '-' || char == '_' {
-			continue
+	event := ws.MessageEvent(msg)
+	version, err := db.MarkMessageDelivered(msg.ID)
+	if err != nil {
+		log.Printf("Failed to record delivery of message %d: %v", msg.ID, err)
+		version = conversationVersion(msg.ReceiverID, msg.SenderID)
+	}
+	event.Version = version
+	if !hub.SendMessage(msg.ReceiverID, event) {
+		// The recipient went offline in between; their next session gets it.
+		if err := db.MarkMessageUndelivered(msg.ID); err != nil {
+			log.Printf("Failed to undo delivery of message %d: %v", msg.ID, err)
 		}
-		return false
 	}
-	return true
 }
 
-func handleClearMessages(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+// pushPendingMessages sends messages held back while the user was paused,
+// oldest first. Newly connected sessions receive them from the hub instead.
+func pushPendingMessages(userID int64) {
+	var afterID int64
+	for {
+		messages, err := db.GetUndeliveredMessagesForUser(userID, afterID, ws.PendingPageSize)
+		if err != nil {
+			log.Printf("Failed to load pending messages for user %d: %v", userID, err)
+			return
+		}
+		for index := range messages {
+			pushMessage(&messages[index])
+		}
+		if len(messages) < ws.PendingPageSize {
+			return
+		}
+		afterID = messages[len(messages)-1].ID
+	}
+}
+
+var handleDoNotDisturb = methods(map[string]http.HandlerFunc{
+	http.MethodGet:  handleGetDoNotDisturb,
+	http.MethodPost: handleSetDoNotDisturb,
+})
+
+func handleSetDoNotDisturb(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil || req.Enabled == nil {
+		errorResponse(w, http.StatusBadRequest, "enabled must be true or false")
+		return
+	}
+	if err := db.SetDoNotDisturb(userID, *req.Enabled); err != nil {
+		log.Printf("Failed to update do-not-disturb for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to update do-not-disturb")
 		return
 	}
+	if !*req.Enabled {
+		pushPendingMessages(userID)
+	}
+	handleGetDoNotDisturb(w, r)
+}
 
+func handleGetDoNotDisturb(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	enabled, err := db.GetDoNotDisturb(userID)
+	if err != nil {
+		log.Printf("Failed to read do-not-disturb for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to read do-not-disturb")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]bool{"enabled": enabled})
+}
+
+func handleGetUnreadTotal(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	total, err := db.CountUnreadMessages(userID)
+	if err != nil {
+		log.Printf("Failed to count unread messages for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to count unread messages")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]int64{"total": total})
+}
+
+// notifyUnreadTotal sends the user's connected sessions their new unread
+// total so that badges stay current without polling.
+func notifyUnreadTotal(userID int64) {
+	if !ws.GetHub().IsOnline(userID) {
+		return
+	}
+	total, err := db.CountUnreadMessages(userID)
+	if err != nil {
+		log.Printf("Failed to count unread messages for user %d: %v", userID, err)
+		return
+	}
+	data, _ := json.Marshal(map[string]int64{"total": total})
+	ws.GetHub().SendMessage(userID, ws.Message{
+		Type:      "unread_total",
+		To:        userID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+var handleNotificationState = methods(map[string]http.HandlerFunc{
+	http.MethodGet:  handleGetNotificationState,
+	http.MethodPost: handleAckNotifications,
+})
+
+func handleGetNotificationState(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	ackedThrough, err := db.GetNotificationAck(userID)
+	if err != nil {
+		log.Printf("Failed to read notification state for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to read notification state")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]int64{"acked_through": ackedThrough})
+}
+
+func handleAckNotifications(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	var req struct {
+		AckedThrough int64 `json:"acked_through"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil || req.AckedThrough < 1 {
+		errorResponse(w, http.StatusBadRequest, "acked_through must be a message ID")
+		return
+	}
+	ackedThrough, changed, err := db.AckNotifications(userID, req.AckedThrough)
+	if err != nil {
+		log.Printf("Failed to update notification state for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to update notification state")
+		return
+	}
+	if changed {
+		// Every session of the user, including the one that acknowledged, converges on the same value.
+		data, _ := json.Marshal(map[string]int64{"acked_through": ackedThrough})
+		ws.GetHub().SendMessage(userID, ws.Message{
+			Type:      "notifications_cleared",
+			From:      userID,
+			Data:      data,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	jsonResponse(w, http.StatusOK, map[string]int64{"acked_through": ackedThrough})
+}
+
+func handleGetMessageStatus(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || messageID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid message ID")
+		return
+	}
+	status, err := db.GetMessageStatus(messageID)
+	if err != nil {
+		log.Printf("Failed to fetch status of message %d: %v", messageID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch message status")
+		return
+	}
+	if status == nil {
+		errorResponse(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if status.SenderID != getUserID(r) {
+		errorResponse(w, http.StatusForbidden, "only the sender can view message status")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, status)
+}
+
+// handleGetMessageByClientID answers "did my message send?" after a send
+// whose response never arrived. It returns the stored message and how far it
+// got, or 404 when the server never stored it. The client can then retry the
+// send with the same client_id, which returns the stored message if one exists.
+func handleGetMessageByClientID(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	if !limits.ValidClientID(clientID) {
+		errorResponse(w, http.StatusBadRequest, "invalid client_id")
+		return
+	}
+	userID := getUserID(r)
+	message, err := db.GetMessageByClientID(userID, clientID)
+	if err != nil {
+		log.Printf("Failed to fetch message by client ID for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch message")
+		return
+	}
+	if message == nil {
+		errorResponse(w, http.StatusNotFound, "message not found")
+		return
+	}
+	status, err := db.GetMessageStatus(message.ID)
+	if err != nil || status == nil {
+		log.Printf("Failed to fetch status of message %d: %v", message.ID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch message status")
+		return
+	}
+
+	state := "sent"
+	switch {
+	case status.ReadAt != nil:
+		state = "read"
+	case status.DeliveredAt != nil:
+		state = "delivered"
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"status":       state,
+		"message":      message,
+		"delivered_at": status.DeliveredAt,
+		"read_at":      status.ReadAt,
+	})
+}
+
+// handleMarkMessageUnread lets the recipient flag a message as unread again,
+// as a reminder to reply. The sender is not told.
+func handleMarkMessageUnread(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || messageID < 1 {
+		errorResponse(w, http.StatusBadRequest, "invalid message ID")
+		return
+	}
+	userID := getUserID(r)
+	message, err := db.GetMessageByID(messageID)
+	if err != nil {
+		log.Printf("Failed to fetch message %d: %v", messageID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch message")
+		return
+	}
+	if message == nil {
+		errorResponse(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if message.ReceiverID != userID {
+		errorResponse(w, http.StatusForbidden, "only the recipient can mark a message unread")
+		return
+	}
+
+	updated, err := db.MarkMessageUnread(messageID, userID)
+	if err != nil {
+		log.Printf("Failed to mark message %d unread: %v", messageID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to update message")
+		return
+	}
+	if updated {
+		notifyUnreadTotal(userID)
+	}
+	jsonResponse(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+const maximumCleanupDays = 3650
+
+// handleCleanupMessages hides the requester's read messages older than a
+// number of days, in one conversation or all of them.
+func handleCleanupMessages(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	var req struct {
+		OlderThanDays int   `json:"older_than_days"`
+		OtherUserID   int64 `json:"other_user_id"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if req.OlderThanDays < 1 || req.OlderThanDays > maximumCleanupDays {
+		errorResponse(w, http.StatusBadRequest, fmt.Sprintf("older_than_days must be between 1 and %d", maximumCleanupDays))
+		return
+	}
+	if req.OtherUserID != 0 {
+		if req.OtherUserID < 0 || req.OtherUserID == userID {
+			errorResponse(w, http.StatusBadRequest, "invalid user ID")
+			return
+		}
+		otherUser, err := db.GetUserByID(req.OtherUserID)
+		if err != nil {
+			log.Printf("Failed to fetch cleanup target %d: %v", req.OtherUserID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
+			return
+		}
+		if otherUser == nil {
+			errorResponse(w, http.StatusNotFound, "user not found")
+			return
+		}
+	}
+
+	before := time.Now().AddDate(0, 0, -req.OlderThanDays)
+	hidden, err := db.HideReadMessages(r.Context(), userID, req.OtherUserID, before)
+	if err != nil {
+		log.Printf("Failed to clean up messages for user %d: %v", userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to clean up messages")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"status": "ok", "hidden": hidden})
+}
+
+func handleClearMessages(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r)
 
 	var req struct {
@@ -695,22 +1582,147 @@ func handleClearMessages(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, http.StatusOK, map[string]interface{}{"status": "ok", "through_id": throughID})
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+func handleDeleteMyMessages(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	var req struct {
+		OtherUserID int64 `json:"other_user_id"`
+	}
+	if err := decodeJSON(w, r, &req, standardRequestLimit); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if req.OtherUserID < 1 || req.OtherUserID == userID {
+		errorResponse(w, http.StatusBadRequest, "invalid user ID")
+		return
+	}
+	otherUser, err := db.GetUserByID(req.OtherUserID)
+	if err != nil {
+		log.Printf("Failed to fetch delete target %d: %v", req.OtherUserID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch user")
 		return
 	}
-	if !IsOriginAllowed(r) {
+	if otherUser == nil {
+		errorResponse(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	deletedIDs, err := db.DeleteSentMessages(r.Context(), userID, req.OtherUserID)
+	if err != nil {
+		log.Printf("Failed to delete messages from %d to %d: %v", userID, req.OtherUserID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to delete messages")
+		return
+	}
+
+	if len(deletedIDs) > 0 {
+		// Both parties' sessions drop the messages from their views.
+		data, _ := json.Marshal(map[string][]int64{"message_ids": deletedIDs})
+		event := ws.Message{
+			Type:      "messages_deleted",
+			From:      userID,
+			Data:      data,
+			Timestamp: time.Now().Unix(),
+			Version:   conversationVersion(userID, req.OtherUserID),
+		}
+		ws.GetHub().SendMessage(req.OtherUserID, event)
+		ws.GetHub().SendMessage(userID, event)
+		notifyUnreadTotal(req.OtherUserID)
+	}
+
+	log.Printf("Deleted %d messages sent by user %d to %d", len(deletedIDs), userID, req.OtherUserID)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"deleted_ids": deletedIDs})
+}
+
+func handleEndCall(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	sessionID := r.PathValue("sessionID")
+	session, err := db.EndCallSession(sessionID, userID)
+	if err != nil {
+		log.Printf("Failed to end call session %s for user %d: %v", sessionID, userID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to end call")
+		return
+	}
+	if session == nil {
+		errorResponse(w, http.StatusNotFound, "call not found")
+		return
+	}
+
+	// The other party hangs up even if the requester's signaling frame was lost.
+	ws.GetHub().EndCallSequences(session.SessionID)
+	ws.GetHub().SendMessage(session.OtherParty(userID), ws.Message{
+		Type:      "call_end",
+		From:      userID,
+		SessionID: session.SessionID,
+		Timestamp: time.Now().Unix(),
+	})
+	jsonResponse(w, http.StatusOK, session)
+}
+
+// onlineCountCacheTTL bounds how often polling clients take the hub lock to
+// count online users.
+const onlineCountCacheTTL = 2 * time.Second
+
+var onlineCountCache struct {
+	sync.Mutex
+	count     int
+	expiresAt time.Time
+}
+
+func cachedOnlineCount(now time.Time) int {
+	onlineCountCache.Lock()
+	defer onlineCountCache.Unlock()
+	if now.After(onlineCountCache.expiresAt) {
+		onlineCountCache.count = ws.GetHub().OnlineCount()
+		onlineCountCache.expiresAt = now.Add(onlineCountCacheTTL)
+	}
+	return onlineCountCache.count
+}
+
+func handleGetOnlineCount(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, map[string]int{"online": cachedOnlineCount(time.Now())})
+}
+
+func handleGetTyping(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, map[string][]int64{
+		"user_ids": ws.GetHub().TypingTo(getUserID(r), time.Now()),
+	})
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !IsWebSocketOriginAllowed(r) {
 		errorResponse(w, http.StatusForbidden, "origin not allowed")
 		return
 	}
-	ticket, ok := webSocketTickets.consume(r.URL.Query().Get("ticket"), time.Now())
+	// Only a valid ticket takes an admission slot, so requests without one
+	// cannot fill the queue. It is consumed after admission so that a turned
+	// away client can retry with the same ticket.
+	token := r.URL.Query().Get("ticket")
+	if !webSocketTickets.valid(token, time.Now()) {
+		errorResponse(w, http.StatusUnauthorized, "invalid or expired WebSocket ticket")
+		return
+	}
+	wait, admitted := webSocketHandshakes.reserve(time.Now())
+	if !admitted {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		errorResponse(w, http.StatusServiceUnavailable, "server busy; try again later")
+		return
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+	ticket, ok := webSocketTickets.consume(token, time.Now())
 	if !ok {
 		errorResponse(w, http.StatusUnauthorized, "invalid or expired WebSocket ticket")
 		return
 	}
-	currentVersion, err := db.GetAuthVersion(ticket.UserID)
-	if err != nil || currentVersion != ticket.Version {
+	currentVersion, revoked, err := db.GetTokenState(ticket.UserID, ticket.TokenID)
+	if err != nil || currentVersion != ticket.Version || revoked {
 		errorResponse(w, http.StatusUnauthorized, "invalid or expired WebSocket ticket")
 		return
 	}
@@ -733,7 +1745,11 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		UserID:      ticket.UserID,
 		Username:    ticket.Username,
 		AuthVersion: ticket.Version,
+		Resumable:   r.URL.Query().Has("resume"),
+		ResumeToken: r.URL.Query().Get("resume"),
 	}
+	client.SetTokenExpiry(ticket.TokenExpiry)
+	client.SetTokenID(ticket.TokenID)
 
 	if !hub.RegisterClient(client) {
 		_ = conn.Close()
@@ -745,12 +1761,8 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCreateWebSocketTicket(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
 	ticket, err := webSocketTickets.issue(
-		getUserID(r), getUsername(r), getAuthVersion(r), time.Now(),
+		getUserID(r), getUsername(r), getAuthVersion(r), getTokenID(r), getTokenExpiry(r), time.Now(),
 	)
 	if err != nil {
 		log.Printf("Failed to issue WebSocket ticket: %v", err)
@@ -764,12 +1776,7 @@ func handleCreateWebSocketTicket(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCreateInvite(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
-
-	code, err := db.GenerateInviteCode()
+	code, err := db.GenerateInviteCode(getUserID(r))
 	if err != nil {
 		errorResponse(w, http.StatusInternalServerError, "failed to generate invite")
 		return
@@ -1,9 +1,13 @@
 package api
 
 import (
+	"chatapp/internal/crypto"
 	"chatapp/internal/db"
+	"chatapp/internal/limits"
 	"context"
+	"crypto/ecdh"
 	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,8 +15,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSPAFileHandler(t *testing.T) {
@@ -46,6 +53,12 @@ func TestSPAFileHandler(t *testing.T) {
 			t.Errorf("%s: expected body %q, got %q", test.path, test.body, recorder.Body.String())
 		}
 	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/chat/42", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: status = %d, Allow = %q; want 405 and \"GET, HEAD\"", recorder.Code, recorder.Header().Get("Allow"))
+	}
 }
 
 func TestDecodeJSONRejectsUnknownTrailingAndOversizedInput(t *testing.T) {
@@ -118,15 +131,70 @@ func TestValidPublicKey(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			if actual := validPublicKey(test.key); actual != test.valid {
-				t.Fatalf("validPublicKey() = %t, want %t", actual, test.valid)
+			if actual := crypto.ValidPublicKey(test.key); actual != test.valid {
+				t.Fatalf("ValidPublicKey() = %t, want %t", actual, test.valid)
 			}
 		})
 	}
 }
 
+func TestWebSocketOriginPolicy(t *testing.T) {
+	for _, value := range []string{"https://", "app://host/path", "app://host?q", "://missing"} {
+		if err := ConfigureWebSocketOrigins(value); err == nil {
+			t.Errorf("WebSocket origin %q was accepted", value)
+		}
+	}
+	if err := ConfigureAllowedOrigins("https://app.example.com, https://*.app.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureWebSocketOrigins("capacitor://localhost, file://, null"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ConfigureAllowedOrigins("")
+		_ = ConfigureWebSocketOrigins("")
+	})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "", allowed: false},
+		{origin: "http://ring.example.com", allowed: true},
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "https://staging.app.example.com", allowed: true},
+		{origin: "https://staging.example.com", allowed: false},
+		{origin: "capacitor://localhost", allowed: true},
+		{origin: "file://", allowed: true},
+		{origin: "null", allowed: true},
+		{origin: "capacitor://evil", allowed: false},
+		{origin: "ionic://localhost", allowed: false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "http://ring.example.com/api/ws", nil)
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		if actual := IsWebSocketOriginAllowed(request); actual != test.allowed {
+			t.Errorf("origin %q: expected %t, got %t", test.origin, test.allowed, actual)
+		}
+	}
+
+	if err := ConfigureWebSocketOrigins("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsWebSocketOriginAllowed(httptest.NewRequest(http.MethodGet, "http://ring.example.com/api/ws", nil)) {
+		t.Fatal("empty origin was rejected after being configured")
+	}
+}
+
 func TestOriginPolicy(t *testing.T) {
-	if err := ConfigureAllowedOrigins("https://app.example.com"); err != nil {
+	for _, value := range []string{"https://*", "https://*.com", "https://app.*.example.com", "https://*example.com", "ftp://*.example.com"} {
+		if err := ConfigureAllowedOrigins(value); err == nil {
+			t.Errorf("allowed origin %q was accepted", value)
+		}
+	}
+	if err := ConfigureAllowedOrigins("https://app.example.com, https://*.preview.example.net"); err != nil {
 		t.Fatal(err)
 	}
 	t.Cleanup(func() { _ = ConfigureAllowedOrigins("") })
@@ -140,6 +208,12 @@ func TestOriginPolicy(t *testing.T) {
 		{origin: "http://ring.example.com", host: "ring.example.com", allowed: true},
 		{origin: "https://app.example.com", host: "ring.example.com", allowed: true},
 		{origin: "https://evil.example.com", host: "ring.example.com", allowed: false},
+		{origin: "https://pr-12.preview.example.net", host: "ring.example.com", allowed: true},
+		{origin: "https://a.b.preview.example.net", host: "ring.example.com", allowed: true},
+		{origin: "https://preview.example.net", host: "ring.example.com", allowed: false},
+		{origin: "http://pr-12.preview.example.net", host: "ring.example.com", allowed: false},
+		{origin: "https://pr-12.preview.example.net:8443", host: "ring.example.com", allowed: false},
+		{origin: "https://evilpreview.example.net", host: "ring.example.com", allowed: false},
 	}
 
 	for _, test := range tests {
@@ -206,9 +280,67 @@ func TestGetMessagesValidatesConversationUser(t *testing.T) {
 	}
 }
 
+func TestMessageHistoryPagesWithCursor(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	page := func(query string) (int, []db.Message, *int64) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d?mark_read=false&%s", bobID, query), "", aliceID))
+		var response struct {
+			Messages   []db.Message `json:"messages"`
+			NextCursor *int64       `json:"next_cursor"`
+		}
+		_ = json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response.Messages, response.NextCursor
+	}
+
+	if code, messages, cursor := page(""); code != http.StatusOK || len(messages) != 0 || cursor != nil {
+		t.Fatalf("empty history = %d, %d messages, cursor %v", code, len(messages), cursor)
+	}
+
+	total := maximumPageSize + 5
+	ids := make([]int64, 0, total)
+	for index := range total {
+		message, _, err := db.SaveMessage(bobID, aliceID, fmt.Sprintf("history-page-%04d", index), "text", []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+	}
+
+	for _, limit := range []string{"0", "-1", "many"} {
+		if code, _, _ := page("limit=" + limit); code != http.StatusBadRequest {
+			t.Fatalf("limit=%s status = %d, want 400", limit, code)
+		}
+	}
+	for _, limit := range []string{fmt.Sprint(maximumPageSize + 1), "99999999999999999999"} {
+		if code, messages, _ := page("limit=" + limit); code != http.StatusOK || len(messages) != maximumPageSize {
+			t.Fatalf("limit=%s = %d, %d messages; want a clamped page of %d", limit, code, len(messages), maximumPageSize)
+		}
+	}
+	code, messages, cursor := page(fmt.Sprintf("limit=%d", maximumPageSize))
+	if code != http.StatusOK || len(messages) != maximumPageSize || cursor == nil || messages[0].ID != ids[total-1] {
+		t.Fatalf("first page = %d, %d messages, cursor %v", code, len(messages), cursor)
+	}
+	code, messages, cursor = page(fmt.Sprintf("limit=%d&before_id=%d", maximumPageSize, *cursor))
+	if code != http.StatusOK || len(messages) != 5 || cursor != nil || messages[len(messages)-1].ID != ids[0] {
+		t.Fatalf("last page = %d, %d messages, cursor %v", code, len(messages), cursor)
+	}
+	// A new message does not shift a cursor-based page.
+	if _, _, err := db.SaveMessage(bobID, aliceID, "history-page-late", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, messages, _ := page(fmt.Sprintf("limit=2&before_id=%d", ids[2])); len(messages) != 2 || messages[0].ID != ids[1] || messages[1].ID != ids[0] {
+		t.Fatalf("page before the third message = %v", messages)
+	}
+	if _, messages, cursor := page(fmt.Sprintf("before_id=%d", ids[0])); len(messages) != 0 || cursor != nil {
+		t.Fatalf("page before the oldest message = %d messages, cursor %v", len(messages), cursor)
+	}
+}
+
 func TestSendMessageValidatesRecipient(t *testing.T) {
 	aliceID, _ := initAPITestDB(t)
-	encodedContent := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	encodedContent := base64.StdEncoding.EncodeToString([]byte("ciphertext and tag"))
 	encodedNonce := base64.StdEncoding.EncodeToString(make([]byte, 12))
 	tests := []struct {
 		name       string
@@ -216,7 +348,6 @@ func TestSendMessageValidatesRecipient(t *testing.T) {
 		status     int
 	}{
 		{name: "negative", receiverID: -1, status: http.StatusBadRequest},
-		{name: "self", receiverID: aliceID, status: http.StatusBadRequest},
 		{name: "missing", receiverID: 9999, status: http.StatusNotFound},
 	}
 	for _, test := range tests {
@@ -231,6 +362,181 @@ func TestSendMessageValidatesRecipient(t *testing.T) {
 	}
 }
 
+func TestSendMessageEnforcesSharedSizeLimit(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	t.Cleanup(func() { _ = limits.Configure(limits.Default) })
+	send := func(index, size int) int {
+		body := fmt.Sprintf(`{"receiver_id":%d,"client_id":"size-limit-message-%02d","content":%q,"nonce":%q}`,
+			bobID, index, base64.StdEncoding.EncodeToString(make([]byte, size)), base64.StdEncoding.EncodeToString(make([]byte, 12)))
+		recorder := httptest.NewRecorder()
+		handleSendMessage(recorder, requestForUser(http.MethodPost, "/api/messages", body, aliceID))
+		return recorder.Code
+	}
+
+	maximum := limits.Default.MessageMaxBytes
+	if code := send(1, maximum); code != http.StatusOK {
+		t.Fatalf("content at the limit = %d, want 200", code)
+	}
+	if code := send(2, maximum+1); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("content over the limit = %d, want 413", code)
+	}
+
+	// A lower limit also shrinks the accepted request body, without refusing
+	// content that fits it.
+	configured := limits.Default
+	configured.MessageMaxBytes = 64
+	if err := limits.Configure(configured); err != nil {
+		t.Fatal(err)
+	}
+	if code := send(3, 64); code != http.StatusOK {
+		t.Fatalf("content at a small limit = %d, want 200", code)
+	}
+	if code := send(4, 65); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("content over a small limit = %d, want 413", code)
+	}
+	if code := send(5, 4<<10); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body = %d, want 413", code)
+	}
+}
+
+func TestSendMessageToSelfIsStoredAsRead(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+	body := fmt.Sprintf(`{"receiver_id":%d,"client_id":"note-to-self-1234","content":%q,"nonce":%q}`,
+		aliceID, base64.StdEncoding.EncodeToString([]byte("ciphertext and tag")), base64.StdEncoding.EncodeToString(make([]byte, 12)))
+	recorder := httptest.NewRecorder()
+	handleSendMessage(recorder, requestForUser(http.MethodPost, "/api/messages", body, aliceID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var message db.Message
+	if err := json.NewDecoder(recorder.Body).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.SenderID != aliceID || message.ReceiverID != aliceID || !message.Read {
+		t.Fatalf("note to self = %+v, want a read message from and to alice", message)
+	}
+	status, err := db.GetMessageStatus(message.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DeliveredAt == nil || status.ReadAt == nil {
+		t.Fatalf("note to self is missing receipts: %+v", status)
+	}
+
+	messages, err := db.GetMessagesBetween(aliceID, aliceID, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != message.ID {
+		t.Fatalf("self conversation = %+v, want the single note", messages)
+	}
+}
+
+func TestSendMessageReportsPreciseEncodingErrors(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	validContent := base64.StdEncoding.EncodeToString([]byte("ciphertext and tag"))
+	validNonce := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	tests := []struct {
+		name    string
+		content string
+		nonce   string
+		status  int
+		error   string
+	}{
+		{name: "valid", content: validContent, nonce: validNonce, status: http.StatusOK},
+		{name: "url-safe content", content: base64.URLEncoding.EncodeToString([]byte{0xfb, 0xff}), nonce: validNonce, status: http.StatusBadRequest, error: "content must use standard base64"},
+		{name: "unpadded content", content: base64.RawStdEncoding.EncodeToString([]byte("ciphertext")), nonce: validNonce, status: http.StatusBadRequest, error: "content must be padded"},
+		{name: "line break in content", content: validContent[:4] + `\n` + validContent[4:], nonce: validNonce, status: http.StatusBadRequest, error: "content must be padded"},
+		{name: "non-canonical padding bits", content: "Y2lwaGVydGV4dB==", nonce: validNonce, status: http.StatusBadRequest, error: "content must be padded"},
+		{name: "url-safe nonce", content: validContent, nonce: "-_-_-_-_-_-_-_-_", status: http.StatusBadRequest, error: "nonce must use standard base64"},
+		{name: "nacl-sized nonce", content: validContent, nonce: base64.StdEncoding.EncodeToString(make([]byte, 24)), status: http.StatusBadRequest, error: "nonce must decode to 12 bytes, got 24"},
+		{name: "shorter than the GCM tag", content: base64.StdEncoding.EncodeToString([]byte("ciphertext")), nonce: validNonce, status: http.StatusBadRequest, error: "content must decode to at least 16 bytes, got 10"},
+	}
+	for index, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"receiver_id":%d,"client_id":"encoding-message-%02d","content":"%s","nonce":"%s"}`, bobID, index, test.content, test.nonce)
+			recorder := httptest.NewRecorder()
+			handleSendMessage(recorder, requestForUser(http.MethodPost, "/api/messages", body, aliceID))
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body.String())
+			}
+			if test.error != "" && !strings.Contains(recorder.Body.String(), test.error) {
+				t.Fatalf("error %s does not mention %q", recorder.Body.String(), test.error)
+			}
+		})
+	}
+}
+
+func TestPublicKeyUpdatesAreRateLimited(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+	t.Cleanup(func() { _ = ConfigureKeyUpdateInterval("") })
+	for _, value := range []string{"-1h", "1y", "721h"} {
+		if err := ConfigureKeyUpdateInterval(value); err == nil {
+			t.Errorf("ConfigureKeyUpdateInterval(%q) accepted an invalid interval", value)
+		}
+	}
+	if err := ConfigureKeyUpdateInterval("1h"); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(fill byte) *httptest.ResponseRecorder {
+		key := make([]byte, 32)
+		key[0] = fill
+		body := fmt.Sprintf(`{"public_key":%q}`, base64.StdEncoding.EncodeToString(key))
+		recorder := httptest.NewRecorder()
+		handleUpdatePublicKey(recorder, requestForUser(http.MethodPost, "/api/users/update-key", body, aliceID))
+		return recorder
+	}
+	epoch := func() int64 {
+		user, err := db.GetUserByID(aliceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.KeyEpoch
+	}
+
+	if recorder := update(1); recorder.Code != http.StatusOK || epoch() != 1 {
+		t.Fatalf("first change = %d, epoch %d; want 200 and epoch 1", recorder.Code, epoch())
+	}
+	recorder := update(2)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("second change = %d, Retry-After %q; want 429 with Retry-After", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if epoch() != 1 {
+		t.Fatalf("rejected change bumped the epoch to %d", epoch())
+	}
+
+	if err := ConfigureKeyUpdateInterval("0"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := update(2); recorder.Code != http.StatusOK || epoch() != 2 {
+		t.Fatalf("change without a limit = %d, epoch %d; want 200 and epoch 2", recorder.Code, epoch())
+	}
+}
+
+func TestSendMessageRejectsReplacedRecipientKey(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if _, err := db.UpdatePublicKey(bobID, make([]byte, 32), 0); err != nil {
+		t.Fatal(err)
+	}
+	encodedContent := base64.StdEncoding.EncodeToString([]byte("ciphertext and tag"))
+	encodedNonce := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	for _, test := range []struct {
+		keyEpoch string
+		status   int
+	}{
+		{keyEpoch: "0", status: http.StatusConflict},
+		{keyEpoch: "1", status: http.StatusOK},
+	} {
+		body := fmt.Sprintf(`{"receiver_id":%d,"client_id":"key-epoch-message-%s","content":%q,"nonce":%q,"key_epoch":%s}`, bobID, test.keyEpoch, encodedContent, encodedNonce, test.keyEpoch)
+		recorder := httptest.NewRecorder()
+		handleSendMessage(recorder, requestForUser(http.MethodPost, "/api/messages", body, aliceID))
+		if recorder.Code != test.status {
+			t.Fatalf("key epoch %s: status = %d, want %d: %s", test.keyEpoch, recorder.Code, test.status, recorder.Body.String())
+		}
+	}
+}
+
 func TestClearMessagesValidatesOtherUser(t *testing.T) {
 	aliceID, _ := initAPITestDB(t)
 	tests := []struct {
@@ -257,7 +563,7 @@ func TestClearMessagesValidatesOtherUser(t *testing.T) {
 func TestMessagePaginationOnlyReturnsCursorWhenMoreExist(t *testing.T) {
 	aliceID, bobID := initAPITestDB(t)
 	for index := range 2 {
-		if _, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("pagination-id-%02d", index), "text", []byte("ciphertext"), make([]byte, 12)); err != nil {
+		if _, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("pagination-id-%02d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -285,7 +591,7 @@ func TestMessagePaginationOnlyReturnsCursorWhenMoreExist(t *testing.T) {
 	if len(page.Messages) != 2 || page.NextCursor != nil {
 		t.Fatalf("exact page should not have a cursor: %+v", page)
 	}
-	if _, _, err := db.SaveMessage(aliceID, bobID, "pagination-id-02", "text", []byte("ciphertext"), make([]byte, 12)); err != nil {
+	if _, _, err := db.SaveMessage(aliceID, bobID, "pagination-id-02", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
 		t.Fatal(err)
 	}
 	page = requestPage()
@@ -294,14 +600,963 @@ func TestMessagePaginationOnlyReturnsCursorWhenMoreExist(t *testing.T) {
 	}
 }
 
-func TestGetMeDistinguishesDatabaseFailure(t *testing.T) {
-	aliceID, _ := initAPITestDB(t)
-	if err := db.DB.Close(); err != nil {
+func TestMessagePageCanBeOldestFirst(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	var ids []int64
+	for index := range 5 {
+		message, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("ascending-id-%02d", index), "text", []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   []int64
+		cursor int64
+	}{
+		{query: "?limit=3&order=asc", status: http.StatusOK, want: ids[2:], cursor: ids[2]},
+		{query: fmt.Sprintf("?limit=3&order=asc&before_id=%d", ids[2]), status: http.StatusOK, want: ids[:2]},
+		{query: "?limit=2&order=desc", status: http.StatusOK, want: []int64{ids[4], ids[3]}, cursor: ids[3]},
+		{query: "?order=oldest", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d%s", bobID, test.query), "", aliceID))
+		if recorder.Code != test.status {
+			t.Fatalf("%s: status = %d, want %d", test.query, recorder.Code, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response struct {
+			Messages   []db.Message `json:"messages"`
+			NextCursor *int64       `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, message := range response.Messages {
+			got = append(got, message.ID)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Fatalf("%s: IDs = %v, want %v", test.query, got, test.want)
+		}
+		if (response.NextCursor == nil) != (test.cursor == 0) || (response.NextCursor != nil && *response.NextCursor != test.cursor) {
+			t.Fatalf("%s: next_cursor = %v, want %d", test.query, response.NextCursor, test.cursor)
+		}
+	}
+}
+
+func TestMessagePageCanJumpToConversationStart(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	var ids []int64
+	for index := range 5 {
+		message, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("from-start-id-%02d", index), "text", []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+	}
+
+	tests := []struct {
+		query    string
+		status   int
+		want     []int64
+		hasNewer bool
+	}{
+		{query: "?from_start=true&limit=2&order=asc", status: http.StatusOK, want: ids[:2], hasNewer: true},
+		{query: "?from_start=true&limit=2", status: http.StatusOK, want: []int64{ids[1], ids[0]}, hasNewer: true},
+		{query: "?from_start=true&limit=5&order=asc", status: http.StatusOK, want: ids, hasNewer: false},
+		{query: fmt.Sprintf("?from_start=true&before_id=%d", ids[3]), status: http.StatusBadRequest},
+		{query: "?from_start=true&anchor=first_unread", status: http.StatusBadRequest},
+		{query: "?from_start=maybe", status: http.StatusBadRequest},
+		{query: fmt.Sprintf("?after_id=%d&limit=2&order=asc", ids[1]), status: http.StatusOK, want: ids[2:4], hasNewer: true},
+		{query: fmt.Sprintf("?after_id=%d&limit=2", ids[3]), status: http.StatusOK, want: ids[4:], hasNewer: false},
+		{query: fmt.Sprintf("?after_id=%d", ids[4]), status: http.StatusOK, want: nil, hasNewer: false},
+		{query: fmt.Sprintf("?after_id=%d&before_id=%d", ids[0], ids[3]), status: http.StatusBadRequest},
+		{query: fmt.Sprintf("?after_id=%d&from_start=true", ids[0]), status: http.StatusBadRequest},
+		{query: "?after_id=0", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d%s", bobID, test.query), "", aliceID))
+		if recorder.Code != test.status {
+			t.Fatalf("%s: status = %d, want %d", test.query, recorder.Code, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response struct {
+			Messages   []db.Message `json:"messages"`
+			NextCursor *int64       `json:"next_cursor"`
+			HasNewer   bool         `json:"has_newer"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, message := range response.Messages {
+			got = append(got, message.ID)
+		}
+		if !slices.Equal(got, test.want) || response.HasNewer != test.hasNewer || response.NextCursor != nil {
+			t.Fatalf("%s: IDs = %v, has_newer = %t, next_cursor = %v; want %v, %t, nil", test.query, got, response.HasNewer, response.NextCursor, test.want, test.hasNewer)
+		}
+	}
+}
+
+func TestMediaMessagesOnlyListsAttachments(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	for index, messageType := range []string{"file", "text", "file", "file"} {
+		saved, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("media-message-id-%02d", index), messageType, []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == 3 {
+			if _, err := db.DeleteMessage(saved.ID, aliceID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The newest listed attachment was edited, and bob has since changed his key.
+	if _, err := db.DB.Exec("UPDATE messages SET edited_at = CURRENT_TIMESTAMP WHERE client_id = 'media-message-id-02'"); err != nil {
 		t.Fatal(err)
 	}
+	if _, err := db.DB.Exec("UPDATE users SET key_epoch = key_epoch + 1 WHERE id = ?", bobID); err != nil {
+		t.Fatal(err)
+	}
+
+	requestPage := func(query string) struct {
+		Messages   []db.Message `json:"messages"`
+		NextCursor *int64       `json:"next_cursor"`
+	} {
+		recorder := httptest.NewRecorder()
+		request := requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d/media?%s", bobID, query), "", aliceID)
+		request.SetPathValue("userID", strconv.FormatInt(bobID, 10))
+		handleGetMediaMessages(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Messages   []db.Message `json:"messages"`
+			NextCursor *int64       `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	page := requestPage("limit=1")
+	if len(page.Messages) != 1 || page.Messages[0].Type != "file" || page.NextCursor == nil {
+		t.Fatalf("first media page = %+v", page)
+	}
+	if first := page.Messages[0]; first.EditedAt == nil || !first.KeyStale || first.IsDeleted {
+		t.Fatalf("first attachment edited_at = %v, key_stale = %t, deleted = %t", first.EditedAt, first.KeyStale, first.IsDeleted)
+	}
+	page = requestPage(fmt.Sprintf("limit=1&before_id=%d", *page.NextCursor))
+	if len(page.Messages) != 1 || page.Messages[0].Type != "file" || page.NextCursor != nil {
+		t.Fatalf("last media page = %+v", page)
+	}
+
 	recorder := httptest.NewRecorder()
-	handleGetMe(recorder, requestForUser(http.MethodGet, "/api/users/me", "", aliceID))
-	if recorder.Code != http.StatusInternalServerError {
-		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	request := requestForUser(http.MethodGet, "/api/messages/999/media", "", aliceID)
+	request.SetPathValue("userID", "999")
+	handleGetMediaMessages(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("unknown user status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestMessagesByTypeSpanConversations(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	var files []int64
+	for index, message := range []struct {
+		from, to    int64
+		messageType string
+	}{
+		{aliceID, bobID, "file"},
+		{bobID, aliceID, "text"},
+		{bobID, aliceID, "file"},
+		{aliceID, aliceID, "file"},
+	} {
+		saved, _, err := db.SaveMessage(message.from, message.to, fmt.Sprintf("by-type-message-%02d", index), message.messageType, []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.messageType == "file" {
+			files = append(files, saved.ID)
+		}
+	}
+
+	list := func(userID int64, query string) (int, []int64, *int64) {
+		recorder := httptest.NewRecorder()
+		handleGetMessagesByType(recorder, requestForUser(http.MethodGet, "/api/messages/by-type?"+query, "", userID))
+		var response struct {
+			Messages   []db.Message `json:"messages"`
+			NextCursor *int64       `json:"next_cursor"`
+		}
+		if recorder.Code == http.StatusOK {
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var ids []int64
+		for _, message := range response.Messages {
+			ids = append(ids, message.ID)
+		}
+		return recorder.Code, ids, response.NextCursor
+	}
+
+	deleted, _, err := db.SaveMessage(aliceID, bobID, "by-type-message-deleted", "file", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteMessage(deleted.ID, aliceID); err != nil {
+		t.Fatal(err)
+	}
+
+	code, ids, cursor := list(aliceID, "type=file&limit=2")
+	if code != http.StatusOK || !slices.Equal(ids, []int64{files[2], files[1]}) || cursor == nil {
+		t.Fatalf("first page = %d %v %v", code, ids, cursor)
+	}
+	code, ids, cursor = list(aliceID, fmt.Sprintf("type=file&limit=2&before_id=%d", *cursor))
+	if code != http.StatusOK || !slices.Equal(ids, []int64{files[0]}) || cursor != nil {
+		t.Fatalf("last page = %d %v %v", code, ids, cursor)
+	}
+
+	if _, err := db.ClearMessagesForUser(context.Background(), bobID, aliceID); err != nil {
+		t.Fatal(err)
+	}
+	if code, ids, _ := list(bobID, "type=file"); code != http.StatusOK || len(ids) != 0 {
+		t.Fatalf("bob's files after clearing = %d %v, want none", code, ids)
+	}
+	if code, ids, _ := list(aliceID, "type=text"); code != http.StatusOK || len(ids) != 1 {
+		t.Fatalf("alice's text messages = %d %v, want one", code, ids)
+	}
+	for _, query := range []string{"", "type=sticker", "type=file&limit=0"} {
+		if code, _, _ := list(aliceID, query); code != http.StatusBadRequest {
+			t.Errorf("%q status = %d, want 400", query, code)
+		}
+	}
+}
+
+func TestMessagePageCanSkipMarkingRead(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	for index := range 2 {
+		if _, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("prefetch-message-%02d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetch := func(query string) int {
+		recorder := httptest.NewRecorder()
+		handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d%s", aliceID, query), "", bobID))
+		return recorder.Code
+	}
+	unread := func() int64 {
+		total, err := db.CountUnreadMessages(bobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+
+	if code := fetch("?mark_read=maybe"); code != http.StatusBadRequest {
+		t.Fatalf("invalid mark_read status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := fetch("?mark_read=false"); code != http.StatusOK || unread() != 2 {
+		t.Fatalf("prefetch = %d with %d unread, want 200 with 2", code, unread())
+	}
+	if code := fetch(""); code != http.StatusOK || unread() != 0 {
+		t.Fatalf("default fetch = %d with %d unread, want 200 with 0", code, unread())
+	}
+}
+
+func TestMessagePageCanStartAtFirstUnread(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	var ids []int64
+	for index := range 10 {
+		message, _, err := db.SaveMessage(aliceID, bobID, fmt.Sprintf("unread-first-id-%02d", index), "text", []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, message.ID)
+	}
+	if _, _, err := db.MarkMessagesAsReadRange(aliceID, bobID, ids[0], ids[5]); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d?limit=4&anchor=first_unread", aliceID), "", bobID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var page struct {
+		Messages      []db.Message `json:"messages"`
+		NextCursor    *int64       `json:"next_cursor"`
+		FirstUnreadID int64        `json:"first_unread_id"`
+		HasNewer      bool         `json:"has_newer"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for _, message := range page.Messages {
+		got = append(got, message.ID)
+	}
+	want := []int64{ids[8], ids[7], ids[6], ids[5]}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("window = %v, want %v", got, want)
+	}
+	if page.FirstUnreadID != ids[6] || !page.HasNewer || page.NextCursor == nil || *page.NextCursor != ids[5] {
+		t.Fatalf("unexpected markers: first_unread_id=%d has_newer=%t next_cursor=%v", page.FirstUnreadID, page.HasNewer, page.NextCursor)
+	}
+
+	recorder = httptest.NewRecorder()
+	handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d?anchor=first_unread&before_id=3", aliceID), "", bobID))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("anchor with before_id status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetMeDistinguishesDatabaseFailure(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handleGetMe(recorder, requestForUser(http.MethodGet, "/api/users/me", "", aliceID))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestUserListingsIncludeKeyEpoch(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if _, err := db.DB.Exec("UPDATE users SET key_epoch = 3 WHERE id = ?", bobID); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handleGetUsers(recorder, requestForUser(http.MethodGet, "/api/users", "", aliceID))
+	var users []map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		if want := map[float64]float64{float64(aliceID): 0, float64(bobID): 3}[user["id"].(float64)]; user["key_epoch"] != want {
+			t.Fatalf("user %v has key_epoch %v, want %v", user["id"], user["key_epoch"], want)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	handleGetMe(recorder, requestForUser(http.MethodGet, "/api/users/me", "", bobID))
+	var me map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&me); err != nil || me["key_epoch"] != float64(3) {
+		t.Fatalf("own key_epoch = %v, %v; want 3", me["key_epoch"], err)
+	}
+}
+
+func TestGetLastSeenValidatesAndReturnsKnownUsers(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	tooMany := make([]string, maximumLastSeenIDs+1)
+	for index := range tooMany {
+		tooMany[index] = fmt.Sprint(index + 1)
+	}
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{query: "", status: http.StatusBadRequest},
+		{query: "?ids=abc", status: http.StatusBadRequest},
+		{query: "?ids=0", status: http.StatusBadRequest},
+		{query: "?ids=" + strings.Join(tooMany, ","), status: http.StatusBadRequest},
+		{query: "?ids=1,1,1", status: http.StatusOK},
+		{query: fmt.Sprintf("?ids=%d,%d,9999", aliceID, bobID), status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handleGetLastSeen(recorder, requestForUser(http.MethodGet, "/api/users/last-seen"+test.query, "", aliceID))
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body.String())
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	handleGetLastSeen(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/users/last-seen?ids=%d,9999", bobID), "", aliceID))
+	var lastSeen map[string]string
+	if err := json.NewDecoder(recorder.Body).Decode(&lastSeen); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lastSeen[fmt.Sprint(bobID)]; !ok || len(lastSeen) != 1 {
+		t.Fatalf("unexpected last seen response: %v", lastSeen)
+	}
+}
+
+func TestMessageStatusIsSenderOnlyAndTracksRead(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	message, _, err := db.SaveMessage(aliceID, bobID, "status-message-id", "text", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestStatus := func(userID int64, id string) *httptest.ResponseRecorder {
+		request := requestForUser(http.MethodGet, "/api/messages/"+id+"/status", "", userID)
+		request.SetPathValue("id", id)
+		recorder := httptest.NewRecorder()
+		handleGetMessageStatus(recorder, request)
+		return recorder
+	}
+	id := fmt.Sprint(message.ID)
+	if recorder := requestStatus(bobID, id); recorder.Code != http.StatusForbidden {
+		t.Fatalf("recipient status = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	if recorder := requestStatus(aliceID, "9999"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("missing message status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+
+	var status db.MessageStatus
+	recorder := requestStatus(aliceID, id)
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.DeliveredAt != nil || status.ReadAt != nil {
+		t.Fatalf("new message already has receipts: %+v", status)
+	}
+
+	if _, _, err := db.MarkMessagesAsReadRange(aliceID, bobID, message.ID, message.ID); err != nil {
+		t.Fatal(err)
+	}
+	recorder = requestStatus(aliceID, id)
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.DeliveredAt == nil || status.ReadAt == nil {
+		t.Fatalf("read message is missing receipts: %+v", status)
+	}
+}
+
+func TestMessageLookupByClientIDReportsSendState(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	message, _, err := db.SaveMessage(aliceID, bobID, "lookup-client-id-1", "text", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(userID int64, clientID string) (int, string, *db.Message) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetMessageByClientID(recorder, requestForUser(http.MethodGet, "/api/messages/by-client-id?client_id="+clientID, "", userID))
+		var response struct {
+			Status  string      `json:"status"`
+			Message *db.Message `json:"message"`
+		}
+		_ = json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response.Status, response.Message
+	}
+
+	if code, _, _ := lookup(aliceID, "short"); code != http.StatusBadRequest {
+		t.Fatalf("invalid client ID = %d, want 400", code)
+	}
+	if code, _, _ := lookup(aliceID, "never-stored-client-id"); code != http.StatusNotFound {
+		t.Fatalf("unsent message = %d, want 404", code)
+	}
+	// Client IDs are scoped to their sender.
+	if code, _, _ := lookup(bobID, "lookup-client-id-1"); code != http.StatusNotFound {
+		t.Fatalf("recipient lookup = %d, want 404", code)
+	}
+	code, status, stored := lookup(aliceID, "lookup-client-id-1")
+	if code != http.StatusOK || status != "sent" || stored == nil || stored.ID != message.ID {
+		t.Fatalf("lookup = %d %q %+v", code, status, stored)
+	}
+
+	if _, err := db.MarkMessageDelivered(message.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _ := lookup(aliceID, "lookup-client-id-1"); status != "delivered" {
+		t.Fatalf("status after delivery = %q", status)
+	}
+	if _, _, err := db.MarkMessagesAsReadRange(aliceID, bobID, message.ID, message.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _ := lookup(aliceID, "lookup-client-id-1"); status != "read" {
+		t.Fatalf("status after reading = %q", status)
+	}
+}
+
+func TestMarkMessageUnreadIsRecipientOnlyAndKeepsReceipt(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	message, _, err := db.SaveMessage(aliceID, bobID, "unread-message-id", "text", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.MarkMessagesAsReadRange(aliceID, bobID, message.ID, message.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	markUnread := func(userID int64, id string) int {
+		request := requestForUser(http.MethodPost, "/api/messages/"+id+"/unread", "", userID)
+		request.SetPathValue("id", id)
+		recorder := httptest.NewRecorder()
+		handleMarkMessageUnread(recorder, request)
+		return recorder.Code
+	}
+	id := fmt.Sprint(message.ID)
+	if code := markUnread(aliceID, id); code != http.StatusForbidden {
+		t.Fatalf("sender mark unread = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := markUnread(bobID, "9999"); code != http.StatusNotFound {
+		t.Fatalf("missing message mark unread = %d, want %d", code, http.StatusNotFound)
+	}
+	for range 2 {
+		if code := markUnread(bobID, id); code != http.StatusOK {
+			t.Fatalf("recipient mark unread = %d, want %d", code, http.StatusOK)
+		}
+	}
+
+	if total, err := db.CountUnreadMessages(bobID); err != nil || total != 1 {
+		t.Fatalf("unread total = %d, %v; want 1", total, err)
+	}
+	status, err := db.GetMessageStatus(message.ID)
+	if err != nil || status.ReadAt == nil {
+		t.Fatalf("sender lost the read receipt: %+v, %v", status, err)
+	}
+
+	// Reading it again neither moves read_at nor counts as a first read,
+	// so the sender gets no second receipt.
+	updated, firstRead, err := db.MarkMessagesAsReadRange(aliceID, bobID, message.ID, message.ID)
+	if err != nil || updated != 1 || firstRead != 0 {
+		t.Fatalf("re-read = %d (%d first), %v; want 1 (0 first)", updated, firstRead, err)
+	}
+	reread, err := db.GetMessageStatus(message.ID)
+	if err != nil || reread.ReadAt == nil || !reread.ReadAt.Equal(*status.ReadAt) {
+		t.Fatalf("read_at after re-read = %+v, want %v (%v)", reread, status.ReadAt, err)
+	}
+	if total, err := db.CountUnreadMessages(bobID); err != nil || total != 0 {
+		t.Fatalf("unread total after re-read = %d, %v; want 0", total, err)
+	}
+}
+
+func TestProvenanceShowsOwnInviteAndReferrer(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	code, err := db.GenerateInviteCode(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := db.RegisterUser(context.Background(), "carol", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend bob was the first account, registered with the bootstrap invite.
+	if _, err := db.DB.Exec("INSERT INTO invites (code, bootstrap, used_by, used_at) VALUES ('bootstrap-invite', TRUE, ?, CURRENT_TIMESTAMP)", bobID); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handleGetProvenance(recorder, requestForUser(http.MethodGet, "/api/users/me/provenance", "", aliceID))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("uninvited user status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+	recorder = httptest.NewRecorder()
+	handleGetProvenance(recorder, requestForUser(http.MethodGet, "/api/users/me/provenance", "", bobID))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("bootstrap invite user status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+
+	recorder = httptest.NewRecorder()
+	handleGetProvenance(recorder, requestForUser(http.MethodGet, "/api/users/me/provenance", "", carol.ID))
+	var provenance db.Provenance
+	if err := json.NewDecoder(recorder.Body).Decode(&provenance); err != nil {
+		t.Fatal(err)
+	}
+	if provenance.InviteCode != code[:maskedInvitePrefix]+"…" {
+		t.Fatalf("invite code = %q, want a masked prefix of %q", provenance.InviteCode, code)
+	}
+	if provenance.InvitedByID == nil || *provenance.InvitedByID != aliceID ||
+		provenance.InvitedByUsername == nil || *provenance.InvitedByUsername != "alice" {
+		t.Fatalf("referrer = %v %v, want alice", provenance.InvitedByID, provenance.InvitedByUsername)
+	}
+}
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if _, err := db.DB.Exec("UPDATE users SET is_admin = TRUE WHERE id = ?", aliceID); err != nil {
+		t.Fatal(err)
+	}
+	handler := adminMiddleware(handleGetReferrals)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, requestForUser(http.MethodGet, "/api/admin/referrals", "", bobID))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("non-admin status = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, requestForUser(http.MethodGet, "/api/admin/referrals", "", aliceID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("admin status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var referrals []db.Referral
+	if err := json.NewDecoder(recorder.Body).Decode(&referrals); err != nil {
+		t.Fatal(err)
+	}
+	if len(referrals) != 2 {
+		t.Fatalf("got %d referrals, want 2", len(referrals))
+	}
+}
+
+func TestActivityCountsOwnSentAndReceivedMessages(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	for index, sender := range []int64{aliceID, aliceID, bobID, aliceID} {
+		receiver := bobID
+		if sender == bobID || index == 3 {
+			receiver = aliceID // the last one is a note to self
+		}
+		if _, _, err := db.SaveMessage(sender, receiver, fmt.Sprintf("activity-%d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.DB.Exec("UPDATE messages SET timestamp = datetime('now', '-40 days') WHERE client_id = 'activity-0'"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		status   int
+		sent     int64
+		received int64
+		cleared  bool // after alice clears her conversation with bob
+	}{
+		{query: "", status: http.StatusOK, sent: 2, received: 1},
+		{query: "?days=60", status: http.StatusOK, sent: 3, received: 1},
+		{query: "?days=0", status: http.StatusBadRequest},
+		{query: "?days=366", status: http.StatusBadRequest},
+		{query: "?days=60", status: http.StatusOK, sent: 1, received: 0, cleared: true},
+	}
+	for _, test := range tests {
+		if test.cleared {
+			if _, err := db.ClearMessagesForUser(context.Background(), aliceID, bobID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		recorder := httptest.NewRecorder()
+		handleGetActivity(recorder, requestForUser(http.MethodGet, "/api/users/me/activity"+test.query, "", aliceID))
+		if recorder.Code != test.status {
+			t.Fatalf("%q: status = %d, want %d", test.query, recorder.Code, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response struct {
+			Days []db.ActivityDay `json:"days"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		var sent, received int64
+		for _, day := range response.Days {
+			sent += day.Sent
+			received += day.Received
+		}
+		if sent != test.sent || received != test.received {
+			t.Fatalf("%q: sent/received = %d/%d, want %d/%d", test.query, sent, received, test.sent, test.received)
+		}
+	}
+}
+
+func TestDoNotDisturbToggle(t *testing.T) {
+	aliceID, _ := initAPITestDB(t)
+	tests := []struct {
+		method  string
+		body    string
+		status  int
+		enabled bool
+	}{
+		{method: http.MethodGet, status: http.StatusOK, enabled: false},
+		{method: http.MethodPost, body: `{}`, status: http.StatusBadRequest},
+		{method: http.MethodPost, body: `{"enabled":true}`, status: http.StatusOK, enabled: true},
+		{method: http.MethodGet, status: http.StatusOK, enabled: true},
+		{method: http.MethodPost, body: `{"enabled":false}`, status: http.StatusOK, enabled: false},
+		{method: http.MethodDelete, status: http.StatusMethodNotAllowed},
+	}
+	for index, test := range tests {
+		recorder := httptest.NewRecorder()
+		handleDoNotDisturb(recorder, requestForUser(test.method, "/api/users/me/dnd", test.body, aliceID))
+		if recorder.Code != test.status {
+			t.Fatalf("step %d: status = %d, want %d", index, recorder.Code, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Enabled != test.enabled {
+			t.Fatalf("step %d: enabled = %t, want %t", index, response.Enabled, test.enabled)
+		}
+	}
+}
+
+func TestPublicKeyFileIncludesKeyAndFingerprint(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	requestKey := func(id string) *httptest.ResponseRecorder {
+		request := requestForUser(http.MethodGet, "/api/users/"+id+"/key.txt", "", aliceID)
+		request.SetPathValue("id", id)
+		recorder := httptest.NewRecorder()
+		handleGetPublicKeyFile(recorder, request)
+		return recorder
+	}
+
+	if recorder := requestKey("9999"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("missing user status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+	recorder := requestKey(fmt.Sprint(bobID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Fatalf("content type = %q", contentType)
+	}
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"user: bob\n",
+		"public_key: " + crypto.EncodeKey(make([]byte, 32)) + "\n",
+		"fingerprint: " + crypto.Fingerprint(make([]byte, 32)) + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("key file %q does not contain %q", body, want)
+		}
+	}
+}
+
+func TestEndCallRequiresParticipant(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	if _, err := db.CreateCallSession("api-call-session-id", aliceID, bobID); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.DB.Exec("INSERT INTO users (username, password_hash, public_key) VALUES ('carol', 'hash', ?)", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endCall := func(userID int64) *httptest.ResponseRecorder {
+		request := requestForUser(http.MethodPost, "/api/calls/api-call-session-id/end", "", userID)
+		request.SetPathValue("sessionID", "api-call-session-id")
+		recorder := httptest.NewRecorder()
+		handleEndCall(recorder, request)
+		return recorder
+	}
+	if recorder := endCall(carolID); recorder.Code != http.StatusNotFound {
+		t.Fatalf("non-participant status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+	recorder := endCall(bobID)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("participant status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var session db.CallSession
+	if err := json.NewDecoder(recorder.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Status != db.CallStatusEnded {
+		t.Fatalf("status = %q, want %q", session.Status, db.CallStatusEnded)
+	}
+}
+
+func TestInviteUsageListsRedeemingUser(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	code, err := db.GenerateInviteCode(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ValidateAndUseInvite(code, bobID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code   string
+		status int
+	}{
+		{code: code, status: http.StatusOK},
+		{code: "unknown", status: http.StatusNotFound},
+		{code: strings.Repeat("a", 1000), status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		request := requestForUser(http.MethodGet, "/api/admin/invites/code/usage", "", aliceID)
+		request.SetPathValue("code", test.code)
+		recorder := httptest.NewRecorder()
+		handleGetInviteUsage(recorder, request)
+		if recorder.Code != test.status {
+			t.Fatalf("code %.10q status = %d, want %d", test.code, recorder.Code, test.status)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var usage db.InviteUsage
+		if err := json.NewDecoder(recorder.Body).Decode(&usage); err != nil {
+			t.Fatal(err)
+		}
+		if usage.CreatedBy == nil || *usage.CreatedBy != aliceID || len(usage.Uses) != 1 || usage.Uses[0].UserID != bobID {
+			t.Fatalf("usage = %+v, want bob invited by alice", usage)
+		}
+		if usage.Uses[0].UsedAt.IsZero() {
+			t.Fatal("invite use has no timestamp")
+		}
+	}
+}
+
+func TestUnreadTotalCountsAcrossConversations(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	result, err := db.DB.Exec("INSERT INTO users (username, password_hash, public_key) VALUES ('carol', 'hash', ?)", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, sender := range []int64{bobID, bobID, carolID, aliceID} {
+		receiver := aliceID
+		if sender == aliceID {
+			receiver = bobID
+		}
+		if _, _, err := db.SaveMessage(sender, receiver, fmt.Sprintf("unread-total-%d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := func() int64 {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetUnreadTotal(recorder, requestForUser(http.MethodGet, "/api/messages/unread-total", "", aliceID))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Total int64 `json:"total"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Total
+	}
+	if got := total(); got != 3 {
+		t.Fatalf("unread total = %d, want 3", got)
+	}
+	if _, err := db.DB.Exec("UPDATE messages SET read = TRUE WHERE sender_id = ?", carolID); err != nil {
+		t.Fatal(err)
+	}
+	if got := total(); got != 2 {
+		t.Fatalf("unread total after reading carol = %d, want 2", got)
+	}
+}
+
+func TestCryptoParamsMatchWhatTheServerAccepts(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handleGetCryptoParams(recorder, httptest.NewRequest(http.MethodGet, "/api/crypto/params", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d", recorder.Code)
+	}
+	var params crypto.Params
+	if err := json.NewDecoder(recorder.Body).Decode(&params); err != nil {
+		t.Fatal(err)
+	}
+
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{
+		"X25519":    make([]byte, 32),
+		"ECDH-P256": p256.PublicKey().Bytes(),
+	}
+	for _, agreement := range params.KeyAgreements {
+		key, ok := keys[agreement.Algorithm]
+		if !ok || len(key) != agreement.PublicKeyLength || !crypto.ValidPublicKey(key) {
+			t.Errorf("key agreement %+v does not match an accepted public key", agreement)
+		}
+	}
+	if len(params.KeyAgreements) != len(keys) {
+		t.Errorf("key agreements = %+v", params.KeyAgreements)
+	}
+	if err := crypto.ValidateCiphertext(make([]byte, params.TagLength), make([]byte, params.NonceLength)); err != nil {
+		t.Errorf("advertised nonce and tag lengths are rejected: %v", err)
+	}
+}
+
+func TestServerTimeReportsSecondsAndMilliseconds(t *testing.T) {
+	before := time.Now().UnixMilli()
+	recorder := httptest.NewRecorder()
+	handleGetServerTime(recorder, httptest.NewRequest(http.MethodGet, "/api/time", nil))
+	after := time.Now().UnixMilli()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d", recorder.Code)
+	}
+	var response struct {
+		Unix   int64 `json:"unix"`
+		UnixMS int64 `json:"unix_ms"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.UnixMS < before || response.UnixMS > after || response.Unix != response.UnixMS/1000 {
+		t.Fatalf("server time = %+v, want between %d and %d ms", response, before, after)
+	}
+}
+
+func TestConversationActivityPagesMetadataOnly(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	result, err := db.DB.Exec("INSERT INTO users (username, password_hash, public_key) VALUES ('carol', 'hash', ?)", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, pair := range [][2]int64{{aliceID, bobID}, {bobID, aliceID}, {aliceID, bobID}, {carolID, aliceID}} {
+		if _, _, err := db.SaveMessage(pair[0], pair[1], fmt.Sprintf("audit-%d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page := func(target string) (conversations []map[string]interface{}, nextCursor *int64) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handleGetConversationActivity(recorder, requestForUser(http.MethodGet, target, "", aliceID))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s = %d: %s", target, recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Conversations []map[string]interface{} `json:"conversations"`
+			NextCursor    *int64                   `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Conversations, response.NextCursor
+	}
+
+	first, cursor := page("/api/admin/conversations?limit=1")
+	if len(first) != 1 || first[0]["user_a"] != float64(aliceID) || first[0]["user_b"] != float64(carolID) || first[0]["message_count"] != float64(1) || cursor == nil {
+		t.Fatalf("first page = %v, cursor %v", first, cursor)
+	}
+	if len(first[0]) != 4 || first[0]["last_activity"] == nil {
+		t.Fatalf("conversation carries more than metadata: %v", first[0])
+	}
+	second, cursor := page(fmt.Sprintf("/api/admin/conversations?limit=1&before_id=%d", *cursor))
+	if len(second) != 1 || second[0]["user_a"] != float64(aliceID) || second[0]["user_b"] != float64(bobID) || second[0]["message_count"] != float64(3) || cursor != nil {
+		t.Fatalf("second page = %v, cursor %v", second, cursor)
 	}
 }
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+
+	// streamBatchSize is how many messages are read per query while
+	// streaming a conversation.
+	streamBatchSize = 500
+
+	// streamWriteTimeout bounds writing one batch; the server write timeout
+	// would otherwise cut long streams short.
+	streamWriteTimeout = 15 * time.Second
+)
+
+// acceptsNDJSON reports whether newline-delimited JSON is the media type the
+// request's Accept header prefers. NDJSON must be listed explicitly with a
+// non-zero quality, and it wins ties with JSON and wildcards since asking for
+// it at all is an opt-in.
+func acceptsNDJSON(r *http.Request) bool {
+	ndjson, other := 0.0, 0.0
+	for _, value := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			quality := 1.0
+			if q, ok := params["q"]; ok {
+				quality, err = strconv.ParseFloat(q, 64)
+				if err != nil || quality < 0 || quality > 1 {
+					continue
+				}
+			}
+			switch mediaType {
+			case ndjsonContentType:
+				ndjson = max(ndjson, quality)
+			case "application/json", "application/*", "*/*":
+				other = max(other, quality)
+			}
+		}
+	}
+	return ndjson > 0 && ndjson >= other
+}
+
+// streamMessages writes the whole visible history between userID and otherID,
+// oldest first, as one JSON message per line. Rows are read in keyset batches
+// instead of from one long-lived cursor: the database has a single connection,
+// and holding it while a slow client drains the response would stall every
+// other request. Streaming is meant for background sync, so nothing is marked
+// as read. A non-nil header is written as the first line.
+func streamMessages(w http.ResponseWriter, r *http.Request, userID, otherID int64, header interface{}) {
+	messages, err := db.GetMessagesFrom(userID, otherID, streamBatchSize, 0)
+	if err != nil {
+		log.Printf("Failed to stream messages between %d and %d: %v", userID, otherID, err)
+		errorResponse(w, http.StatusInternalServerError, "failed to fetch messages")
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	if header != nil {
+		if err := encoder.Encode(header); err != nil {
+			return
+		}
+	}
+	for {
+		_ = controller.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		for _, message := range messages {
+			if err := encoder.Encode(message); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+		if len(messages) < streamBatchSize || r.Context().Err() != nil {
+			return
+		}
+
+		fromID := messages[len(messages)-1].ID + 1
+		if messages, err = db.GetMessagesFrom(userID, otherID, streamBatchSize, fromID); err != nil {
+			log.Printf("Failed to stream messages between %d and %d: %v", userID, otherID, err)
+			// Abort the connection so the client sees a truncated body
+			// rather than a complete but short history.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bufio"
+	"chatapp/internal/db"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMessagesStreamAsNDJSON(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	save := func(index int) {
+		t.Helper()
+		if _, _, err := db.SaveMessage(bobID, aliceID, fmt.Sprintf("stream-message-%04d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save(0)
+	if _, err := db.ClearMessagesForUser(context.Background(), aliceID, bobID); err != nil {
+		t.Fatal(err)
+	}
+	// Span more than one batch.
+	total := streamBatchSize + 2
+	for index := 1; index <= total; index++ {
+		save(index)
+	}
+
+	request := requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d", bobID), "", aliceID)
+	request.Header.Set("Accept", "application/json;q=0.9, application/x-ndjson")
+	recorder := httptest.NewRecorder()
+	handleGetMessages(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("stream = %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	var lastID int64
+	lines := 0
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		var message db.Message
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatalf("line %d: %v", lines, err)
+		}
+		if message.ID <= lastID {
+			t.Fatalf("message %d streamed after %d", message.ID, lastID)
+		}
+		if message.ClientID == "stream-message-0000" {
+			t.Fatal("cleared message was streamed")
+		}
+		lastID = message.ID
+		lines++
+	}
+	if lines != total {
+		t.Fatalf("streamed %d messages, want %d", lines, total)
+	}
+
+	unread, err := db.GetFirstUnreadID(aliceID, bobID)
+	if err != nil || unread == 0 {
+		t.Fatalf("streaming marked messages as read: %d, %v", unread, err)
+	}
+
+	recorder = httptest.NewRecorder()
+	handleGetMessages(recorder, requestForUser(http.MethodGet, fmt.Sprintf("/api/messages/%d?limit=1", bobID), "", aliceID))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("paged request = %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestAcceptsNDJSONOnlyWhenPreferred(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "application/x-ndjson", want: true},
+		{accept: "application/json, application/x-ndjson;q=0.9", want: false},
+		{accept: "application/json;q=0.5, application/x-ndjson", want: true},
+		{accept: "application/x-ndjson, */*", want: true},
+		{accept: "application/x-ndjson;q=0", want: false},
+		{accept: "application/x-ndjson;q=0.5, */*;q=0.8", want: false},
+		{accept: "application/x-ndjson;q=bogus", want: false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.accept != "" {
+			request.Header.Set("Accept", test.accept)
+		}
+		if got := acceptsNDJSON(request); got != test.want {
+			t.Errorf("Accept %q: acceptsNDJSON = %t, want %t", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestConversationExportStartsWithParticipantKeys(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	for index, senderID := range []int64{aliceID, bobID, aliceID} {
+		receiverID := aliceID + bobID - senderID
+		if _, _, err := db.SaveMessage(senderID, receiverID, fmt.Sprintf("export-message-%04d", index), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export := func(otherID int64) *httptest.ResponseRecorder {
+		request := requestForUser(http.MethodGet, fmt.Sprintf("/api/conversations/%d/export", otherID), "", aliceID)
+		request.SetPathValue("userID", fmt.Sprint(otherID))
+		recorder := httptest.NewRecorder()
+		handleExportConversation(recorder, request)
+		return recorder
+	}
+	if recorder := export(aliceID); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("export of own conversation = %d, want 400", recorder.Code)
+	}
+	if recorder := export(bobID + 100); recorder.Code != http.StatusNotFound {
+		t.Fatalf("export with missing user = %d, want 404", recorder.Code)
+	}
+
+	recorder := export(bobID)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != ndjsonContentType ||
+		recorder.Header().Get("Content-Disposition") != `attachment; filename="conversation-bob.ndjson"` {
+		t.Fatalf("export = %d %q %q", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Header().Get("Content-Disposition"))
+	}
+	scanner := bufio.NewScanner(recorder.Body)
+	if !scanner.Scan() {
+		t.Fatal("export is empty")
+	}
+	var header conversationArchive
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Format != conversationArchiveFormat || header.UserID != aliceID || header.OtherUserID != bobID ||
+		len(header.Participants) != 2 || header.Participants[1].Username != "bob" || header.Participants[1].Fingerprint == "" {
+		t.Fatalf("archive header = %+v", header)
+	}
+	var clientIDs []string
+	for scanner.Scan() {
+		var message db.Message
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatal(err)
+		}
+		clientIDs = append(clientIDs, message.ClientID)
+	}
+	if len(clientIDs) != 3 || clientIDs[0] != "export-message-0000" || clientIDs[2] != "export-message-0002" {
+		t.Fatalf("exported messages = %v", clientIDs)
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+const maximumWelcomeMessageLength = 4096
+
+var welcomeConfiguration struct {
+	sync.RWMutex
+	senderID int64
+	text     string
+}
+
+// ConfigureWelcomeMessage sets the system account and text sent to every newly
+// registered user. Leaving both empty disables the welcome message.
+func ConfigureWelcomeMessage(senderID, text string) error {
+	welcomeConfiguration.Lock()
+	defer welcomeConfiguration.Unlock()
+	welcomeConfiguration.senderID = 0
+	welcomeConfiguration.text = ""
+	if senderID == "" && text == "" {
+		return nil
+	}
+	id, err := strconv.ParseInt(senderID, 10, 64)
+	if err != nil || id < 1 {
+		return fmt.Errorf("WELCOME_SYSTEM_USER_ID must be a positive user ID")
+	}
+	if text == "" || len(text) > maximumWelcomeMessageLength {
+		return fmt.Errorf("WELCOME_MESSAGE must be between 1 and %d bytes", maximumWelcomeMessageLength)
+	}
+	welcomeConfiguration.senderID = id
+	welcomeConfiguration.text = text
+	return nil
+}
+
+// sendWelcomeMessage delivers the configured welcome message to a new user.
+// Registration has already succeeded, so failures are only logged.
+func sendWelcomeMessage(userID int64) {
+	welcomeConfiguration.RLock()
+	senderID, text := welcomeConfiguration.senderID, welcomeConfiguration.text
+	welcomeConfiguration.RUnlock()
+	if senderID == 0 || senderID == userID {
+		return
+	}
+	if _, err := db.SaveSystemMessage(senderID, userID, text); err != nil {
+		log.Printf("Failed to send welcome message to user %d: %v", userID, err)
+	}
+}
+
+// welcomeSenderID returns the system account that sends the welcome message,
+// or 0 when none is configured.
+func welcomeSenderID() int64 {
+	welcomeConfiguration.RLock()
+	defer welcomeConfiguration.RUnlock()
+	return welcomeConfiguration.senderID
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"chatapp/internal/db"
+	"fmt"
+	"testing"
+)
+
+func TestWelcomeMessageConfiguration(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureWelcomeMessage("", "") })
+	for _, test := range []struct{ senderID, text string }{
+		{senderID: "1"},
+		{text: "Welcome!"},
+		{senderID: "0", text: "Welcome!"},
+		{senderID: "system", text: "Welcome!"},
+	} {
+		if err := ConfigureWelcomeMessage(test.senderID, test.text); err == nil {
+			t.Errorf("ConfigureWelcomeMessage(%q, %q) succeeded", test.senderID, test.text)
+		}
+	}
+}
+
+func TestWelcomeMessageIsStoredAsPlaintextSystemMessage(t *testing.T) {
+	aliceID, bobID := initAPITestDB(t)
+	t.Cleanup(func() { _ = ConfigureWelcomeMessage("", "") })
+	if err := ConfigureWelcomeMessage(fmt.Sprint(aliceID), "Welcome aboard!"); err != nil {
+		t.Fatal(err)
+	}
+
+	sendWelcomeMessage(aliceID)
+	sendWelcomeMessage(bobID)
+
+	messages, err := db.GetMessagesBetween(aliceID, bobID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	message := messages[0]
+	if message.SenderID != aliceID || message.Type != db.MessageTypeSystem ||
+		string(message.Content) != "Welcome aboard!" || len(message.Nonce) != 0 {
+		t.Fatalf("unexpected welcome message: %+v", message)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebSocketHandshakeRate = 20
+	// maximumHandshakeWait bounds the admission queue: a handshake that would
+	// wait longer than this is turned away instead.
+	maximumHandshakeWait = 2 * time.Second
+)
+
+// handshakeLimiter spaces WebSocket upgrades evenly so that a reconnect storm
+// reaches the database at a steady rate instead of all at once.
+type handshakeLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // zero disables admission control
+	maxWait  time.Duration
+	next     time.Time
+}
+
+func newHandshakeLimiter(perSecond int, maxWait time.Duration) *handshakeLimiter {
+	limiter := &handshakeLimiter{maxWait: maxWait}
+	limiter.setRate(perSecond)
+	return limiter
+}
+
+func (l *handshakeLimiter) setRate(perSecond int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = 0
+	if perSecond > 0 {
+		l.interval = time.Second / time.Duration(perSecond)
+	}
+	l.next = time.Time{}
+}
+
+// reserve claims the next admission slot and returns how long the caller must
+// wait for it. When the queue is full it reports false with the wait a retry
+// would face.
+func (l *handshakeLimiter) reserve(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.interval == 0 {
+		return 0, true
+	}
+	start := now
+	if l.next.After(now) {
+		start = l.next
+	}
+	wait := start.Sub(now)
+	if wait > l.maxWait {
+		return wait, false
+	}
+	l.next = start.Add(l.interval)
+	return wait, true
+}
+
+var webSocketHandshakes = newHandshakeLimiter(defaultWebSocketHandshakeRate, maximumHandshakeWait)
+
+// ConfigureWebSocketHandshakeRate sets how many WebSocket upgrades are admitted
+// per second. Zero disables admission control; empty restores the default.
+func ConfigureWebSocketHandshakeRate(value string) error {
+	rate := defaultWebSocketHandshakeRate
+	if value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 10000 {
+			return fmt.Errorf("WEBSOCKET_HANDSHAKE_RATE must be between 0 and 10000")
+		}
+		rate = parsed
+	}
+	webSocketHandshakes.setRate(rate)
+	return nil
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimiterQueuesThenRejects(t *testing.T) {
+	limiter := newHandshakeLimiter(10, 200*time.Millisecond)
+	now := time.Date(2026, time.July, 12, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		at       time.Duration
+		wait     time.Duration
+		admitted bool
+	}{
+		{at: 0, wait: 0, admitted: true},
+		{at: 0, wait: 100 * time.Millisecond, admitted: true},
+		{at: 0, wait: 200 * time.Millisecond, admitted: true},
+		{at: 0, wait: 300 * time.Millisecond, admitted: false},
+		{at: time.Second, wait: 0, admitted: true},
+	}
+	for index, test := range tests {
+		wait, admitted := limiter.reserve(now.Add(test.at))
+		if wait != test.wait || admitted != test.admitted {
+			t.Fatalf("handshake %d: wait = %s, admitted = %t; want %s, %t", index, wait, admitted, test.wait, test.admitted)
+		}
+	}
+
+	limiter.setRate(0)
+	for range 100 {
+		if wait, admitted := limiter.reserve(now); wait != 0 || !admitted {
+			t.Fatal("disabled limiter delayed a handshake")
+		}
+	}
+}
+
+func TestConfigureWebSocketHandshakeRate(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureWebSocketHandshakeRate("") })
+	for _, value := range []string{"-1", "fast", "10001"} {
+		if err := ConfigureWebSocketHandshakeRate(value); err == nil {
+			t.Errorf("ConfigureWebSocketHandshakeRate(%q) succeeded", value)
+		}
+	}
+	if err := ConfigureWebSocketHandshakeRate("0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakesWithoutTicketTakeNoAdmissionSlot(t *testing.T) {
+	previous := webSocketHandshakes
+	webSocketHandshakes = newHandshakeLimiter(1, 0)
+	t.Cleanup(func() { webSocketHandshakes = previous })
+
+	for range 10 {
+		request := httptest.NewRequest(http.MethodGet, "/ws?ticket=bogus", nil)
+		request.Header.Set("Origin", "http://example.com")
+		recorder := httptest.NewRecorder()
+		handleWebSocket(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("bogus ticket = %d %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	if wait, admitted := webSocketHandshakes.reserve(time.Now()); wait != 0 || !admitted {
+		t.Fatalf("valid handshake waits %s, admitted = %t", wait, admitted)
+	}
+}
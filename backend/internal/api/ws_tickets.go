@@ -16,10 +16,12 @@ const (
 var errTooManyPendingTickets = errors.New("too many pending WebSocket tickets")
 
 type webSocketTicket struct {
-	UserID    int64
-	Username  string
-	Version   int64
-	ExpiresAt time.Time
+	UserID      int64
+	Username    string
+	Version     int64
+	TokenID     string    // jti of the JWT the ticket was issued for
+	TokenExpiry time.Time // expiry of the JWT the ticket was issued for
+	ExpiresAt   time.Time
 }
 
 type webSocketTicketStore struct {
@@ -31,7 +33,7 @@ func newWebSocketTicketStore() *webSocketTicketStore {
 	return &webSocketTicketStore{tickets: make(map[string]webSocketTicket)}
 }
 
-func (s *webSocketTicketStore) issue(userID int64, username string, authVersion int64, now time.Time) (string, error) {
+func (s *webSocketTicketStore) issue(userID int64, username string, authVersion int64, tokenID string, tokenExpiry, now time.Time) (string, error) {
 	bytes := make([]byte, 32)
 	if _, err := rand.Read(bytes); err != nil {
 		return "", err
@@ -45,14 +47,24 @@ func (s *webSocketTicketStore) issue(userID int64, username string, authVersion
 		return "", errTooManyPendingTickets
 	}
 	s.tickets[token] = webSocketTicket{
-		UserID:    userID,
-		Username:  username,
-		Version:   authVersion,
-		ExpiresAt: now.Add(webSocketTicketLifetime),
+		UserID:      userID,
+		Username:    username,
+		Version:     authVersion,
+		TokenID:     tokenID,
+		TokenExpiry: tokenExpiry,
+		ExpiresAt:   now.Add(webSocketTicketLifetime),
 	}
 	return token, nil
 }
 
+// valid reports whether a ticket would be accepted now, without using it up.
+func (s *webSocketTicketStore) valid(token string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket, ok := s.tickets[token]
+	return ok && ticket.ExpiresAt.After(now)
+}
+
 func (s *webSocketTicketStore) consume(token string, now time.Time) (webSocketTicket, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
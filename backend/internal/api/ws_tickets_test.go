@@ -8,13 +8,14 @@ import (
 func TestWebSocketTicketIsSingleUse(t *testing.T) {
 	store := newWebSocketTicketStore()
 	now := time.Date(2026, time.July, 12, 12, 0, 0, 0, time.UTC)
-	token, err := store.issue(42, "alice", 3, now)
+	token, err := store.issue(42, "alice", 3, "token-id", now.Add(time.Hour), now)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	ticket, ok := store.consume(token, now.Add(time.Second))
-	if !ok || ticket.UserID != 42 || ticket.Username != "alice" || ticket.Version != 3 {
+	if !ok || ticket.UserID != 42 || ticket.Username != "alice" || ticket.Version != 3 ||
+		ticket.TokenID != "token-id" || !ticket.TokenExpiry.Equal(now.Add(time.Hour)) {
 		t.Fatalf("unexpected ticket: %+v, valid=%t", ticket, ok)
 	}
 	if _, ok := store.consume(token, now.Add(2*time.Second)); ok {
@@ -25,7 +26,7 @@ func TestWebSocketTicketIsSingleUse(t *testing.T) {
 func TestWebSocketTicketExpires(t *testing.T) {
 	store := newWebSocketTicketStore()
 	now := time.Date(2026, time.July, 12, 12, 0, 0, 0, time.UTC)
-	token, err := store.issue(42, "alice", 3, now)
+	token, err := store.issue(42, "alice", 3, "token-id", now.Add(time.Hour), now)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,3 +34,21 @@ func TestWebSocketTicketExpires(t *testing.T) {
 		t.Fatal("expired ticket was accepted")
 	}
 }
+
+func TestWebSocketTicketCheckDoesNotUseItUp(t *testing.T) {
+	store := newWebSocketTicketStore()
+	now := time.Date(2026, time.July, 12, 12, 0, 0, 0, time.UTC)
+	token, err := store.issue(42, "alice", 3, "token-id", now.Add(time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.valid(token, now) || !store.valid(token, now) || store.valid("bogus", now) {
+		t.Fatal("ticket check disagrees with the issued tickets")
+	}
+	if _, ok := store.consume(token, now); !ok {
+		t.Fatal("checked ticket could not be used")
+	}
+	if store.valid(token, now) || store.valid(token, now.Add(webSocketTicketLifetime)) {
+		t.Fatal("used ticket is still valid")
+	}
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -32,14 +34,19 @@ func GenerateToken(userID int64, username string, authVersion int64) (string, er
 	if len(jwtSecret) == 0 {
 		return "", errors.New("JWT signing is not configured")
 	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
 
 	claims := Claims{
 		UserID:   userID,
 		Username: username,
 		Version:  authVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL())),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        hex.EncodeToString(id), // jti, so that one token can be revoked
 		},
 	}
 
@@ -48,13 +55,18 @@ func GenerateToken(userID int64, username string, authVersion int64) (string, er
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString)
+}
+
+func parseToken(tokenString string, options ...jwt.ParserOption) (*Claims, error) {
 	if len(jwtSecret) == 0 {
 		return nil, errors.New("JWT validation is not configured")
 	}
 
+	options = append(options, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	}, options...)
 
 	if err != nil {
 		return nil, err
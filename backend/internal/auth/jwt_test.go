@@ -2,6 +2,7 @@ package auth
 
 import (
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -30,9 +31,16 @@ func TestGenerateAndValidateToken(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if claims.UserID != 42 || claims.Username != "alice" || claims.Version != 3 {
+	if claims.UserID != 42 || claims.Username != "alice" || claims.Version != 3 || claims.ID == "" {
 		t.Fatalf("unexpected claims: %+v", claims)
 	}
+	other, err := GenerateToken(42, "alice", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherClaims, err := ValidateToken(other); err != nil || otherClaims.ID == claims.ID {
+		t.Fatalf("tokens share the ID %q", claims.ID)
+	}
 }
 
 func TestValidateTokenRejectsOtherSigningMethods(t *testing.T) {
@@ -49,3 +57,58 @@ func TestValidateTokenRejectsOtherSigningMethods(t *testing.T) {
 		t.Fatal("ValidateToken accepted a non-HS256 token")
 	}
 }
+
+func TestRefreshTokenAcceptsRecentlyExpiredTokens(t *testing.T) {
+	if err := Configure(testSecret); err != nil {
+		t.Fatal(err)
+	}
+	signed := func(expiresAt *jwt.NumericDate) string {
+		t.Helper()
+		claims := Claims{UserID: 42, Username: "alice", Version: 3, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: expiresAt}}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	recent := signed(jwt.NewNumericDate(time.Now().Add(-RefreshGracePeriod / 2)))
+	if _, err := ValidateToken(recent); err == nil {
+		t.Fatal("ValidateToken accepted an expired token")
+	}
+	refreshed, err := RefreshToken(recent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateToken(refreshed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 42 || claims.Username != "alice" || claims.Version != 3 {
+		t.Fatalf("refreshed claims = %+v", claims)
+	}
+
+	for name, token := range map[string]string{
+		"fully expired": signed(jwt.NewNumericDate(time.Now().Add(-2 * RefreshGracePeriod))),
+		"no expiry":     signed(nil),
+	} {
+		if _, err := RefreshToken(token); err == nil {
+			t.Errorf("RefreshToken accepted a token with %s", name)
+		}
+	}
+}
+
+func TestConfigureTokenLifetimes(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureTokenLifetimes("", "") })
+	for _, values := range [][2]string{{"30s", ""}, {"soon", ""}, {"1h", "30m"}, {"", "9000h"}} {
+		if err := ConfigureTokenLifetimes(values[0], values[1]); err == nil {
+			t.Errorf("ConfigureTokenLifetimes(%q, %q) accepted invalid lifetimes", values[0], values[1])
+		}
+	}
+	if err := ConfigureTokenLifetimes("15m", "72h"); err != nil {
+		t.Fatal(err)
+	}
+	if AccessTokenTTL() != 15*time.Minute || RefreshTokenTTL() != 72*time.Hour {
+		t.Fatalf("lifetimes = %s/%s", AccessTokenTTL(), RefreshTokenTTL())
+	}
+}
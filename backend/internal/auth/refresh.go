@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultAccessTokenTTL  = 7 * 24 * time.Hour
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	minimumAccessTokenTTL  = time.Minute
+	maximumTokenTTL        = 365 * 24 * time.Hour
+
+	// RefreshGracePeriod is how long after it expires an access token can
+	// still be exchanged for a new one.
+	RefreshGracePeriod = 10 * time.Minute
+)
+
+var lifetimes = struct {
+	sync.RWMutex
+	access  time.Duration
+	refresh time.Duration
+}{access: defaultAccessTokenTTL, refresh: defaultRefreshTokenTTL}
+
+// ConfigureTokenLifetimes sets how long access tokens and refresh tokens stay
+// valid. Empty values keep the defaults. A refresh token may not expire before
+// the access tokens it renews.
+func ConfigureTokenLifetimes(access, refresh string) error {
+	parse := func(name, value string, fallback time.Duration) (time.Duration, error) {
+		if value == "" {
+			return fallback, nil
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < minimumAccessTokenTTL || parsed > maximumTokenTTL {
+			return 0, fmt.Errorf("%s must be a duration between %s and %s", name, minimumAccessTokenTTL, maximumTokenTTL)
+		}
+		return parsed, nil
+	}
+	accessTTL, err := parse("ACCESS_TOKEN_TTL", access, defaultAccessTokenTTL)
+	if err != nil {
+		return err
+	}
+	refreshTTL, err := parse("REFRESH_TOKEN_TTL", refresh, defaultRefreshTokenTTL)
+	if err != nil {
+		return err
+	}
+	if refreshTTL < accessTTL {
+		return fmt.Errorf("REFRESH_TOKEN_TTL must not be shorter than ACCESS_TOKEN_TTL")
+	}
+	lifetimes.Lock()
+	lifetimes.access = accessTTL
+	lifetimes.refresh = refreshTTL
+	lifetimes.Unlock()
+	return nil
+}
+
+// AccessTokenTTL returns how long a newly issued access token is valid.
+func AccessTokenTTL() time.Duration {
+	lifetimes.RLock()
+	defer lifetimes.RUnlock()
+	return lifetimes.access
+}
+
+// RefreshTokenTTL returns how long a newly issued refresh token is valid.
+func RefreshTokenTTL() time.Duration {
+	lifetimes.RLock()
+	defer lifetimes.RUnlock()
+	return lifetimes.refresh
+}
+
+// ValidateRefreshable is ValidateToken for token renewal: it also accepts a
+// token that expired less than RefreshGracePeriod ago, but never one without
+// an expiry.
+func ValidateRefreshable(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, jwt.WithLeeway(RefreshGracePeriod), jwt.WithExpirationRequired())
+}
+
+// RefreshToken signs a new access token carrying the user, username and auth
+// version of old, which may have expired within RefreshGracePeriod. Callers
+// still have to check the auth version against the database.
+func RefreshToken(old string) (string, error) {
+	claims, err := ValidateRefreshable(old)
+	if err != nil {
+		return "", err
+	}
+	return GenerateToken(claims.UserID, claims.Username, claims.Version)
+}
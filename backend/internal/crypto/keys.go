@@ -1,11 +1,15 @@
 package crypto
 
 import (
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
@@ -72,7 +76,74 @@ func EncodeKey(key []byte) string {
 	return base64.StdEncoding.EncodeToString(key)
 }
 
+// MessageNonceSize is the AES-GCM nonce length clients use for message content.
+const MessageNonceSize = 12
+
+// MessageTagSize is the AES-GCM authentication tag appended to every
+// ciphertext, so it is also the shortest valid message content.
+const MessageTagSize = 16
+
+// ValidateCiphertext checks that encrypted message content and its nonce have
+// the shapes AES-GCM produces. It cannot detect tampering, only client bugs
+// that would otherwise surface later as decryption failures.
+func ValidateCiphertext(content, nonce []byte) error {
+	if len(nonce) != MessageNonceSize {
+		return fmt.Errorf("nonce must decode to %d bytes, got %d", MessageNonceSize, len(nonce))
+	}
+	if len(content) < MessageTagSize {
+		return fmt.Errorf("content must decode to at least %d bytes, got %d", MessageTagSize, len(content))
+	}
+	return nil
+}
+
+var (
+	ErrURLSafeBase64   = errors.New("must use standard base64 ('+' and '/'), not URL-safe base64")
+	ErrMalformedBase64 = errors.New("must be padded standard base64 without line breaks")
+)
+
+// DecodeStrict decodes padded standard base64 (RFC 4648 section 4). Unlike
+// DecodeKey it rejects line breaks and non-canonical trailing bits, and it
+// reports URL-safe input separately so clients can tell what went wrong.
+func DecodeStrict(value string) ([]byte, error) {
+	if strings.ContainsAny(value, "-_") {
+		return nil, ErrURLSafeBase64
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return nil, ErrMalformedBase64
+	}
+	decoded, err := base64.StdEncoding.Strict().DecodeString(value)
+	if err != nil {
+		return nil, ErrMalformedBase64
+	}
+	return decoded, nil
+}
+
 // DecodeKey decodes a key from base64
 func DecodeKey(keyStr string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(keyStr)
 }
+
+// ValidPublicKey reports whether key is a raw X25519 public key or an
+// uncompressed point on P-256, the formats MessageParams lists.
+func ValidPublicKey(key []byte) bool {
+	if len(key) == X25519PublicKeySize {
+		return true
+	}
+	if len(key) != P256PublicKeySize {
+		return false
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), key)
+	return x != nil && y != nil
+}
+
+// Fingerprint returns the SHA-256 of a public key as upper-case hex in groups
+// of four, for out-of-band comparison.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	digits := strings.ToUpper(hex.EncodeToString(sum[:]))
+	groups := make([]string, 0, len(digits)/4)
+	for index := 0; index < len(digits); index += 4 {
+		groups = append(groups, digits[index:index+4])
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,53 @@
+package crypto
+
+// SchemeVersion identifies the message encryption scheme described by
+// MessageParams. It changes whenever clients would need to change how they
+// encrypt.
+const SchemeVersion = 1
+
+// Public key lengths accepted for each key agreement.
+const (
+	X25519PublicKeySize = 32
+	P256PublicKeySize   = 65 // uncompressed point
+)
+
+// KeyAgreement is one supported way of deriving the message key from a
+// public key.
+type KeyAgreement struct {
+	Algorithm       string `json:"algorithm"`
+	PublicKeyLength int    `json:"public_key_length"`
+	PublicKeyFormat string `json:"public_key_format"`
+}
+
+// Params describes how clients encrypt message content. Nothing in it is
+// secret.
+type Params struct {
+	Version       int            `json:"version"`
+	KeyAgreements []KeyAgreement `json:"key_agreements"`
+	KeyDerivation string         `json:"key_derivation"`
+	Cipher        string         `json:"cipher"`
+	KeyLength     int            `json:"key_length"`
+	NonceLength   int            `json:"nonce_length"`
+	TagLength     int            `json:"tag_length"`
+	Encoding      string         `json:"encoding"`
+}
+
+// MessageParams returns the parameters the server enforces on messages.
+// Clients pick the key agreement matching their peer's public key length; the
+// shared secret is used directly as the AES-GCM key, as WebCrypto deriveKey
+// does.
+func MessageParams() Params {
+	return Params{
+		Version: SchemeVersion,
+		KeyAgreements: []KeyAgreement{
+			{Algorithm: "X25519", PublicKeyLength: X25519PublicKeySize, PublicKeyFormat: "raw"},
+			{Algorithm: "ECDH-P256", PublicKeyLength: P256PublicKeySize, PublicKeyFormat: "uncompressed"},
+		},
+		KeyDerivation: "raw-shared-secret",
+		Cipher:        "AES-256-GCM",
+		KeyLength:     32,
+		NonceLength:   MessageNonceSize,
+		TagLength:     MessageTagSize,
+		Encoding:      "base64-std",
+	}
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	CallStatusPending = "pending"
+	CallStatusActive  = "active"
+	CallStatusEnded   = "ended"
+)
+
+// CallSession tracks one call from offer to hang-up. DurationSeconds is set
+// only for calls that were answered.
+type CallSession struct {
+	SessionID       string     `json:"session_id"`
+	CallerID        int64      `json:"caller_id"`
+	CalleeID        int64      `json:"callee_id"`
+	Status          string     `json:"status"`
+	CreatedAt       time.Time  `json:"created_at"`
+	AnsweredAt      *time.Time `json:"answered_at"`
+	EndedAt         *time.Time `json:"ended_at"`
+	DurationSeconds *int64     `json:"duration_seconds"`
+}
+
+// OtherParty returns the participant that is not userID.
+func (c *CallSession) OtherParty(userID int64) int64 {
+	if c.CallerID == userID {
+		return c.CalleeID
+	}
+	return c.CallerID
+}
+
+// CreateCallSession records a new pending call. Reusing an existing session ID
+// leaves the original session untouched and reports false.
+func CreateCallSession(sessionID string, callerID, calleeID int64) (bool, error) {
+	result, err := DB.Exec(
+		"INSERT OR IGNORE INTO call_sessions (session_id, caller_id, callee_id, status) VALUES (?, ?, ?, ?)",
+		sessionID, callerID, calleeID, CallStatusPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// AnswerCallSession marks a pending call active when its callee answers.
+func AnswerCallSession(sessionID string, calleeID int64) (bool, error) {
+	result, err := DB.Exec(
+		"UPDATE call_sessions SET status = ?, answered_at = ? WHERE session_id = ? AND callee_id = ? AND status = ?",
+		CallStatusActive, time.Now(), sessionID, calleeID, CallStatusPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// EndCallSession ends a call on behalf of either participant and records its
+// duration. Ending an already ended call is a no-op. It returns nil when the
+// session does not exist or userID is not a participant.
+func EndCallSession(sessionID string, userID int64) (*CallSession, error) {
+	var session *CallSession
+	err := WithTx(func(tx *sql.Tx) error {
+		var err error
+		session, err = scanCallSession(tx.QueryRow(
+			`SELECT session_id, caller_id, callee_id, status, created_at, answered_at, ended_at, duration_seconds
+			 FROM call_sessions WHERE session_id = ? AND (caller_id = ? OR callee_id = ?)`,
+			sessionID, userID, userID,
+		))
+		if err != nil || session.Status == CallStatusEnded {
+			return err
+		}
+
+		endedAt := time.Now()
+		var duration *int64
+		if session.AnsweredAt != nil {
+			seconds := int64(max(0, endedAt.Sub(*session.AnsweredAt).Seconds()))
+			duration = &seconds
+		}
+		if _, err := tx.Exec(
+			"UPDATE call_sessions SET status = ?, ended_at = ?, duration_seconds = ? WHERE session_id = ?",
+			CallStatusEnded, endedAt, duration, sessionID,
+		); err != nil {
+			return err
+		}
+		session.Status = CallStatusEnded
+		session.EndedAt = &endedAt
+		session.DurationSeconds = duration
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// InCallWithOther reports whether userID is in an answered call with anyone
+// other than exceptUserID. Offers between the two parties of an ongoing call
+// are renegotiations, not new calls.
+func InCallWithOther(userID, exceptUserID int64) (bool, error) {
+	var busy bool
+	err := DB.QueryRow(
+		`SELECT EXISTS (
+		   SELECT 1 FROM call_sessions
+		   WHERE status = ?
+		     AND ((caller_id = ? AND callee_id != ?) OR (callee_id = ? AND caller_id != ?))
+		 )`,
+		CallStatusActive, userID, exceptUserID, userID, exceptUserID,
+	).Scan(&busy)
+	return busy, err
+}
+
+// HasOpenCall reports whether a pending or active call exists between the two
+// users. A non-empty sessionID must also match the call.
+func HasOpenCall(userID, otherUserID int64, sessionID string) (bool, error) {
+	var open bool
+	err := DB.QueryRow(
+		`SELECT EXISTS (
+		   SELECT 1 FROM call_sessions
+		   WHERE status != ?
+		     AND ((caller_id = ? AND callee_id = ?) OR (caller_id = ? AND callee_id = ?))
+		     AND (? = '' OR session_id = ?)
+		 )`,
+		CallStatusEnded, userID, otherUserID, otherUserID, userID, sessionID, sessionID,
+	).Scan(&open)
+	return open, err
+}
+
+// EndOpenCallSessions ends every pending or active call userID is part of, for
+// when their last connection drops without a hang-up, and returns the
+// sessions it ended.
+func EndOpenCallSessions(userID int64) ([]CallSession, error) {
+	rows, err := DB.Query(
+		"SELECT session_id FROM call_sessions WHERE status != ? AND (caller_id = ? OR callee_id = ?)",
+		CallStatusEnded, userID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var sessionIDs []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	ended := make([]CallSession, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		session, err := EndCallSession(sessionID, userID)
+		if err != nil {
+			return ended, err
+		}
+		if session != nil {
+			ended = append(ended, *session)
+		}
+	}
+	return ended, nil
+}
+
+func scanCallSession(row *sql.Row) (*CallSession, error) {
+	var session CallSession
+	var answeredAt, endedAt sql.NullTime
+	var duration sql.NullInt64
+	if err := row.Scan(
+		&session.SessionID, &session.CallerID, &session.CalleeID, &session.Status,
+		&session.CreatedAt, &answeredAt, &endedAt, &duration,
+	); err != nil {
+		return nil, err
+	}
+	if answeredAt.Valid {
+		session.AnsweredAt = &answeredAt.Time
+	}
+	if endedAt.Valid {
+		session.EndedAt = &endedAt.Time
+	}
+	if duration.Valid {
+		session.DurationSeconds = &duration.Int64
+	}
+	return &session, nil
+}
+
+// CallStats summarizes a user's call history. Only answered calls contribute
+// to the talk time; missed calls are unanswered calls the user received.
+type CallStats struct {
+	TotalCalls   int64   `json:"total_calls"`
+	Answered     int64   `json:"answered"`
+	Missed       int64   `json:"missed"`
+	TotalSeconds int64   `json:"total_seconds"`
+	TotalMinutes float64 `json:"total_minutes"`
+}
+
+func GetCallStats(userID int64) (*CallStats, error) {
+	var stats CallStats
+	err := DB.QueryRow(
+		`SELECT COUNT(*),
+		   COALESCE(SUM(answered_at IS NOT NULL), 0),
+		   COALESCE(SUM(callee_id = ? AND status = ? AND answered_at IS NULL), 0),
+		   COALESCE(SUM(CASE WHEN answered_at IS NOT NULL THEN duration_seconds END), 0)
+		 FROM call_sessions WHERE caller_id = ? OR callee_id = ?`,
+		userID, CallStatusEnded, userID, userID,
+	).Scan(&stats.TotalCalls, &stats.Answered, &stats.Missed, &stats.TotalSeconds)
+	if err != nil {
+		return nil, err
+	}
+	stats.TotalMinutes = float64(stats.TotalSeconds) / 60
+	return &stats, nil
+}
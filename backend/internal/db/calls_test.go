@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCallSessionLifecycleAndStats(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const sessionID = "call-session-lifecycle"
+	if created, err := CreateCallSession(sessionID, alice.ID, bob.ID); err != nil || !created {
+		t.Fatalf("create: created=%t err=%v", created, err)
+	}
+	if created, err := CreateCallSession(sessionID, bob.ID, alice.ID); err != nil || created {
+		t.Fatalf("duplicate session ID: created=%t err=%v", created, err)
+	}
+	if answered, err := AnswerCallSession(sessionID, alice.ID); err != nil || answered {
+		t.Fatalf("caller answered own call: answered=%t err=%v", answered, err)
+	}
+	if answered, err := AnswerCallSession(sessionID, bob.ID); err != nil || !answered {
+		t.Fatalf("answer: answered=%t err=%v", answered, err)
+	}
+
+	if session, err := EndCallSession(sessionID, 9999); err != nil || session != nil {
+		t.Fatalf("non-participant ended call: %+v, err=%v", session, err)
+	}
+	session, err := EndCallSession(sessionID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Status != CallStatusEnded || session.EndedAt == nil || session.DurationSeconds == nil {
+		t.Fatalf("ended session = %+v", session)
+	}
+	if session.OtherParty(bob.ID) != alice.ID {
+		t.Fatalf("other party of bob = %d, want %d", session.OtherParty(bob.ID), alice.ID)
+	}
+
+	if _, err := CreateCallSession("call-session-unanswered", alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	session, err = EndCallSession("call-session-unanswered", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.DurationSeconds != nil {
+		t.Fatalf("unanswered call has a duration: %+v", session)
+	}
+	if _, err := DB.Exec("UPDATE call_sessions SET duration_seconds = 90 WHERE session_id = ?", sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCallSession("call-session-ringing", alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userID int64
+		want   CallStats
+	}{
+		{userID: alice.ID, want: CallStats{TotalCalls: 3, Answered: 1, Missed: 0, TotalSeconds: 90, TotalMinutes: 1.5}},
+		{userID: bob.ID, want: CallStats{TotalCalls: 3, Answered: 1, Missed: 1, TotalSeconds: 90, TotalMinutes: 1.5}},
+	}
+	for _, test := range tests {
+		stats, err := GetCallStats(test.userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *stats != test.want {
+			t.Fatalf("stats for %d = %+v, want %+v", test.userID, *stats, test.want)
+		}
+	}
+}
+
+func TestInCallWithOtherIgnoresRenegotiationAndEndedCalls(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const carolID = 9999
+
+	if _, err := CreateCallSession("busy-call-session", alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if busy, err := InCallWithOther(bob.ID, carolID); err != nil || busy {
+		t.Fatalf("ringing call made bob busy: busy=%t err=%v", busy, err)
+	}
+	if _, err := AnswerCallSession("busy-call-session", bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		userID, caller int64
+		busy           bool
+	}{
+		{userID: bob.ID, caller: carolID, busy: true},
+		{userID: alice.ID, caller: carolID, busy: true},
+		{userID: bob.ID, caller: alice.ID, busy: false},
+	}
+	for _, test := range tests {
+		if busy, err := InCallWithOther(test.userID, test.caller); err != nil || busy != test.busy {
+			t.Fatalf("InCallWithOther(%d, %d) = %t, %v; want %t", test.userID, test.caller, busy, err, test.busy)
+		}
+	}
+
+	if ended, err := EndOpenCallSessions(bob.ID); err != nil || len(ended) != 1 || ended[0].OtherParty(bob.ID) != alice.ID {
+		t.Fatalf("EndOpenCallSessions() = %+v, %v; want the call with alice", ended, err)
+	}
+	if busy, err := InCallWithOther(alice.ID, carolID); err != nil || busy {
+		t.Fatalf("call still active after bob dropped: busy=%t err=%v", busy, err)
+	}
+	if stats, err := GetCallStats(bob.ID); err != nil || stats.Answered != 1 {
+		t.Fatalf("dropped call was not recorded as answered: %+v, err=%v", stats, err)
+	}
+}
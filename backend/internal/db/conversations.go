@@ -0,0 +1,290 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ConversationPrefs are one user's settings for a conversation with another
+// user. They only affect the owner's view and notifications.
+type ConversationPrefs struct {
+	OtherUserID  int64      `json:"other_user_id"`
+	Muted        bool       `json:"muted"`         // no push notifications
+	Archived     bool       `json:"archived"`      // hidden from the main list
+	ReadReceipts bool       `json:"read_receipts"` // tell the other user when messages are read
+	UpdatedAt    *time.Time `json:"updated_at"`
+}
+
+// ConversationPrefsUpdate changes the non-nil fields of ConversationPrefs.
+type ConversationPrefsUpdate struct {
+	Muted        *bool `json:"muted"`
+	Archived     *bool `json:"archived"`
+	ReadReceipts *bool `json:"read_receipts"`
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getConversationPrefs(q queryRower, userID, otherUserID int64) (ConversationPrefs, error) {
+	prefs := ConversationPrefs{OtherUserID: otherUserID, ReadReceipts: true}
+	var updatedAt time.Time
+	err := q.QueryRow(
+		`SELECT muted, archived, read_receipts, updated_at FROM conversation_prefs
+		 WHERE user_id = ? AND other_user_id = ?`,
+		userID, otherUserID,
+	).Scan(&prefs.Muted, &prefs.Archived, &prefs.ReadReceipts, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return prefs, nil
+	}
+	if err != nil {
+		return ConversationPrefs{}, err
+	}
+	prefs.UpdatedAt = &updatedAt
+	return prefs, nil
+}
+
+// GetConversationPrefs returns the user's settings for a conversation, or the
+// defaults when none were saved.
+func GetConversationPrefs(userID, otherUserID int64) (ConversationPrefs, error) {
+	return getConversationPrefs(DB, userID, otherUserID)
+}
+
+// UpdateConversationPrefs applies an update and returns the resulting settings.
+func UpdateConversationPrefs(userID, otherUserID int64, update ConversationPrefsUpdate) (ConversationPrefs, error) {
+	var prefs ConversationPrefs
+	err := WithTx(func(tx *sql.Tx) error {
+		current, err := getConversationPrefs(tx, userID, otherUserID)
+		if err != nil {
+			return err
+		}
+		if update.Muted != nil {
+			current.Muted = *update.Muted
+		}
+		if update.Archived != nil {
+			current.Archived = *update.Archived
+		}
+		if update.ReadReceipts != nil {
+			current.ReadReceipts = *update.ReadReceipts
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO conversation_prefs (user_id, other_user_id, muted, archived, read_receipts, updated_at)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(user_id, other_user_id) DO UPDATE SET
+				muted = excluded.muted,
+				archived = excluded.archived,
+				read_receipts = excluded.read_receipts,
+				updated_at = CURRENT_TIMESTAMP
+		`, userID, otherUserID, current.Muted, current.Archived, current.ReadReceipts); err != nil {
+			return err
+		}
+		prefs, err = getConversationPrefs(tx, userID, otherUserID)
+		return err
+	})
+	if err != nil {
+		return ConversationPrefs{}, err
+	}
+	return prefs, nil
+}
+
+// MaximumAppearanceSize caps the appearance settings stored per conversation.
+const MaximumAppearanceSize = 4096
+
+// GetConversationAppearance returns the opaque appearance settings, such as a
+// theme or wallpaper reference, that userID saved for a conversation.
+func GetConversationAppearance(userID, otherUserID int64) (string, error) {
+	var appearance string
+	err := DB.QueryRow(
+		"SELECT appearance FROM conversation_prefs WHERE user_id = ? AND other_user_id = ?",
+		userID, otherUserID,
+	).Scan(&appearance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return appearance, err
+}
+
+// SetConversationAppearance replaces the appearance settings of a
+// conversation without touching its other preferences.
+func SetConversationAppearance(userID, otherUserID int64, appearance string) error {
+	_, err := DB.Exec(`
+		INSERT INTO conversation_prefs (user_id, other_user_id, appearance, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id, other_user_id) DO UPDATE SET
+			appearance = excluded.appearance,
+			updated_at = CURRENT_TIMESTAMP
+	`, userID, otherUserID, appearance)
+	return err
+}
+
+// Conversation summarizes one of a user's conversations for list views.
+type Conversation struct {
+	OtherUserID   int64     `json:"other_user_id"`
+	Username      string    `json:"username"`
+	Nickname      string    `json:"nickname,omitempty"` // the requester's private name for the other user
+	LastMessageID int64     `json:"last_message_id"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	UnreadCount   int64     `json:"unread_count"`
+	Archived      bool      `json:"archived"`
+	Muted         bool      `json:"muted"`
+}
+
+// ConversationPreview extends a Conversation with everything a conversation
+// list shows, so that it renders from a single request. Online is left for
+// the caller to fill in from live presence.
+type ConversationPreview struct {
+	Conversation
+	PublicKey           []byte    `json:"public_key"`
+	KeyEpoch            int64     `json:"key_epoch"`
+	LastSeen            time.Time `json:"last_seen"`
+	Online              bool      `json:"online"`
+	LastMessageSenderID int64     `json:"last_message_sender_id"`
+	LastMessageType     string    `json:"last_message_type"`
+	LastMessageRead     bool      `json:"last_message_read"`
+	ReadReceipts        bool      `json:"read_receipts"`
+	Appearance          string    `json:"appearance,omitempty"`
+}
+
+// GetConversations lists everyone userID has exchanged visible messages with,
+// most recently active first. Archived conversations are left out unless
+// includeArchived is set, and a non-zero activeSince keeps only those whose
+// last visible message is newer.
+func GetConversations(userID int64, includeArchived bool, activeSince time.Time) ([]Conversation, error) {
+	previews, err := GetConversationPreviews(userID, includeArchived, activeSince)
+	if err != nil {
+		return nil, err
+	}
+	conversations := make([]Conversation, len(previews))
+	for index, preview := range previews {
+		conversations[index] = preview.Conversation
+	}
+	return conversations, nil
+}
+
+// GetConversationPreviews lists the same conversations as GetConversations
+// together with the other user's profile, the last message's metadata and
+// the requester's settings for each, in one query.
+func GetConversationPreviews(userID int64, includeArchived bool, activeSince time.Time) ([]ConversationPreview, error) {
+	// Partners with recent messages are found through the timestamp index
+	// first, so only their conversations are aggregated.
+	recent, active := "", ""
+	args := []interface{}{userID, userID, userID}
+	var since string
+	if !activeSince.IsZero() {
+		since = activeSince.UTC().Format("2006-01-02 15:04:05")
+		recent = `AND other_id IN (
+		     SELECT CASE WHEN sender_id = ? THEN receiver_id ELSE sender_id END FROM messages
+		     WHERE timestamp > ? AND (sender_id = ? OR receiver_id = ?)
+		   )`
+		active = "AND m.timestamp > ?"
+		args = append(args, userID, since, userID, userID)
+	}
+	args = append(args, userID, userID, includeArchived)
+	if since != "" {
+		args = append(args, since)
+	}
+	rows, err := DB.Query(
+		`SELECT c.other_id, u.username, COALESCE(n.nickname, ''), c.last_id, m.timestamp, c.unread,
+		   COALESCE(p.archived, FALSE), COALESCE(p.muted, FALSE),
+		   u.public_key, u.key_epoch, u.last_seen, m.sender_id, m.type, m.read,
+		   COALESCE(p.read_receipts, TRUE), COALESCE(p.appearance, '')
+		 FROM (
+		   SELECT other_id, MAX(id) AS last_id, SUM(unread) AS unread FROM (
+		     SELECT receiver_id AS other_id, id, 0 AS unread FROM messages WHERE sender_id = ?
+		     UNION ALL
+		     SELECT sender_id, id, read = FALSE AND NOT deleted FROM messages WHERE receiver_id = ?
+		   ) AS t
+		   WHERE id > COALESCE((
+		     SELECT through_id FROM conversation_clears WHERE user_id = ? AND other_user_id = t.other_id
+		   ), 0)
+		   `+recent+`
+		   GROUP BY other_id
+		 ) AS c
+		 JOIN users u ON u.id = c.other_id
+		 JOIN messages m ON m.id = c.last_id
+		 LEFT JOIN conversation_prefs p ON p.user_id = ? AND p.other_user_id = c.other_id
+		 LEFT JOIN contact_nicknames n ON n.user_id = ? AND n.contact_id = c.other_id
+		 WHERE (? OR COALESCE(p.archived, FALSE) = FALSE)
+		   `+active+`
+		 ORDER BY c.last_id DESC`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	previews := make([]ConversationPreview, 0)
+	for rows.Next() {
+		var p ConversationPreview
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&p.OtherUserID, &p.Username, &p.Nickname, &p.LastMessageID, &p.LastMessageAt, &p.UnreadCount, &p.Archived, &p.Muted,
+			&p.PublicKey, &p.KeyEpoch, &lastSeen, &p.LastMessageSenderID, &p.LastMessageType, &p.LastMessageRead,
+			&p.ReadReceipts, &p.Appearance); err != nil {
+			return nil, err
+		}
+		p.LastSeen = lastSeen.Time
+		previews = append(previews, p)
+	}
+	return previews, rows.Err()
+}
+
+// GetConversationVersion returns a counter that grows whenever a message
+// between the two users is added, changed or removed. Conversations without
+// messages are at version 0.
+func GetConversationVersion(userID, otherUserID int64) (int64, error) {
+	var version int64
+	err := DB.QueryRow(
+		"SELECT version FROM conversation_versions WHERE user_a = ? AND user_b = ?",
+		min(userID, otherUserID), max(userID, otherUserID),
+	).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+// ConversationActivity is the metadata of one conversation between two users,
+// for moderators. UserA is always the lower user ID.
+type ConversationActivity struct {
+	UserA         int64     `json:"user_a"`
+	UserB         int64     `json:"user_b"`
+	MessageCount  int64     `json:"message_count"`
+	LastMessageID int64     `json:"-"`
+	LastActivity  time.Time `json:"last_activity"`
+}
+
+// GetConversationActivity lists every conversation on the server, most
+// recently active first, without any message content. beforeID continues
+// from the conversation whose last message has that ID.
+func GetConversationActivity(limit int, beforeID int64) ([]ConversationActivity, error) {
+	rows, err := DB.Query(`
+		SELECT pairs.user_a, pairs.user_b, pairs.message_count, m.id, m.timestamp
+		FROM (
+			SELECT MIN(sender_id, receiver_id) AS user_a, MAX(sender_id, receiver_id) AS user_b,
+				COUNT(*) AS message_count, MAX(id) AS last_id
+			FROM messages
+			GROUP BY user_a, user_b
+			HAVING ? = 0 OR MAX(id) < ?
+		) pairs
+		JOIN messages m ON m.id = pairs.last_id
+		ORDER BY m.id DESC
+		LIMIT ?`,
+		beforeID, beforeID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := make([]ConversationActivity, 0)
+	for rows.Next() {
+		var conversation ConversationActivity
+		if err := rows.Scan(&conversation.UserA, &conversation.UserB, &conversation.MessageCount, &conversation.LastMessageID, &conversation.LastActivity); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
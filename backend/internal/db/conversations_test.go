@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetConversationsSkipsArchivedByDefault(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]*User, 0, 2)
+	for _, name := range []string{"bob", "carol"} {
+		code, err := GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol := users[0], users[1]
+
+	for _, message := range []struct {
+		from, to int64
+		clientID string
+	}{
+		{from: bob.ID, to: alice.ID, clientID: "conversation-list-1"},
+		{from: bob.ID, to: alice.ID, clientID: "conversation-list-2"},
+		{from: alice.ID, to: carol.ID, clientID: "conversation-list-3"},
+	} {
+		if _, _, err := SaveMessage(message.from, message.to, message.clientID, "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conversations, err := GetConversations(alice.ID, false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 2 || conversations[0].OtherUserID != carol.ID || conversations[1].UnreadCount != 2 || conversations[1].Username != "bob" {
+		t.Fatalf("conversations = %+v", conversations)
+	}
+
+	archived := true
+	if _, err := UpdateConversationPrefs(alice.ID, bob.ID, ConversationPrefsUpdate{Archived: &archived}); err != nil {
+		t.Fatal(err)
+	}
+	if conversations, err = GetConversations(alice.ID, false, time.Time{}); err != nil || len(conversations) != 1 || conversations[0].OtherUserID != carol.ID {
+		t.Fatalf("archived conversation still listed: %+v, err = %v", conversations, err)
+	}
+	if conversations, err = GetConversations(alice.ID, true, time.Time{}); err != nil || len(conversations) != 2 || !conversations[1].Archived {
+		t.Fatalf("include archived: %+v, err = %v", conversations, err)
+	}
+	if conversations, err = GetConversations(bob.ID, false, time.Time{}); err != nil || len(conversations) != 1 || conversations[0].UnreadCount != 0 {
+		t.Fatalf("archiving changed bob's view: %+v, err = %v", conversations, err)
+	}
+}
+
+func TestConversationVersionGrowsOnEveryMutation(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := int64(-1)
+	expectBump := func(step string) {
+		t.Helper()
+		version, err := GetConversationVersion(bob.ID, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version <= last {
+			t.Fatalf("%s: version = %d, want more than %d", step, version, last)
+		}
+		if mirrored, err := GetConversationVersion(alice.ID, bob.ID); err != nil || mirrored != version {
+			t.Fatalf("%s: versions differ by direction: %d vs %d (%v)", step, version, mirrored, err)
+		}
+		last = version
+	}
+
+	expectBump("empty conversation")
+	message, _, err := SaveMessage(alice.ID, bob.ID, "conversation-version-1", "text", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBump("new message")
+	if _, _, err := MarkMessagesAsReadRange(alice.ID, bob.ID, message.ID, message.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectBump("read")
+	if _, err := DeleteSentMessages(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectBump("delete")
+}
@@ -16,25 +16,32 @@ type User struct {
 	PasswordHash string    `json:"-"` // never expose in JSON
 	PublicKey    []byte    `json:"public_key"`
 	AuthVersion  int64     `json:"-"`
+	IsAdmin      bool      `json:"is_admin"`
+	KeyEpoch     int64     `json:"key_epoch"` // incremented on every public key change
 	CreatedAt    time.Time `json:"created_at"`
 	LastSeen     time.Time `json:"last_seen"`
 }
 
 type Message struct {
-	ID         int64     `json:"id"`
-	SenderID   int64     `json:"sender_id"`
-	ReceiverID int64     `json:"receiver_id"`
-	Type       string    `json:"type"`    // text, file, call
-	Content    []byte    `json:"content"` // encrypted content
-	Nonce      []byte    `json:"nonce"`
-	ClientID   string    `json:"client_id,omitempty"`
-	Timestamp  time.Time `json:"timestamp"`
-	Read       bool      `json:"read"`
+	ID         int64      `json:"id"`
+	SenderID   int64      `json:"sender_id"`
+	ReceiverID int64      `json:"receiver_id"`
+	Type       string     `json:"type"`    // text, file, call
+	Content    []byte     `json:"content"` // encrypted content
+	Nonce      []byte     `json:"nonce"`
+	ClientID   string     `json:"client_id,omitempty"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Read       bool       `json:"read"`
+	KeyEpoch   *int64     `json:"key_epoch,omitempty"` // recipient key epoch the content was encrypted to
+	KeyStale   bool       `json:"key_stale,omitempty"` // recipient has rotated keys since
+	EditedAt   *time.Time `json:"edited_at,omitempty"`
+	IsDeleted  bool       `json:"is_deleted,omitempty"` // deleted by the sender; content is empty
 }
 
 type Invite struct {
 	ID        int64      `json:"id"`
 	Code      string     `json:"code"`
+	CreatedBy *int64     `json:"created_by"`
 	UsedBy    *int64     `json:"used_by"`
 	CreatedAt time.Time  `json:"created_at"`
 	UsedAt    *time.Time `json:"used_at"`
@@ -156,6 +163,353 @@ var migrations = []migration{
 			)
 		`},
 	},
+	{
+		version: 6,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN stored_bytes INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE users SET stored_bytes = COALESCE((SELECT SUM(LENGTH(content)) FROM messages WHERE sender_id = users.id), 0)`,
+			`CREATE TRIGGER messages_stored_bytes_insert AFTER INSERT ON messages BEGIN
+				UPDATE users SET stored_bytes = stored_bytes + LENGTH(NEW.content) WHERE id = NEW.sender_id;
+			END`,
+			`CREATE TRIGGER messages_stored_bytes_delete AFTER DELETE ON messages BEGIN
+				UPDATE users SET stored_bytes = stored_bytes - LENGTH(OLD.content) WHERE id = OLD.sender_id;
+			END`,
+			`CREATE TRIGGER messages_stored_bytes_update AFTER UPDATE OF content ON messages BEGIN
+				UPDATE users SET stored_bytes = stored_bytes - LENGTH(OLD.content) + LENGTH(NEW.content) WHERE id = NEW.sender_id;
+			END`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN delivered_at DATETIME`,
+			`ALTER TABLE messages ADD COLUMN read_at DATETIME`,
+		},
+	},
+	{
+		version: 8,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE`,
+			`UPDATE users SET is_admin = TRUE WHERE id = (SELECT MIN(id) FROM users)`,
+			`ALTER TABLE invites ADD COLUMN created_by INTEGER REFERENCES users(id)`,
+			`CREATE INDEX idx_invites_used_by ON invites(used_by)`,
+		},
+	},
+	{
+		version: 9,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN do_not_disturb BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 10,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN key_epoch INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE messages ADD COLUMN key_epoch INTEGER`,
+		},
+	},
+	{
+		version: 11,
+		statements: []string{`
+			CREATE TABLE notification_state (
+				user_id INTEGER PRIMARY KEY,
+				acked_through INTEGER NOT NULL DEFAULT 0,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)
+		`},
+	},
+	{
+		version: 12,
+		statements: []string{
+			`ALTER TABLE call_sessions ADD COLUMN answered_at DATETIME`,
+			`ALTER TABLE call_sessions ADD COLUMN duration_seconds INTEGER`,
+			`CREATE INDEX idx_call_sessions_caller ON call_sessions(caller_id)`,
+			`CREATE INDEX idx_call_sessions_callee ON call_sessions(callee_id)`,
+		},
+	},
+	{
+		version: 13,
+		statements: []string{`
+			CREATE TABLE device_tokens (
+				token TEXT PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				platform TEXT NOT NULL,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_device_tokens_user ON device_tokens(user_id, updated_at)`,
+		},
+	},
+	{
+		version: 14,
+		statements: []string{`
+			CREATE TABLE hidden_messages (
+				user_id INTEGER NOT NULL,
+				message_id INTEGER NOT NULL,
+				PRIMARY KEY (user_id, message_id),
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+			)`,
+		},
+	},
+	{
+		version: 15,
+		statements: []string{`
+			CREATE TABLE conversation_prefs (
+				user_id INTEGER NOT NULL,
+				other_user_id INTEGER NOT NULL,
+				muted BOOLEAN NOT NULL DEFAULT FALSE,
+				archived BOOLEAN NOT NULL DEFAULT FALSE,
+				read_receipts BOOLEAN NOT NULL DEFAULT TRUE,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, other_user_id),
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (other_user_id) REFERENCES users(id)
+			)`,
+		},
+	},
+	{
+		// Every insert, update or delete of a message bumps its
+		// conversation's version; user_a is the smaller user ID.
+		version: 16,
+		statements: []string{
+			`CREATE TABLE conversation_versions (
+				user_a INTEGER NOT NULL,
+				user_b INTEGER NOT NULL,
+				version INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_a, user_b)
+			)`,
+			`INSERT INTO conversation_versions (user_a, user_b, version)
+			 SELECT MIN(sender_id, receiver_id), MAX(sender_id, receiver_id), 1
+			 FROM messages GROUP BY 1, 2`,
+			`CREATE TRIGGER messages_version_insert AFTER INSERT ON messages BEGIN
+				INSERT INTO conversation_versions (user_a, user_b, version)
+				VALUES (MIN(NEW.sender_id, NEW.receiver_id), MAX(NEW.sender_id, NEW.receiver_id), 1)
+				ON CONFLICT(user_a, user_b) DO UPDATE SET version = version + 1;
+			END`,
+			`CREATE TRIGGER messages_version_update AFTER UPDATE ON messages BEGIN
+				INSERT INTO conversation_versions (user_a, user_b, version)
+				VALUES (MIN(NEW.sender_id, NEW.receiver_id), MAX(NEW.sender_id, NEW.receiver_id), 1)
+				ON CONFLICT(user_a, user_b) DO UPDATE SET version = version + 1;
+			END`,
+			`CREATE TRIGGER messages_version_delete AFTER DELETE ON messages BEGIN
+				INSERT INTO conversation_versions (user_a, user_b, version)
+				VALUES (MIN(OLD.sender_id, OLD.receiver_id), MAX(OLD.sender_id, OLD.receiver_id), 1)
+				ON CONFLICT(user_a, user_b) DO UPDATE SET version = version + 1;
+			END`,
+		},
+	},
+	{
+		version: 17,
+		statements: []string{`
+			CREATE TABLE contact_nicknames (
+				user_id INTEGER NOT NULL,
+				contact_id INTEGER NOT NULL,
+				nickname TEXT NOT NULL,
+				updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, contact_id),
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (contact_id) REFERENCES users(id)
+			)`,
+		},
+	},
+	{
+		version: 18,
+		statements: []string{
+			`ALTER TABLE conversation_prefs ADD COLUMN appearance TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 19,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN key_updated_at DATETIME`,
+		},
+	},
+	{
+		version: 20,
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN escrow_envelope BLOB`,
+		},
+	},
+	{
+		version: 21,
+		statements: []string{
+			`ALTER TABLE invites ADD COLUMN bootstrap BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 22,
+		statements: []string{`
+			CREATE TABLE refresh_tokens (
+				token_hash TEXT PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				auth_version INTEGER NOT NULL,
+				expires_at DATETIME NOT NULL,
+				revoked_at DATETIME,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_refresh_tokens_user ON refresh_tokens(user_id)`,
+		},
+	},
+	{
+		version: 23,
+		statements: []string{`
+			CREATE TABLE revoked_tokens (
+				jti TEXT PRIMARY KEY,
+				expires_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX idx_revoked_tokens_expiry ON revoked_tokens(expires_at)`,
+		},
+	},
+	{
+		version: 24,
+		statements: []string{`
+			CREATE TABLE rooms (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				creator_id INTEGER NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (creator_id) REFERENCES users(id)
+			)`, `
+			CREATE TABLE room_members (
+				room_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				joined_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (room_id, user_id),
+				FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_room_members_user ON room_members(user_id)`, `
+			CREATE TABLE room_messages (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				room_id INTEGER NOT NULL,
+				sender_id INTEGER NOT NULL,
+				client_id TEXT NOT NULL,
+				type TEXT NOT NULL,
+				escrow_envelope BLOB,
+				timestamp DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+				FOREIGN KEY (sender_id) REFERENCES users(id)
+			)`,
+			`CREATE UNIQUE INDEX idx_room_messages_sender_client_id ON room_messages(sender_id, client_id)`,
+			`CREATE INDEX idx_room_messages_room ON room_messages(room_id, id DESC)`, `
+			CREATE TABLE room_message_copies (
+				message_id INTEGER NOT NULL,
+				recipient_id INTEGER NOT NULL,
+				content BLOB NOT NULL,
+				nonce BLOB NOT NULL,
+				key_epoch INTEGER NOT NULL,
+				PRIMARY KEY (message_id, recipient_id),
+				FOREIGN KEY (message_id) REFERENCES room_messages(id) ON DELETE CASCADE,
+				FOREIGN KEY (recipient_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_room_message_copies_recipient ON room_message_copies(recipient_id, message_id)`,
+			// Every copy counts against the sender's storage quota.
+			`CREATE TRIGGER room_message_copies_stored_bytes_insert AFTER INSERT ON room_message_copies BEGIN
+				UPDATE users SET stored_bytes = stored_bytes + LENGTH(NEW.content)
+				WHERE id = (SELECT sender_id FROM room_messages WHERE id = NEW.message_id);
+			END`,
+			`CREATE TRIGGER room_messages_stored_bytes_delete BEFORE DELETE ON room_messages BEGIN
+				UPDATE users SET stored_bytes = stored_bytes - COALESCE((SELECT SUM(LENGTH(content)) FROM room_message_copies WHERE message_id = OLD.id), 0)
+				WHERE id = OLD.sender_id;
+			END`,
+		},
+	},
+	{
+		version: 25,
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN edited_at DATETIME`, `
+			CREATE TABLE message_edits (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				message_id INTEGER NOT NULL,
+				content BLOB NOT NULL,
+				nonce BLOB NOT NULL,
+				key_epoch INTEGER,
+				edited_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX idx_message_edits_message ON message_edits(message_id, id)`,
+		},
+	},
+	{
+		version: 26,
+		statements: []string{
+			`ALTER TABLE messages ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		version: 27,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN notification_preview TEXT NOT NULL DEFAULT 'none'`,
+		},
+	},
+	{
+		// Bootstrap invites left over on servers that are already set up.
+		version: 28,
+		statements: []string{
+			`DELETE FROM invites WHERE bootstrap AND used_by IS NULL AND EXISTS (SELECT 1 FROM users)`,
+		},
+	},
+	{
+		// System messages are server-authored and not charged to the sender.
+		version: 29,
+		statements: []string{
+			`DROP TRIGGER messages_stored_bytes_insert`,
+			`DROP TRIGGER messages_stored_bytes_delete`,
+			`DROP TRIGGER messages_stored_bytes_update`,
+			`CREATE TRIGGER messages_stored_bytes_insert AFTER INSERT ON messages WHEN NEW.type != 'system' BEGIN
+				UPDATE users SET stored_bytes = stored_bytes + LENGTH(NEW.content) WHERE id = NEW.sender_id;
+			END`,
+			`CREATE TRIGGER messages_stored_bytes_delete AFTER DELETE ON messages WHEN OLD.type != 'system' BEGIN
+				UPDATE users SET stored_bytes = stored_bytes - LENGTH(OLD.content) WHERE id = OLD.sender_id;
+			END`,
+			`CREATE TRIGGER messages_stored_bytes_update AFTER UPDATE OF content ON messages WHEN NEW.type != 'system' BEGIN
+				UPDATE users SET stored_bytes = stored_bytes - LENGTH(OLD.content) + LENGTH(NEW.content) WHERE id = NEW.sender_id;
+			END`,
+			`UPDATE users SET stored_bytes = stored_bytes - COALESCE((
+				SELECT SUM(LENGTH(content)) FROM messages WHERE sender_id = users.id AND type = 'system'
+			), 0)`,
+		},
+	},
+	{
+		// Replaced versions count against the sender's storage quota. The
+		// sender is kept on each version so that the delete trigger still
+		// finds it when the message is already gone.
+		version: 30,
+		statements: []string{
+			`ALTER TABLE message_edits ADD COLUMN sender_id INTEGER`,
+			`ALTER TABLE message_edits ADD COLUMN escrow_envelope BLOB`,
+			`UPDATE message_edits SET sender_id = (SELECT sender_id FROM messages WHERE messages.id = message_edits.message_id)`,
+			`UPDATE users SET stored_bytes = stored_bytes + COALESCE((
+				SELECT SUM(LENGTH(content)) FROM message_edits WHERE sender_id = users.id
+			), 0)`,
+			`CREATE TRIGGER message_edits_stored_bytes_insert AFTER INSERT ON message_edits BEGIN
+				UPDATE users SET stored_bytes = stored_bytes + LENGTH(NEW.content) WHERE id = NEW.sender_id;
+			END`,
+			`CREATE TRIGGER message_edits_stored_bytes_delete AFTER DELETE ON message_edits BEGIN
+				UPDATE users SET stored_bytes = stored_bytes - LENGTH(OLD.content) WHERE id = OLD.sender_id;
+			END`,
+		},
+	},
+	{
+		// Users join a room by accepting an invitation.
+		version: 31,
+		statements: []string{`
+			CREATE TABLE room_invites (
+				room_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				invited_by INTEGER NOT NULL,
+				created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (room_id, user_id),
+				FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (invited_by) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_room_invites_user ON room_invites(user_id)`,
+		},
+	},
 }
 
 func migrate(db *sql.DB) error {
@@ -0,0 +1,61 @@
+package db
+
+import "database/sql"
+
+// MaximumDeviceTokens bounds how many devices a user can register for push;
+// registering another replaces the least recently refreshed one.
+const MaximumDeviceTokens = 10
+
+type DeviceToken struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+// SaveDeviceToken registers a push token for a user. A token moves to the
+// latest user that registers it, since a device has one signed-in account.
+func SaveDeviceToken(userID int64, token, platform string) error {
+	return WithTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			INSERT INTO device_tokens (token, user_id, platform, updated_at)
+			VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(token) DO UPDATE SET
+				user_id = excluded.user_id,
+				platform = excluded.platform,
+				updated_at = CURRENT_TIMESTAMP
+		`, token, userID, platform); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			DELETE FROM device_tokens
+			WHERE user_id = ? AND token NOT IN (
+				SELECT token FROM device_tokens WHERE user_id = ? ORDER BY updated_at DESC, rowid DESC LIMIT ?
+			)
+		`, userID, userID, MaximumDeviceTokens)
+		return err
+	})
+}
+
+// DeleteDeviceToken unregisters one of the user's push tokens.
+func DeleteDeviceToken(userID int64, token string) error {
+	_, err := DB.Exec("DELETE FROM device_tokens WHERE user_id = ? AND token = ?", userID, token)
+	return err
+}
+
+// GetDeviceTokens returns the user's registered push tokens.
+func GetDeviceTokens(userID int64) ([]DeviceToken, error) {
+	rows, err := DB.Query("SELECT token, platform FROM device_tokens WHERE user_id = ? ORDER BY updated_at DESC, rowid DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]DeviceToken, 0)
+	for rows.Next() {
+		var device DeviceToken
+		if err := rows.Scan(&device.Token, &device.Platform); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestDeviceTokensMoveBetweenUsersAndAreCapped(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveDeviceToken(alice.ID, "shared-device", "ios"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveDeviceToken(bob.ID, "shared-device", "ios"); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err := GetDeviceTokens(alice.ID); err != nil || len(devices) != 0 {
+		t.Fatalf("alice devices = %+v, err = %v; want none", devices, err)
+	}
+
+	for index := range MaximumDeviceTokens + 2 {
+		if err := SaveDeviceToken(alice.ID, fmt.Sprintf("device-%02d", index), "android"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices, err := GetDeviceTokens(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != MaximumDeviceTokens || devices[0].Token != fmt.Sprintf("device-%02d", MaximumDeviceTokens+1) {
+		t.Fatalf("devices = %+v; want the %d newest", devices, MaximumDeviceTokens)
+	}
+
+	if err := DeleteDeviceToken(alice.ID, "shared-device"); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err := GetDeviceTokens(bob.ID); err != nil || len(devices) != 1 {
+		t.Fatalf("another user's token was removed: %+v, err = %v", devices, err)
+	}
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMessageEditWindow = 24 * time.Hour
+
+	// maximumMessageEdits bounds the history kept per message.
+	maximumMessageEdits = 20
+)
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender can change a message")
+	ErrEditWindowClosed = errors.New("message can no longer be edited")
+)
+
+var messageEditWindow = struct {
+	sync.RWMutex
+	window time.Duration
+}{window: defaultMessageEditWindow}
+
+// MessageEdit is a version of a message and when an edit replaced it.
+type MessageEdit struct {
+	ID       int64     `json:"id"`
+	Content  []byte    `json:"content"`
+	Nonce    []byte    `json:"nonce"`
+	KeyEpoch *int64    `json:"key_epoch,omitempty"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// ConfigureMessageEditWindow sets how long after sending a message its sender
+// can edit it. An empty value keeps the default of 24 hours; 0 disables
+// editing.
+func ConfigureMessageEditWindow(value string) error {
+	window := defaultMessageEditWindow
+	if value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("MESSAGE_EDIT_WINDOW must be a non-negative duration")
+		}
+		window = parsed
+	}
+	messageEditWindow.Lock()
+	messageEditWindow.window = window
+	messageEditWindow.Unlock()
+	return nil
+}
+
+// MessageEditWindow returns how long after sending a message can be edited.
+func MessageEditWindow() time.Duration {
+	messageEditWindow.RLock()
+	defer messageEditWindow.RUnlock()
+	return messageEditWindow.window
+}
+
+// EditMessage replaces the content of a text message senderID sent within the
+// edit window, re-encrypted to the recipient's current key epoch, and keeps
+// the replaced version and its escrow envelope in message_edits. The escrow
+// envelope is replaced with escrow, the new content's copy in compliance mode
+// and nil otherwise. Replaced versions count against the sender's storage
+// quota, so an edit is charged the size of the new content. A message can be
+// edited at most maximumMessageEdits times. Deleted messages cannot be
+// edited.
+func EditMessage(messageID, senderID int64, content, nonce, escrow []byte) (*Message, error) {
+	window := MessageEditWindow()
+	now := time.Now().UTC()
+	err := WithTx(func(tx *sql.Tx) error {
+		msgType, sentAt, err := ownMessage(tx, messageID, senderID)
+		if err != nil {
+			return err
+		}
+		if msgType != "text" || now.Sub(sentAt) > window {
+			return ErrEditWindowClosed
+		}
+		var edits int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM message_edits WHERE message_id = ?", messageID).Scan(&edits); err != nil {
+			return err
+		}
+		if edits >= maximumMessageEdits {
+			return ErrEditWindowClosed
+		}
+		if limit, policy := currentStorageQuota(); limit > 0 {
+			if err := enforceStorageQuota(tx, senderID, int64(len(content)), limit, policy); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(
+			`INSERT INTO message_edits (message_id, sender_id, content, nonce, key_epoch, escrow_envelope, edited_at)
+			 SELECT id, sender_id, content, nonce, key_epoch, escrow_envelope, ? FROM messages WHERE id = ?`,
+			now, messageID,
+		); err != nil {
+			return err
+		}
+		result, err := tx.Exec(
+			`UPDATE messages SET content = ?, nonce = ?, escrow_envelope = ?, edited_at = ?,
+			   key_epoch = (SELECT key_epoch FROM users WHERE users.id = messages.receiver_id)
+			 WHERE id = ?`,
+			content, nonce, escrow, now, messageID,
+		)
+		if err != nil {
+			return err
+		}
+		// Evicting for the quota may have taken the edited message itself.
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			if err == nil {
+				err = ErrStorageQuotaExceeded
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetMessageByID(messageID)
+}
+
+// ownMessage returns the type and send time of a message that senderID sent
+// and has not deleted. Messages the caller cannot see fail with
+// ErrMessageNotFound, and messages they received with ErrNotMessageSender.
+func ownMessage(tx *sql.Tx, messageID, senderID int64) (string, time.Time, error) {
+	var (
+		sender, receiver int64
+		msgType          string
+		sentAt           time.Time
+		deleted          bool
+	)
+	err := tx.QueryRow(
+		"SELECT sender_id, receiver_id, type, timestamp, deleted FROM messages WHERE id = ?", messageID,
+	).Scan(&sender, &receiver, &msgType, &sentAt, &deleted)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && deleted) {
+		return "", time.Time{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if sender != senderID {
+		if receiver == senderID {
+			return "", time.Time{}, ErrNotMessageSender
+		}
+		return "", time.Time{}, ErrMessageNotFound
+	}
+	return msgType, sentAt, nil
+}
+
+// GetMessageEdits returns the versions of a message that edits replaced,
+// oldest first.
+func GetMessageEdits(messageID int64) ([]MessageEdit, error) {
+	rows, err := DB.Query(
+		"SELECT id, content, nonce, key_epoch, edited_at FROM message_edits WHERE message_id = ? ORDER BY id",
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := make([]MessageEdit, 0)
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.ID, &edit.Content, &edit.Nonce, &edit.KeyEpoch, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
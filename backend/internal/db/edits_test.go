@@ -0,0 +1,146 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEditMessageKeepsHistoryAndChecksOwnership(t *testing.T) {
+	initTestDB(t)
+	t.Cleanup(func() { _ = ConfigureMessageEditWindow("") })
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]*User, 0, 2)
+	for _, name := range []string{"bob", "carol"} {
+		code, err := GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol := users[0], users[1]
+	message, _, err := SaveMessage(alice.ID, bob.ID, "edit-message-0001", "text", []byte("first"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := EditMessage(message.ID, bob.ID, []byte("hijacked"), make([]byte, 12), nil); !errors.Is(err, ErrNotMessageSender) {
+		t.Fatalf("recipient edit error = %v", err)
+	}
+	if _, err := EditMessage(message.ID, carol.ID, []byte("hijacked"), make([]byte, 12), nil); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("outsider edit error = %v", err)
+	}
+	if _, err := EditMessage(message.ID+100, alice.ID, []byte("missing"), make([]byte, 12), nil); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("missing message error = %v", err)
+	}
+
+	for _, content := range []string{"second", "third"} {
+		edited, err := EditMessage(message.ID, alice.ID, []byte(content), bytes.Repeat([]byte{1}, 12), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(edited.Content, []byte(content)) || edited.EditedAt == nil {
+			t.Fatalf("edited message = %+v", edited)
+		}
+	}
+	edits, err := GetMessageEdits(message.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 2 || !bytes.Equal(edits[0].Content, []byte("first")) || !bytes.Equal(edits[0].Nonce, make([]byte, 12)) ||
+		!bytes.Equal(edits[1].Content, []byte("second")) || edits[1].EditedAt.Before(edits[0].EditedAt) {
+		t.Fatalf("edit history = %+v", edits)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != int64(len("first"+"second"+"third")) {
+		t.Fatalf("stored bytes after edits = %d, %v", used, err)
+	}
+
+	if _, err := DB.Exec("UPDATE messages SET timestamp = ? WHERE id = ?", time.Now().Add(-2*time.Hour).UTC(), message.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureMessageEditWindow("1h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EditMessage(message.ID, alice.ID, []byte("too late"), make([]byte, 12), nil); !errors.Is(err, ErrEditWindowClosed) {
+		t.Fatalf("edit after the window error = %v", err)
+	}
+	if err := ConfigureMessageEditWindow("-1h"); err == nil {
+		t.Fatal("negative window was accepted")
+	}
+}
+
+func TestDeleteMessageLeavesTombstone(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]*User, 0, 2)
+	for _, name := range []string{"bob", "carol"} {
+		code, err := GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol := users[0], users[1]
+	message, _, err := SaveMessage(alice.ID, bob.ID, "delete-message-0001", "text", []byte("first"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EditMessage(message.ID, alice.ID, []byte("second"), make([]byte, 12), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DeleteMessage(message.ID, bob.ID); !errors.Is(err, ErrNotMessageSender) {
+		t.Fatalf("recipient delete error = %v", err)
+	}
+	if _, err := DeleteMessage(message.ID, carol.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("outsider delete error = %v", err)
+	}
+	deleted, err := DeleteMessage(message.ID, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.IsDeleted || len(deleted.Content) != 0 || len(deleted.Nonce) != 0 {
+		t.Fatalf("deleted message = %+v", deleted)
+	}
+	if _, err := DeleteMessage(message.ID, alice.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("second delete error = %v", err)
+	}
+	if _, err := EditMessage(message.ID, alice.ID, []byte("revived"), make([]byte, 12), nil); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("edit after delete error = %v", err)
+	}
+
+	history, err := GetMessagesBetween(alice.ID, bob.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !history[0].IsDeleted || len(history[0].Content) != 0 {
+		t.Fatalf("history after delete = %+v", history)
+	}
+	if edits, err := GetMessageEdits(message.ID); err != nil || len(edits) != 0 {
+		t.Fatalf("edits after delete = %+v, %v", edits, err)
+	}
+	if unread, err := CountUnreadMessages(bob.ID); err != nil || unread != 0 {
+		t.Fatalf("unread after delete = %d, %v", unread, err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 0 {
+		t.Fatalf("stored bytes after delete = %d, %v", used, err)
+	}
+}
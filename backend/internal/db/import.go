@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ErrNotBootstrapped rejects an import into a server without its first
+// account, which would otherwise leave the server without an admin.
+var ErrNotBootstrapped = errors.New("create the first account through the application before importing users")
+
+// ImportedUser is an account for ImportUsers to create.
+type ImportedUser struct {
+	Username     string
+	PasswordHash string
+	PublicKey    []byte
+}
+
+// ImportUsers creates users in a single transaction and returns the usernames
+// it skipped because they were already taken. Imported users are never
+// admins and need no invite. Any other failure creates no user at all.
+func ImportUsers(ctx context.Context, users []ImportedUser) ([]string, error) {
+	skipped := make([]string, 0)
+	err := WithTxContext(ctx, func(tx *sql.Tx) error {
+		var userCount int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
+			return err
+		}
+		if userCount == 0 {
+			return ErrNotBootstrapped
+		}
+		for _, user := range users {
+			result, err := tx.ExecContext(ctx,
+				"INSERT INTO users (username, password_hash, public_key) VALUES (?, ?, ?) ON CONFLICT(username) DO NOTHING",
+				user.Username, user.PasswordHash, user.PublicKey,
+			)
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rows == 0 {
+				skipped = append(skipped, user.Username)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
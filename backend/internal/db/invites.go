@@ -7,23 +7,60 @@ import (
 	"time"
 )
 
-func GenerateInviteCode() (string, error) {
-	bytes := make([]byte, 16)
-	if _, err := rand.Read(bytes); err != nil {
+// GenerateInviteCode creates an invite attributed to createdBy, or to no one
+// when createdBy is zero.
+func GenerateInviteCode(createdBy int64) (string, error) {
+	code, err := newInviteCode()
+	if err != nil {
 		return "", err
 	}
-	code := hex.EncodeToString(bytes)
 
-	_, err := DB.Exec("INSERT INTO invites (code) VALUES (?)", code)
+	var creator sql.NullInt64
+	if createdBy > 0 {
+		creator = sql.NullInt64{Int64: createdBy, Valid: true}
+	}
+	_, err = DB.Exec("INSERT INTO invites (code, created_by) VALUES (?, ?)", code, creator)
 	if err != nil {
 		return "", err
 	}
 	return code, nil
 }
 
+// CreateBootstrapInvite creates a single-use invite that registers the first
+// account in place of the bootstrap secret. Once any user or invite exists it
+// creates nothing and returns an empty code, so a database gets at most one.
+func CreateBootstrapInvite() (string, error) {
+	code, err := newInviteCode()
+	if err != nil {
+		return "", err
+	}
+	var created bool
+	err = WithTx(func(tx *sql.Tx) error {
+		var initialized bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users) OR EXISTS (SELECT 1 FROM invites)").Scan(&initialized); err != nil || initialized {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO invites (code, bootstrap) VALUES (?, TRUE)", code)
+		created = err == nil
+		return err
+	})
+	if err != nil || !created {
+		return "", err
+	}
+	return code, nil
+}
+
+func newInviteCode() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
 func ValidateAndUseInvite(code string, userID int64) error {
 	result, err := DB.Exec(
-		"UPDATE invites SET used_by = ?, used_at = ? WHERE code = ? AND used_by IS NULL",
+		"UPDATE invites SET used_by = ?, used_at = ? WHERE code = ? AND used_by IS NULL AND NOT bootstrap",
 		userID, time.Now(), code,
 	)
 	if err != nil {
@@ -56,3 +93,126 @@ func GetInviteStats() (total, used int, err error) {
 	err = DB.QueryRow("SELECT COUNT(*) FROM invites WHERE used_by IS NOT NULL").Scan(&used)
 	return
 }
+
+// Referral records who brought a user in through an invite.
+type Referral struct {
+	UserID            int64     `json:"user_id"`
+	Username          string    `json:"username"`
+	JoinedAt          time.Time `json:"joined_at"`
+	InvitedByID       *int64    `json:"invited_by_id"`
+	InvitedByUsername *string   `json:"invited_by_username"`
+}
+
+// GetReferrals lists every user with the creator of the invite they redeemed.
+// Users who joined without an attributed invite have no referrer.
+func GetReferrals() ([]Referral, error) {
+	rows, err := DB.Query(`
+		SELECT u.id, u.username, u.created_at, creator.id, creator.username
+		FROM users u
+		LEFT JOIN invites i ON i.used_by = u.id
+		LEFT JOIN users creator ON creator.id = i.created_by
+		ORDER BY u.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrals := make([]Referral, 0)
+	for rows.Next() {
+		var referral Referral
+		var invitedByID sql.NullInt64
+		var invitedByUsername sql.NullString
+		if err := rows.Scan(&referral.UserID, &referral.Username, &referral.JoinedAt, &invitedByID, &invitedByUsername); err != nil {
+			return nil, err
+		}
+		if invitedByID.Valid {
+			referral.InvitedByID = &invitedByID.Int64
+			referral.InvitedByUsername = &invitedByUsername.String
+		}
+		referrals = append(referrals, referral)
+	}
+	return referrals, rows.Err()
+}
+
+// Provenance is how a user joined: the invite they redeemed and who created
+// it.
+type Provenance struct {
+	InviteCode        string    `json:"invite_code"`
+	UsedAt            time.Time `json:"used_at"`
+	InvitedByID       *int64    `json:"invited_by_id"`
+	InvitedByUsername *string   `json:"invited_by_username"`
+}
+
+// GetProvenance returns the invite userID registered with, or nil when they
+// joined without one. The bootstrap invite counts as none, since nobody
+// referred the first account. The referrer is nil for unattributed invites.
+func GetProvenance(userID int64) (*Provenance, error) {
+	var provenance Provenance
+	var invitedByID sql.NullInt64
+	var invitedByUsername sql.NullString
+	err := DB.QueryRow(`
+		SELECT i.code, i.used_at, creator.id, creator.username
+		FROM invites i
+		LEFT JOIN users creator ON creator.id = i.created_by
+		WHERE i.used_by = ? AND NOT i.bootstrap
+	`, userID).Scan(&provenance.InviteCode, &provenance.UsedAt, &invitedByID, &invitedByUsername)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if invitedByID.Valid {
+		provenance.InvitedByID = &invitedByID.Int64
+		provenance.InvitedByUsername = &invitedByUsername.String
+	}
+	return &provenance, nil
+}
+
+// InviteUse is one registration made with an invite.
+type InviteUse struct {
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	UsedAt   time.Time `json:"used_at"`
+}
+
+// InviteUsage lists who registered with an invite code.
+type InviteUsage struct {
+	Code      string      `json:"code"`
+	CreatedBy *int64      `json:"created_by"`
+	CreatedAt time.Time   `json:"created_at"`
+	Uses      []InviteUse `json:"uses"`
+}
+
+// GetInviteUsage returns the users an invite brought in, or nil when the code
+// does not exist. Invites are single-use, so Uses holds at most one entry.
+func GetInviteUsage(code string) (*InviteUsage, error) {
+	usage := InviteUsage{Code: code, Uses: make([]InviteUse, 0, 1)}
+	var createdBy, usedBy sql.NullInt64
+	var username sql.NullString
+	var usedAt sql.NullTime
+	err := DB.QueryRow(`
+		SELECT i.created_by, i.created_at, i.used_by, u.username, i.used_at
+		FROM invites i
+		LEFT JOIN users u ON u.id = i.used_by
+		WHERE i.code = ?
+	`, code).Scan(&createdBy, &usage.CreatedAt, &usedBy, &username, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if createdBy.Valid {
+		usage.CreatedBy = &createdBy.Int64
+	}
+	if usedBy.Valid && username.Valid {
+		use := InviteUse{UserID: usedBy.Int64, Username: username.String}
+		if usedAt.Valid {
+			use.UsedAt = usedAt.Time
+		}
+		usage.Uses = append(usage.Uses, use)
+	}
+	return &usage, nil
+}
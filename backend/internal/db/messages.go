@@ -5,28 +5,64 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"slices"
+	"strings"
+	"time"
 )
 
 var ErrIdempotencyConflict = errors.New("message idempotency key already used with different content")
 
-func SaveMessage(senderID, receiverID int64, clientID, msgType string, content, nonce []byte) (*Message, bool, error) {
-	result, err := DB.Exec(
-		`INSERT OR IGNORE INTO messages (sender_id, receiver_id, client_id, type, content, nonce)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		senderID, receiverID, clientID, msgType, content, nonce,
-	)
-	if err != nil {
-		return nil, false, err
-	}
-	rows, err := result.RowsAffected()
+// MessageTypeSystem marks server-authored messages whose content is plaintext
+// and whose nonce is empty. Clients cannot send this type.
+const MessageTypeSystem = "system"
+
+// SaveMessage stores a message encrypted to the recipient's key epoch keyEpoch.
+// Notes to self, where sender and receiver match, are stored as already
+// delivered and read.
+func SaveMessage(senderID, receiverID int64, clientID, msgType string, content, nonce []byte, keyEpoch int64) (*Message, bool, error) {
+	return SaveEscrowedMessage(senderID, receiverID, clientID, msgType, content, nonce, keyEpoch, nil)
+}
+
+// SaveEscrowedMessage stores a message like SaveMessage together with an
+// envelope the sender encrypted to the compliance escrow key. The envelope is
+// kept for the operator and never returned to clients; nil stores none.
+func SaveEscrowedMessage(senderID, receiverID int64, clientID, msgType string, content, nonce []byte, keyEpoch int64, escrow []byte) (*Message, bool, error) {
+	var rows, id int64
+	err := WithTx(func(tx *sql.Tx) error {
+		if limit, policy := currentStorageQuota(); limit > 0 {
+			// Retries of an already stored message must not be charged twice.
+			var existing int
+			if err := tx.QueryRow(
+				"SELECT COUNT(*) FROM messages WHERE sender_id = ? AND client_id = ?", senderID, clientID,
+			).Scan(&existing); err != nil {
+				return err
+			}
+			if existing == 0 {
+				if err := enforceStorageQuota(tx, senderID, int64(len(content)), limit, policy); err != nil {
+					return err
+				}
+			}
+		}
+
+		result, err := tx.Exec(
+			`INSERT OR IGNORE INTO messages (sender_id, receiver_id, client_id, type, content, nonce, key_epoch, escrow_envelope, read, delivered_at, read_at)
+			 SELECT ?, ?, ?, ?, ?, ?, ?, ?, self, CASE WHEN self THEN CURRENT_TIMESTAMP END, CASE WHEN self THEN CURRENT_TIMESTAMP END
+			 FROM (SELECT ? AS self)`,
+			senderID, receiverID, clientID, msgType, content, nonce, keyEpoch, escrow, senderID == receiverID,
+		)
+		if err != nil {
+			return err
+		}
+		if rows, err = result.RowsAffected(); err != nil || rows != 1 {
+			return err
+		}
+		id, err = result.LastInsertId()
+		return err
+	})
 	if err != nil {
 		return nil, false, err
 	}
 	if rows == 1 {
-		id, err := result.LastInsertId()
-		if err != nil {
-			return nil, false, err
-		}
 		message, err := GetMessageByID(id)
 		return message, true, err
 	}
@@ -42,12 +78,131 @@ func SaveMessage(senderID, receiverID int64, clientID, msgType string, content,
 	return message, false, nil
 }
 
+// conversationClause matches the messages exchanged by two users. A note-to-self
+// conversation has a single direction, so it gets one equality pair rather
+// than the same pair twice.
+func conversationClause(userID1, userID2 int64) (string, []interface{}) {
+	if userID1 == userID2 {
+		return "(sender_id = ? AND receiver_id = ?)", []interface{}{userID1, userID1}
+	}
+	return "((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))",
+		[]interface{}{userID1, userID2, userID2, userID1}
+}
+
+// MediaMessageTypes are the message types shown in a conversation's shared
+// media view.
+var MediaMessageTypes = []string{"file", "image", "video", "audio"}
+
+// ListableMessageTypes are the message types messages can be listed by
+// across conversations.
+var ListableMessageTypes = append([]string{"text", MessageTypeSystem}, MediaMessageTypes...)
+
+// GetMediaMessagesBetween pages through media messages between two users,
+// newest first, honoring the requester's cleared history. Deleted messages
+// are left out; the rest carry the same edit and key state as the history.
+func GetMediaMessagesBetween(userID1, userID2 int64, limit int, beforeID int64) ([]Message, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(MediaMessageTypes)), ", ")
+	participants, args := conversationClause(userID1, userID2)
+	for _, messageType := range MediaMessageTypes {
+		args = append(args, messageType)
+	}
+	args = append(args, beforeID, beforeID, userID1, userID2, userID1, limit)
+	rows, err := DB.Query(
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch,
+		   COALESCE(key_epoch != (SELECT key_epoch FROM users WHERE users.id = messages.receiver_id), FALSE), edited_at, deleted
+		 FROM messages
+		 WHERE `+participants+`
+		   AND type IN (`+placeholders+`)
+		   AND NOT deleted
+		   AND (? = 0 OR id < ?)
+		   AND id > COALESCE((
+		     SELECT through_id FROM conversation_clears WHERE user_id = ? AND other_user_id = ?
+		   ), 0)
+		   AND NOT EXISTS (
+		     SELECT 1 FROM hidden_messages WHERE hidden_messages.user_id = ? AND hidden_messages.message_id = messages.id
+		   )
+		 ORDER BY id DESC
+		 LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]Message, 0)
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read, &m.KeyEpoch, &m.KeyStale, &m.EditedAt, &m.IsDeleted); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// GetMessagesByType pages through the messages of one type that userID sent
+// or received in any conversation, newest first, honoring the user's cleared
+// histories and hidden messages. Deleted messages are left out.
+func GetMessagesByType(userID int64, messageType string, limit int, beforeID int64) ([]Message, error) {
+	rows, err := DB.Query(
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch
+		 FROM messages
+		 WHERE (sender_id = ? OR receiver_id = ?)
+		   AND type = ?
+		   AND NOT deleted
+		   AND (? = 0 OR id < ?)
+		   AND id > COALESCE((
+		     SELECT through_id FROM conversation_clears
+		     WHERE user_id = ?
+		       AND other_user_id = CASE WHEN messages.sender_id = ? THEN messages.receiver_id ELSE messages.sender_id END
+		   ), 0)
+		   AND NOT EXISTS (
+		     SELECT 1 FROM hidden_messages WHERE hidden_messages.user_id = ? AND hidden_messages.message_id = messages.id
+		   )
+		 ORDER BY id DESC
+		 LIMIT ?`,
+		userID, userID, messageType, beforeID, beforeID, userID, userID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]Message, 0)
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read, &m.KeyEpoch); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// SaveSystemMessage stores a plaintext system message. The storage triggers
+// skip system messages, so it is not charged against the sender's quota.
+func SaveSystemMessage(senderID, receiverID int64, text string) (*Message, error) {
+	result, err := DB.Exec(
+		"INSERT INTO messages (sender_id, receiver_id, type, content, nonce) VALUES (?, ?, ?, ?, ?)",
+		senderID, receiverID, MessageTypeSystem, []byte(text), []byte{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return GetMessageByID(id)
+}
+
 func GetMessageByID(id int64) (*Message, error) {
 	var msg Message
 	err := DB.QueryRow(
-		"SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read FROM messages WHERE id = ?",
+		"SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch, edited_at, deleted FROM messages WHERE id = ?",
 		id,
-	).Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Type, &msg.Content, &msg.Nonce, &msg.ClientID, &msg.Timestamp, &msg.Read)
+	).Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Type, &msg.Content, &msg.Nonce, &msg.ClientID, &msg.Timestamp, &msg.Read, &msg.KeyEpoch, &msg.EditedAt, &msg.IsDeleted)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -61,10 +216,10 @@ func GetMessageByID(id int64) (*Message, error) {
 func GetMessageByClientID(senderID int64, clientID string) (*Message, error) {
 	var msg Message
 	err := DB.QueryRow(
-		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch
 		 FROM messages WHERE sender_id = ? AND client_id = ?`,
 		senderID, clientID,
-	).Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Type, &msg.Content, &msg.Nonce, &msg.ClientID, &msg.Timestamp, &msg.Read)
+	).Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Type, &msg.Content, &msg.Nonce, &msg.ClientID, &msg.Timestamp, &msg.Read, &msg.KeyEpoch)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
@@ -74,18 +229,31 @@ func GetMessageByClientID(senderID int64, clientID string) (*Message, error) {
 	return &msg, nil
 }
 
+// GetMessagesBetween returns the newest limit messages before beforeID, newest
+// first.
 func GetMessagesBetween(userID1, userID2 int64, limit int, beforeID int64) ([]Message, error) {
+	return GetMessagesBetweenOrdered(userID1, userID2, limit, beforeID, false)
+}
+
+// GetMessagesBetweenOrdered returns the same page as GetMessagesBetween,
+// oldest first when oldestFirst is set.
+func GetMessagesBetweenOrdered(userID1, userID2 int64, limit int, beforeID int64, oldestFirst bool) ([]Message, error) {
+	participants, args := conversationClause(userID1, userID2)
 	rows, err := DB.Query(
-		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read 
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch,
+		   COALESCE(key_epoch != (SELECT key_epoch FROM users WHERE users.id = messages.receiver_id), FALSE), edited_at, deleted
 		 FROM messages 
-		 WHERE ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))
+		 WHERE `+participants+`
 		   AND (? = 0 OR id < ?)
 		   AND id > COALESCE((
 		     SELECT through_id FROM conversation_clears WHERE user_id = ? AND other_user_id = ?
 		   ), 0)
+		   AND NOT EXISTS (
+		     SELECT 1 FROM hidden_messages WHERE hidden_messages.user_id = ? AND hidden_messages.message_id = messages.id
+		   )
 		 ORDER BY id DESC
 		 LIMIT ?`,
-		userID1, userID2, userID2, userID1, beforeID, beforeID, userID1, userID2, limit,
+		append(args, beforeID, beforeID, userID1, userID2, userID1, limit)...,
 	)
 	if err != nil {
 		return nil, err
@@ -96,7 +264,64 @@ func GetMessagesBetween(userID1, userID2 int64, limit int, beforeID int64) ([]Me
 	messages := make([]Message, 0)
 	for rows.Next() {
 		var m Message
-		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read); err != nil {
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read, &m.KeyEpoch, &m.KeyStale, &m.EditedAt, &m.IsDeleted); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if oldestFirst {
+		slices.Reverse(messages)
+	}
+	return messages, nil
+}
+
+// GetFirstUnreadID returns the oldest unread message userID has received from
+// otherUserID in the visible history, or zero when everything is read.
+func GetFirstUnreadID(userID, otherUserID int64) (int64, error) {
+	var id int64
+	err := DB.QueryRow(
+		`SELECT COALESCE(MIN(id), 0) FROM messages
+		 WHERE sender_id = ? AND receiver_id = ? AND read = FALSE
+		   AND id > COALESCE((
+		     SELECT through_id FROM conversation_clears WHERE user_id = ? AND other_user_id = ?
+		   ), 0)`,
+		otherUserID, userID, userID, otherUserID,
+	).Scan(&id)
+	return id, err
+}
+
+// GetMessagesFrom returns up to limit messages between two users starting at
+// fromID, oldest first.
+func GetMessagesFrom(userID1, userID2 int64, limit int, fromID int64) ([]Message, error) {
+	participants, args := conversationClause(userID1, userID2)
+	rows, err := DB.Query(
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch,
+		   COALESCE(key_epoch != (SELECT key_epoch FROM users WHERE users.id = messages.receiver_id), FALSE), edited_at, deleted
+		 FROM messages
+		 WHERE `+participants+`
+		   AND id >= ?
+		   AND id > COALESCE((
+		     SELECT through_id FROM conversation_clears WHERE user_id = ? AND other_user_id = ?
+		   ), 0)
+		   AND NOT EXISTS (
+		     SELECT 1 FROM hidden_messages WHERE hidden_messages.user_id = ? AND hidden_messages.message_id = messages.id
+		   )
+		 ORDER BY id ASC
+		 LIMIT ?`,
+		append(args, fromID, userID1, userID2, userID1, limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]Message, 0)
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read, &m.KeyEpoch, &m.KeyStale, &m.EditedAt, &m.IsDeleted); err != nil {
 			return nil, err
 		}
 		messages = append(messages, m)
@@ -106,9 +331,9 @@ func GetMessagesBetween(userID1, userID2 int64, limit int, beforeID int64) ([]Me
 
 func GetUnreadMessagesForUser(userID int64) ([]Message, error) {
 	rows, err := DB.Query(
-		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read 
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch
 		 FROM messages 
-		 WHERE receiver_id = ? AND read = FALSE
+		 WHERE receiver_id = ? AND read = FALSE AND NOT deleted
 		 ORDER BY timestamp ASC`,
 		userID,
 	)
@@ -120,7 +345,50 @@ func GetUnreadMessagesForUser(userID int64) ([]Message, error) {
 	messages := make([]Message, 0)
 	for rows.Next() {
 		var m Message
-		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read); err != nil {
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read, &m.KeyEpoch); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// CountUnreadMessages returns how many messages userID has received and not
+// read, across all conversations. Deleted messages and messages userID
+// cleared from their history do not count, as in the conversation previews.
+func CountUnreadMessages(userID int64) (int64, error) {
+	var count int64
+	err := DB.QueryRow(
+		`SELECT COUNT(*) FROM messages m
+		 WHERE m.receiver_id = ? AND m.read = FALSE AND NOT m.deleted
+		   AND m.id > COALESCE((
+		     SELECT through_id FROM conversation_clears WHERE user_id = m.receiver_id AND other_user_id = m.sender_id
+		   ), 0)`,
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// GetUndeliveredMessagesForUser returns up to limit unread messages with IDs
+// above afterID that never reached any of the user's sessions, oldest first.
+func GetUndeliveredMessagesForUser(userID, afterID int64, limit int) ([]Message, error) {
+	rows, err := DB.Query(
+		`SELECT id, sender_id, receiver_id, type, content, nonce, COALESCE(client_id, ''), timestamp, read, key_epoch
+		 FROM messages
+		 WHERE receiver_id = ? AND id > ? AND read = FALSE AND delivered_at IS NULL AND NOT deleted
+		 ORDER BY id ASC
+		 LIMIT ?`,
+		userID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]Message, 0)
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID, &m.Type, &m.Content, &m.Nonce, &m.ClientID, &m.Timestamp, &m.Read, &m.KeyEpoch); err != nil {
 			return nil, err
 		}
 		messages = append(messages, m)
@@ -128,44 +396,264 @@ func GetUnreadMessagesForUser(userID int64) ([]Message, error) {
 	return messages, rows.Err()
 }
 
-func MarkMessagesAsReadRange(senderID, receiverID, fromID, throughID int64) (int64, error) {
+// MarkMessagesAsReadRange marks the messages senderID sent receiverID with
+// IDs from fromID through throughID as read. It reports how many were unread,
+// and how many of those are read for the first time; messages marked unread
+// again keep their original read_at.
+func MarkMessagesAsReadRange(senderID, receiverID, fromID, throughID int64) (int64, int64, error) {
+	var updated, firstRead int64
+	err := WithTx(func(tx *sql.Tx) error {
+		if err := tx.QueryRow(
+			`SELECT COUNT(*) FROM messages
+			 WHERE sender_id = ? AND receiver_id = ? AND read = FALSE AND read_at IS NULL AND id BETWEEN ? AND ?`,
+			senderID, receiverID, fromID, throughID,
+		).Scan(&firstRead); err != nil {
+			return err
+		}
+		now := time.Now()
+		result, err := tx.Exec(
+			`UPDATE messages SET read = TRUE, read_at = COALESCE(read_at, ?), delivered_at = COALESCE(delivered_at, ?)
+			 WHERE sender_id = ? AND receiver_id = ? AND read = FALSE AND id BETWEEN ? AND ?`,
+			now, now, senderID, receiverID, fromID, throughID,
+		)
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return updated, firstRead, nil
+}
+
+// MarkMessageUnread flags a read message receiverID got as unread again and
+// reports whether it changed. read_at is kept, so the sender's view of the
+// message does not change.
+func MarkMessageUnread(messageID, receiverID int64) (bool, error) {
 	result, err := DB.Exec(
-		`UPDATE messages SET read = TRUE
-		 WHERE sender_id = ? AND receiver_id = ? AND read = FALSE AND id BETWEEN ? AND ?`,
-		senderID, receiverID, fromID, throughID,
+		"UPDATE messages SET read = FALSE WHERE id = ? AND receiver_id = ? AND read = TRUE",
+		messageID, receiverID,
 	)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	return result.RowsAffected()
+	updated, err := result.RowsAffected()
+	return updated > 0, err
 }
 
-func ClearMessagesForUser(ctx context.Context, userID, otherUserID int64) (int64, error) {
-	tx, err := DB.BeginTx(ctx, nil)
+// MessageStatus is the delivery state of a message as seen by its sender.
+type MessageStatus struct {
+	MessageID   int64      `json:"message_id"`
+	SenderID    int64      `json:"-"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+// MarkMessageDelivered records the first time a message reached the recipient
+// and returns the version of its conversation afterwards, which the update
+// itself bumps.
+func MarkMessageDelivered(messageID int64) (int64, error) {
+	var version int64
+	err := WithTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			"UPDATE messages SET delivered_at = ? WHERE id = ? AND delivered_at IS NULL",
+			time.Now(), messageID,
+		); err != nil {
+			return err
+		}
+		err := tx.QueryRow(`
+			SELECT v.version FROM messages m
+			JOIN conversation_versions v
+			  ON v.user_a = MIN(m.sender_id, m.receiver_id) AND v.user_b = MAX(m.sender_id, m.receiver_id)
+			WHERE m.id = ?`,
+			messageID,
+		).Scan(&version)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+	return version, err
+}
+
+// MarkMessageUndelivered forgets the delivery of a message that has not been
+// read, so that the recipient's next session receives it again.
+func MarkMessageUndelivered(messageID int64) error {
+	_, err := DB.Exec("UPDATE messages SET delivered_at = NULL WHERE id = ? AND read_at IS NULL", messageID)
+	return err
+}
+
+func GetMessageStatus(messageID int64) (*MessageStatus, error) {
+	var status MessageStatus
+	var deliveredAt, readAt sql.NullTime
+	err := DB.QueryRow(
+		"SELECT id, sender_id, delivered_at, read_at FROM messages WHERE id = ?",
+		messageID,
+	).Scan(&status.MessageID, &status.SenderID, &deliveredAt, &readAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if deliveredAt.Valid {
+		status.DeliveredAt = &deliveredAt.Time
+	}
+	if readAt.Valid {
+		status.ReadAt = &readAt.Time
 	}
-	defer tx.Rollback()
+	return &status, nil
+}
+
+// ActivityDay counts the messages a user sent and received on one UTC day.
+type ActivityDay struct {
+	Date     string `json:"date"`
+	Sent     int64  `json:"sent"`
+	Received int64  `json:"received"`
+}
 
+// GetMessageActivity returns per-day message counts for userID since the start
+// of the given day. Days without messages are omitted. Like the conversation
+// history, it honors the user's cleared histories and hidden messages, and
+// notes to self count as sent only.
+func GetMessageActivity(userID int64, since time.Time) ([]ActivityDay, error) {
+	// Timestamps are stored in SQLite's CURRENT_TIMESTAMP format, which sorts as text.
+	rows, err := DB.Query(
+		`SELECT date(timestamp) AS day, SUM(sender_id = ?), SUM(sender_id != ?)
+		 FROM messages
+		 WHERE (sender_id = ? OR receiver_id = ?)
+		   AND timestamp >= ?
+		   AND id > COALESCE((
+		     SELECT through_id FROM conversation_clears
+		     WHERE user_id = ?
+		       AND other_user_id = CASE WHEN messages.sender_id = ? THEN messages.receiver_id ELSE messages.sender_id END
+		   ), 0)
+		   AND NOT EXISTS (
+		     SELECT 1 FROM hidden_messages WHERE hidden_messages.user_id = ? AND hidden_messages.message_id = messages.id
+		   )
+		 GROUP BY day
+		 ORDER BY day`,
+		userID, userID, userID, userID, since.UTC().Format("2006-01-02"), userID, userID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make([]ActivityDay, 0)
+	for rows.Next() {
+		var day ActivityDay
+		if err := rows.Scan(&day.Date, &day.Sent, &day.Received); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+func ClearMessagesForUser(ctx context.Context, userID, otherUserID int64) (int64, error) {
 	var throughID int64
-	if err := tx.QueryRowContext(ctx,
-		`SELECT COALESCE(MAX(id), 0) FROM messages
-		 WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)`,
-		userID, otherUserID, otherUserID, userID,
-	).Scan(&throughID); err != nil {
+	err := WithTxContext(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx,
+			`SELECT COALESCE(MAX(id), 0) FROM messages
+			 WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)`,
+			userID, otherUserID, otherUserID, userID,
+		).Scan(&throughID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO conversation_clears (user_id, other_user_id, through_id, cleared_at)
+			VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(user_id, other_user_id) DO UPDATE SET
+				through_id = MAX(conversation_clears.through_id, excluded.through_id),
+				cleared_at = CURRENT_TIMESTAMP
+		`, userID, otherUserID, throughID)
+		return err
+	})
+	if err != nil {
 		return 0, err
 	}
-	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO conversation_clears (user_id, other_user_id, through_id, cleared_at)
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(user_id, other_user_id) DO UPDATE SET
-			through_id = MAX(conversation_clears.through_id, excluded.through_id),
-			cleared_at = CURRENT_TIMESTAMP
-	`, userID, otherUserID, throughID); err != nil {
+	return throughID, nil
+}
+
+// HideReadMessages hides read messages older than before from userID's view of
+// one conversation, or of all conversations when otherUserID is zero. Other
+// participants still see them, and unread messages are never hidden. It
+// returns the number of newly hidden messages.
+func HideReadMessages(ctx context.Context, userID, otherUserID int64, before time.Time) (int64, error) {
+	result, err := DB.ExecContext(ctx,
+		`INSERT OR IGNORE INTO hidden_messages (user_id, message_id)
+		 SELECT ?, id FROM messages
+		 WHERE (sender_id = ? OR receiver_id = ?)
+		   AND (? = 0 OR sender_id = ? OR receiver_id = ?)
+		   AND read = TRUE
+		   AND timestamp < ?`,
+		userID, userID, userID, otherUserID, otherUserID, otherUserID,
+		before.UTC().Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
 		return 0, err
 	}
-	if err := tx.Commit(); err != nil {
-		return 0, err
+	return result.RowsAffected()
+}
+
+// DeleteMessage deletes a message senderID sent for both sides. The row stays
+// as a tombstone with its timestamp, while the content, nonce and edit history
+// are dropped. Messages the caller cannot see fail with ErrMessageNotFound,
+// and messages they received with ErrNotMessageSender.
+func DeleteMessage(messageID, senderID int64) (*Message, error) {
+	err := WithTx(func(tx *sql.Tx) error {
+		if _, _, err := ownMessage(tx, messageID, senderID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM message_edits WHERE message_id = ?", messageID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE messages SET deleted = TRUE, content = X'', nonce = X'' WHERE id = ?", messageID)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return throughID, nil
+	return GetMessageByID(messageID)
+}
+
+// DeleteSentMessages permanently removes every message senderID sent to
+// receiverID and returns the deleted IDs in ascending order.
+func DeleteSentMessages(ctx context.Context, senderID, receiverID int64) ([]int64, error) {
+	ids := make([]int64, 0)
+	err := WithTxContext(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			"SELECT id FROM messages WHERE sender_id = ? AND receiver_id = ? ORDER BY id",
+			senderID, receiverID,
+		)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if err := rows.Err(); err != nil || len(ids) == 0 {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM messages WHERE sender_id = ? AND receiver_id = ? AND id <= ?",
+			senderID, receiverID, ids[len(ids)-1],
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
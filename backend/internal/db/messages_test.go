@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMessageCursorPaginationAndReadRange(t *testing.T) {
@@ -16,7 +18,7 @@ func TestMessageCursorPaginationAndReadRange(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	code, err := GenerateInviteCode()
+	code, err := GenerateInviteCode(alice.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -26,7 +28,7 @@ func TestMessageCursorPaginationAndReadRange(t *testing.T) {
 	}
 
 	for i := 0; i < 12; i++ {
-		if _, _, err := SaveMessage(alice.ID, bob.ID, fmt.Sprintf("client-message-%d", i), "text", []byte(fmt.Sprintf("message-%d", i)), make([]byte, 12)); err != nil {
+		if _, _, err := SaveMessage(alice.ID, bob.ID, fmt.Sprintf("client-message-%d", i), "text", []byte(fmt.Sprintf("message-%d", i)), make([]byte, 12), 0); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -46,12 +48,12 @@ func TestMessageCursorPaginationAndReadRange(t *testing.T) {
 		t.Fatalf("unexpected second page: %+v", secondPage)
 	}
 
-	updated, err := MarkMessagesAsReadRange(alice.ID, bob.ID, firstPage[4].ID, firstPage[0].ID)
+	updated, firstRead, err := MarkMessagesAsReadRange(alice.ID, bob.ID, firstPage[4].ID, firstPage[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if updated != 5 {
-		t.Fatalf("expected 5 messages marked read, got %d", updated)
+	if updated != 5 || firstRead != 5 {
+		t.Fatalf("expected 5 messages marked read for the first time, got %d (%d first)", updated, firstRead)
 	}
 
 	remaining, err := GetUnreadMessagesForUser(bob.ID)
@@ -71,7 +73,7 @@ func TestSaveMessageIsIdempotent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	code, err := GenerateInviteCode()
+	code, err := GenerateInviteCode(alice.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,18 +82,18 @@ func TestSaveMessageIsIdempotent(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	first, created, err := SaveMessage(alice.ID, bob.ID, "client-message-1", "text", []byte("ciphertext"), make([]byte, 12))
+	first, created, err := SaveMessage(alice.ID, bob.ID, "client-message-1", "text", []byte("ciphertext"), make([]byte, 12), 0)
 	if err != nil || !created {
 		t.Fatalf("first save: created=%t err=%v", created, err)
 	}
-	duplicate, created, err := SaveMessage(alice.ID, bob.ID, "client-message-1", "text", []byte("ciphertext"), make([]byte, 12))
+	duplicate, created, err := SaveMessage(alice.ID, bob.ID, "client-message-1", "text", []byte("ciphertext"), make([]byte, 12), 0)
 	if err != nil || created {
 		t.Fatalf("duplicate save: created=%t err=%v", created, err)
 	}
 	if duplicate.ID != first.ID {
 		t.Fatalf("duplicate returned ID %d, expected %d", duplicate.ID, first.ID)
 	}
-	if _, _, err := SaveMessage(alice.ID, bob.ID, "client-message-1", "text", []byte("different"), make([]byte, 12)); !errors.Is(err, ErrIdempotencyConflict) {
+	if _, _, err := SaveMessage(alice.ID, bob.ID, "client-message-1", "text", []byte("different"), make([]byte, 12), 0); !errors.Is(err, ErrIdempotencyConflict) {
 		t.Fatalf("expected ErrIdempotencyConflict, got %v", err)
 	}
 
@@ -103,7 +105,7 @@ func TestSaveMessageIsIdempotent(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			_, created, err := SaveMessage(alice.ID, bob.ID, "concurrent-message-id", "text", []byte("ciphertext"), make([]byte, 12))
+			_, created, err := SaveMessage(alice.ID, bob.ID, "concurrent-message-id", "text", []byte("ciphertext"), make([]byte, 12), 0)
 			results <- created
 			errs <- err
 		}()
@@ -135,7 +137,7 @@ func TestClearMessagesOnlyHidesHistoryForRequester(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	code, err := GenerateInviteCode()
+	code, err := GenerateInviteCode(alice.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,7 +147,7 @@ func TestClearMessagesOnlyHidesHistoryForRequester(t *testing.T) {
 	}
 
 	for i := 0; i < 3; i++ {
-		if _, _, err := SaveMessage(alice.ID, bob.ID, fmt.Sprintf("clear-test-%d", i), "text", []byte("ciphertext"), make([]byte, 12)); err != nil {
+		if _, _, err := SaveMessage(alice.ID, bob.ID, fmt.Sprintf("clear-test-%d", i), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -172,7 +174,7 @@ func TestClearMessagesOnlyHidesHistoryForRequester(t *testing.T) {
 		t.Fatalf("bob lost history after alice cleared it: %d messages", len(bobMessages))
 	}
 
-	newMessage, _, err := SaveMessage(bob.ID, alice.ID, "after-clear-message", "text", []byte("new"), make([]byte, 12))
+	newMessage, _, err := SaveMessage(bob.ID, alice.ID, "after-clear-message", "text", []byte("new"), make([]byte, 12), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -184,3 +186,305 @@ func TestClearMessagesOnlyHidesHistoryForRequester(t *testing.T) {
 		t.Fatalf("new message is not visible after clear: %+v", aliceMessages)
 	}
 }
+
+func TestUnreadTotalMatchesPreviewsAfterClear(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := SaveMessage(alice.ID, bob.ID, fmt.Sprintf("unread-clear-%d", i), "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, _, err := SaveMessage(alice.ID, bob.ID, "unread-clear-deleted", "text", []byte("ciphertext"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteMessage(deleted.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	unread := func() (int64, int64) {
+		t.Helper()
+		total, err := CountUnreadMessages(bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previews, err := GetConversationPreviews(bob.ID, true, time.Time{})
+		if err != nil || len(previews) != 1 {
+			t.Fatalf("previews = %+v, %v", previews, err)
+		}
+		return total, previews[0].UnreadCount
+	}
+	if total, preview := unread(); total != 3 || preview != 3 {
+		t.Fatalf("unread before clear = %d total, %d in preview; want 3", total, preview)
+	}
+	if _, err := ClearMessagesForUser(ctx, bob.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SaveMessage(alice.ID, bob.ID, "unread-after-clear", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	if total, preview := unread(); total != 1 || preview != 1 {
+		t.Fatalf("unread after clear = %d total, %d in preview; want 1", total, preview)
+	}
+}
+
+func TestMessagesEncryptedToReplacedKeyAreFlaggedStale(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, _, err := SaveMessage(alice.ID, bob.ID, "epoch-0", "text", []byte("old"), make([]byte, 12), bob.KeyEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdatePublicKey(bob.ID, publicKey, 0); err != nil {
+		t.Fatal(err)
+	}
+	if bob, err = GetUserByID(bob.ID); err != nil || bob.KeyEpoch != 1 {
+		t.Fatalf("key epoch after update = %+v, err = %v; want 1", bob, err)
+	}
+	current, _, err := SaveMessage(alice.ID, bob.ID, "epoch-1", "text", []byte("new"), make([]byte, 12), bob.KeyEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := GetMessagesBetween(bob.ID, alice.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := map[int64]bool{}
+	for _, message := range messages {
+		stale[message.ID] = message.KeyStale
+	}
+	if !stale[old.ID] || stale[current.ID] {
+		t.Fatalf("stale flags = %v, want only message %d stale", stale, old.ID)
+	}
+}
+
+func TestDeleteSentMessagesOnlyRemovesSenderMessages(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []int64
+	for i := 0; i < 2; i++ {
+		message, _, err := SaveMessage(alice.ID, bob.ID, fmt.Sprintf("delete-mine-%d", i), "text", []byte("sent"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, message.ID)
+	}
+	reply, _, err := SaveMessage(bob.ID, alice.ID, "delete-mine-reply", "text", []byte("reply"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := DeleteSentMessages(ctx, alice.ID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(deleted) != fmt.Sprint(sent) {
+		t.Fatalf("deleted %v, want %v", deleted, sent)
+	}
+	messages, err := GetMessagesBetween(alice.ID, bob.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != reply.ID {
+		t.Fatalf("remaining messages = %+v, want only the reply", messages)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 0 {
+		t.Fatalf("sender usage = %d, err = %v; want 0", used, err)
+	}
+}
+
+func TestHideReadMessagesKeepsUnreadAndRecentMessages(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]*User, 0, 2)
+	for _, name := range []string{"bob", "carol"} {
+		code, err := GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := RegisterUser(ctx, name, "hash", publicKey, code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol := users[0], users[1]
+
+	save := func(sender, receiver int64, clientID string, read bool, age string) int64 {
+		t.Helper()
+		message, _, err := SaveMessage(sender, receiver, clientID, "text", []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DB.Exec("UPDATE messages SET read = ?, timestamp = datetime('now', ?) WHERE id = ?", read, age, message.ID); err != nil {
+			t.Fatal(err)
+		}
+		return message.ID
+	}
+	oldRead := save(bob.ID, alice.ID, "cleanup-old-read", true, "-40 days")
+	oldUnread := save(bob.ID, alice.ID, "cleanup-old-unread", false, "-40 days")
+	recentRead := save(bob.ID, alice.ID, "cleanup-recent-read", true, "-1 days")
+	carolOldRead := save(carol.ID, alice.ID, "cleanup-carol-old-read", true, "-40 days")
+
+	visible := func(viewer, other int64) []int64 {
+		t.Helper()
+		messages, err := GetMessagesBetween(viewer, other, 50, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int64, 0, len(messages))
+		for _, message := range messages {
+			ids = append(ids, message.ID)
+		}
+		return ids
+	}
+
+	before := time.Now().AddDate(0, 0, -30)
+	if hidden, err := HideReadMessages(ctx, alice.ID, bob.ID, before); err != nil || hidden != 1 {
+		t.Fatalf("conversation cleanup hid %d, err = %v; want 1", hidden, err)
+	}
+	if got := visible(alice.ID, bob.ID); !slices.Equal(got, []int64{recentRead, oldUnread}) {
+		t.Fatalf("alice sees %v, want %v", got, []int64{recentRead, oldUnread})
+	}
+	if got := visible(bob.ID, alice.ID); !slices.Equal(got, []int64{recentRead, oldUnread, oldRead}) {
+		t.Fatalf("bob sees %v; sender history must be untouched", got)
+	}
+	if got := visible(alice.ID, carol.ID); !slices.Equal(got, []int64{carolOldRead}) {
+		t.Fatalf("conversation cleanup reached carol's conversation: %v", got)
+	}
+
+	if hidden, err := HideReadMessages(ctx, alice.ID, 0, before); err != nil || hidden != 1 {
+		t.Fatalf("global cleanup hid %d, err = %v; want 1", hidden, err)
+	}
+	if got := visible(alice.ID, carol.ID); len(got) != 0 {
+		t.Fatalf("alice still sees %v from carol", got)
+	}
+}
+
+func TestGetMessagesBetweenSelfReturnsEachNoteOnce(t *testing.T) {
+	initTestDB(t)
+	if _, err := DB.Exec("INSERT INTO users (id, username, password_hash, public_key) VALUES (5, 'notes', 'hash', ?)", make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec("INSERT INTO users (id, username, password_hash, public_key) VALUES (6, 'other', 'hash', ?)", make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	var noteIDs []int64
+	for index := 0; index < 3; index++ {
+		note, _, err := SaveMessage(5, 5, fmt.Sprintf("note-to-self-%d", index), "text", []byte("ciphertext"), make([]byte, 12), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		noteIDs = append(noteIDs, note.ID)
+	}
+	if _, _, err := SaveMessage(5, 6, "not-a-self-note", "text", []byte("ciphertext"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := GetMessagesBetween(5, 5, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	slices.Reverse(ids)
+	if !slices.Equal(ids, noteIDs) {
+		t.Fatalf("GetMessagesBetween(5, 5) = %v, want %v", ids, noteIDs)
+	}
+	if fromStart, err := GetMessagesFrom(5, 5, 50, 0); err != nil || len(fromStart) != len(noteIDs) {
+		t.Fatalf("GetMessagesFrom(5, 5) returned %d messages (%v), want %d", len(fromStart), err, len(noteIDs))
+	}
+}
+
+func TestMarkMessageDeliveredReturnsVersionAfterDelivery(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, _, err := SaveMessage(alice.ID, bob.ID, "delivery-version-1", "text", []byte("ciphertext and tag"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := GetConversationVersion(alice.ID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := MarkMessageDelivered(message.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := GetConversationVersion(bob.ID, alice.ID)
+	if err != nil || version <= before || version != current {
+		t.Fatalf("version after delivery = %d, before %d, current %d, %v", version, before, current, err)
+	}
+	if again, err := MarkMessageDelivered(message.ID); err != nil || again != version {
+		t.Fatalf("repeated delivery version = %d, want %d, %v", again, version, err)
+	}
+
+	if err := MarkMessageUndelivered(message.ID); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := GetUndeliveredMessagesForUser(bob.ID, 0, 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != message.ID {
+		t.Fatalf("pending after undoing delivery = %+v, %v", pending, err)
+	}
+}
@@ -0,0 +1,41 @@
+package db
+
+// MaximumNicknameLength bounds a contact nickname in characters.
+const MaximumNicknameLength = 64
+
+// SetNickname stores the private name userID gives contactID. An empty
+// nickname removes it.
+func SetNickname(userID, contactID int64, nickname string) error {
+	if nickname == "" {
+		_, err := DB.Exec("DELETE FROM contact_nicknames WHERE user_id = ? AND contact_id = ?", userID, contactID)
+		return err
+	}
+	_, err := DB.Exec(`
+		INSERT INTO contact_nicknames (user_id, contact_id, nickname, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id, contact_id) DO UPDATE SET
+			nickname = excluded.nickname,
+			updated_at = CURRENT_TIMESTAMP
+	`, userID, contactID, nickname)
+	return err
+}
+
+// GetNicknames returns the nicknames userID has set, keyed by contact.
+func GetNicknames(userID int64) (map[int64]string, error) {
+	rows, err := DB.Query("SELECT contact_id, nickname FROM contact_nicknames WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nicknames := make(map[int64]string)
+	for rows.Next() {
+		var contactID int64
+		var nickname string
+		if err := rows.Scan(&contactID, &nickname); err != nil {
+			return nil, err
+		}
+		nicknames[contactID] = nickname
+	}
+	return nicknames, rows.Err()
+}
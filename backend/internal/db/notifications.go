@@ -0,0 +1,48 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// GetNotificationAck returns the highest message ID whose notification the
+// user has dismissed on any device.
+func GetNotificationAck(userID int64) (int64, error) {
+	var ackedThrough int64
+	err := DB.QueryRow("SELECT acked_through FROM notification_state WHERE user_id = ?", userID).Scan(&ackedThrough)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return ackedThrough, err
+}
+
+// AckNotifications advances the user's acknowledged message ID. The stored value
+// never moves backwards, so a stale device cannot resurrect cleared notifications.
+// It returns the resulting value and whether it changed.
+func AckNotifications(userID, throughID int64) (int64, bool, error) {
+	ackedThrough, changed := throughID, false
+	err := WithTx(func(tx *sql.Tx) error {
+		var previous int64
+		err := tx.QueryRow("SELECT acked_through FROM notification_state WHERE user_id = ?", userID).Scan(&previous)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if throughID <= previous {
+			ackedThrough = previous
+			return nil
+		}
+		_, err = tx.Exec(`
+			INSERT INTO notification_state (user_id, acked_through, updated_at)
+			VALUES (?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(user_id) DO UPDATE SET
+				acked_through = excluded.acked_through,
+				updated_at = CURRENT_TIMESTAMP
+		`, userID, throughID)
+		changed = err == nil
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return ackedThrough, changed, nil
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAckNotificationsOnlyMovesForward(t *testing.T) {
+	initTestDB(t)
+	alice, err := RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		through int64
+		want    int64
+		changed bool
+	}{
+		{through: 5, want: 5, changed: true},
+		{through: 3, want: 5, changed: false},
+		{through: 5, want: 5, changed: false},
+		{through: 9, want: 9, changed: true},
+	}
+	for _, test := range tests {
+		got, changed, err := AckNotifications(alice.ID, test.through)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want || changed != test.changed {
+			t.Fatalf("AckNotifications(%d) = %d, %t; want %d, %t", test.through, got, changed, test.want, test.changed)
+		}
+	}
+	if acked, err := GetNotificationAck(alice.ID); err != nil || acked != 9 {
+		t.Fatalf("GetNotificationAck = %d, %v; want 9", acked, err)
+	}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	QuotaPolicyReject = "reject"
+	QuotaPolicyEvict  = "evict"
+)
+
+var ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+
+var storageQuota struct {
+	sync.RWMutex
+	limit  int64
+	policy string
+}
+
+// ConfigureStorageQuota sets the per-user limit on stored message bytes.
+// An empty or zero limit disables the quota.
+func ConfigureStorageQuota(limit, policy string) error {
+	var bytes int64
+	if limit != "" {
+		parsed, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid storage quota %q", limit)
+		}
+		bytes = parsed
+	}
+	if policy == "" {
+		policy = QuotaPolicyReject
+	}
+	if policy != QuotaPolicyReject && policy != QuotaPolicyEvict {
+		return fmt.Errorf("storage quota policy must be %q or %q", QuotaPolicyReject, QuotaPolicyEvict)
+	}
+
+	storageQuota.Lock()
+	storageQuota.limit = bytes
+	storageQuota.policy = policy
+	storageQuota.Unlock()
+	return nil
+}
+
+// StorageQuota returns the configured per-user limit, or zero when disabled.
+func StorageQuota() int64 {
+	storageQuota.RLock()
+	defer storageQuota.RUnlock()
+	return storageQuota.limit
+}
+
+func currentStorageQuota() (int64, string) {
+	storageQuota.RLock()
+	defer storageQuota.RUnlock()
+	return storageQuota.limit, storageQuota.policy
+}
+
+// GetStorageUsage returns the number of message content bytes a user has stored.
+func GetStorageUsage(userID int64) (int64, error) {
+	var used int64
+	err := DB.QueryRow("SELECT stored_bytes FROM users WHERE id = ?", userID).Scan(&used)
+	return used, err
+}
+
+// enforceStorageQuota makes room for size more bytes from senderID, either by
+// rejecting the write or by deleting the sender's oldest messages.
+func enforceStorageQuota(tx *sql.Tx, senderID, size, limit int64, policy string) error {
+	if size > limit {
+		return ErrStorageQuotaExceeded
+	}
+	var used int64
+	if err := tx.QueryRow("SELECT stored_bytes FROM users WHERE id = ?", senderID).Scan(&used); err != nil {
+		return err
+	}
+	excess := used + size - limit
+	if excess <= 0 {
+		return nil
+	}
+	if policy != QuotaPolicyEvict {
+		return ErrStorageQuotaExceeded
+	}
+
+	// A message frees its replaced versions along with its content.
+	rows, err := tx.Query(
+		`SELECT id, LENGTH(content) + COALESCE((SELECT SUM(LENGTH(content)) FROM message_edits WHERE message_id = messages.id), 0)
+		 FROM messages WHERE sender_id = ? AND type != ? ORDER BY id`,
+		senderID, MessageTypeSystem,
+	)
+	if err != nil {
+		return err
+	}
+	var throughID, freed int64
+	for freed < excess && rows.Next() {
+		var length int64
+		if err := rows.Scan(&throughID, &length); err != nil {
+			rows.Close()
+			return err
+		}
+		freed += length
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if freed < excess {
+		return ErrStorageQuotaExceeded
+	}
+	_, err = tx.Exec("DELETE FROM messages WHERE sender_id = ? AND type != ? AND id <= ?", senderID, MessageTypeSystem, throughID)
+	return err
+}
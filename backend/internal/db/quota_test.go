@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStorageQuotaRejectsAndEvicts(t *testing.T) {
+	initTestDB(t)
+	t.Cleanup(func() { _ = ConfigureStorageQuota("", "") })
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ConfigureStorageQuota("10", QuotaPolicyReject); err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := SaveMessage(alice.ID, bob.ID, "quota-message-1", "text", []byte("123456"), make([]byte, 12), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SaveMessage(alice.ID, bob.ID, "quota-message-2", "text", []byte("123456"), make([]byte, 12), 0); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Fatalf("expected ErrStorageQuotaExceeded, got %v", err)
+	}
+	if _, created, err := SaveMessage(alice.ID, bob.ID, "quota-message-1", "text", []byte("123456"), make([]byte, 12), 0); err != nil || created {
+		t.Fatalf("retry of stored message: created=%t err=%v", created, err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 6 {
+		t.Fatalf("usage = %d, err = %v; want 6", used, err)
+	}
+
+	if err := ConfigureStorageQuota("10", QuotaPolicyEvict); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SaveMessage(alice.ID, bob.ID, "quota-message-2", "text", []byte("123456"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	if evicted, err := GetMessageByID(first.ID); err != nil || evicted != nil {
+		t.Fatalf("oldest message was not evicted: %+v, err = %v", evicted, err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 6 {
+		t.Fatalf("usage after eviction = %d, err = %v; want 6", used, err)
+	}
+	if _, _, err := SaveMessage(alice.ID, bob.ID, "quota-message-3", "text", make([]byte, 11), make([]byte, 12), 0); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Fatalf("message larger than the quota: expected ErrStorageQuotaExceeded, got %v", err)
+	}
+}
+
+func TestConfigureStorageQuotaRejectsInvalidValues(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureStorageQuota("", "") })
+	for _, test := range []struct{ limit, policy string }{
+		{limit: "-1"},
+		{limit: "ten"},
+		{limit: "10", policy: "drop"},
+	} {
+		if err := ConfigureStorageQuota(test.limit, test.policy); err == nil {
+			t.Errorf("ConfigureStorageQuota(%q, %q) succeeded", test.limit, test.policy)
+		}
+	}
+}
+
+func TestSystemMessagesAreNotChargedOrEvicted(t *testing.T) {
+	initTestDB(t)
+	t.Cleanup(func() { _ = ConfigureStorageQuota("", "") })
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	welcome, err := SaveSystemMessage(alice.ID, bob.ID, "Welcome aboard!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 0 {
+		t.Fatalf("usage after system message = %d, err = %v; want 0", used, err)
+	}
+
+	if err := ConfigureStorageQuota("10", QuotaPolicyEvict); err != nil {
+		t.Fatal(err)
+	}
+	for index, clientID := range []string{"system-quota-1", "system-quota-2"} {
+		if _, _, err := SaveMessage(alice.ID, bob.ID, clientID, "text", []byte("123456"), make([]byte, 12), 0); err != nil {
+			t.Fatalf("message %d: %v", index, err)
+		}
+	}
+	if kept, err := GetMessageByID(welcome.ID); err != nil || kept == nil {
+		t.Fatalf("system message was evicted: err = %v", err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 6 {
+		t.Fatalf("usage after eviction = %d, err = %v; want 6", used, err)
+	}
+}
+
+func TestEditsAreChargedAndFreedWithTheirMessage(t *testing.T) {
+	initTestDB(t)
+	t.Cleanup(func() { _ = ConfigureStorageQuota("", "") })
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ConfigureStorageQuota("10", QuotaPolicyReject); err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := SaveEscrowedMessage(alice.ID, bob.ID, "quota-edit-1", "text", []byte("123456"), make([]byte, 12), 0, []byte("escrow-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EditMessage(first.ID, alice.ID, []byte("12345"), make([]byte, 12), nil); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Fatalf("edit past the quota: expected ErrStorageQuotaExceeded, got %v", err)
+	}
+	if _, err := EditMessage(first.ID, alice.ID, []byte("1234"), make([]byte, 12), []byte("escrow-2")); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 10 {
+		t.Fatalf("usage after edit = %d, err = %v; want 10", used, err)
+	}
+	var escrow []byte
+	if err := DB.QueryRow("SELECT escrow_envelope FROM message_edits WHERE message_id = ?", first.ID).Scan(&escrow); err != nil || string(escrow) != "escrow-1" {
+		t.Fatalf("escrow of the replaced version = %q, %v", escrow, err)
+	}
+
+	if err := ConfigureStorageQuota("10", QuotaPolicyEvict); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SaveMessage(alice.ID, bob.ID, "quota-edit-2", "text", []byte("123456"), make([]byte, 12), 0); err != nil {
+		t.Fatal(err)
+	}
+	if evicted, err := GetMessageByID(first.ID); err != nil || evicted != nil {
+		t.Fatalf("edited message was not evicted: %+v, err = %v", evicted, err)
+	}
+	if used, err := GetStorageUsage(alice.ID); err != nil || used != 6 {
+		t.Fatalf("usage after evicting an edited message = %d, err = %v; want 6", used, err)
+	}
+}
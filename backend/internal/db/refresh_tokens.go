@@ -0,0 +1,126 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrInvalidRefreshToken covers unknown, expired, already used and revoked
+// refresh tokens alike.
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// revokedRefreshTokenRetention is how long used and revoked refresh tokens
+// are kept before pruning, so that recent rotations can still be traced.
+const revokedRefreshTokenRetention = 24 * time.Hour
+
+// CreateRefreshToken issues a refresh token for userID valid for ttl. Only a
+// hash of it is stored, and it stops working when the user's auth version
+// changes, for example on a password reset.
+func CreateRefreshToken(userID int64, ttl time.Duration) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = WithTx(func(tx *sql.Tx) error {
+		var version int64
+		if err := tx.QueryRow("SELECT auth_version FROM users WHERE id = ?", userID).Scan(&version); err != nil {
+			return err
+		}
+		return insertRefreshToken(tx, token, userID, version, ttl)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one valid for ttl
+// and returns the user it belongs to. The presented token is revoked, so each
+// refresh token works once.
+func RotateRefreshToken(token string, ttl time.Duration) (*User, string, error) {
+	next, err := newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+	var user User
+	err = WithTx(func(tx *sql.Tx) error {
+		var (
+			expiresAt time.Time
+			revokedAt sql.NullTime
+		)
+		err := tx.QueryRow(`
+			SELECT u.id, u.username, u.auth_version, r.expires_at, r.revoked_at
+			FROM refresh_tokens r
+			JOIN users u ON u.id = r.user_id AND u.auth_version = r.auth_version
+			WHERE r.token_hash = ?`,
+			hashRefreshToken(token),
+		).Scan(&user.ID, &user.Username, &user.AuthVersion, &expiresAt, &revokedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if revokedAt.Valid || !time.Now().Before(expiresAt) {
+			return ErrInvalidRefreshToken
+		}
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE token_hash = ?", time.Now().UTC(), hashRefreshToken(token)); err != nil {
+			return err
+		}
+		return insertRefreshToken(tx, next, user.ID, user.AuthVersion, ttl)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &user, next, nil
+}
+
+// RevokeRefreshToken stops a refresh token of userID from working. Unknown
+// tokens and tokens of other users are ignored.
+func RevokeRefreshToken(userID int64, token string) error {
+	_, err := DB.Exec(
+		"UPDATE refresh_tokens SET revoked_at = ? WHERE token_hash = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), hashRefreshToken(token), userID,
+	)
+	return err
+}
+
+// PruneRefreshTokens deletes refresh tokens that have expired by now or were
+// revoked more than revokedRefreshTokenRetention ago, and reports how many it
+// removed.
+func PruneRefreshTokens(now time.Time) (int64, error) {
+	result, err := DB.Exec(
+		"DELETE FROM refresh_tokens WHERE expires_at < ? OR revoked_at < ?",
+		now.UTC(), now.Add(-revokedRefreshTokenRetention).UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func insertRefreshToken(tx *sql.Tx, token string, userID, authVersion int64, ttl time.Duration) error {
+	_, err := tx.Exec(
+		"INSERT INTO refresh_tokens (token_hash, user_id, auth_version, expires_at) VALUES (?, ?, ?, ?)",
+		hashRefreshToken(token), userID, authVersion, time.Now().Add(ttl).UTC(),
+	)
+	return err
+}
+
+func newRefreshToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
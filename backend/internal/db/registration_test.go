@@ -34,7 +34,7 @@ func TestRegisterUserRequiresAndConsumesInvite(t *testing.T) {
 		t.Fatalf("expected ErrInviteRequired, got %v", err)
 	}
 
-	code, err := GenerateInviteCode()
+	code, err := GenerateInviteCode(0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,6 +46,29 @@ func TestRegisterUserRequiresAndConsumesInvite(t *testing.T) {
 	}
 }
 
+func TestRegisterOpenUserSkipsInviteAfterBootstrap(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+
+	if _, err := RegisterOpenUser(ctx, "first", "hash", publicKey); !errors.Is(err, ErrBootstrapAuth) {
+		t.Fatalf("expected ErrBootstrapAuth before bootstrap, got %v", err)
+	}
+	if _, err := RegisterUser(ctx, "first", "hash", publicKey, "", true); err != nil {
+		t.Fatal(err)
+	}
+	user, err := RegisterOpenUser(ctx, "second", "hash", publicKey)
+	if err != nil {
+		t.Fatalf("open registration: %v", err)
+	}
+	if user.IsAdmin {
+		t.Fatal("openly registered user became an admin")
+	}
+	if _, err := RegisterOpenUser(ctx, "second", "hash", publicKey); !errors.Is(err, ErrUsernameExists) {
+		t.Fatalf("expected ErrUsernameExists, got %v", err)
+	}
+}
+
 func TestRegisterUserRequiresBootstrapAuthorizationForFirstUser(t *testing.T) {
 	initTestDB(t)
 	_, err := RegisterUser(context.Background(), "first", "hash", make([]byte, 32), "", false)
@@ -61,6 +84,60 @@ func TestRegisterUserRequiresBootstrapAuthorizationForFirstUser(t *testing.T) {
 	}
 }
 
+func TestBootstrapInviteRegistersFirstUserOnce(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+
+	code, err := CreateBootstrapInvite()
+	if err != nil || code == "" {
+		t.Fatalf("CreateBootstrapInvite() = %q, %v", code, err)
+	}
+	if again, err := CreateBootstrapInvite(); err != nil || again != "" {
+		t.Fatalf("second CreateBootstrapInvite() = %q, %v", again, err)
+	}
+
+	plain, err := GenerateInviteCode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RegisterUser(ctx, "first", "hash", publicKey, plain, false); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("ordinary invite before bootstrap: expected ErrInvalidInvite, got %v", err)
+	}
+	user, err := RegisterUser(ctx, "first", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatalf("register with bootstrap invite: %v", err)
+	}
+	if !user.IsAdmin {
+		t.Fatal("first user registered with the bootstrap invite is not an admin")
+	}
+	if _, err := RegisterUser(ctx, "second", "hash", publicKey, code, false); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("reused bootstrap invite: expected ErrInvalidInvite, got %v", err)
+	}
+}
+
+func TestBootstrapInviteStopsWorkingOnceBootstrapped(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+
+	code, err := CreateBootstrapInvite()
+	if err != nil || code == "" {
+		t.Fatalf("CreateBootstrapInvite() = %q, %v", code, err)
+	}
+	// The operator sets up the first account with the bootstrap secret.
+	admin, err := RegisterUser(ctx, "admin", "hash", publicKey, "", true)
+	if err != nil || !admin.IsAdmin {
+		t.Fatalf("register with bootstrap secret = %+v, %v", admin, err)
+	}
+	if _, err := RegisterUser(ctx, "intruder", "hash", publicKey, code, false); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("logged bootstrap invite after bootstrap: expected ErrInvalidInvite, got %v", err)
+	}
+	if err := ValidateInvite(code); err == nil {
+		t.Fatal("logged bootstrap invite is still valid after bootstrap")
+	}
+}
+
 func TestRegisterUserAllowsOnlyOneConcurrentFirstUser(t *testing.T) {
 	initTestDB(t)
 	ctx := context.Background()
@@ -102,7 +179,7 @@ func TestRegisterUserAllowsOnlyOneConcurrentInviteClaim(t *testing.T) {
 	if _, err := RegisterUser(ctx, "first", "hash", publicKey, "", true); err != nil {
 		t.Fatal(err)
 	}
-	code, err := GenerateInviteCode()
+	code, err := GenerateInviteCode(0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,7 +215,7 @@ func TestRegisterUserAllowsOnlyOneConcurrentInviteClaim(t *testing.T) {
 
 func TestForeignKeysAreEnforced(t *testing.T) {
 	initTestDB(t)
-	if _, _, err := SaveMessage(100, 200, "client-message-id", "text", []byte("ciphertext"), make([]byte, 12)); err == nil {
+	if _, _, err := SaveMessage(100, 200, "client-message-id", "text", []byte("ciphertext"), make([]byte, 12), 0); err == nil {
 		t.Fatal("message with nonexistent users was accepted")
 	}
 }
@@ -166,3 +243,93 @@ func TestUpdatePasswordHashRequiresExistingUser(t *testing.T) {
 		t.Fatalf("expected sql.ErrNoRows, got %v", err)
 	}
 }
+
+func TestBootstrapUserIsAdminAndReferralsFollowInviteCreator(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	publicKey := make([]byte, 32)
+	alice, err := RegisterUser(ctx, "alice", "hash", publicKey, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alice.IsAdmin {
+		t.Fatal("bootstrap user is not an admin")
+	}
+	code, err := GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := RegisterUser(ctx, "bob", "hash", publicKey, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.IsAdmin {
+		t.Fatal("invited user is an admin")
+	}
+	code, err = GenerateInviteCode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RegisterUser(ctx, "carol", "hash", publicKey, code, false); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := GetInviteUsage(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage == nil || usage.CreatedBy != nil || len(usage.Uses) != 1 || usage.Uses[0].Username != "carol" {
+		t.Fatalf("invite usage = %+v, want carol with no creator", usage)
+	}
+	if usage, err := GetInviteUsage("missing"); err != nil || usage != nil {
+		t.Fatalf("missing invite usage = %+v, %v", usage, err)
+	}
+
+	referrals, err := GetReferrals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrals) != 3 {
+		t.Fatalf("got %d referrals, want 3", len(referrals))
+	}
+	if referrals[0].InvitedByID != nil {
+		t.Fatalf("bootstrap user has a referrer: %+v", referrals[0])
+	}
+	if referrals[1].InvitedByID == nil || *referrals[1].InvitedByID != alice.ID || *referrals[1].InvitedByUsername != "alice" {
+		t.Fatalf("bob referral = %+v, want alice", referrals[1])
+	}
+	if referrals[2].InvitedByID != nil {
+		t.Fatalf("unattributed invite has a referrer: %+v", referrals[2])
+	}
+}
+
+func TestImportUsersSkipsTakenUsernames(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	imported := []ImportedUser{
+		{Username: "alice", PasswordHash: "hash", PublicKey: make([]byte, 32)},
+		{Username: "bob", PasswordHash: "hash", PublicKey: make([]byte, 32)},
+	}
+	if _, err := ImportUsers(ctx, imported); !errors.Is(err, ErrNotBootstrapped) {
+		t.Fatalf("import before bootstrap error = %v", err)
+	}
+
+	if _, err := RegisterUser(ctx, "alice", "original", make([]byte, 32), "", true); err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := ImportUsers(ctx, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != "alice" {
+		t.Fatalf("skipped = %v, want [alice]", skipped)
+	}
+	alice, err := GetUserByUsernameWithPassword("alice")
+	if err != nil || alice.PasswordHash != "original" {
+		t.Fatalf("existing user was changed: %+v, %v", alice, err)
+	}
+	bob, err := GetUserByUsername("bob")
+	if err != nil || bob == nil || bob.IsAdmin {
+		t.Fatalf("imported user = %+v, %v", bob, err)
+	}
+}
@@ -0,0 +1,60 @@
+package db
+
+import "time"
+
+// RevokeToken denylists the access token with the given jti until it expires.
+// Tokens without an ID can only be revoked through the auth version.
+func RevokeToken(tokenID string, expiresAt time.Time) error {
+	if tokenID == "" {
+		return nil
+	}
+	_, err := DB.Exec(
+		"INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)",
+		tokenID, expiresAt.UTC(),
+	)
+	return err
+}
+
+// ConsumeToken revokes the access token with the given jti until expiresAt
+// and reports whether this call revoked it, so that of concurrent renewals
+// of one token only the first succeeds. Tokens without an ID are never
+// consumed.
+func ConsumeToken(tokenID string, expiresAt time.Time) (bool, error) {
+	if tokenID == "" {
+		return false, nil
+	}
+	result, err := DB.Exec(
+		"INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)",
+		tokenID, expiresAt.UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// GetTokenState returns the user's current auth version and whether the
+// token with the given jti was revoked, in one query since it runs on every
+// authenticated request.
+func GetTokenState(userID int64, tokenID string) (int64, bool, error) {
+	var (
+		version int64
+		revoked bool
+	)
+	err := DB.QueryRow(
+		"SELECT auth_version, EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?) FROM users WHERE id = ?",
+		tokenID, userID,
+	).Scan(&version, &revoked)
+	return version, revoked, err
+}
+
+// PruneRevokedTokens forgets revocations of tokens that have expired by now
+// and reports how many it removed.
+func PruneRevokedTokens(now time.Time) (int64, error) {
+	result, err := DB.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
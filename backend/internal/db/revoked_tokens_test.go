@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPruneRevokedTokensRemovesExpiredEntries(t *testing.T) {
+	initTestDB(t)
+	user, err := RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := RevokeToken("expired", now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeToken("current", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := func(tokenID string) bool {
+		t.Helper()
+		version, revoked, err := GetTokenState(user.ID, tokenID)
+		if err != nil || version != user.AuthVersion {
+			t.Fatalf("GetTokenState(%q) = %d, %v", tokenID, version, err)
+		}
+		return revoked
+	}
+	if !revoked("expired") || !revoked("current") || revoked("other") {
+		t.Fatal("revocations were not recorded")
+	}
+
+	pruned, err := PruneRevokedTokens(now)
+	if err != nil || pruned != 1 {
+		t.Fatalf("PruneRevokedTokens() = %d, %v, want 1", pruned, err)
+	}
+	if revoked("expired") || !revoked("current") {
+		t.Fatal("pruning removed the wrong revocations")
+	}
+}
+
+func TestPruneRefreshTokensRemovesExpiredAndLongRevokedTokens(t *testing.T) {
+	initTestDB(t)
+	user, err := RegisterUser(context.Background(), "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expired, err := CreateRefreshToken(user.ID, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := CreateRefreshToken(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recentlyRevoked, err := CreateRefreshToken(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeRefreshToken(user.ID, recentlyRevoked); err != nil {
+		t.Fatal(err)
+	}
+	longRevoked, err := CreateRefreshToken(user.ID, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec(
+		"UPDATE refresh_tokens SET revoked_at = ? WHERE token_hash = ?",
+		now.Add(-revokedRefreshTokenRetention-time.Minute).UTC(), hashRefreshToken(longRevoked),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := PruneRefreshTokens(now)
+	if err != nil || pruned != 2 {
+		t.Fatalf("PruneRefreshTokens() = %d, %v, want 2", pruned, err)
+	}
+	for token, kept := range map[string]bool{expired: false, current: true, recentlyRevoked: true, longRevoked: false} {
+		var exists bool
+		if err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE token_hash = ?)", hashRefreshToken(token)).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists != kept {
+			t.Errorf("token kept = %t, want %t", exists, kept)
+		}
+	}
+}
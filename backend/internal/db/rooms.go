@@ -0,0 +1,488 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	// MaximumRoomNameLength bounds a room name in characters.
+	MaximumRoomNameLength = 64
+
+	// MaximumRoomMembers bounds a room's size. Senders encrypt every message
+	// once per member, so the limit also bounds a room message request.
+	MaximumRoomMembers = 32
+)
+
+var (
+	ErrRoomFull      = errors.New("room is full")
+	ErrNotRoomMember = errors.New("not a member of this room")
+
+	// ErrRoomMembersChanged rejects a room message whose copies do not match
+	// the room's current members one to one.
+	ErrRoomMembersChanged = errors.New("room members have changed")
+)
+
+// Room is a group conversation. Only its members can see it.
+type Room struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatorID int64     `json:"creator_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RoomInvite is an invitation to a room that the invited user has not
+// answered yet.
+type RoomInvite struct {
+	RoomID    int64     `json:"room_id"`
+	RoomName  string    `json:"room_name"`
+	InvitedBy int64     `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RoomMessage is one member's copy of a message sent to a room: the content is
+// encrypted to that member, or to the sender for their own copy.
+type RoomMessage struct {
+	ID          int64     `json:"id"`
+	RoomID      int64     `json:"room_id"`
+	SenderID    int64     `json:"sender_id"`
+	RecipientID int64     `json:"recipient_id"`
+	ClientID    string    `json:"client_id"`
+	Type        string    `json:"type"`
+	Content     []byte    `json:"content"`
+	Nonce       []byte    `json:"nonce"`
+	KeyEpoch    int64     `json:"key_epoch"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// RoomMessageCopy is the content of a room message encrypted to one member.
+type RoomMessageCopy struct {
+	RecipientID int64
+	Content     []byte
+	Nonce       []byte
+	KeyEpoch    int64
+}
+
+// CreateRoom creates a room with creatorID as its first member.
+func CreateRoom(name string, creatorID int64) (*Room, error) {
+	var id int64
+	err := WithTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO rooms (name, creator_id) VALUES (?, ?)", name, creatorID)
+		if err != nil {
+			return err
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO room_members (room_id, user_id) VALUES (?, ?)", id, creatorID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetRoom(id)
+}
+
+// GetRoom returns a room, or nil when it does not exist.
+func GetRoom(roomID int64) (*Room, error) {
+	var room Room
+	err := DB.QueryRow(
+		"SELECT id, name, creator_id, created_at FROM rooms WHERE id = ?", roomID,
+	).Scan(&room.ID, &room.Name, &room.CreatorID, &room.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// GetRoomsForUser returns the rooms userID is a member of, newest first.
+func GetRoomsForUser(userID int64) ([]Room, error) {
+	rows, err := DB.Query(`
+		SELECT r.id, r.name, r.creator_id, r.created_at
+		FROM rooms r
+		JOIN room_members m ON m.room_id = r.id
+		WHERE m.user_id = ?
+		ORDER BY r.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make([]Room, 0)
+	for rows.Next() {
+		var room Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatorID, &room.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// AddRoomMember adds userID to a room and reports whether they were not a
+// member yet. New members only receive messages sent after they joined.
+// Users added through the API accept an invitation instead; see
+// InviteRoomMember.
+func AddRoomMember(roomID, userID int64) (bool, error) {
+	var added bool
+	err := WithTx(func(tx *sql.Tx) error {
+		var err error
+		added, err = addRoomMember(tx, roomID, userID)
+		return err
+	})
+	return added, err
+}
+
+func addRoomMember(tx *sql.Tx, roomID, userID int64) (bool, error) {
+	var members int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM room_members WHERE room_id = ?", roomID).Scan(&members); err != nil {
+		return false, err
+	}
+	result, err := tx.Exec("INSERT OR IGNORE INTO room_members (room_id, user_id) VALUES (?, ?)", roomID, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows == 1 && members >= MaximumRoomMembers {
+		return false, ErrRoomFull
+	}
+	return rows == 1, nil
+}
+
+// InviteRoomMember invites userID to a room on behalf of invitedBy and
+// reports whether a new invitation was recorded. Members and users already
+// invited are left as they are. Invitations to a full room fail with
+// ErrRoomFull.
+func InviteRoomMember(roomID, userID, invitedBy int64) (bool, error) {
+	var invited bool
+	err := WithTx(func(tx *sql.Tx) error {
+		var member bool
+		var members int
+		if err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id = ? AND user_id = ?), (SELECT COUNT(*) FROM room_members WHERE room_id = ?)",
+			roomID, userID, roomID,
+		).Scan(&member, &members); err != nil {
+			return err
+		}
+		if member {
+			return nil
+		}
+		if members >= MaximumRoomMembers {
+			return ErrRoomFull
+		}
+		result, err := tx.Exec(
+			"INSERT OR IGNORE INTO room_invites (room_id, user_id, invited_by) VALUES (?, ?, ?)", roomID, userID, invitedBy,
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		invited = rows == 1
+		return err
+	})
+	return invited, err
+}
+
+// AcceptRoomInvite makes userID a member of a room they were invited to and
+// reports whether there was an invitation. A full room fails with
+// ErrRoomFull and keeps the invitation.
+func AcceptRoomInvite(roomID, userID int64) (bool, error) {
+	var accepted bool
+	err := WithTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM room_invites WHERE room_id = ? AND user_id = ?", roomID, userID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil || rows == 0 {
+			return err
+		}
+		if _, err := addRoomMember(tx, roomID, userID); err != nil {
+			return err
+		}
+		accepted = true
+		return nil
+	})
+	return accepted, err
+}
+
+// DeclineRoomInvite drops userID's invitation to a room and reports whether
+// there was one.
+func DeclineRoomInvite(roomID, userID int64) (bool, error) {
+	result, err := DB.Exec("DELETE FROM room_invites WHERE room_id = ? AND user_id = ?", roomID, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// GetRoomInvitesForUser returns the invitations userID has not answered,
+// newest first.
+func GetRoomInvitesForUser(userID int64) ([]RoomInvite, error) {
+	rows, err := DB.Query(`
+		SELECT i.room_id, r.name, i.invited_by, i.created_at
+		FROM room_invites i
+		JOIN rooms r ON r.id = i.room_id
+		WHERE i.user_id = ?
+		ORDER BY i.created_at DESC, i.room_id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]RoomInvite, 0)
+	for rows.Next() {
+		var invite RoomInvite
+		if err := rows.Scan(&invite.RoomID, &invite.RoomName, &invite.InvitedBy, &invite.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// RemoveRoomMember removes userID from a room and reports whether they were a
+// member. They keep no access to the room's history. When the creator
+// leaves, the member who joined first after them takes over the room; a room
+// without members is deleted.
+func RemoveRoomMember(roomID, userID int64) (bool, error) {
+	var removed bool
+	err := WithTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM room_members WHERE room_id = ? AND user_id = ?", roomID, userID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil || rows == 0 {
+			return err
+		}
+		removed = true
+
+		var creatorID int64
+		if err := tx.QueryRow("SELECT creator_id FROM rooms WHERE id = ?", roomID).Scan(&creatorID); err != nil {
+			return err
+		}
+		if creatorID != userID {
+			return nil
+		}
+		var successor int64
+		err = tx.QueryRow(
+			"SELECT user_id FROM room_members WHERE room_id = ? ORDER BY joined_at, user_id LIMIT 1", roomID,
+		).Scan(&successor)
+		if errors.Is(err, sql.ErrNoRows) {
+			_, err = tx.Exec("DELETE FROM rooms WHERE id = ?", roomID)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE rooms SET creator_id = ? WHERE id = ?", successor, roomID)
+		return err
+	})
+	return removed, err
+}
+
+// IsRoomMember reports whether userID belongs to a room.
+func IsRoomMember(roomID, userID int64) (bool, error) {
+	var member bool
+	err := DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id = ? AND user_id = ?)", roomID, userID,
+	).Scan(&member)
+	return member, err
+}
+
+// GetRoomMemberIDs returns the members of a room in the order they joined.
+func GetRoomMemberIDs(roomID int64) ([]int64, error) {
+	return queryRoomMemberIDs(DB, roomID)
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryRoomMemberIDs(q queryer, roomID int64) ([]int64, error) {
+	rows, err := q.Query("SELECT user_id FROM room_members WHERE room_id = ? ORDER BY joined_at, user_id", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberIDs := make([]int64, 0)
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		memberIDs = append(memberIDs, userID)
+	}
+	return memberIDs, rows.Err()
+}
+
+// SaveRoomMessage stores a message senderID sent to a room, with one copy per
+// current member including the sender, and returns the stored copies. Copies
+// that do not match the members exactly fail with ErrRoomMembersChanged.
+// Retrying with the same client ID and copies returns the stored message and
+// false; different content fails with ErrIdempotencyConflict.
+func SaveRoomMessage(roomID, senderID int64, clientID, msgType string, copies []RoomMessageCopy, escrow []byte) ([]RoomMessage, bool, error) {
+	var (
+		id      int64
+		created bool
+	)
+	err := WithTx(func(tx *sql.Tx) error {
+		var existingRoomID int64
+		var existingType string
+		err := tx.QueryRow(
+			"SELECT id, room_id, type FROM room_messages WHERE sender_id = ? AND client_id = ?", senderID, clientID,
+		).Scan(&id, &existingRoomID, &existingType)
+		if err == nil {
+			if existingRoomID != roomID || existingType != msgType {
+				return ErrIdempotencyConflict
+			}
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		memberIDs, err := queryRoomMemberIDs(tx, roomID)
+		if err != nil {
+			return err
+		}
+		members := make(map[int64]bool, len(memberIDs))
+		for _, memberID := range memberIDs {
+			members[memberID] = true
+		}
+		if !members[senderID] {
+			return ErrNotRoomMember
+		}
+		if len(memberIDs) != len(copies) {
+			return ErrRoomMembersChanged
+		}
+		var size int64
+		for _, c := range copies {
+			if !members[c.RecipientID] {
+				return ErrRoomMembersChanged
+			}
+			// A duplicate recipient would leave another member out.
+			delete(members, c.RecipientID)
+			size += int64(len(c.Content))
+		}
+		if limit, policy := currentStorageQuota(); limit > 0 {
+			if err := enforceStorageQuota(tx, senderID, size, limit, policy); err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.Exec(
+			"INSERT INTO room_messages (room_id, sender_id, client_id, type, escrow_envelope) VALUES (?, ?, ?, ?, ?)",
+			roomID, senderID, clientID, msgType, escrow,
+		)
+		if err != nil {
+			return err
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		for _, c := range copies {
+			if _, err := tx.Exec(
+				"INSERT INTO room_message_copies (message_id, recipient_id, content, nonce, key_epoch) VALUES (?, ?, ?, ?, ?)",
+				id, c.RecipientID, c.Content, c.Nonce, c.KeyEpoch,
+			); err != nil {
+				return err
+			}
+		}
+		created = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	stored, err := getRoomMessageCopies(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if !created && !sameRoomMessageCopies(stored, copies) {
+		return nil, false, ErrIdempotencyConflict
+	}
+	return stored, created, nil
+}
+
+func sameRoomMessageCopies(stored []RoomMessage, copies []RoomMessageCopy) bool {
+	if len(stored) != len(copies) {
+		return false
+	}
+	byRecipient := make(map[int64]RoomMessage, len(stored))
+	for _, message := range stored {
+		byRecipient[message.RecipientID] = message
+	}
+	for _, c := range copies {
+		message, ok := byRecipient[c.RecipientID]
+		if !ok || !bytes.Equal(message.Content, c.Content) || !bytes.Equal(message.Nonce, c.Nonce) {
+			return false
+		}
+	}
+	return true
+}
+
+const roomMessageColumns = `m.id, m.room_id, m.sender_id, c.recipient_id, m.client_id, m.type, c.content, c.nonce, c.key_epoch, m.timestamp`
+
+func scanRoomMessages(rows *sql.Rows) ([]RoomMessage, error) {
+	defer rows.Close()
+	messages := make([]RoomMessage, 0)
+	for rows.Next() {
+		var m RoomMessage
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.SenderID, &m.RecipientID, &m.ClientID, &m.Type, &m.Content, &m.Nonce, &m.KeyEpoch, &m.Timestamp); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func getRoomMessageCopies(messageID int64) ([]RoomMessage, error) {
+	rows, err := DB.Query(`
+		SELECT `+roomMessageColumns+`
+		FROM room_message_copies c
+		JOIN room_messages m ON m.id = c.message_id
+		WHERE m.id = ?
+		ORDER BY c.recipient_id`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoomMessages(rows)
+}
+
+// GetRoomMessages returns userID's copies of the newest limit room messages
+// before beforeID, newest first. Messages sent before userID joined have no
+// copy for them and are left out.
+func GetRoomMessages(roomID, userID int64, limit int, beforeID int64) ([]RoomMessage, error) {
+	rows, err := DB.Query(`
+		SELECT `+roomMessageColumns+`
+		FROM room_message_copies c
+		JOIN room_messages m ON m.id = c.message_id
+		WHERE m.room_id = ? AND c.recipient_id = ? AND (? = 0 OR m.id < ?)
+		ORDER BY m.id DESC
+		LIMIT ?`,
+		roomID, userID, beforeID, beforeID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoomMessages(rows)
+}
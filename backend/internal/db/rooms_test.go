@@ -0,0 +1,194 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRoomMessagesFollowMembership(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(name string) *User {
+		t.Helper()
+		code, err := GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	bob, carol := register("bob"), register("carol")
+
+	room, err := CreateRoom("Team", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := AddRoomMember(room.ID, bob.ID); err != nil || !added {
+		t.Fatalf("add bob = %v, %v", added, err)
+	}
+	if added, err := AddRoomMember(room.ID, bob.ID); err != nil || added {
+		t.Fatalf("adding bob again = %v, %v", added, err)
+	}
+	copiesFor := func(content string, recipients ...*User) []RoomMessageCopy {
+		copies := make([]RoomMessageCopy, 0, len(recipients))
+		for _, recipient := range recipients {
+			copies = append(copies, RoomMessageCopy{RecipientID: recipient.ID, Content: []byte(content + " for " + recipient.Username), Nonce: make([]byte, 12)})
+		}
+		return copies
+	}
+
+	stored, created, err := SaveRoomMessage(room.ID, alice.ID, "room-message-0001", "text", copiesFor("first", alice, bob), nil)
+	if err != nil || !created || len(stored) != 2 {
+		t.Fatalf("first message = %v, %v, %v", stored, created, err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, alice.ID, "room-message-0001", "text", copiesFor("changed", alice, bob), nil); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("reused client ID error = %v", err)
+	}
+	if _, created, err := SaveRoomMessage(room.ID, alice.ID, "room-message-0001", "text", copiesFor("first", alice, bob), nil); err != nil || created {
+		t.Fatalf("retry = %v, %v", created, err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, carol.ID, "room-message-0002", "text", copiesFor("outsider", alice, bob), nil); !errors.Is(err, ErrNotRoomMember) {
+		t.Fatalf("outsider error = %v", err)
+	}
+
+	if _, err := AddRoomMember(room.ID, carol.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, bob.ID, "room-message-0003", "text", copiesFor("stale", alice, bob), nil); !errors.Is(err, ErrRoomMembersChanged) {
+		t.Fatalf("copies missing a new member error = %v", err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, bob.ID, "room-message-0003", "text", copiesFor("twice", alice, bob, bob), nil); !errors.Is(err, ErrRoomMembersChanged) {
+		t.Fatalf("duplicate recipient error = %v", err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, bob.ID, "room-message-0003", "text", copiesFor("second", alice, bob, carol), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := GetRoomMessages(room.ID, carol.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].SenderID != bob.ID || !bytes.Equal(history[0].Content, []byte("second for carol")) {
+		t.Fatalf("new member history = %+v, want only the message sent after joining", history)
+	}
+	history, err = GetRoomMessages(room.ID, alice.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || !bytes.Equal(history[1].Content, []byte("first for alice")) {
+		t.Fatalf("creator history = %+v", history)
+	}
+
+	if removed, err := RemoveRoomMember(room.ID, bob.ID); err != nil || !removed {
+		t.Fatalf("remove bob = %v, %v", removed, err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, alice.ID, "room-message-0004", "text", copiesFor("third", alice, bob, carol), nil); !errors.Is(err, ErrRoomMembersChanged) {
+		t.Fatalf("copy for a removed member error = %v", err)
+	}
+	if _, _, err := SaveRoomMessage(room.ID, alice.ID, "room-message-0004", "text", copiesFor("third", alice, carol), nil); err != nil {
+		t.Fatal(err)
+	}
+	if member, err := IsRoomMember(room.ID, bob.ID); err != nil || member {
+		t.Fatalf("bob still a member = %v, %v", member, err)
+	}
+	rooms, err := GetRoomsForUser(bob.ID)
+	if err != nil || len(rooms) != 0 {
+		t.Fatalf("rooms of removed member = %v, %v", rooms, err)
+	}
+
+	used, err := GetStorageUsage(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("first for alice") + len("first for bob") + len("third for alice") + len("third for carol")); used != want {
+		t.Fatalf("stored bytes = %d, want %d", used, want)
+	}
+}
+
+func TestRoomInvitesAndCreatorHandover(t *testing.T) {
+	initTestDB(t)
+	ctx := context.Background()
+	alice, err := RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(name string) *User {
+		t.Helper()
+		code, err := GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	bob, carol := register("bob"), register("carol")
+
+	room, err := CreateRoom("Team", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invited, err := InviteRoomMember(room.ID, bob.ID, alice.ID); err != nil || !invited {
+		t.Fatalf("invite bob = %v, %v", invited, err)
+	}
+	if invited, err := InviteRoomMember(room.ID, alice.ID, alice.ID); err != nil || invited {
+		t.Fatalf("invite a member = %v, %v", invited, err)
+	}
+	if member, err := IsRoomMember(room.ID, bob.ID); err != nil || member {
+		t.Fatalf("bob a member before accepting = %v, %v", member, err)
+	}
+	invites, err := GetRoomInvitesForUser(bob.ID)
+	if err != nil || len(invites) != 1 || invites[0].RoomID != room.ID || invites[0].RoomName != "Team" {
+		t.Fatalf("bob's invitations = %+v, %v", invites, err)
+	}
+	if accepted, err := AcceptRoomInvite(room.ID, carol.ID); err != nil || accepted {
+		t.Fatalf("accept without an invitation = %v, %v", accepted, err)
+	}
+	if accepted, err := AcceptRoomInvite(room.ID, bob.ID); err != nil || !accepted {
+		t.Fatalf("accept = %v, %v", accepted, err)
+	}
+	if member, err := IsRoomMember(room.ID, bob.ID); err != nil || !member {
+		t.Fatalf("bob a member after accepting = %v, %v", member, err)
+	}
+
+	if _, err := InviteRoomMember(room.ID, carol.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if declined, err := DeclineRoomInvite(room.ID, carol.ID); err != nil || !declined {
+		t.Fatalf("decline = %v, %v", declined, err)
+	}
+	if invites, err := GetRoomInvitesForUser(carol.ID); err != nil || len(invites) != 0 {
+		t.Fatalf("carol's invitations after declining = %+v, %v", invites, err)
+	}
+
+	if removed, err := RemoveRoomMember(room.ID, alice.ID); err != nil || !removed {
+		t.Fatalf("creator leaves = %v, %v", removed, err)
+	}
+	handedOver, err := GetRoom(room.ID)
+	if err != nil || handedOver == nil || handedOver.CreatorID != bob.ID {
+		t.Fatalf("room after the creator left = %+v, %v, want bob as creator", handedOver, err)
+	}
+	if _, err := InviteRoomMember(room.ID, carol.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := RemoveRoomMember(room.ID, bob.ID); err != nil || !removed {
+		t.Fatalf("last member leaves = %v, %v", removed, err)
+	}
+	if deleted, err := GetRoom(room.ID); err != nil || deleted != nil {
+		t.Fatalf("room without members = %+v, %v", deleted, err)
+	}
+	if invites, err := GetRoomInvitesForUser(carol.ID); err != nil || len(invites) != 0 {
+		t.Fatalf("invitations to a deleted room = %+v, %v", invites, err)
+	}
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// WithTx runs fn in a transaction, committing when it returns nil and rolling
+// back otherwise, including when it panics.
+//
+// The pool holds a single connection, which the transaction occupies until it
+// ends: fn must run every statement through tx. Using DB, or any function in
+// this package that does, from inside fn blocks forever.
+func WithTx(fn func(*sql.Tx) error) error {
+	return WithTxContext(context.Background(), fn)
+}
+
+// WithTxContext is WithTx with a context for beginning the transaction and
+// rolling it back when ctx is cancelled.
+func WithTxContext(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestWithTxCommitsOnlyOnSuccess(t *testing.T) {
+	initTestDB(t)
+	insert := func(code string, fail error) func(*sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			if _, err := tx.Exec("INSERT INTO invites (code) VALUES (?)", code); err != nil {
+				return err
+			}
+			if fail != nil {
+				panic(fail)
+			}
+			return nil
+		}
+	}
+	stored := func(code string) bool {
+		return ValidateInvite(code) == nil
+	}
+
+	if err := WithTx(insert("committed", nil)); err != nil || !stored("committed") {
+		t.Fatalf("WithTx() = %v, committed stored = %v", err, stored("committed"))
+	}
+
+	failure := errors.New("failed")
+	err := WithTx(func(tx *sql.Tx) error {
+		if err := insert("returned-error", nil)(tx); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) || stored("returned-error") {
+		t.Fatalf("WithTx() = %v, rolled back = %v", err, !stored("returned-error"))
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was swallowed")
+			}
+		}()
+		_ = WithTx(insert("panicked", failure))
+	}()
+	if stored("panicked") {
+		t.Fatal("a panicking transaction was committed")
+	}
+	// The connection must be released after each outcome.
+	if err := WithTx(insert("after-panic", nil)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
@@ -16,6 +17,10 @@ var (
 	ErrInvalidInvite  = errors.New("invalid or used invite code")
 	ErrUsernameExists = errors.New("username already exists")
 	ErrBootstrapAuth  = errors.New("bootstrap authorization required")
+
+	// ErrKeyUpdateTooSoon is returned when a user replaces their public key
+	// again before the minimum interval has passed.
+	ErrKeyUpdateTooSoon = errors.New("public key was updated too recently")
 )
 
 var dummyPasswordHash = func() string {
@@ -60,68 +65,89 @@ func CreateUser(username string, passwordHash string, publicKey []byte) (*User,
 
 // RegisterUser atomically creates a user and consumes the required invite.
 func RegisterUser(ctx context.Context, username, passwordHash string, publicKey []byte, inviteCode string, bootstrapAuthorized bool) (*User, error) {
-	tx, err := DB.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
-
-	var userCount int
-	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
-		return nil, err
-	}
+	return registerUser(ctx, username, passwordHash, publicKey, inviteCode, bootstrapAuthorized, false)
+}
 
-	requiresInvite := userCount > 0
-	if !requiresInvite && !bootstrapAuthorized {
-		return nil, ErrBootstrapAuth
-	}
-	if requiresInvite && inviteCode == "" {
-		return nil, ErrInviteRequired
-	}
+// RegisterOpenUser creates a user without an invite once the server has been
+// bootstrapped. Callers are responsible for any bot protection.
+func RegisterOpenUser(ctx context.Context, username, passwordHash string, publicKey []byte) (*User, error) {
+	return registerUser(ctx, username, passwordHash, publicKey, "", false, true)
+}
 
-	result, err := tx.ExecContext(ctx,
-		"INSERT INTO users (username, password_hash, public_key) VALUES (?, ?, ?)",
-		username, passwordHash, publicKey,
-	)
-	if err != nil {
-		var sqliteErr sqlite3.Error
-		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			return nil, ErrUsernameExists
+func registerUser(ctx context.Context, username, passwordHash string, publicKey []byte, inviteCode string, bootstrapAuthorized, open bool) (*User, error) {
+	var user User
+	err := WithTxContext(ctx, func(tx *sql.Tx) error {
+		var userCount int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
+			return err
 		}
-		return nil, err
-	}
 
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
+		bootstrapped := userCount > 0
+		requiresInvite := bootstrapped && !open
+		// Without the bootstrap secret, the first account needs the invite
+		// issued at startup.
+		bootstrapInvite := !bootstrapped && !bootstrapAuthorized && inviteCode != ""
+		if !bootstrapped && !bootstrapAuthorized && !bootstrapInvite {
+			return ErrBootstrapAuth
+		}
+		if requiresInvite && inviteCode == "" {
+			return ErrInviteRequired
+		}
 
-	if requiresInvite {
-		result, err = tx.ExecContext(ctx,
-			"UPDATE invites SET used_by = ?, used_at = ? WHERE code = ? AND used_by IS NULL",
-			userID, time.Now(), inviteCode,
+		// The bootstrap account administers the server.
+		result, err := tx.ExecContext(ctx,
+			"INSERT INTO users (username, password_hash, public_key, is_admin) VALUES (?, ?, ?, ?)",
+			username, passwordHash, publicKey, !bootstrapped,
 		)
 		if err != nil {
-			return nil, err
+			var sqliteErr sqlite3.Error
+			if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+				return ErrUsernameExists
+			}
+			return err
 		}
-		rows, err := result.RowsAffected()
+
+		userID, err := result.LastInsertId()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if rows != 1 {
-			return nil, ErrInvalidInvite
+
+		// The bootstrap invite only admits the first account, and ordinary
+		// invites only the ones after it.
+		if requiresInvite || bootstrapInvite {
+			result, err = tx.ExecContext(ctx,
+				"UPDATE invites SET used_by = ?, used_at = ? WHERE code = ? AND used_by IS NULL AND bootstrap = ?",
+				userID, time.Now(), inviteCode, bootstrapInvite,
+			)
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rows != 1 {
+				return ErrInvalidInvite
+			}
 		}
-	}
 
-	var user User
-	if err := tx.QueryRowContext(ctx,
-		"SELECT id, username, public_key, auth_version, created_at, last_seen FROM users WHERE id = ?",
-		userID,
-	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.AuthVersion, &user.CreatedAt, &user.LastSeen); err != nil {
-		return nil, fmt.Errorf("load registered user: %w", err)
-	}
+		if !bootstrapped {
+			// The logged bootstrap invite must not outlive a first account
+			// registered with the bootstrap secret instead.
+			if _, err := tx.ExecContext(ctx, "DELETE FROM invites WHERE bootstrap AND used_by IS NULL"); err != nil {
+				return err
+			}
+		}
 
-	if err := tx.Commit(); err != nil {
+		if err := tx.QueryRowContext(ctx,
+			"SELECT id, username, public_key, auth_version, is_admin, key_epoch, created_at, last_seen FROM users WHERE id = ?",
+			userID,
+		).Scan(&user.ID, &user.Username, &user.PublicKey, &user.AuthVersion, &user.IsAdmin, &user.KeyEpoch, &user.CreatedAt, &user.LastSeen); err != nil {
+			return fmt.Errorf("load registered user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &user, nil
@@ -130,9 +156,9 @@ func RegisterUser(ctx context.Context, username, passwordHash string, publicKey
 func GetUserByID(id int64) (*User, error) {
 	var user User
 	err := DB.QueryRow(
-		"SELECT id, username, public_key, auth_version, created_at, last_seen FROM users WHERE id = ?",
+		"SELECT id, username, public_key, auth_version, is_admin, key_epoch, created_at, last_seen FROM users WHERE id = ?",
 		id,
-	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.AuthVersion, &user.CreatedAt, &user.LastSeen)
+	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.AuthVersion, &user.IsAdmin, &user.KeyEpoch, &user.CreatedAt, &user.LastSeen)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -147,9 +173,9 @@ func GetUserByID(id int64) (*User, error) {
 func GetUserByUsername(username string) (*User, error) {
 	var user User
 	err := DB.QueryRow(
-		"SELECT id, username, public_key, auth_version, created_at, last_seen FROM users WHERE username = ?",
+		"SELECT id, username, public_key, auth_version, is_admin, key_epoch, created_at, last_seen FROM users WHERE username = ?",
 		username,
-	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.AuthVersion, &user.CreatedAt, &user.LastSeen)
+	).Scan(&user.ID, &user.Username, &user.PublicKey, &user.AuthVersion, &user.IsAdmin, &user.KeyEpoch, &user.CreatedAt, &user.LastSeen)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -164,9 +190,9 @@ func GetUserByUsername(username string) (*User, error) {
 func GetUserByUsernameWithPassword(username string) (*User, error) {
 	var user User
 	err := DB.QueryRow(
-		"SELECT id, username, password_hash, public_key, auth_version, created_at, last_seen FROM users WHERE username = ?",
+		"SELECT id, username, password_hash, public_key, auth_version, is_admin, key_epoch, created_at, last_seen FROM users WHERE username = ?",
 		username,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.PublicKey, &user.AuthVersion, &user.CreatedAt, &user.LastSeen)
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.PublicKey, &user.AuthVersion, &user.IsAdmin, &user.KeyEpoch, &user.CreatedAt, &user.LastSeen)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -177,9 +203,20 @@ func GetUserByUsernameWithPassword(username string) (*User, error) {
 	return &user, nil
 }
 
+// IsSystemUsername reports whether username is, without regard to case, the
+// name of an administrator or of the account systemUserID, which may be 0.
+func IsSystemUsername(username string, systemUserID int64) (bool, error) {
+	var system bool
+	err := DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM users WHERE username = ? COLLATE NOCASE AND (is_admin OR id = ?))",
+		username, systemUserID,
+	).Scan(&system)
+	return system, err
+}
+
 func GetAllUsers() ([]User, error) {
 	rows, err := DB.Query(
-		"SELECT id, username, public_key, created_at, last_seen FROM users ORDER BY username",
+		"SELECT id, username, public_key, is_admin, key_epoch, created_at, last_seen FROM users ORDER BY username",
 	)
 	if err != nil {
 		return nil, err
@@ -189,7 +226,7 @@ func GetAllUsers() ([]User, error) {
 	users := make([]User, 0)
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.PublicKey, &u.CreatedAt, &u.LastSeen); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.PublicKey, &u.IsAdmin, &u.KeyEpoch, &u.CreatedAt, &u.LastSeen); err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -197,14 +234,65 @@ func GetAllUsers() ([]User, error) {
 	return users, rows.Err()
 }
 
+// GetLastSeen returns the last-seen time for each existing user in ids.
+func GetLastSeen(ids []int64) (map[int64]time.Time, error) {
+	lastSeen := make(map[int64]time.Time, len(ids))
+	if len(ids) == 0 {
+		return lastSeen, nil
+	}
+	placeholders := strings.Repeat("?, ", len(ids)-1) + "?"
+	args := make([]interface{}, len(ids))
+	for index, id := range ids {
+		args[index] = id
+	}
+	rows, err := DB.Query("SELECT id, last_seen FROM users WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var seen time.Time
+		if err := rows.Scan(&id, &seen); err != nil {
+			return nil, err
+		}
+		lastSeen[id] = seen
+	}
+	return lastSeen, rows.Err()
+}
+
 func UpdateLastSeen(userID int64) error {
 	_, err := DB.Exec("UPDATE users SET last_seen = ? WHERE id = ?", time.Now(), userID)
 	return err
 }
 
-func UpdatePublicKey(userID int64, publicKey []byte) error {
-	_, err := DB.Exec("UPDATE users SET public_key = ? WHERE id = ?", publicKey, userID)
-	return err
+// UpdatePublicKey replaces a user's public key and bumps their key epoch, so
+// messages encrypted to the previous key can be detected. When the previous
+// change was less than minInterval ago it returns ErrKeyUpdateTooSoon and how
+// long to wait; a zero minInterval disables the check.
+func UpdatePublicKey(userID int64, publicKey []byte, minInterval time.Duration) (time.Duration, error) {
+	var wait time.Duration
+	err := WithTx(func(tx *sql.Tx) error {
+		var updatedAt sql.NullTime
+		if err := tx.QueryRow("SELECT key_updated_at FROM users WHERE id = ?", userID).Scan(&updatedAt); err != nil {
+			return err
+		}
+		if minInterval > 0 && updatedAt.Valid {
+			if wait = minInterval - time.Since(updatedAt.Time); wait > 0 {
+				return ErrKeyUpdateTooSoon
+			}
+		}
+		_, err := tx.Exec(
+			"UPDATE users SET public_key = ?, key_epoch = key_epoch + 1, key_updated_at = ? WHERE id = ?",
+			publicKey, time.Now().UTC(), userID,
+		)
+		return err
+	})
+	if errors.Is(err, ErrKeyUpdateTooSoon) {
+		return wait, err
+	}
+	return 0, err
 }
 
 func UpdatePasswordHash(userID int64, passwordHash string) error {
@@ -230,3 +318,66 @@ func GetAuthVersion(userID int64) (int64, error) {
 	err := DB.QueryRow("SELECT auth_version FROM users WHERE id = ?", userID).Scan(&version)
 	return version, err
 }
+
+// SetDoNotDisturb pauses or resumes live message pushes for a user.
+func SetDoNotDisturb(userID int64, enabled bool) error {
+	result, err := DB.Exec("UPDATE users SET do_not_disturb = ? WHERE id = ?", enabled, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func GetDoNotDisturb(userID int64) (bool, error) {
+	var enabled bool
+	err := DB.QueryRow("SELECT do_not_disturb FROM users WHERE id = ?", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Notification previews, from least to most revealing. Push notifications pass
+// through Apple's and Google's servers, so by default they only say that a
+// message arrived.
+const (
+	NotificationPreviewNone   = "none"
+	NotificationPreviewSender = "sender"
+	NotificationPreviewFull   = "full"
+)
+
+// ValidNotificationPreview reports whether value is a known preview level.
+func ValidNotificationPreview(value string) bool {
+	switch value {
+	case NotificationPreviewNone, NotificationPreviewSender, NotificationPreviewFull:
+		return true
+	}
+	return false
+}
+
+// SetNotificationPreview sets how much a user's push notifications reveal:
+// nothing, the sender, or the sender and the message type.
+func SetNotificationPreview(userID int64, preview string) error {
+	result, err := DB.Exec("UPDATE users SET notification_preview = ? WHERE id = ?", preview, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func GetNotificationPreview(userID int64) (string, error) {
+	var preview string
+	err := DB.QueryRow("SELECT notification_preview FROM users WHERE id = ?", userID).Scan(&preview)
+	return preview, err
+}
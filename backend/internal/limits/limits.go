@@ -0,0 +1,143 @@
+// Package limits holds the input bounds shared by the HTTP API and the
+// command-line tools so that both apply the same validation rules.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// bcryptPasswordLimit is the number of password bytes bcrypt actually hashes.
+const bcryptPasswordLimit = 72
+
+type Limits struct {
+	UsernameMinLength    int
+	UsernameMaxLength    int
+	PasswordMinLength    int
+	PasswordMaxLength    int
+	MessageTypeMaxLength int
+	InviteCodeMaxLength  int
+	// MessageMaxBytes bounds decoded message content sent over REST and
+	// the frames a WebSocket client sends, so both transports agree. Frames
+	// may always be 64 KiB, so that call signaling fits.
+	MessageMaxBytes int
+}
+
+var Default = Limits{
+	UsernameMinLength:    3,
+	UsernameMaxLength:    32,
+	PasswordMinLength:    8,
+	PasswordMaxLength:    bcryptPasswordLimit,
+	MessageTypeMaxLength: 16,
+	InviteCodeMaxLength:  64,
+	MessageMaxBytes:      64 << 10,
+}
+
+var current = struct {
+	sync.RWMutex
+	limits Limits
+}{limits: Default}
+
+// Validate reports whether the limits are internally consistent.
+func (l Limits) Validate() error {
+	if l.UsernameMinLength < 1 || l.UsernameMaxLength < l.UsernameMinLength {
+		return errors.New("username length bounds are invalid")
+	}
+	if l.PasswordMinLength < 1 || l.PasswordMaxLength < l.PasswordMinLength {
+		return errors.New("password length bounds are invalid")
+	}
+	if l.PasswordMaxLength > bcryptPasswordLimit {
+		return fmt.Errorf("password length cannot exceed %d bytes", bcryptPasswordLimit)
+	}
+	if l.MessageTypeMaxLength < 1 || l.InviteCodeMaxLength < 1 || l.MessageMaxBytes < 1 {
+		return errors.New("field length limits must be positive")
+	}
+	return nil
+}
+
+// Configure replaces the active limits after validating them.
+func Configure(l Limits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	current.Lock()
+	current.limits = l
+	current.Unlock()
+	return nil
+}
+
+// ConfigureFromEnv replaces the active limits with the defaults overridden by
+// any of USERNAME_MIN_LENGTH, USERNAME_MAX_LENGTH, PASSWORD_MIN_LENGTH,
+// PASSWORD_MAX_LENGTH, MESSAGE_TYPE_MAX_LENGTH, INVITE_CODE_MAX_LENGTH and
+// MESSAGE_MAX_BYTES that getenv returns.
+func ConfigureFromEnv(getenv func(string) string) error {
+	l := Default
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"USERNAME_MIN_LENGTH", &l.UsernameMinLength},
+		{"USERNAME_MAX_LENGTH", &l.UsernameMaxLength},
+		{"PASSWORD_MIN_LENGTH", &l.PasswordMinLength},
+		{"PASSWORD_MAX_LENGTH", &l.PasswordMaxLength},
+		{"MESSAGE_TYPE_MAX_LENGTH", &l.MessageTypeMaxLength},
+		{"INVITE_CODE_MAX_LENGTH", &l.InviteCodeMaxLength},
+		{"MESSAGE_MAX_BYTES", &l.MessageMaxBytes},
+	} {
+		value := getenv(field.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", field.name, value)
+		}
+		*field.value = parsed
+	}
+	if err := Configure(l); err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
+	}
+	return nil
+}
+
+// Current returns the active limits.
+func Current() Limits {
+	current.RLock()
+	defer current.RUnlock()
+	return current.limits
+}
+
+// ValidClientID reports whether value can serve as an ID a client picks for
+// something it creates, such as a message or a call session: 16 to 64 ASCII
+// letters, digits, hyphens and underscores. Server-issued hex IDs qualify.
+func ValidClientID(value string) bool {
+	if len(value) < 16 || len(value) > 64 {
+		return false
+	}
+	for _, char := range value {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') || char == '-' || char == '_' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func ValidUsername(username string) bool {
+	l := Current()
+	return len(username) >= l.UsernameMinLength && len(username) <= l.UsernameMaxLength
+}
+
+func ValidPassword(password string) bool {
+	l := Current()
+	return len(password) >= l.PasswordMinLength && len(password) <= l.PasswordMaxLength
+}
+
+// PasswordError describes the password length rule for user-facing errors.
+func PasswordError() string {
+	l := Current()
+	return fmt.Sprintf("password must be between %d and %d characters", l.PasswordMinLength, l.PasswordMaxLength)
+}
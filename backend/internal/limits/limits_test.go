@@ -0,0 +1,132 @@
+package limits
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultLimitsAreValid(t *testing.T) {
+	if err := Default.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigureRejectsInconsistentLimits(t *testing.T) {
+	t.Cleanup(func() { _ = Configure(Default) })
+	tests := []struct {
+		name   string
+		modify func(*Limits)
+	}{
+		{name: "username bounds reversed", modify: func(l *Limits) { l.UsernameMinLength, l.UsernameMaxLength = 10, 5 }},
+		{name: "zero password minimum", modify: func(l *Limits) { l.PasswordMinLength = 0 }},
+		{name: "password beyond bcrypt", modify: func(l *Limits) { l.PasswordMaxLength = 100 }},
+		{name: "zero message type length", modify: func(l *Limits) { l.MessageTypeMaxLength = 0 }},
+		{name: "zero message size", modify: func(l *Limits) { l.MessageMaxBytes = 0 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := Default
+			test.modify(&l)
+			if err := Configure(l); err == nil {
+				t.Fatal("inconsistent limits were accepted")
+			}
+			if Current() != Default {
+				t.Fatal("rejected limits replaced the active configuration")
+			}
+		})
+	}
+}
+
+func TestConfigureFromEnv(t *testing.T) {
+	t.Cleanup(func() { _ = Configure(Default) })
+	env := map[string]string{"MESSAGE_MAX_BYTES": "1024", "USERNAME_MIN_LENGTH": "2"}
+	if err := ConfigureFromEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	want := Default
+	want.MessageMaxBytes = 1024
+	want.UsernameMinLength = 2
+	if Current() != want {
+		t.Fatalf("limits = %+v, want %+v", Current(), want)
+	}
+
+	for _, bad := range []map[string]string{
+		{"MESSAGE_MAX_BYTES": "64KB"},
+		{"PASSWORD_MAX_LENGTH": "100"},
+	} {
+		if err := ConfigureFromEnv(func(name string) string { return bad[name] }); err == nil {
+			t.Errorf("%v was accepted", bad)
+		}
+		if Current() != want {
+			t.Fatalf("rejected %v replaced the active configuration", bad)
+		}
+	}
+}
+
+func TestValidUsernameAndPasswordFollowConfiguration(t *testing.T) {
+	t.Cleanup(func() { _ = Configure(Default) })
+	if !ValidUsername("bob") || ValidUsername("bo") || !ValidPassword("12345678") || ValidPassword("1234567") {
+		t.Fatal("default limits were not applied")
+	}
+	l := Default
+	l.UsernameMinLength = 2
+	l.PasswordMinLength = 12
+	if err := Configure(l); err != nil {
+		t.Fatal(err)
+	}
+	if !ValidUsername("bo") || ValidPassword("12345678") {
+		t.Fatal("configured limits were not applied")
+	}
+}
+
+func TestUsernamePolicy(t *testing.T) {
+	t.Cleanup(func() { _ = ConfigureUsernamePolicy("", "") })
+	if err := ConfigureUsernamePolicy("", "[a-z"); err == nil {
+		t.Fatal("invalid pattern was accepted")
+	}
+	if err := CheckUsernamePolicy("admin"); err != nil {
+		t.Fatalf("default policy refused admin: %v", err)
+	}
+	if err := ConfigureUsernamePolicy(" admin, Support ,", "[a-z][a-z0-9_]*"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		err      error
+	}{
+		{username: "alice_2", err: nil},
+		{username: "admin", err: ErrReservedUsername},
+		{username: "ADMIN", err: ErrReservedUsername},
+		{username: "support", err: ErrReservedUsername},
+		{username: "administrator", err: nil},
+		{username: "Alice", err: ErrUsernameNotAllowed},
+		{username: "alice!", err: ErrUsernameNotAllowed},
+	}
+	for _, test := range tests {
+		if err := CheckUsernamePolicy(test.username); err != test.err {
+			t.Errorf("CheckUsernamePolicy(%q) = %v, want %v", test.username, err, test.err)
+		}
+	}
+	if err := CheckUsernamePattern("admin"); err != nil {
+		t.Errorf("CheckUsernamePattern(%q) = %v, want nil", "admin", err)
+	}
+	if err := CheckUsernamePattern("Admin"); err != ErrUsernameNotAllowed {
+		t.Errorf("CheckUsernamePattern(%q) = %v, want %v", "Admin", err, ErrUsernameNotAllowed)
+	}
+}
+
+func TestValidClientID(t *testing.T) {
+	for value, want := range map[string]bool{
+		"0123456789abcdef":          true,
+		"message-ID_0123456789":     true,
+		"0123456789abcde":           false,
+		"0123456789abcdef!":         false,
+		"0123456789abcdef 01234567": false,
+		strings.Repeat("a", 64):     true,
+		strings.Repeat("a", 65):     false,
+	} {
+		if got := ValidClientID(value); got != want {
+			t.Errorf("ValidClientID(%q) = %t, want %t", value, got, want)
+		}
+	}
+}
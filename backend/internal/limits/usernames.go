@@ -0,0 +1,71 @@
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrReservedUsername   = errors.New("username is reserved")
+	ErrUsernameNotAllowed = errors.New("username does not match the required format")
+)
+
+var usernamePolicy = struct {
+	sync.RWMutex
+	reserved map[string]struct{}
+	pattern  *regexp.Regexp
+}{}
+
+// ConfigureUsernamePolicy sets the usernames self-service registration
+// refuses: reserved is a comma-separated list of names matched without regard
+// to case, and pattern a regular expression every new username must match in
+// full. Empty values reserve nothing and allow any name.
+func ConfigureUsernamePolicy(reserved, pattern string) error {
+	names := make(map[string]struct{})
+	for _, name := range strings.Split(reserved, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[strings.ToLower(name)] = struct{}{}
+		}
+	}
+	var compiled *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if compiled, err = regexp.Compile(`^(?:` + pattern + `)$`); err != nil {
+			return fmt.Errorf("USERNAME_PATTERN is not a valid regular expression: %v", err)
+		}
+	}
+	usernamePolicy.Lock()
+	usernamePolicy.reserved = names
+	usernamePolicy.pattern = compiled
+	usernamePolicy.Unlock()
+	return nil
+}
+
+// CheckUsernamePolicy reports why a new username is refused by the configured
+// policy, or nil if it may be registered. Length is checked by ValidUsername.
+func CheckUsernamePolicy(username string) error {
+	usernamePolicy.RLock()
+	defer usernamePolicy.RUnlock()
+	if _, reserved := usernamePolicy.reserved[strings.ToLower(username)]; reserved {
+		return ErrReservedUsername
+	}
+	return checkUsernamePattern(username)
+}
+
+// CheckUsernamePattern is CheckUsernamePolicy without the reserved names, for
+// accounts the operator creates.
+func CheckUsernamePattern(username string) error {
+	usernamePolicy.RLock()
+	defer usernamePolicy.RUnlock()
+	return checkUsernamePattern(username)
+}
+
+func checkUsernamePattern(username string) error {
+	if usernamePolicy.pattern != nil && !usernamePolicy.pattern.MatchString(username) {
+		return ErrUsernameNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Gorush platform codes.
+const (
+	gorushIOS     = 1
+	gorushAndroid = 2
+)
+
+// gorushProvider relays notifications through a Gorush gateway, which holds
+// the APNs and FCM credentials.
+type gorushProvider struct {
+	endpoint string
+	client   *http.Client
+}
+
+type gorushNotification struct {
+	Tokens   []string          `json:"tokens"`
+	Platform int               `json:"platform"`
+	Message  string            `json:"message"`
+	Data     map[string]string `json:"data"`
+}
+
+func (p *gorushProvider) Send(ctx context.Context, notification Notification) error {
+	platform := gorushAndroid
+	if notification.Platform == PlatformIOS {
+		platform = gorushIOS
+	}
+	message := "New message"
+	data := map[string]string{"message_id": fmt.Sprint(notification.MessageID)}
+	if notification.SenderID != 0 {
+		message = "New message from " + notification.SenderName
+		data["sender_id"] = fmt.Sprint(notification.SenderID)
+	}
+	if notification.MessageType != "" {
+		data["type"] = notification.MessageType
+	}
+	body, err := json.Marshal(map[string][]gorushNotification{
+		"notifications": {{
+			Tokens:   []string{notification.Token},
+			Platform: platform,
+			Message:  message,
+			Data:     data,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := p.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("push gateway returned %s", response.Status)
+	default:
+		return fmt.Errorf("%w: push gateway returned %s", ErrPermanent, response.Status)
+	}
+}
@@ -0,0 +1,176 @@
+// Package push wakes mobile clients that are not connected to the WebSocket
+// hub. Notifications carry the message identifier and, if the recipient opted
+// in, who sent it and its type; the client fetches and decrypts the message
+// itself once it is running.
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+
+	ProviderGorush = "gorush"
+)
+
+const (
+	queueSize       = 256
+	sendTimeout     = 10 * time.Second
+	defaultAttempts = 3
+	defaultBackoff  = time.Second
+)
+
+// ErrPermanent marks a delivery failure that retrying cannot fix, such as a
+// rejected request.
+var ErrPermanent = errors.New("permanent push failure")
+
+// Notification is a single wake-up for one device. The sender and message
+// type are left empty unless the recipient chose to preview them.
+type Notification struct {
+	Token       string
+	Platform    string
+	MessageID   int64
+	SenderID    int64
+	SenderName  string
+	MessageType string
+}
+
+// Provider hands a notification to a push service.
+type Provider interface {
+	Send(ctx context.Context, notification Notification) error
+}
+
+// Dispatcher delivers notifications in the background so that a slow push
+// service never delays the request that triggered it.
+type Dispatcher struct {
+	provider Provider
+	attempts int
+	backoff  time.Duration
+	queue    chan Notification
+	done     chan struct{}
+}
+
+func newDispatcher(provider Provider, attempts int, backoff time.Duration) *Dispatcher {
+	d := &Dispatcher{
+		provider: provider,
+		attempts: attempts,
+		backoff:  backoff,
+		queue:    make(chan Notification, queueSize),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Enqueue schedules a notification. It never blocks; when the queue is full
+// the notification is dropped, since the message is still stored.
+func (d *Dispatcher) Enqueue(notification Notification) bool {
+	select {
+	case d.queue <- notification:
+		return true
+	default:
+		log.Printf("Push queue full; dropping notification for message %d", notification.MessageID)
+		return false
+	}
+}
+
+// Close stops accepting notifications and waits for queued ones to finish.
+func (d *Dispatcher) Close() {
+	close(d.queue)
+	<-d.done
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for notification := range d.queue {
+		if err := d.deliver(notification); err != nil {
+			log.Printf("Push for message %d failed: %v", notification.MessageID, err)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(notification Notification) error {
+	backoff := d.backoff
+	var err error
+	for attempt := 1; attempt <= d.attempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err = d.provider.Send(ctx, notification)
+		cancel()
+		if err == nil || errors.Is(err, ErrPermanent) {
+			return err
+		}
+		if attempt < d.attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+var dispatcher struct {
+	sync.RWMutex
+	current *Dispatcher
+}
+
+// Configure selects the push provider. An empty provider disables push.
+func Configure(provider, gatewayURL string) error {
+	var next *Dispatcher
+	switch provider {
+	case "":
+	case ProviderGorush:
+		parsed, err := url.Parse(gatewayURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("PUSH_GATEWAY_URL must be an http or https URL")
+		}
+		next = newDispatcher(&gorushProvider{endpoint: parsed.JoinPath("api", "push").String()}, defaultAttempts, defaultBackoff)
+	default:
+		return fmt.Errorf("unsupported PUSH_PROVIDER %q", provider)
+	}
+
+	dispatcher.Lock()
+	previous := dispatcher.current
+	dispatcher.current = next
+	dispatcher.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Enabled reports whether a push provider is configured.
+func Enabled() bool {
+	dispatcher.RLock()
+	defer dispatcher.RUnlock()
+	return dispatcher.current != nil
+}
+
+// Notify queues notifications for the configured provider. It is a no-op when
+// push is disabled.
+func Notify(notifications ...Notification) {
+	dispatcher.RLock()
+	defer dispatcher.RUnlock()
+	if dispatcher.current == nil {
+		return
+	}
+	for _, notification := range notifications {
+		dispatcher.current.Enqueue(notification)
+	}
+}
+
+// Shutdown drains queued notifications and disables push.
+func Shutdown() {
+	_ = Configure("", "")
+}
+
+// ValidPlatform reports whether platform names a supported device platform.
+func ValidPlatform(platform string) bool {
+	return platform == PlatformIOS || platform == PlatformAndroid
+}
@@ -0,0 +1,120 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type recordingProvider struct {
+	mu       sync.Mutex
+	failures []error
+	sent     []Notification
+	attempts int
+}
+
+func (p *recordingProvider) Send(_ context.Context, notification Notification) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	if len(p.failures) > 0 {
+		err := p.failures[0]
+		p.failures = p.failures[1:]
+		return err
+	}
+	p.sent = append(p.sent, notification)
+	return nil
+}
+
+func TestDispatcherRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []error
+		attempts int
+		sent     int
+	}{
+		{name: "transient", failures: []error{errors.New("unavailable"), errors.New("unavailable")}, attempts: 3, sent: 1},
+		{name: "exhausted", failures: []error{errors.New("a"), errors.New("b"), errors.New("c")}, attempts: 3, sent: 0},
+		{name: "permanent", failures: []error{ErrPermanent}, attempts: 1, sent: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &recordingProvider{failures: test.failures}
+			dispatcher := newDispatcher(provider, 3, 0)
+			dispatcher.Enqueue(Notification{Token: "token", Platform: PlatformIOS, MessageID: 7})
+			dispatcher.Close()
+			if provider.attempts != test.attempts || len(provider.sent) != test.sent {
+				t.Fatalf("attempts = %d, sent = %d; want %d, %d", provider.attempts, len(provider.sent), test.attempts, test.sent)
+			}
+		})
+	}
+}
+
+func TestGorushProviderSendsPlaceholderOnly(t *testing.T) {
+	var received struct {
+		Notifications []gorushNotification `json:"notifications"`
+	}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/push" {
+			t.Errorf("path = %q", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	provider := &gorushProvider{endpoint: server.URL + "/api/push", client: server.Client()}
+	notification := Notification{Token: "device-token", Platform: PlatformIOS, MessageID: 42}
+	if err := provider.Send(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+	if len(received.Notifications) != 1 {
+		t.Fatalf("notifications = %+v", received.Notifications)
+	}
+	got := received.Notifications[0]
+	if got.Platform != gorushIOS || got.Tokens[0] != "device-token" || got.Data["message_id"] != "42" || got.Message != "New message" ||
+		len(got.Data) != 1 {
+		t.Fatalf("unexpected notification %+v", got)
+	}
+
+	preview := Notification{Token: "device-token", Platform: PlatformAndroid, MessageID: 43, SenderID: 3, SenderName: "alice", MessageType: "text"}
+	if err := provider.Send(context.Background(), preview); err != nil {
+		t.Fatal(err)
+	}
+	got = received.Notifications[0]
+	if got.Platform != gorushAndroid || got.Message != "New message from alice" || got.Data["sender_id"] != "3" || got.Data["type"] != "text" {
+		t.Fatalf("unexpected preview notification %+v", got)
+	}
+
+	status = http.StatusBadRequest
+	if err := provider.Send(context.Background(), notification); !errors.Is(err, ErrPermanent) {
+		t.Fatalf("400 response: expected ErrPermanent, got %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := provider.Send(context.Background(), notification); err == nil || errors.Is(err, ErrPermanent) {
+		t.Fatalf("502 response should be retryable, got %v", err)
+	}
+}
+
+func TestConfigureRejectsInvalidProviders(t *testing.T) {
+	t.Cleanup(Shutdown)
+	for _, test := range []struct{ provider, gatewayURL string }{
+		{provider: "apns"},
+		{provider: ProviderGorush},
+		{provider: ProviderGorush, gatewayURL: "ftp://push.example"},
+	} {
+		if err := Configure(test.provider, test.gatewayURL); err == nil {
+			t.Errorf("Configure(%q, %q) succeeded", test.provider, test.gatewayURL)
+		}
+	}
+	if err := Configure(ProviderGorush, "https://push.example"); err != nil || !Enabled() {
+		t.Fatalf("Configure gorush: enabled=%t err=%v", Enabled(), err)
+	}
+}
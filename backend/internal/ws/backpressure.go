@@ -0,0 +1,45 @@
+package ws
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// slowConsumerDrops is how many events a session may miss because Send
+	// was full before it is disconnected.
+	slowConsumerDrops = 32
+
+	// closeSlowConsumer is the close code sent to sessions that fell too far
+	// behind. Unlike closeIdleTimeout, clients should reconnect right away
+	// and refetch, since they have missed events.
+	closeSlowConsumer = 4001
+)
+
+// noteDrop reacts to an event dropped because Send was full, given how many
+// the session has dropped so far. The first drop queues a slow_consumer event
+// on the control buffer. It is written once the session has caught up on Send,
+// telling the client to refetch what it missed. If the control buffer is full
+// as well, the next drop tries again. Reaching slowConsumerDrops disconnects
+// the session with closeSlowConsumer.
+func (c *Client) noteDrop(dropped int64) {
+	if c.slowWarned.CompareAndSwap(false, true) {
+		data, _ := json.Marshal(map[string]int64{"dropped": dropped})
+		if !c.tryControl(c.Hub.serializeMessage(Message{Type: "slow_consumer", To: c.UserID, Data: data, Timestamp: time.Now().Unix()})) {
+			c.slowWarned.Store(false)
+		}
+	}
+	if dropped != slowConsumerDrops {
+		return
+	}
+	c.slow.Store(true)
+	c.Hub.slowConsumers.Add(1)
+	// Drops happen under the hub's read lock, which unregistering takes for
+	// writing, so hand the session to the event loop instead.
+	go func() {
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.Done():
+		}
+	}()
+}
@@ -2,19 +2,44 @@ package ws
 
 import (
 	"chatapp/internal/db"
+	"chatapp/internal/limits"
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"log"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 65536 // 64KB
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	// minimumReadLimit keeps frames such as SDP offers readable when
+	// MESSAGE_MAX_BYTES is set lower than they need.
+	minimumReadLimit = 64 << 10
+
+	// Clients that opt into batching receive events queued within batchWindow
+	// as a single frame of at most maxBatchEvents.
+	batchWindow    = 5 * time.Millisecond
+	maxBatchEvents = 64
+
+	// typingExpiry bounds how long a typing indicator stays active without
+	// being refreshed by the sender. Expired indicators are swept every
+	// typingSweepPeriod and the recipient gets typing:false.
+	typingExpiry      = 5 * time.Second
+	typingSweepPeriod = time.Second
+
+	// typingRefreshInterval is how often repeated typing:true frames reach the
+	// recipient, so that clients timing indicators out themselves keep
+	// showing them.
+	typingRefreshInterval = typingExpiry / 2
 )
 
 var (
@@ -39,19 +64,73 @@ type Hub struct {
 	done       chan struct{}
 	stopOnce   sync.Once
 	mu         sync.RWMutex
+
+	typingMu sync.Mutex
+	typing   map[typingPair]typingState // sender/recipient -> active indicator
+
+	subscriptionsMu sync.Mutex
+	subscriptions   map[int64]map[*Client]struct{} // watched userID -> subscribed sessions
+
+	signalingMu         sync.Mutex
+	signalingPeers      map[typingPair]*signalingBucket // sender/recipient -> call signaling budget
+	callSequences       map[string]*callSequence        // call session ID -> signaling numbering
+	callSequenceOrder   *list.List                      // call session IDs, most recently signaled first
+	signalingViolations atomic.Int64
+
+	resumeMu  sync.Mutex
+	resumable map[string]*resumeState // resume token -> recently closed session
+
+	presenceSeq int64            // last presence change, guarded by mu
+	presenceLog []presenceChange // recent presence changes, oldest first, guarded by mu
+
+	droppedSends   atomic.Int64
+	droppedControl atomic.Int64
+	slowConsumers  atomic.Int64
+}
+
+type typingPair struct {
+	From int64
+	To   int64
 }
 
 type Client struct {
 	Hub         *Hub
 	Conn        *websocket.Conn
-	Send        chan []byte
+	Send        chan []byte // messages and other durable events
 	UserID      int64
 	Username    string
 	AuthVersion int64
+	Resumable   bool   // the session asked for a resume token
+	ResumeToken string // token presented to resume a recently closed session
+	batching    atomic.Bool
+	watching    map[int64]struct{} // presence subscriptions, guarded by Hub.subscriptionsMu
+
+	authMu         sync.Mutex
+	tokenID        string // jti of the token that authenticated the session
+	tokenExpiry    time.Time
+	reauthDeadline time.Time
+
+	// Signaling budget, used only by the session's read loop.
+	signaling        signalingBucket
+	signalingStrikes int
+	abusive          atomic.Bool
+
+	lastActivity atomic.Int64 // unix nanoseconds of the last application frame from the client
+	evicted      atomic.Bool
+	dropped      atomic.Int64 // frames dropped because Send was full
+	slowWarned   atomic.Bool  // a slow_consumer event was queued
+	slow         atomic.Bool  // disconnected for dropping too many frames
+
+	// Ephemeral control events wait here, apart from Send, so a burst of them
+	// is dropped before it can crowd out a message. Made by RegisterClient.
+	control        chan []byte
+	controlDropped atomic.Int64
+
+	resumeToken string // issued on register when Resumable is set
 }
 
 type WSMessage struct {
-	Type      string          `json:"type"` // message, typing, presence, call_offer, call_answer, call_ice, call_end, clear_messages
+	Type      string          `json:"type"` // hello, reauth, message, typing, presence, subscribe_presence, unsubscribe_presence, call_offer, call_answer, call_ice, call_end, clear_messages
 	Payload   json.RawMessage `json:"payload"`
 	Timestamp int64           `json:"timestamp"`
 }
@@ -64,7 +143,27 @@ type Message struct {
 	Content   []byte `json:"content,omitempty"`
 	Nonce     []byte `json:"nonce,omitempty"`
 	Timestamp int64  `json:"timestamp"`
-	Data      []byte `json:"data,omitempty"` // For WebRTC signaling
+	Data      []byte `json:"data,omitempty"`       // For WebRTC signaling
+	SessionID string `json:"session_id,omitempty"` // Call session for signaling events
+	Seq       int64  `json:"seq,omitempty"`        // Order of a signaling event within its call session
+	Version   int64  `json:"version,omitempty"`    // Conversation version after a message change
+	RoomID    int64  `json:"room_id,omitempty"`    // Room of room messages and membership events
+}
+
+// controlEvents are the event types a client can afford to miss: a later event
+// supersedes them, or the client refetches the state they describe.
+var controlEvents = map[string]bool{
+	"presence":        true,
+	"presence_detail": true,
+	"typing":          true,
+	"read_receipt":    true,
+	"unread_total":    true,
+}
+
+type Batch struct {
+	Type      string            `json:"type"`
+	Events    []json.RawMessage `json:"events"`
+	Timestamp int64             `json:"timestamp"`
 }
 
 type Presence struct {
@@ -80,99 +179,208 @@ func NewHub() *Hub {
 		unregister: make(chan *Client),
 		stop:       make(chan struct{}),
 		done:       make(chan struct{}),
+		typing:     make(map[typingPair]typingState),
+
+		subscriptions:     make(map[int64]map[*Client]struct{}),
+		signalingPeers:    make(map[typingPair]*signalingBucket),
+		callSequences:     make(map[string]*callSequence),
+		callSequenceOrder: list.New(),
+		resumable:         make(map[string]*resumeState),
 	}
 }
 
 func (h *Hub) Run() {
-	go h.handleEvents()
+	go h.supervise()
 }
 
-func (h *Hub) handleEvents() {
+// supervise keeps the event loop running until the hub is stopped. A panic
+// while handling one event is logged and the loop restarts, so a single bad
+// event cannot silently stop message and presence delivery.
+func (h *Hub) supervise() {
 	defer close(h.done)
+	for !h.handleEvents() {
+		log.Printf("Hub event loop restarted after panic")
+	}
+}
+
+// handleEvents processes events until the hub is stopped, returning true, or
+// until an event handler panics, returning false.
+func (h *Hub) handleEvents() (stopped bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("Hub event loop panic: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+	idleSweep := time.NewTicker(idleSweepPeriod)
+	defer idleSweep.Stop()
+	typingSweep := time.NewTicker(typingSweepPeriod)
+	defer typingSweep.Stop()
 	for {
 		select {
 		case client := <-h.Register:
-			h.mu.Lock()
-			wasOffline := len(h.Clients[client.UserID]) == 0
-			// Send current online users to the new client
-			for id, sessions := range h.Clients {
-				if id != client.UserID {
-					var username string
-					for session := range sessions {
-						username = session.Username
-						break
-					}
-					msg := Message{
-						Type: "presence",
-						Data: func() []byte {
-							p := Presence{
-								UserID:   id,
-								Username: username,
-								Online:   true,
-							}
-							b, _ := json.Marshal(p)
-							return b
-						}(),
-						Timestamp: time.Now().Unix(),
-					}
-					select {
-					case client.Send <- h.serializeMessage(msg):
-					default:
-					}
-				}
-			}
-			if h.Clients[client.UserID] == nil {
-				h.Clients[client.UserID] = make(map[*Client]struct{})
-			}
-			h.Clients[client.UserID][client] = struct{}{}
-			h.mu.Unlock()
-			if wasOffline {
-				h.notifyPresence(client.UserID, client.Username, true)
-			}
-
+			h.register(client)
 		case client := <-h.unregister:
-			h.mu.Lock()
-			sessions := h.Clients[client.UserID]
-			_, registered := sessions[client]
-			if registered {
-				delete(sessions, client)
-				close(client.Send)
+			h.unregisterClient(client)
+		case now := <-idleSweep.C:
+			h.evictIdle(now)
+			h.pruneSignalingPeers(now)
+			h.pruneCallSequences(now)
+			h.pruneResumable(now)
+		case now := <-typingSweep.C:
+			h.sendTypingStopped(h.expireTyping(now), now)
+		case <-h.stop:
+			h.closeAll()
+			return true
+		}
+	}
+}
+
+func (h *Hub) register(client *Client) {
+	var resumed *resumeState
+	if client.Resumable {
+		resumed = h.takeResume(client.ResumeToken, client.UserID, time.Now())
+		client.resumeToken = newCallSessionID()
+	}
+	wasOffline, replayed := h.addClient(client, resumed)
+	if wasOffline {
+		h.notifyPresence(client.UserID, client.Username, true)
+		go h.notifySubscribers(client.UserID)
+	}
+	if client.Resumable {
+		h.sendSession(client, replayed)
+	}
+	go h.deliverPending(client)
+}
+
+// addClient records a new session and sends it the online users, or for a
+// resumed session only the presence changes since it disconnected. It
+// reports whether the user had no other session, and whether the changes
+// could be replayed; otherwise a resumed session gets a full snapshot.
+func (h *Hub) addClient(client *Client, resumed *resumeState) (wasOffline, replayed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	wasOffline = len(h.Clients[client.UserID]) == 0
+	client.touch(now)
+	var changes []presenceChange
+	if resumed != nil {
+		changes, replayed = h.presenceSince(resumed.PresenceSeq)
+	}
+	if replayed {
+		latest := make(map[int64]presenceChange, len(changes))
+		for _, change := range changes {
+			if change.UserID != client.UserID {
+				latest[change.UserID] = change
 			}
-			wentOffline := registered && len(sessions) == 0
-			if wentOffline {
-				delete(h.Clients, client.UserID)
+		}
+		for id, change := range latest {
+			client.tryControl(h.presenceEvent(id, change.Username, change.Online))
+		}
+	} else {
+		for id, sessions := range h.Clients {
+			if id == client.UserID {
+				continue
 			}
-			h.mu.Unlock()
-			if wentOffline {
-				if err := db.UpdateLastSeen(client.UserID); err != nil {
-					log.Printf("Failed to update last seen for user %d: %v", client.UserID, err)
-				}
-				h.notifyPresence(client.UserID, client.Username, false)
+			for session := range sessions {
+				client.tryControl(h.presenceEvent(id, session.Username, true))
+				break
 			}
+		}
+	}
+	if h.Clients[client.UserID] == nil {
+		h.Clients[client.UserID] = make(map[*Client]struct{})
+	}
+	h.Clients[client.UserID][client] = struct{}{}
+	if wasOffline {
+		h.recordPresence(client.UserID, client.Username, true, now)
+	}
+	return wasOffline, replayed
+}
 
-		case <-h.stop:
-			h.mu.Lock()
-			for _, sessions := range h.Clients {
-				for client := range sessions {
-					close(client.Send)
-					if client.Conn != nil {
-						_ = client.Conn.WriteControl(
-							websocket.CloseMessage,
-							websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
-							time.Now().Add(writeWait),
-						)
-						_ = client.Conn.Close()
-					}
-				}
+func (h *Hub) unregisterClient(client *Client) {
+	h.unsubscribeAll(client)
+	if !h.removeClient(client) {
+		return
+	}
+	h.sendTypingStopped(h.clearTyping(client.UserID), time.Now())
+	h.notifyPresence(client.UserID, client.Username, false)
+	go h.recordOffline(client.UserID)
+}
+
+// recordOffline stores when a user went offline and ends their calls, away
+// from the event loop. A user with no connection cannot be in a call;
+// otherwise a dropped call would keep them busy. The other party of each
+// ended call gets a call_end, as if the user had hung up. Calls are left
+// alone if the user has reconnected meanwhile.
+func (h *Hub) recordOffline(userID int64) {
+	if err := db.UpdateLastSeen(userID); err != nil {
+		log.Printf("Failed to update last seen for user %d: %v", userID, err)
+	}
+	if !h.IsOnline(userID) {
+		ended, err := db.EndOpenCallSessions(userID)
+		if err != nil {
+			log.Printf("Failed to end open calls of user %d: %v", userID, err)
+		}
+		for _, session := range ended {
+			h.EndCallSequences(session.SessionID)
+			h.SendMessage(session.OtherParty(userID), Message{
+				Type:      "call_end",
+				From:      userID,
+				SessionID: session.SessionID,
+				Timestamp: time.Now().Unix(),
+			})
+		}
+	}
+	h.notifySubscribers(userID)
+}
+
+// removeClient drops a session and reports whether its user went offline.
+// Sessions are keyed by client, so a stale session unregistering late, or
+// twice, never takes a newer session of the same user offline.
+func (h *Hub) removeClient(client *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sessions := h.Clients[client.UserID]
+	_, registered := sessions[client]
+	if registered {
+		delete(sessions, client)
+		close(client.Send)
+	}
+	wentOffline := registered && len(sessions) == 0
+	if wentOffline {
+		delete(h.Clients, client.UserID)
+		h.recordPresence(client.UserID, client.Username, false, time.Now())
+	}
+	if registered {
+		h.remember(client, time.Now())
+	}
+	return wentOffline
+}
+
+func (h *Hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sessions := range h.Clients {
+		for client := range sessions {
+			close(client.Send)
+			if client.Conn != nil {
+				_ = client.Conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+					time.Now().Add(writeWait),
+				)
+				_ = client.Conn.Close()
 			}
-			h.Clients = make(map[int64]map[*Client]struct{})
-			h.mu.Unlock()
-			return
 		}
 	}
+	h.Clients = make(map[int64]map[*Client]struct{})
 }
 
 func (h *Hub) RegisterClient(client *Client) bool {
+	// The pumps start after registration, so this never races with WritePump.
+	if client != nil && client.control == nil {
+		client.control = make(chan []byte, cap(client.Send))
+	}
 	select {
 	case h.Register <- client:
 		return true
@@ -195,53 +403,275 @@ func (h *Hub) serializeMessage(msg Message) []byte {
 	return data
 }
 
+func (h *Hub) presenceEvent(userID int64, username string, online bool) []byte {
+	data, _ := json.Marshal(Presence{UserID: userID, Username: username, Online: online})
+	return h.serializeMessage(Message{Type: "presence", Data: data, Timestamp: time.Now().Unix()})
+}
+
 // notifyPresence sends presence updates directly to all connected clients.
 // This must NOT use the broadcast channel since it's called from handleEvents.
+// Presence subscribers are told separately, see notifySubscribers, since
+// that reads the database.
 func (h *Hub) notifyPresence(userID int64, username string, online bool) {
-	msg := Message{
-		Type: "presence",
-		Data: func() []byte {
-			p := Presence{
-				UserID:   userID,
-				Username: username,
-				Online:   online,
-			}
-			b, _ := json.Marshal(p)
-			return b
-		}(),
-		Timestamp: time.Now().Unix(),
-	}
-	data := h.serializeMessage(msg)
+	data := h.presenceEvent(userID, username, online)
 
 	h.mu.RLock()
-	defer h.mu.RUnlock()
 	for id, sessions := range h.Clients {
 		if id == userID {
 			continue
 		}
 		for client := range sessions {
-			select {
-			case client.Send <- data:
-			default:
-			}
+			client.tryControl(data)
 		}
 	}
+	h.mu.RUnlock()
 }
 
-// SendMessage sends a message directly to a specific online user.
-func (h *Hub) SendMessage(to int64, msg Message) {
+// SendMessage sends a message directly to a specific online user and reports
+// whether at least one of their sessions accepted it. Control events go to the
+// low-priority buffer; everything else to Send.
+func (h *Hub) SendMessage(to int64, msg Message) bool {
 	msg.To = to
 	data := h.serializeMessage(msg)
 
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	delivered := false
 	for client := range h.Clients[to] {
-		select {
-		case client.Send <- data:
-		default:
+		if client.send(msg.Type, data) {
+			delivered = true
+		} else if !controlEvents[msg.Type] {
 			log.Printf("Failed to send message to user %d: send buffer full", to)
 		}
 	}
+	return delivered
+}
+
+// SendToRoom sends msg to every online member of a room and returns the
+// members at least one of whose sessions accepted it. Members who are offline
+// catch up from the room's history.
+func (h *Hub) SendToRoom(roomID int64, msg Message) []int64 {
+	memberIDs, err := db.GetRoomMemberIDs(roomID)
+	if err != nil {
+		log.Printf("Failed to load members of room %d: %v", roomID, err)
+		return nil
+	}
+	msg.RoomID = roomID
+	delivered := make([]int64, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		if h.SendMessage(memberID, msg) {
+			delivered = append(delivered, memberID)
+		}
+	}
+	return delivered
+}
+
+// sendToClient delivers a message to one registered session only.
+func (h *Hub) sendToClient(client *Client, msg Message) bool {
+	data := h.serializeMessage(msg)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, registered := h.Clients[client.UserID][client]; !registered {
+		return false
+	}
+	if !client.send(msg.Type, data) {
+		if !controlEvents[msg.Type] {
+			log.Printf("Failed to send message to user %d: send buffer full", client.UserID)
+		}
+		return false
+	}
+	return true
+}
+
+// MessageEvent converts a stored message into its WebSocket event.
+func MessageEvent(msg *db.Message) Message {
+	return Message{
+		ID:        msg.ID,
+		Type:      "message",
+		From:      msg.SenderID,
+		To:        msg.ReceiverID,
+		Content:   msg.Content,
+		Nonce:     msg.Nonce,
+		Timestamp: msg.Timestamp.Unix(),
+	}
+}
+
+// RoomMessageEvent converts a member's copy of a room message into the
+// room_message event for that member.
+func RoomMessageEvent(msg *db.RoomMessage) Message {
+	return Message{
+		ID:        msg.ID,
+		Type:      "room_message",
+		From:      msg.SenderID,
+		To:        msg.RecipientID,
+		Content:   msg.Content,
+		Nonce:     msg.Nonce,
+		Timestamp: msg.Timestamp.Unix(),
+		RoomID:    msg.RoomID,
+	}
+}
+
+// PendingPageSize is how many held-back messages are loaded at a time.
+const PendingPageSize = 100
+
+// pendingRetryInterval is how long pending delivery waits for a full Send
+// buffer to drain.
+const pendingRetryInterval = 100 * time.Millisecond
+
+// deliverPending sends a newly connected session the messages that were held
+// back while its user was offline or in do-not-disturb mode. It runs outside
+// the event loop, a page at a time, and waits for Send to drain rather than
+// give up on the rest of the backlog; it stops once the session is gone.
+func (h *Hub) deliverPending(client *Client) {
+	paused, err := db.GetDoNotDisturb(client.UserID)
+	if err != nil {
+		log.Printf("Failed to read do-not-disturb state of user %d: %v", client.UserID, err)
+		return
+	}
+	if paused {
+		return
+	}
+	var afterID int64
+	for {
+		messages, err := db.GetUndeliveredMessagesForUser(client.UserID, afterID, PendingPageSize)
+		if err != nil {
+			log.Printf("Failed to load pending messages for user %d: %v", client.UserID, err)
+			return
+		}
+		for index := range messages {
+			if !h.deliverWhenDrained(client, MessageEvent(&messages[index])) {
+				return
+			}
+			if _, err := db.MarkMessageDelivered(messages[index].ID); err != nil {
+				log.Printf("Failed to record delivery of message %d: %v", messages[index].ID, err)
+			}
+		}
+		if len(messages) < PendingPageSize {
+			return
+		}
+		afterID = messages[len(messages)-1].ID
+	}
+}
+
+// deliverWhenDrained sends msg to the session once Send has room, and
+// reports false if the session was unregistered first.
+func (h *Hub) deliverWhenDrained(client *Client, msg Message) bool {
+	for {
+		if !h.isRegistered(client) {
+			return false
+		}
+		if len(client.Send) < cap(client.Send) && h.sendToClient(client, msg) {
+			return true
+		}
+		time.Sleep(pendingRetryInterval)
+	}
+}
+
+func (h *Hub) isRegistered(client *Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, registered := h.Clients[client.UserID][client]
+	return registered
+}
+
+type typingPayload struct {
+	To     int64  `json:"to"`
+	Typing bool   `json:"typing"`
+	Length string `json:"length,omitempty"` // short or long; clients without it send nothing
+}
+
+// validTypingLength reports whether a typing length hint is one of the
+// buckets clients may send.
+func validTypingLength(length string) bool {
+	switch length {
+	case "", "short", "long":
+		return true
+	}
+	return false
+}
+
+// typingState is an active typing indicator from one user to another.
+type typingState struct {
+	expiresAt   time.Time
+	forwardedAt time.Time // when a typing:true was last relayed
+	length      string
+}
+
+// setTyping records a typing frame and reports whether to relay it. Repeated
+// typing:true frames only extend the indicator, unless the length hint changed
+// or typingRefreshInterval has passed since the last relayed one. typing:false
+// is relayed only while the recipient has not been told the indicator ended.
+func (h *Hub) setTyping(from, to int64, typing bool, length string, now time.Time) bool {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+	pair := typingPair{From: from, To: to}
+	state, exists := h.typing[pair]
+	if !typing {
+		delete(h.typing, pair)
+		return exists
+	}
+	relay := !exists || !state.expiresAt.After(now) || state.length != length ||
+		now.Sub(state.forwardedAt) >= typingRefreshInterval
+	state.expiresAt = now.Add(typingExpiry)
+	state.length = length
+	if relay {
+		state.forwardedAt = now
+	}
+	h.typing[pair] = state
+	return relay
+}
+
+// expireTyping removes the indicators that were not refreshed in time and
+// returns them.
+func (h *Hub) expireTyping(now time.Time) []typingPair {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+	var expired []typingPair
+	for pair, state := range h.typing {
+		if !state.expiresAt.After(now) {
+			delete(h.typing, pair)
+			expired = append(expired, pair)
+		}
+	}
+	return expired
+}
+
+// clearTyping removes every indicator of a user who went offline and returns
+// them.
+func (h *Hub) clearTyping(from int64) []typingPair {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+	var cleared []typingPair
+	for pair := range h.typing {
+		if pair.From == from {
+			delete(h.typing, pair)
+			cleared = append(cleared, pair)
+		}
+	}
+	return cleared
+}
+
+// sendTypingStopped tells the recipients of ended indicators that their
+// senders stopped typing.
+func (h *Hub) sendTypingStopped(pairs []typingPair, now time.Time) {
+	for _, pair := range pairs {
+		data, _ := json.Marshal(typingPayload{To: pair.To, Typing: false})
+		h.SendMessage(pair.To, Message{Type: "typing", From: pair.From, Data: data, Timestamp: now.Unix()})
+	}
+}
+
+// TypingTo returns the users whose typing indicator towards userID is active.
+func (h *Hub) TypingTo(userID int64, now time.Time) []int64 {
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+	senders := make([]int64, 0)
+	for pair, state := range h.typing {
+		if pair.To == userID && state.expiresAt.After(now) {
+			senders = append(senders, pair.From)
+		}
+	}
+	return senders
 }
 
 func (h *Hub) IsOnline(userID int64) bool {
@@ -250,6 +680,13 @@ func (h *Hub) IsOnline(userID int64) bool {
 	return len(h.Clients[userID]) > 0
 }
 
+// OnlineCount returns the number of users with at least one session.
+func (h *Hub) OnlineCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.Clients)
+}
+
 func (h *Hub) GetOnlineUsers() []int64 {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -269,7 +706,7 @@ func (c *Client) ReadPump() {
 		c.Conn.Close()
 	}()
 
-	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadLimit(int64(max(limits.Current().MessageMaxBytes, minimumReadLimit)))
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -284,6 +721,7 @@ func (c *Client) ReadPump() {
 			}
 			break
 		}
+		c.touch(time.Now())
 		if !c.isAuthorized() {
 			break
 		}
@@ -294,28 +732,41 @@ func (c *Client) ReadPump() {
 		}
 
 		c.handleMessage(&wsMsg)
+		if c.abusive.Load() {
+			_ = c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "signaling limit exceeded"), time.Now().Add(writeWait))
+			break
+		}
 	}
 }
 
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
+	authCheck := time.NewTicker(authCheckPeriod)
 	defer func() {
 		ticker.Stop()
+		authCheck.Stop()
 		c.Conn.Close()
 	}()
 
 	for {
+		// Queued messages always go out before queued control events.
 		select {
 		case message, ok := <-c.Send:
-			if err := c.Conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if !c.writeQueued(message, ok) {
 				return
 			}
-			if !ok {
-				_ = c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+			continue
+		default:
+		}
+
+		select {
+		case message, ok := <-c.Send:
+			if !c.writeQueued(message, ok) {
 				return
 			}
 
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case message := <-c.control:
+			if !c.writeQueued(message, true) {
 				return
 			}
 
@@ -330,45 +781,225 @@ func (c *Client) WritePump() {
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case now := <-authCheck.C:
+			switch c.checkTokenExpiry(now) {
+			case tokenReauthRequired:
+				c.requestReauth()
+			case tokenExpired:
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				_ = c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication expired"))
+				return
+			}
+		}
+	}
+}
+
+// writeQueued writes one queued event, batched with those following it when
+// the session asked for batching. ok is false once Send has been closed, in
+// which case the connection is closed as well. It reports whether the pump
+// should keep running.
+func (c *Client) writeQueued(message []byte, ok bool) bool {
+	open := ok
+	if ok && c.batching.Load() {
+		message, open = c.collectBatch(message)
+	}
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return false
+	}
+	if ok {
+		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			return false
+		}
+	}
+	if !open {
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		switch {
+		case c.slow.Load():
+			closeMessage = websocket.FormatCloseMessage(closeSlowConsumer, "slow consumer")
+		case c.evicted.Load():
+			closeMessage = websocket.FormatCloseMessage(closeIdleTimeout, "idle timeout")
+		}
+		_ = c.Conn.WriteMessage(websocket.CloseMessage, closeMessage)
+		return false
+	}
+	return true
+}
+
+// collectBatch gathers events queued shortly after first, from both buffers,
+// into one batch frame. Events keep their order within each buffer. It reports
+// false if Send was closed meanwhile.
+func (c *Client) collectBatch(first []byte) ([]byte, bool) {
+	events := []json.RawMessage{first}
+	timer := time.NewTimer(batchWindow)
+	defer timer.Stop()
+
+	open := true
+collect:
+	for len(events) < maxBatchEvents {
+		select {
+		case message, ok := <-c.Send:
+			if !ok {
+				open = false
+				break collect
+			}
+			events = append(events, message)
+		case message := <-c.control:
+			events = append(events, message)
+		case <-timer.C:
+			break collect
 		}
 	}
+	if len(events) == 1 {
+		return first, open
+	}
+	data, _ := json.Marshal(Batch{Type: "batch", Events: events, Timestamp: time.Now().Unix()})
+	return data, open
 }
 
+// isAuthorized reports whether the session's credentials are still current
+// and its token has not been revoked by a logout.
 func (c *Client) isAuthorized() bool {
-	version, err := db.GetAuthVersion(c.UserID)
-	return err == nil && version == c.AuthVersion
+	version, revoked, err := db.GetTokenState(c.UserID, c.currentTokenID())
+	return err == nil && version == c.AuthVersion && !revoked
 }
 
 func (c *Client) handleMessage(msg *WSMessage) {
 	switch msg.Type {
-	case "typing":
-		// Forward typing indicator to recipient
+	case "hello":
+		// Clients announce optional protocol features they understand.
+		var payload struct {
+			Batch bool `json:"batch"`
+		}
+		if err := json.Unmarshal(msg.Payload, &payload); err == nil {
+			c.batching.Store(payload.Batch)
+			features, _ := json.Marshal(map[string]bool{"batch": payload.Batch})
+			c.Hub.sendToClient(c, Message{Type: "hello", To: c.UserID, Data: features, Timestamp: time.Now().Unix()})
+		}
+
+	case "reauth":
+		// Clients present a fresh token after a reauth_required event.
 		var payload struct {
-			To     int64 `json:"to"`
-			Typing bool  `json:"typing"`
+			Token string `json:"token"`
 		}
 		if err := json.Unmarshal(msg.Payload, &payload); err == nil {
+			c.reauthenticate(payload.Token)
+		}
+
+	case "typing":
+		// Forward typing indicator to recipient. The optional length bucket
+		// is computed by the sender's client and relayed as is.
+		var payload typingPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err == nil && payload.To > 0 && validTypingLength(payload.Length) &&
+			c.Hub.setTyping(c.UserID, payload.To, payload.Typing, payload.Length, time.Now()) {
+			data, _ := json.Marshal(payload)
 			c.Hub.SendMessage(payload.To, Message{
 				Type:      "typing",
 				From:      c.UserID,
-				Data:      msg.Payload,
+				Data:      data,
 				Timestamp: time.Now().Unix(),
 			})
 		}
 
+	case "subscribe_presence", "unsubscribe_presence":
+		var payload struct {
+			UserID int64 `json:"user_id"`
+		}
+		if err := json.Unmarshal(msg.Payload, &payload); err == nil && payload.UserID > 0 {
+			if msg.Type == "subscribe_presence" {
+				c.Hub.subscribe(c, payload.UserID)
+			} else {
+				c.Hub.unsubscribe(c, payload.UserID)
+			}
+		}
+
 	case "call_offer", "call_answer", "call_ice", "call_end":
 		// WebRTC signaling
 		var payload struct {
-			To   int64           `json:"to"`
-			Data json.RawMessage `json:"data"`
+			To        int64           `json:"to"`
+			SessionID string          `json:"session_id"`
+			Seq       int64           `json:"seq"` // optional, increasing per sender within a session
+			Data      json.RawMessage `json:"data"`
 		}
 		if err := json.Unmarshal(msg.Payload, &payload); err == nil {
+			if !c.allowSignaling(msg.Type, payload.To, payload.SessionID, time.Now()) {
+				return
+			}
+			if msg.Type == "call_offer" && c.calleeBusy(payload.To) {
+				c.Hub.sendToClient(c, Message{Type: "call_busy", From: payload.To, To: c.UserID, SessionID: payload.SessionID, Timestamp: time.Now().Unix()})
+				return
+			}
+			sessionID := c.trackCall(msg.Type, payload.To, payload.SessionID)
+			seq, fresh := c.Hub.sequenceSignaling(sessionID, c.UserID, payload.Seq, time.Now())
+			if !fresh {
+				return
+			}
 			c.Hub.SendMessage(payload.To, Message{
 				Type:      msg.Type,
 				From:      c.UserID,
 				Data:      payload.Data,
+				SessionID: sessionID,
+				Seq:       seq,
 				Timestamp: time.Now().Unix(),
 			})
+			if msg.Type == "call_end" {
+				c.Hub.EndCallSequences(sessionID)
+			}
 		}
 	}
 }
+
+// calleeBusy reports whether the callee is already in a call with someone
+// other than this client's user.
+func (c *Client) calleeBusy(callee int64) bool {
+	busy, err := db.InCallWithOther(callee, c.UserID)
+	if err != nil {
+		log.Printf("Failed to check call state of user %d: %v", callee, err)
+		return false
+	}
+	return busy
+}
+
+// trackCall advances the stored call session for a signaling event and returns
+// the session ID to forward. An offer without a session ID starts a new
+// session, whose ID is sent back to the caller as a call_session event.
+func (c *Client) trackCall(eventType string, to int64, sessionID string) string {
+	if sessionID != "" && !limits.ValidClientID(sessionID) {
+		return ""
+	}
+	switch eventType {
+	case "call_offer":
+		generated := sessionID == ""
+		if generated {
+			sessionID = newCallSessionID()
+		}
+		if _, err := db.CreateCallSession(sessionID, c.UserID, to); err != nil {
+			log.Printf("Failed to record call session from %d to %d: %v", c.UserID, to, err)
+			return sessionID
+		}
+		if generated {
+			c.Hub.sendToClient(c, Message{Type: "call_session", To: to, SessionID: sessionID, Timestamp: time.Now().Unix()})
+		}
+	case "call_answer":
+		if sessionID == "" {
+			return ""
+		}
+		if _, err := db.AnswerCallSession(sessionID, c.UserID); err != nil {
+			log.Printf("Failed to mark call session %s active: %v", sessionID, err)
+		}
+	case "call_end":
+		if sessionID == "" {
+			return ""
+		}
+		if _, err := db.EndCallSession(sessionID, c.UserID); err != nil {
+			log.Printf("Failed to end call session %s: %v", sessionID, err)
+		}
+	}
+	return sessionID
+}
+
+func newCallSessionID() string {
+	bytes := make([]byte, 16)
+	_, _ = rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
@@ -1,12 +1,33 @@
 package ws
 
 import (
+	"chatapp/internal/auth"
+	"chatapp/internal/db"
+	"context"
 	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
 
+func initHubTestDB(t *testing.T) {
+	t.Helper()
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "hub-test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		db.DB = nil
+	})
+}
+
 func TestHubSupportsMultipleSessionsPerUser(t *testing.T) {
+	initHubTestDB(t)
 	hub := NewHub()
 	hub.Run()
 	first := &Client{Hub: hub, Send: make(chan []byte, 4), UserID: 42, Username: "alice"}
@@ -19,6 +40,9 @@ func TestHubSupportsMultipleSessionsPerUser(t *testing.T) {
 		defer hub.mu.RUnlock()
 		return len(hub.Clients[42]) == 2
 	})
+	if count := hub.OnlineCount(); count != 1 {
+		t.Fatalf("OnlineCount = %d with two sessions of one user, want 1", count)
+	}
 
 	hub.SendMessage(42, Message{Type: "message", ID: 99, From: 7})
 	for index, client := range []*Client{first, second} {
@@ -65,3 +89,1392 @@ func waitFor(t *testing.T, condition func() bool) {
 		time.Sleep(time.Millisecond)
 	}
 }
+
+func TestCollectBatchPreservesOrder(t *testing.T) {
+	client := &Client{Send: make(chan []byte, 4)}
+	client.Send <- []byte(`{"id":2}`)
+	client.Send <- []byte(`{"id":3}`)
+
+	payload, open := client.collectBatch([]byte(`{"id":1}`))
+	if !open {
+		t.Fatal("batch reported a closed send channel")
+	}
+	var batch Batch
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Type != "batch" || len(batch.Events) != 3 {
+		t.Fatalf("unexpected batch: %s", payload)
+	}
+	for index, event := range batch.Events {
+		var message Message
+		if err := json.Unmarshal(event, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.ID != int64(index+1) {
+			t.Fatalf("event %d has ID %d", index, message.ID)
+		}
+	}
+
+	close(client.Send)
+	payload, open = client.collectBatch([]byte(`{"id":4}`))
+	if open || string(payload) != `{"id":4}` {
+		t.Fatalf("single event before close: payload=%s open=%t", payload, open)
+	}
+}
+
+func TestTypingToTracksAndExpiresIndicators(t *testing.T) {
+	hub := NewHub()
+	now := time.Date(2026, time.July, 12, 12, 0, 0, 0, time.UTC)
+	hub.setTyping(1, 42, true, "", now)
+	hub.setTyping(2, 42, true, "", now)
+	hub.setTyping(3, 7, true, "", now)
+	hub.setTyping(2, 42, false, "", now)
+
+	if senders := hub.TypingTo(42, now.Add(time.Second)); len(senders) != 1 || senders[0] != 1 {
+		t.Fatalf("typing senders = %v, want [1]", senders)
+	}
+	if senders := hub.TypingTo(42, now.Add(typingExpiry)); len(senders) != 0 {
+		t.Fatalf("expired indicator is still reported: %v", senders)
+	}
+}
+
+func TestSetTypingCoalescesRepeatedFrames(t *testing.T) {
+	hub := NewHub()
+	now := time.Date(2026, time.July, 12, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at      time.Duration
+		typing  bool
+		length  string
+		relayed bool
+	}{
+		{at: 0, typing: true, relayed: true},
+		{at: 500 * time.Millisecond, typing: true, relayed: false},
+		{at: time.Second, typing: true, length: "long", relayed: true},
+		{at: time.Second + typingRefreshInterval, typing: true, length: "long", relayed: true},
+		{at: 2 * time.Second, typing: false, relayed: true},
+		{at: 2 * time.Second, typing: false, relayed: false},
+	}
+	for index, step := range steps {
+		if relayed := hub.setTyping(1, 42, step.typing, step.length, now.Add(step.at)); relayed != step.relayed {
+			t.Fatalf("step %d: relayed = %t, want %t", index, relayed, step.relayed)
+		}
+	}
+
+	hub.setTyping(1, 42, true, "", now)
+	hub.setTyping(2, 42, true, "", now.Add(time.Second))
+	if expired := hub.expireTyping(now.Add(typingExpiry)); len(expired) != 1 || expired[0] != (typingPair{From: 1, To: 42}) {
+		t.Fatalf("expired = %v, want only 1 -> 42", expired)
+	}
+	if relayed := hub.setTyping(1, 42, false, "", now.Add(typingExpiry)); relayed {
+		t.Fatal("typing:false relayed after the indicator expired")
+	}
+}
+
+func TestTypingIndicatorsEndWhenNotRefreshed(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	sender := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: alice.ID, Username: "alice"}
+	receiver := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	if !hub.RegisterClient(sender) || !hub.RegisterClient(receiver) {
+		t.Fatal("failed to register clients")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(alice.ID) && hub.IsOnline(bob.ID) })
+
+	received := func() []typingPayload {
+		t.Helper()
+		var payloads []typingPayload
+		for {
+			select {
+			case data := <-receiver.control:
+				var message Message
+				if err := json.Unmarshal(data, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.Type != "typing" || message.From != alice.ID {
+					continue
+				}
+				var payload typingPayload
+				if err := json.Unmarshal(message.Data, &payload); err != nil {
+					t.Fatal(err)
+				}
+				payloads = append(payloads, payload)
+			case <-time.After(50 * time.Millisecond):
+				return payloads
+			}
+		}
+	}
+
+	for range 3 {
+		sender.handleMessage(&WSMessage{Type: "typing", Payload: json.RawMessage(fmt.Sprintf(`{"to":%d,"typing":true}`, bob.ID))})
+	}
+	if payloads := received(); len(payloads) != 1 || !payloads[0].Typing {
+		t.Fatalf("repeated typing frames relayed as %+v, want one typing:true", payloads)
+	}
+
+	// The sender never sends typing:false; the sweep ends the indicator.
+	now := time.Now().Add(typingExpiry)
+	hub.sendTypingStopped(hub.expireTyping(now), now)
+	if payloads := received(); len(payloads) != 1 || payloads[0].Typing || payloads[0].To != bob.ID {
+		t.Fatalf("expiry sent %+v, want one typing:false", payloads)
+	}
+	sender.handleMessage(&WSMessage{Type: "typing", Payload: json.RawMessage(fmt.Sprintf(`{"to":%d,"typing":false}`, bob.ID))})
+	if payloads := received(); len(payloads) != 0 {
+		t.Fatalf("late typing:false relayed as %+v", payloads)
+	}
+}
+
+func TestTypingRelaysValidLengthHints(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	sender := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: alice.ID, Username: "alice"}
+	receiver := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	if !hub.RegisterClient(sender) || !hub.RegisterClient(receiver) {
+		t.Fatal("failed to register clients")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(alice.ID) && hub.IsOnline(bob.ID) })
+
+	nextTyping := func() (typingPayload, bool) {
+		t.Helper()
+		for {
+			select {
+			case data := <-receiver.control:
+				var message Message
+				if err := json.Unmarshal(data, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.Type != "typing" {
+					continue
+				}
+				var payload typingPayload
+				if err := json.Unmarshal(message.Data, &payload); err != nil {
+					t.Fatal(err)
+				}
+				return payload, true
+			case <-time.After(50 * time.Millisecond):
+				return typingPayload{}, false
+			}
+		}
+	}
+
+	tests := []struct {
+		payload string
+		relayed bool
+		length  string
+	}{
+		{payload: `{"to":%d,"typing":true}`, relayed: true},
+		{payload: `{"to":%d,"typing":true,"length":"long"}`, relayed: true, length: "long"},
+		{payload: `{"to":%d,"typing":true,"length":"enormous"}`, relayed: false},
+	}
+	for _, test := range tests {
+		sender.handleMessage(&WSMessage{Type: "typing", Payload: json.RawMessage(fmt.Sprintf(test.payload, bob.ID))})
+		payload, relayed := nextTyping()
+		if relayed != test.relayed || payload.Length != test.length {
+			t.Fatalf("%s: relayed = %t with %+v, want relayed = %t with length %q", test.payload, relayed, payload, test.relayed, test.length)
+		}
+	}
+}
+
+func TestRegisterReplaysBacklogInOrderWithoutReadingIt(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]*db.User, 0, 2)
+	for _, name := range []string{"bob", "carol"} {
+		code, err := db.GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := db.RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol := users[0], users[1]
+
+	// Interleave two senders so that order across conversations is checked.
+	var backlog []string
+	for index, senderID := range []int64{alice.ID, carol.ID, alice.ID, carol.ID, carol.ID} {
+		clientID := fmt.Sprintf("backlog-%d", index)
+		if _, _, err := db.SaveMessage(senderID, bob.ID, clientID, "text", []byte(clientID), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+		backlog = append(backlog, clientID)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	var lastID int64
+	for _, want := range backlog {
+		select {
+		case payload := <-client.Send:
+			var message Message
+			if err := json.Unmarshal(payload, &message); err != nil {
+				t.Fatal(err)
+			}
+			if message.Type != "message" || string(message.Content) != want || message.ID <= lastID {
+				t.Fatalf("got %s %q (id %d after %d), want message %q", message.Type, message.Content, message.ID, lastID, want)
+			}
+			lastID = message.ID
+		case <-time.After(time.Second):
+			t.Fatalf("did not receive %s", want)
+		}
+	}
+
+	// Delivery is not reading: the backlog stays unread until the client
+	// reports it as read.
+	if unread, err := db.CountUnreadMessages(bob.ID); err != nil || unread != int64(len(backlog)) {
+		t.Fatalf("unread after replay = %d, %v; want %d", unread, err, len(backlog))
+	}
+}
+
+func TestRegisterDeliversPendingMessagesUnlessPaused(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clientID := range []string{"pending-1", "pending-2"} {
+		if _, _, err := db.SaveMessage(alice.ID, bob.ID, clientID, "text", []byte(clientID), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	connect := func() *Client {
+		client := &Client{Hub: hub, Send: make(chan []byte, 8), UserID: bob.ID, Username: "bob"}
+		if !hub.RegisterClient(client) {
+			t.Fatal("failed to register client")
+		}
+		return client
+	}
+
+	if err := db.SetDoNotDisturb(bob.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	paused := connect()
+	waitFor(t, func() bool { return hub.IsOnline(bob.ID) })
+	select {
+	case payload := <-paused.Send:
+		t.Fatalf("paused session received %s", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := db.SetDoNotDisturb(bob.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	resumed := connect()
+	for _, want := range []string{"pending-1", "pending-2"} {
+		select {
+		case payload := <-resumed.Send:
+			var message Message
+			if err := json.Unmarshal(payload, &message); err != nil {
+				t.Fatal(err)
+			}
+			if message.Type != "message" || string(message.Content) != want {
+				t.Fatalf("got %s %q, want message %q", message.Type, message.Content, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("did not receive %s", want)
+		}
+	}
+	waitFor(t, func() bool {
+		pending, err := db.GetUndeliveredMessagesForUser(bob.ID, 0, PendingPageSize)
+		return err == nil && len(pending) == 0
+	})
+}
+
+func TestPendingBacklogLargerThanSendIsDeliveredAsItDrains(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := PendingPageSize + 5
+	for index := range total {
+		clientID := fmt.Sprintf("backlog-%d", index)
+		if _, _, err := db.SaveMessage(alice.ID, bob.ID, clientID, "text", []byte(clientID), make([]byte, 12), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	for index := range total {
+		select {
+		case payload := <-client.Send:
+			var message Message
+			if err := json.Unmarshal(payload, &message); err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("backlog-%d", index); string(message.Content) != want {
+				t.Fatalf("got %q, want %q", message.Content, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("backlog stalled after %d of %d messages", index, total)
+		}
+	}
+	if dropped := client.dropped.Load(); dropped != 0 {
+		t.Fatalf("%d pending messages were dropped", dropped)
+	}
+}
+
+func TestHubKeepsRunningAfterEventPanic(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	// A nil client panics inside the register handler.
+	if !hub.RegisterClient(nil) {
+		t.Fatal("failed to submit nil client")
+	}
+	client := &Client{Hub: hub, Send: make(chan []byte, 4), UserID: 42, Username: "alice"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("hub stopped accepting clients after a panic")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(42) })
+
+	hub.unregister <- client
+	waitFor(t, func() bool { return !hub.IsOnline(42) })
+}
+
+func TestPresenceSubscriptionReceivesDetailedUpdates(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	watcher := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: alice.ID, Username: "alice"}
+	if !hub.RegisterClient(watcher) {
+		t.Fatal("failed to register watcher")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(alice.ID) })
+
+	nextDetail := func() PresenceDetail {
+		t.Helper()
+		for {
+			select {
+			case payload := <-watcher.control:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.Type != "presence_detail" {
+					continue
+				}
+				var detail PresenceDetail
+				if err := json.Unmarshal(message.Data, &detail); err != nil {
+					t.Fatal(err)
+				}
+				return detail
+			case <-time.After(time.Second):
+				t.Fatal("no presence_detail event")
+			}
+		}
+	}
+
+	watcher.handleMessage(&WSMessage{Type: "subscribe_presence", Payload: json.RawMessage(fmt.Sprintf(`{"user_id":%d}`, bob.ID))})
+	if detail := nextDetail(); detail.UserID != bob.ID || detail.Online || detail.LastSeen == nil {
+		t.Fatalf("initial detail = %+v, want bob offline with last seen", detail)
+	}
+
+	bobClient := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	if !hub.RegisterClient(bobClient) {
+		t.Fatal("failed to register bob")
+	}
+	if detail := nextDetail(); detail.UserID != bob.ID || !detail.Online {
+		t.Fatalf("detail after connect = %+v, want bob online", detail)
+	}
+
+	watcher.handleMessage(&WSMessage{Type: "unsubscribe_presence", Payload: json.RawMessage(fmt.Sprintf(`{"user_id":%d}`, bob.ID))})
+	hub.unregister <- bobClient
+	waitFor(t, func() bool { return !hub.IsOnline(bob.ID) })
+	for {
+		select {
+		case payload := <-watcher.control:
+			var message Message
+			if err := json.Unmarshal(payload, &message); err != nil {
+				t.Fatal(err)
+			}
+			if message.Type == "presence_detail" {
+				t.Fatalf("unsubscribed session received %s", payload)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestDroppedCallerEndsTheCallForThePeer(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateCallSession("dropped-call-session", alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	aliceClient := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: alice.ID, Username: "alice"}
+	bobClient := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	for _, client := range []*Client{aliceClient, bobClient} {
+		if !hub.RegisterClient(client) {
+			t.Fatal("failed to register client")
+		}
+	}
+	waitFor(t, func() bool { return hub.OnlineCount() == 2 })
+
+	hub.unregister <- aliceClient
+	select {
+	case payload := <-bobClient.Send:
+		var message Message
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Type != "call_end" || message.From != alice.ID || message.SessionID != "dropped-call-session" {
+			t.Fatalf("peer got %s, want call_end for the dropped call", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer was not told the call ended")
+	}
+	if open, err := db.HasOpenCall(alice.ID, bob.ID, "dropped-call-session"); err != nil || open {
+		t.Fatalf("call still open after the caller dropped: %t, %v", open, err)
+	}
+}
+
+func TestExpiredTokenRequiresReauthWithinGracePeriod(t *testing.T) {
+	initHubTestDB(t)
+	if err := auth.Configure(strings.Repeat("s", 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureReauthGracePeriod("1m"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureReauthGracePeriod("") })
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: 42, Username: "alice", AuthVersion: 1}
+	now := time.Now()
+	client.SetTokenExpiry(now.Add(-time.Second))
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(42) })
+
+	nextEvent := func(eventType string) Message {
+		t.Helper()
+		for {
+			select {
+			case payload := <-client.Send:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.Type == eventType {
+					return message
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no %s event", eventType)
+			}
+		}
+	}
+
+	tests := []struct {
+		at   time.Time
+		want tokenState
+	}{
+		{at: now, want: tokenReauthRequired},
+		{at: now.Add(30 * time.Second), want: tokenValid},
+		{at: now.Add(time.Minute + time.Second), want: tokenExpired},
+	}
+	for _, test := range tests {
+		if got := client.checkTokenExpiry(test.at); got != test.want {
+			t.Fatalf("checkTokenExpiry(%s) = %d, want %d", test.at.Sub(now), got, test.want)
+		}
+	}
+
+	otherUser, err := auth.GenerateToken(7, "mallory", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.handleMessage(&WSMessage{Type: "reauth", Payload: json.RawMessage(fmt.Sprintf(`{"token":%q}`, otherUser))})
+	nextEvent("reauth_failed")
+
+	fresh, err := auth.GenerateToken(42, "alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.handleMessage(&WSMessage{Type: "reauth", Payload: json.RawMessage(fmt.Sprintf(`{"token":%q}`, fresh))})
+	nextEvent("reauth_ok")
+	if got := client.checkTokenExpiry(now.Add(time.Hour)); got != tokenValid {
+		t.Fatalf("after reauth state = %d, want valid", got)
+	}
+}
+
+func TestCallOfferToBusyUserIsRejected(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]*db.User, 0, 2)
+	for _, name := range []string{"bob", "carol"} {
+		code, err := db.GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := db.RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol := users[0], users[1]
+	if _, err := db.CreateCallSession("busy-hub-session", alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AnswerCallSession("busy-hub-session", bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	clients := make(map[int64]*Client)
+	for _, user := range []*db.User{alice, bob, carol} {
+		client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: user.ID, Username: user.Username}
+		if !hub.RegisterClient(client) {
+			t.Fatal("failed to register client")
+		}
+		clients[user.ID] = client
+	}
+	waitFor(t, func() bool { return hub.OnlineCount() == 3 })
+
+	nextCallEvent := func(client *Client) *Message {
+		t.Helper()
+		for {
+			select {
+			case payload := <-client.Send:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasPrefix(message.Type, "call_") {
+					return &message
+				}
+			case <-time.After(100 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+
+	offer := func(from, to int64, sessionID string) {
+		clients[from].handleMessage(&WSMessage{Type: "call_offer", Payload: json.RawMessage(fmt.Sprintf(`{"to":%d,"session_id":%q}`, to, sessionID))})
+	}
+	offer(carol.ID, alice.ID, "carol-calls-alice")
+	if event := nextCallEvent(clients[carol.ID]); event == nil || event.Type != "call_busy" || event.From != alice.ID {
+		t.Fatalf("caller event = %+v, want call_busy from alice", event)
+	}
+	if event := nextCallEvent(clients[alice.ID]); event != nil {
+		t.Fatalf("busy callee received %+v", event)
+	}
+
+	offer(bob.ID, alice.ID, "busy-hub-session")
+	if event := nextCallEvent(clients[alice.ID]); event == nil || event.Type != "call_offer" {
+		t.Fatalf("renegotiation offer = %+v, want call_offer", event)
+	}
+}
+
+func TestSignalingNeedsOpenCallAndIsRateLimited(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	caller := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: alice.ID, Username: "alice"}
+	callee := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: bob.ID, Username: "bob"}
+	if !hub.RegisterClient(caller) || !hub.RegisterClient(callee) {
+		t.Fatal("failed to register clients")
+	}
+	waitFor(t, func() bool { return hub.OnlineCount() == 2 })
+
+	receivedICE := func() bool {
+		t.Helper()
+		for {
+			select {
+			case payload := <-callee.Send:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.Type == "call_ice" {
+					return true
+				}
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}
+	}
+	sendICE := func() {
+		caller.handleMessage(&WSMessage{Type: "call_ice", Payload: json.RawMessage(fmt.Sprintf(`{"to":%d,"session_id":"ice-limit-session","data":{}}`, bob.ID))})
+	}
+
+	sendICE()
+	if receivedICE() {
+		t.Fatal("ICE candidate relayed without a call session")
+	}
+	if hub.SignalingViolations() != 1 {
+		t.Fatalf("violations = %d, want 1", hub.SignalingViolations())
+	}
+	if _, err := db.CreateCallSession("ice-limit-session", alice.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	sendICE()
+	if !receivedICE() {
+		t.Fatal("ICE candidate for an open call was dropped")
+	}
+
+	if err := ConfigureSignalingLimits("1", "0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureSignalingLimits("", "") })
+	limited := &Client{Hub: hub, UserID: alice.ID}
+	now := time.Now()
+	for frame := 0; frame < signalingBurst; frame++ {
+		if !limited.allowSignaling("call_offer", bob.ID, "", now) {
+			t.Fatalf("frame %d within the burst was dropped", frame)
+		}
+	}
+	for strike := 1; strike <= maximumSignalingViolations; strike++ {
+		if limited.allowSignaling("call_offer", bob.ID, "", now) {
+			t.Fatal("frame over the limit was allowed")
+		}
+		if limited.abusive.Load() != (strike == maximumSignalingViolations) {
+			t.Fatalf("abusive = %t after %d strikes", limited.abusive.Load(), strike)
+		}
+	}
+	if !limited.allowSignaling("call_offer", bob.ID, "", now.Add(time.Second)) {
+		t.Fatal("bucket did not refill")
+	}
+}
+
+func TestRapidReconnectKeepsUserOnline(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	watcher := &Client{Hub: hub, Send: make(chan []byte, 64), UserID: 7, Username: "watcher"}
+	if !hub.RegisterClient(watcher) {
+		t.Fatal("failed to register watcher")
+	}
+	presenceOf := func(userID int64) []bool {
+		t.Helper()
+		var states []bool
+		for {
+			select {
+			case payload := <-watcher.control:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				var presence Presence
+				if message.Type == "presence" && json.Unmarshal(message.Data, &presence) == nil && presence.UserID == userID {
+					states = append(states, presence.Online)
+				}
+			case <-time.After(50 * time.Millisecond):
+				return states
+			}
+		}
+	}
+
+	stale := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: 42, Username: "alice"}
+	if !hub.RegisterClient(stale) {
+		t.Fatal("failed to register first session")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(42) })
+	if states := presenceOf(42); !slices.Equal(states, []bool{true}) {
+		t.Fatalf("presence after connect = %v, want [true]", states)
+	}
+
+	// The new connection registers before the stale one notices it is dead,
+	// and both pumps of the stale connection unregister it.
+	fresh := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: 42, Username: "alice"}
+	if !hub.RegisterClient(fresh) {
+		t.Fatal("failed to register reconnected session")
+	}
+	hub.unregister <- stale
+	hub.unregister <- stale
+	waitFor(t, func() bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		_, registered := hub.Clients[42][stale]
+		return !registered
+	})
+	if states := presenceOf(42); len(states) != 0 {
+		t.Fatalf("reconnect produced presence changes %v", states)
+	}
+	if !hub.IsOnline(42) {
+		t.Fatal("user is offline while the reconnected session is registered")
+	}
+	for range stale.Send {
+		// Drain whatever was queued before the stale session was closed.
+	}
+	if !hub.SendMessage(42, Message{Type: "message", ID: 1}) {
+		t.Fatal("reconnected session did not receive a message")
+	}
+
+	// When the stale session is gone before the new one arrives, watchers
+	// see the user go offline and back online, ending online.
+	hub.unregister <- fresh
+	again := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: 42, Username: "alice"}
+	if !hub.RegisterClient(again) {
+		t.Fatal("failed to register third session")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(42) })
+	if states := presenceOf(42); !slices.Equal(states, []bool{false, true}) {
+		t.Fatalf("presence after disconnect and reconnect = %v, want [false true]", states)
+	}
+}
+
+func TestIdleSessionsAreEvicted(t *testing.T) {
+	initHubTestDB(t)
+	for _, value := range []string{"30s", "8d", "soon"} {
+		if err := ConfigureIdleTimeout(value); err == nil {
+			t.Errorf("ConfigureIdleTimeout(%q) accepted an invalid timeout", value)
+		}
+	}
+	if err := ConfigureIdleTimeout("10m"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ConfigureIdleTimeout("") })
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	idle := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: 42, Username: "alice"}
+	active := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: 42, Username: "alice"}
+	if !hub.RegisterClient(idle) || !hub.RegisterClient(active) {
+		t.Fatal("failed to register client sessions")
+	}
+	waitFor(t, func() bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		return len(hub.Clients[42]) == 2
+	})
+
+	now := time.Now()
+	idle.touch(now.Add(-11 * time.Minute))
+	active.touch(now.Add(-time.Minute))
+	hub.evictIdle(now)
+	for range idle.Send {
+	}
+	if !idle.evicted.Load() || active.evicted.Load() {
+		t.Fatalf("evicted = %v/%v, want only the idle session", idle.evicted.Load(), active.evicted.Load())
+	}
+	if !hub.IsOnline(42) {
+		t.Fatal("user went offline while an active session remains")
+	}
+
+	hub.evictIdle(now.Add(10 * time.Minute))
+	if hub.IsOnline(42) {
+		t.Fatal("user is online after every session was evicted")
+	}
+	if hub.SendMessage(42, Message{Type: "message", ID: 1}) {
+		t.Fatal("evicted user still accepts live messages instead of waiting for replay")
+	}
+}
+
+func TestResumedSessionReceivesOnlyPresenceChanges(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	connect := func(userID int64, resumable bool, token string) *Client {
+		t.Helper()
+		client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: userID, Username: fmt.Sprintf("user%d", userID), Resumable: resumable, ResumeToken: token}
+		if !hub.RegisterClient(client) {
+			t.Fatal("failed to register client")
+		}
+		waitFor(t, func() bool {
+			hub.mu.RLock()
+			defer hub.mu.RUnlock()
+			_, registered := hub.Clients[userID][client]
+			return registered
+		})
+		return client
+	}
+	type snapshot struct {
+		presence map[int64]bool
+		token    string
+		resumed  bool
+	}
+	drain := func(client *Client) snapshot {
+		t.Helper()
+		result := snapshot{presence: make(map[int64]bool)}
+		for {
+			var payload []byte
+			select {
+			case payload = <-client.Send:
+			case payload = <-client.control:
+			case <-time.After(50 * time.Millisecond):
+				return result
+			}
+			var message Message
+			if err := json.Unmarshal(payload, &message); err != nil {
+				t.Fatal(err)
+			}
+			switch message.Type {
+			case "presence":
+				var presence Presence
+				if err := json.Unmarshal(message.Data, &presence); err != nil {
+					t.Fatal(err)
+				}
+				result.presence[presence.UserID] = presence.Online
+			case "session":
+				var session struct {
+					ResumeToken string `json:"resume_token"`
+					Resumed     bool   `json:"resumed"`
+				}
+				if err := json.Unmarshal(message.Data, &session); err != nil {
+					t.Fatal(err)
+				}
+				result.token, result.resumed = session.ResumeToken, session.Resumed
+			}
+		}
+	}
+
+	if session := drain(connect(42, false, "")); session.token != "" {
+		t.Fatal("a session that did not ask to resume got a resume token")
+	}
+	connect(7, false, "")
+	leaving := connect(8, false, "")
+	first := drain(connect(43, true, ""))
+	if first.token == "" || first.resumed || len(first.presence) != 3 {
+		t.Fatalf("first connect = %+v, want a token and a full snapshot", first)
+	}
+
+	var resumable *Client
+	hub.mu.RLock()
+	for client := range hub.Clients[43] {
+		resumable = client
+	}
+	hub.mu.RUnlock()
+	hub.unregister <- resumable
+	hub.unregister <- leaving
+	connect(9, false, "")
+	waitFor(t, func() bool { return !hub.IsOnline(8) && !hub.IsOnline(43) })
+
+	resumed := drain(connect(43, true, first.token))
+	if !resumed.resumed || resumed.token == "" || resumed.token == first.token {
+		t.Fatalf("resumed session = %+v, want a fresh token", resumed)
+	}
+	if want := map[int64]bool{8: false, 9: true}; !maps.Equal(resumed.presence, want) {
+		t.Fatalf("resumed presence = %v, want only the changes %v", resumed.presence, want)
+	}
+
+	again := drain(connect(43, true, first.token))
+	if again.resumed || len(again.presence) != 3 {
+		t.Fatalf("reused token = %+v, want a full snapshot", again)
+	}
+}
+
+func TestPresenceLogIsBoundedAndPrunedWithResumeTokens(t *testing.T) {
+	hub := NewHub()
+	now := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	hub.resumable["expired"] = &resumeState{UserID: 1, ExpiresAt: now}
+	hub.resumable["live"] = &resumeState{UserID: 2, ExpiresAt: now.Add(2 * time.Hour)}
+	for index := range maximumPresenceChanges + 1 {
+		hub.recordPresence(int64(index), "user", index%2 == 0, now.Add(time.Duration(index)*time.Millisecond))
+	}
+	if len(hub.presenceLog) != maximumPresenceChanges {
+		t.Fatalf("presence log holds %d changes, want %d", len(hub.presenceLog), maximumPresenceChanges)
+	}
+	if _, ok := hub.presenceSince(0); ok {
+		t.Fatal("replayed changes that were dropped from the log")
+	}
+	if changes, ok := hub.presenceSince(hub.presenceSeq - 2); !ok || len(changes) != 2 {
+		t.Fatalf("recent changes = %d, %t; want 2", len(changes), ok)
+	}
+
+	hub.recordPresence(1, "late", true, now.Add(resumeTokenTTL+time.Hour))
+	hub.pruneResumable(now.Add(resumeTokenTTL + time.Hour))
+	if len(hub.resumable) != 1 || hub.resumable["live"] == nil {
+		t.Fatalf("resume tokens = %v, want only the live one", hub.resumable)
+	}
+	if len(hub.presenceLog) != 1 || hub.presenceLog[0].Username != "late" {
+		t.Fatalf("presence log = %+v, want only the change within the resume TTL", hub.presenceLog)
+	}
+}
+
+func TestStatsReportBufferUseAndDrops(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	client := &Client{Hub: hub, Send: make(chan []byte, 2), UserID: 9, Username: "alice"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(9) })
+	for len(client.Send) > 0 {
+		<-client.Send
+	}
+
+	delivered := 0
+	for id := range 4 {
+		if hub.SendMessage(9, Message{Type: "message", ID: int64(id + 1)}) {
+			delivered++
+		}
+	}
+	if delivered != 2 {
+		t.Fatalf("delivered %d messages into a buffer of 2", delivered)
+	}
+
+	stats := hub.Stats(time.Now())
+	// The first drop queued a slow_consumer warning.
+	want := SessionStats{UserID: 9, Buffered: 2, Capacity: 2, Dropped: 2, ControlBuffered: 1, ControlCapacity: 2}
+	if stats.OnlineUsers != 1 || len(stats.Sessions) != 1 || stats.DroppedSends != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if session := stats.Sessions[0]; session != want {
+		t.Fatalf("session stats = %+v, want %+v", session, want)
+	}
+}
+
+func TestControlEventsNeverCrowdOutMessages(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	client := &Client{Hub: hub, Send: make(chan []byte, 2), UserID: 9, Username: "alice"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(9) })
+
+	for range 5 {
+		hub.SendMessage(9, Message{Type: "typing", From: 7})
+		hub.SendMessage(9, Message{Type: "read_receipt", From: 7})
+	}
+	hub.notifyPresence(7, "bob", true)
+	for id := range 2 {
+		if !hub.SendMessage(9, Message{Type: "message", ID: int64(id + 1), From: 7}) {
+			t.Fatalf("message %d was dropped behind control events", id+1)
+		}
+	}
+
+	stats := hub.Stats(time.Now())
+	if session := stats.Sessions[0]; session.Dropped != 0 || session.ControlDropped != 9 || stats.DroppedControl != 9 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	for id := range 2 {
+		var message Message
+		if err := json.Unmarshal(<-client.Send, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Type != "message" || message.ID != int64(id+1) {
+			t.Fatalf("Send holds %s %d, want message %d", message.Type, message.ID, id+1)
+		}
+	}
+}
+
+func TestSlowConsumerIsWarnedThenDisconnected(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	client := &Client{Hub: hub, Send: make(chan []byte, 1), UserID: 9, Username: "alice"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(9) })
+
+	hub.SendMessage(9, Message{Type: "message", ID: 1})
+	hub.SendMessage(9, Message{Type: "message", ID: 2})
+	var warning Message
+	if err := json.Unmarshal(<-client.control, &warning); err != nil {
+		t.Fatal(err)
+	}
+	if warning.Type != "slow_consumer" {
+		t.Fatalf("control event = %s, want slow_consumer", warning.Type)
+	}
+	if !hub.IsOnline(9) || client.slow.Load() {
+		t.Fatal("session was disconnected after a single drop")
+	}
+
+	for id := 3; id <= slowConsumerDrops+1; id++ {
+		hub.SendMessage(9, Message{Type: "message", ID: int64(id)})
+	}
+	waitFor(t, func() bool { return !hub.IsOnline(9) })
+	if !client.slow.Load() || hub.Stats(time.Now()).SlowConsumers != 1 {
+		t.Fatalf("slow = %t, stats = %+v", client.slow.Load(), hub.Stats(time.Now()))
+	}
+	if len(client.control) != 0 {
+		t.Fatal("the warning was queued more than once")
+	}
+}
+
+func TestSlowConsumerWarningIsRetriedWhenControlIsFull(t *testing.T) {
+	initHubTestDB(t)
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+
+	client := &Client{Hub: hub, Send: make(chan []byte, 1), UserID: 9, Username: "alice"}
+	if !hub.RegisterClient(client) {
+		t.Fatal("failed to register client")
+	}
+	waitFor(t, func() bool { return hub.IsOnline(9) })
+
+	hub.SendMessage(9, Message{Type: "unread_total"})
+	hub.SendMessage(9, Message{Type: "message", ID: 1})
+	hub.SendMessage(9, Message{Type: "message", ID: 2})
+	if client.slowWarned.Load() {
+		t.Fatal("warning counted as queued while the control buffer was full")
+	}
+	<-client.control
+
+	hub.SendMessage(9, Message{Type: "message", ID: 3})
+	var warning Message
+	if err := json.Unmarshal(<-client.control, &warning); err != nil {
+		t.Fatal(err)
+	}
+	if warning.Type != "slow_consumer" {
+		t.Fatalf("control event = %s, want slow_consumer", warning.Type)
+	}
+}
+
+func TestSendToRoomReachesOnlyOnlineMembers(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []*db.User{alice}
+	for _, name := range []string{"bob", "carol", "dave"} {
+		code, err := db.GenerateInviteCode(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := db.RegisterUser(ctx, name, "hash", make([]byte, 32), code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	bob, carol, dave := users[1], users[2], users[3]
+	room, err := db.CreateRoom("Team", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range []*db.User{bob, carol} {
+		if _, err := db.AddRoomMember(room.ID, member.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	// Bob is offline and Dave is online but not a member.
+	clients := make(map[int64]*Client)
+	for _, user := range []*db.User{alice, carol, dave} {
+		client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: user.ID, Username: user.Username}
+		if !hub.RegisterClient(client) {
+			t.Fatal("failed to register client")
+		}
+		clients[user.ID] = client
+	}
+	waitFor(t, func() bool { return hub.OnlineCount() == 3 })
+
+	delivered := hub.SendToRoom(room.ID, Message{Type: "room_member_added", From: alice.ID, Data: []byte(`{"user_id":2}`)})
+	slices.Sort(delivered)
+	if want := []int64{alice.ID, carol.ID}; !slices.Equal(delivered, want) {
+		t.Fatalf("delivered to %v, want %v", delivered, want)
+	}
+	roomEvent := func(client *Client) *Message {
+		t.Helper()
+		for {
+			select {
+			case payload := <-client.Send:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.RoomID != 0 {
+					return &message
+				}
+			case <-time.After(100 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+	for _, member := range []*db.User{alice, carol} {
+		if event := roomEvent(clients[member.ID]); event == nil || event.RoomID != room.ID || event.To != member.ID {
+			t.Fatalf("event for %s = %+v", member.Username, event)
+		}
+	}
+	if event := roomEvent(clients[dave.ID]); event != nil {
+		t.Fatalf("non-member received %+v", event)
+	}
+
+	// Once a member leaves, room events stop reaching them.
+	if _, err := db.RemoveRoomMember(room.ID, carol.ID); err != nil {
+		t.Fatal(err)
+	}
+	if delivered := hub.SendToRoom(room.ID, Message{Type: "room_member_removed", From: alice.ID}); !slices.Equal(delivered, []int64{alice.ID}) {
+		t.Fatalf("delivered after removal to %v", delivered)
+	}
+	if event := roomEvent(clients[carol.ID]); event != nil {
+		t.Fatalf("former member received %+v", event)
+	}
+}
+
+func TestSignalingIsNumberedPerCallAndDeduplicated(t *testing.T) {
+	initHubTestDB(t)
+	ctx := context.Background()
+	alice, err := db.RegisterUser(ctx, "alice", "hash", make([]byte, 32), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.GenerateInviteCode(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.RegisterUser(ctx, "bob", "hash", make([]byte, 32), code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub()
+	hub.Run()
+	defer hub.Shutdown()
+	clients := make(map[int64]*Client)
+	for _, user := range []*db.User{alice, bob} {
+		client := &Client{Hub: hub, Send: make(chan []byte, 16), UserID: user.ID, Username: user.Username}
+		if !hub.RegisterClient(client) {
+			t.Fatal("failed to register client")
+		}
+		clients[user.ID] = client
+	}
+	waitFor(t, func() bool { return hub.OnlineCount() == 2 })
+
+	nextCallEvent := func(client *Client) *Message {
+		t.Helper()
+		for {
+			select {
+			case payload := <-client.Send:
+				var message Message
+				if err := json.Unmarshal(payload, &message); err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasPrefix(message.Type, "call_") {
+					return &message
+				}
+			case <-time.After(100 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+	signal := func(eventType string, from, to, seq int64) {
+		clients[from].handleMessage(&WSMessage{Type: eventType, Payload: json.RawMessage(
+			fmt.Sprintf(`{"to":%d,"session_id":"sequenced-session-1","seq":%d,"data":{}}`, to, seq))})
+	}
+
+	steps := []struct {
+		eventType string
+		from, to  int64
+		clientSeq int64
+		seq       int64 // 0 when the frame must be dropped
+	}{
+		{eventType: "call_offer", from: alice.ID, to: bob.ID, clientSeq: 1, seq: 1},
+		{eventType: "call_answer", from: bob.ID, to: alice.ID, clientSeq: 1, seq: 2},
+		{eventType: "call_ice", from: alice.ID, to: bob.ID, clientSeq: 2, seq: 3},
+		{eventType: "call_ice", from: alice.ID, to: bob.ID, clientSeq: 2},
+		{eventType: "call_ice", from: bob.ID, to: alice.ID, clientSeq: 2, seq: 4},
+		{eventType: "call_ice", from: alice.ID, to: bob.ID, clientSeq: 0, seq: 5},
+		{eventType: "call_ice", from: alice.ID, to: bob.ID, clientSeq: 3, seq: 6},
+		{eventType: "call_end", from: bob.ID, to: alice.ID, clientSeq: 3, seq: 7},
+	}
+	for index, step := range steps {
+		signal(step.eventType, step.from, step.to, step.clientSeq)
+		event := nextCallEvent(clients[step.to])
+		if step.seq == 0 {
+			if event != nil {
+				t.Fatalf("step %d: duplicate relayed as %+v", index, event)
+			}
+			continue
+		}
+		if event == nil || event.Type != step.eventType || event.Seq != step.seq || event.SessionID != "sequenced-session-1" {
+			t.Fatalf("step %d: event = %+v, want %s with seq %d", index, event, step.eventType, step.seq)
+		}
+	}
+	hub.signalingMu.Lock()
+	remaining := len(hub.callSequences)
+	hub.signalingMu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("%d call sessions are still numbered after call_end", remaining)
+	}
+}
+
+func TestCallSequencesAreForgottenWhenIdleOrEnded(t *testing.T) {
+	hub := NewHub()
+	now := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	hub.sequenceSignaling("idle-call-session-1", 1, 1, now)
+	hub.sequenceSignaling("ended-call-session", 1, 1, now)
+	hub.sequenceSignaling("busy-call-session-1", 1, 1, now.Add(callSequenceIdle))
+
+	hub.EndCallSequences("ended-call-session")
+	hub.pruneCallSequences(now.Add(callSequenceIdle + time.Second))
+	if len(hub.callSequences) != 1 || hub.callSequences["busy-call-session-1"] == nil {
+		t.Fatalf("numbered sessions = %v, want only the busy one", hub.callSequences)
+	}
+
+	for index := len(hub.callSequences); index < maximumCallSequences; index++ {
+		hub.sequenceSignaling(fmt.Sprintf("filler-session-%d", index), 1, 1, now)
+	}
+	if seq, fresh := hub.sequenceSignaling("busy-call-session-1", 1, 2, now); seq != 2 || !fresh {
+		t.Fatalf("known session at the limit = %d, %t; want seq 2", seq, fresh)
+	}
+	if seq, fresh := hub.sequenceSignaling("one-session-too-many", 1, 1, now); seq != 1 || !fresh {
+		t.Fatalf("session past the limit = %d, %t; want seq 1", seq, fresh)
+	}
+	if len(hub.callSequences) != maximumCallSequences || hub.callSequences["filler-session-1"] != nil {
+		t.Fatalf("numbered sessions = %d, want the least recently signaled one evicted", len(hub.callSequences))
+	}
+	if hub.callSequences["busy-call-session-1"] == nil {
+		t.Fatal("recently signaled session was evicted")
+	}
+}
+
+func TestIdleSignalingPeersArePrunedOnTheSweep(t *testing.T) {
+	hub := NewHub()
+	now := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	hub.allowPeerSignaling(1, 2, 1, now)
+	hub.allowPeerSignaling(1, 3, 1, now.Add(signalingBurst*time.Second))
+	hub.pruneSignalingPeers(now.Add(signalingBurst*time.Second + time.Second))
+	if len(hub.signalingPeers) != 1 || hub.signalingPeers[typingPair{From: 1, To: 3}] == nil {
+		t.Fatalf("peer buckets = %v, want only the recent one", hub.signalingPeers)
+	}
+
+	for index := int64(len(hub.signalingPeers)); index < maximumSignalingPeers; index++ {
+		hub.signalingPeers[typingPair{From: 100, To: index}] = &signalingBucket{updated: now}
+	}
+	if !hub.allowPeerSignaling(1, 4, 1, now) || len(hub.signalingPeers) != maximumSignalingPeers {
+		t.Fatalf("new pair past the limit: buckets = %d, want it allowed without a bucket", len(hub.signalingPeers))
+	}
+}
@@ -0,0 +1,84 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	minimumIdleTimeout = time.Minute
+	maximumIdleTimeout = 7 * 24 * time.Hour
+
+	// idleSweepPeriod is how often the hub looks for idle sessions.
+	idleSweepPeriod = 15 * time.Second
+
+	// closeIdleTimeout is the close code sent to evicted sessions. Clients
+	// should reconnect on their next activity rather than right away.
+	closeIdleTimeout = 4000
+)
+
+var idleConfiguration = struct {
+	sync.RWMutex
+	timeout time.Duration
+}{}
+
+// ConfigureIdleTimeout sets how long a session may go without sending an
+// application frame before it is closed to free its buffers. Frames the server
+// writes, pings and pongs do not count as activity, so sessions that only
+// receive presence or typing traffic still go idle. An empty value or 0
+// disables eviction.
+func ConfigureIdleTimeout(value string) error {
+	var timeout time.Duration
+	if value != "" && value != "0" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < minimumIdleTimeout || parsed > maximumIdleTimeout {
+			return fmt.Errorf("WS_IDLE_TIMEOUT must be 0 or a duration between %s and %s", minimumIdleTimeout, maximumIdleTimeout)
+		}
+		timeout = parsed
+	}
+	idleConfiguration.Lock()
+	idleConfiguration.timeout = timeout
+	idleConfiguration.Unlock()
+	return nil
+}
+
+func idleTimeout() time.Duration {
+	idleConfiguration.RLock()
+	defer idleConfiguration.RUnlock()
+	return idleConfiguration.timeout
+}
+
+// touch records an application frame read from the client.
+func (c *Client) touch(now time.Time) {
+	c.lastActivity.Store(now.UnixNano())
+}
+
+func (c *Client) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActivity.Load()))
+}
+
+// evictIdle unregisters sessions idle for longer than the configured timeout.
+// Their write loops flush what is already queued before closing, and messages
+// sent once a user has no session left wait for the offline replay on
+// reconnect.
+func (h *Hub) evictIdle(now time.Time) {
+	timeout := idleTimeout()
+	if timeout == 0 {
+		return
+	}
+	var idle []*Client
+	h.mu.RLock()
+	for _, sessions := range h.Clients {
+		for client := range sessions {
+			if client.idleSince(now) > timeout {
+				idle = append(idle, client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+	for _, client := range idle {
+		client.evicted.Store(true)
+		h.unregisterClient(client)
+	}
+}
@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"chatapp/internal/db"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// maxPresenceSubscriptions bounds how many users one session may watch.
+const maxPresenceSubscriptions = 100
+
+// PresenceDetail is the per-user presence pushed to subscribed sessions.
+type PresenceDetail struct {
+	UserID   int64      `json:"user_id"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// subscribe starts sending presence_detail events about userID to client,
+// beginning with the current state.
+func (h *Hub) subscribe(client *Client, userID int64) {
+	h.subscriptionsMu.Lock()
+	if client.watching == nil {
+		client.watching = make(map[int64]struct{})
+	}
+	if _, watching := client.watching[userID]; !watching && len(client.watching) >= maxPresenceSubscriptions {
+		h.subscriptionsMu.Unlock()
+		return
+	}
+	client.watching[userID] = struct{}{}
+	if h.subscriptions[userID] == nil {
+		h.subscriptions[userID] = make(map[*Client]struct{})
+	}
+	h.subscriptions[userID][client] = struct{}{}
+	h.subscriptionsMu.Unlock()
+
+	if detail, ok := h.presenceDetail(userID); ok {
+		h.sendToClient(client, detail)
+	}
+}
+
+func (h *Hub) unsubscribe(client *Client, userID int64) {
+	h.subscriptionsMu.Lock()
+	defer h.subscriptionsMu.Unlock()
+	delete(client.watching, userID)
+	if subscribers := h.subscriptions[userID]; subscribers != nil {
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(h.subscriptions, userID)
+		}
+	}
+}
+
+// unsubscribeAll drops every presence subscription held by a closing session.
+func (h *Hub) unsubscribeAll(client *Client) {
+	h.subscriptionsMu.Lock()
+	defer h.subscriptionsMu.Unlock()
+	for userID := range client.watching {
+		if subscribers := h.subscriptions[userID]; subscribers != nil {
+			delete(subscribers, client)
+			if len(subscribers) == 0 {
+				delete(h.subscriptions, userID)
+			}
+		}
+	}
+	client.watching = nil
+}
+
+// notifySubscribers pushes the current presence of userID to its subscribers.
+func (h *Hub) notifySubscribers(userID int64) {
+	h.subscriptionsMu.Lock()
+	subscribers := make([]*Client, 0, len(h.subscriptions[userID]))
+	for client := range h.subscriptions[userID] {
+		subscribers = append(subscribers, client)
+	}
+	h.subscriptionsMu.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+
+	detail, ok := h.presenceDetail(userID)
+	if !ok {
+		return
+	}
+	for _, client := range subscribers {
+		h.sendToClient(client, detail)
+	}
+}
+
+func (h *Hub) presenceDetail(userID int64) (Message, bool) {
+	lastSeen, err := db.GetLastSeen([]int64{userID})
+	if err != nil {
+		log.Printf("Failed to fetch last seen for user %d: %v", userID, err)
+		return Message{}, false
+	}
+	seen, exists := lastSeen[userID]
+	if !exists {
+		return Message{}, false
+	}
+	detail := PresenceDetail{UserID: userID, Online: h.IsOnline(userID), LastSeen: &seen}
+	data, _ := json.Marshal(detail)
+	return Message{Type: "presence_detail", Data: data, Timestamp: time.Now().Unix()}, true
+}
@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"chatapp/internal/auth"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// authCheckPeriod is how often a session's token expiry is checked.
+	authCheckPeriod = 5 * time.Second
+
+	defaultReauthGracePeriod = 30 * time.Second
+	maximumReauthGracePeriod = 10 * time.Minute
+)
+
+var reauthConfiguration = struct {
+	sync.RWMutex
+	grace time.Duration
+}{grace: defaultReauthGracePeriod}
+
+// ConfigureReauthGracePeriod sets how long a session whose token has expired
+// may stay connected while the client presents a fresh one. An empty value
+// restores the default.
+func ConfigureReauthGracePeriod(value string) error {
+	grace := defaultReauthGracePeriod
+	if value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maximumReauthGracePeriod {
+			return fmt.Errorf("WS_REAUTH_GRACE_PERIOD must be a duration between 1s and %s", maximumReauthGracePeriod)
+		}
+		grace = parsed
+	}
+	reauthConfiguration.Lock()
+	reauthConfiguration.grace = grace
+	reauthConfiguration.Unlock()
+	return nil
+}
+
+func reauthGracePeriod() time.Duration {
+	reauthConfiguration.RLock()
+	defer reauthConfiguration.RUnlock()
+	return reauthConfiguration.grace
+}
+
+type tokenState int
+
+const (
+	tokenValid tokenState = iota
+	tokenReauthRequired
+	tokenExpired
+)
+
+// SetTokenExpiry records when the token that authenticated the session
+// expires. A zero time disables expiry checks for the session.
+func (c *Client) SetTokenExpiry(expiresAt time.Time) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	c.tokenExpiry = expiresAt
+	c.reauthDeadline = time.Time{}
+}
+
+// SetTokenID records the jti of the token that authenticated the session, so
+// that logging that token out closes the session at the next authorization
+// check.
+func (c *Client) SetTokenID(tokenID string) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	c.tokenID = tokenID
+}
+
+func (c *Client) currentTokenID() string {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.tokenID
+}
+
+// checkTokenExpiry reports whether the session must re-authenticate. The first
+// check after expiry starts the grace period and asks for a new token; once
+// the grace period passes without one the session is expired.
+func (c *Client) checkTokenExpiry(now time.Time) tokenState {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.tokenExpiry.IsZero() || now.Before(c.tokenExpiry) {
+		return tokenValid
+	}
+	if c.reauthDeadline.IsZero() {
+		c.reauthDeadline = now.Add(reauthGracePeriod())
+		return tokenReauthRequired
+	}
+	if now.Before(c.reauthDeadline) {
+		return tokenValid
+	}
+	return tokenExpired
+}
+
+// requestReauth tells the client its token has expired and how long it has to
+// send a reauth message.
+func (c *Client) requestReauth() {
+	data, _ := json.Marshal(map[string]int64{"grace_seconds": int64(reauthGracePeriod().Seconds())})
+	c.Hub.sendToClient(c, Message{Type: "reauth_required", To: c.UserID, Data: data, Timestamp: time.Now().Unix()})
+}
+
+// reauthenticate extends the session with a fresh token for the same user and
+// credentials version.
+func (c *Client) reauthenticate(token string) {
+	claims, err := auth.ValidateToken(token)
+	if err != nil || claims.UserID != c.UserID || claims.Version != c.AuthVersion || claims.ExpiresAt == nil {
+		c.Hub.sendToClient(c, Message{Type: "reauth_failed", To: c.UserID, Timestamp: time.Now().Unix()})
+		return
+	}
+	c.SetTokenExpiry(claims.ExpiresAt.Time)
+	c.SetTokenID(claims.ID)
+	data, _ := json.Marshal(map[string]int64{"expires_at": claims.ExpiresAt.Unix()})
+	c.Hub.sendToClient(c, Message{Type: "reauth_ok", To: c.UserID, Data: data, Timestamp: time.Now().Unix()})
+}
@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// resumeTokenTTL is how long after a disconnect a session can be resumed.
+	resumeTokenTTL = 2 * time.Minute
+
+	maximumResumableSessions = 10000
+
+	// maximumPresenceChanges bounds the presence log resumed sessions replay.
+	// A session that disconnected before the oldest kept change gets a full
+	// snapshot instead.
+	maximumPresenceChanges = 10000
+)
+
+// resumeState is what the hub remembers about a closed session so that a
+// reconnect can receive only what changed meanwhile.
+type resumeState struct {
+	UserID      int64
+	PresenceSeq int64 // last presence change the session was sent
+	ExpiresAt   time.Time
+}
+
+// presenceChange is one user coming online or going offline.
+type presenceChange struct {
+	Seq      int64
+	UserID   int64
+	Username string
+	Online   bool
+	At       time.Time
+}
+
+// recordPresence appends a presence change to the log. The caller holds h.mu.
+func (h *Hub) recordPresence(userID int64, username string, online bool, now time.Time) {
+	h.presenceSeq++
+	if len(h.presenceLog) >= maximumPresenceChanges {
+		h.presenceLog = h.presenceLog[1:]
+	}
+	h.presenceLog = append(h.presenceLog, presenceChange{Seq: h.presenceSeq, UserID: userID, Username: username, Online: online, At: now})
+}
+
+// presenceSince returns the presence changes after seq, and false when the
+// log no longer reaches back that far. The caller holds h.mu.
+func (h *Hub) presenceSince(seq int64) ([]presenceChange, bool) {
+	first := h.presenceSeq + 1
+	if len(h.presenceLog) > 0 {
+		first = h.presenceLog[0].Seq
+	}
+	if seq+1 < first || seq > h.presenceSeq {
+		return nil, false
+	}
+	return h.presenceLog[seq+1-first:], true
+}
+
+// remember keeps the state of a session that just left under its resume
+// token. The caller holds h.mu.
+func (h *Hub) remember(client *Client, now time.Time) {
+	if client.resumeToken == "" {
+		return
+	}
+	h.resumeMu.Lock()
+	defer h.resumeMu.Unlock()
+	if len(h.resumable) >= maximumResumableSessions {
+		return
+	}
+	h.resumable[client.resumeToken] = &resumeState{UserID: client.UserID, PresenceSeq: h.presenceSeq, ExpiresAt: now.Add(resumeTokenTTL)}
+}
+
+// pruneResumable forgets expired resume tokens and the presence changes no
+// unexpired token can need. It runs with the idle sweep.
+func (h *Hub) pruneResumable(now time.Time) {
+	h.resumeMu.Lock()
+	for token, state := range h.resumable {
+		if !state.ExpiresAt.After(now) {
+			delete(h.resumable, token)
+		}
+	}
+	h.resumeMu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	kept := 0
+	for kept < len(h.presenceLog) && now.Sub(h.presenceLog[kept].At) > resumeTokenTTL {
+		kept++
+	}
+	h.presenceLog = h.presenceLog[kept:]
+}
+
+// takeResume consumes a resume token presented by a reconnecting session of
+// userID. It returns nil for unknown, expired or foreign tokens, in which
+// case the session gets a full snapshot.
+func (h *Hub) takeResume(token string, userID int64, now time.Time) *resumeState {
+	if token == "" {
+		return nil
+	}
+	h.resumeMu.Lock()
+	defer h.resumeMu.Unlock()
+	state := h.resumable[token]
+	delete(h.resumable, token)
+	if state == nil || state.UserID != userID || !state.ExpiresAt.After(now) {
+		return nil
+	}
+	return state
+}
+
+// sendSession tells a newly registered session its resume token and whether
+// it resumed an earlier one.
+func (h *Hub) sendSession(client *Client, resumed bool) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"resume_token":       client.resumeToken,
+		"resume_ttl_seconds": int64(resumeTokenTTL.Seconds()),
+		"resumed":            resumed,
+	})
+	h.sendToClient(client, Message{Type: "session", To: client.UserID, Data: data, Timestamp: time.Now().Unix()})
+}
@@ -0,0 +1,249 @@
+package ws
+
+import (
+	"chatapp/internal/db"
+	"container/list"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSignalingRate     = 20 // frames per second from one session
+	defaultSignalingPeerRate = 30 // frames per second from one user to another, across sessions
+	maximumSignalingRate     = 10000
+
+	// signalingBurst is how many seconds of frames a bucket can hold, so that
+	// the candidates gathered at call setup pass unthrottled.
+	signalingBurst = 5
+
+	// maximumSignalingViolations dropped frames disconnect the session.
+	maximumSignalingViolations = 50
+
+	// maximumSignalingPeers bounds the sender/recipient buckets. The idle
+	// sweep forgets buckets that have refilled; while the table is full, new
+	// pairs are held to the per-session limit alone.
+	maximumSignalingPeers = 10000
+
+	// maximumCallSequences bounds the call sessions whose signaling is being
+	// numbered. Numbering stops with call_end or when the caller's or callee's
+	// last session drops, and the idle sweep forgets sessions without frames
+	// for callSequenceIdle. A new session past the limit evicts the one
+	// signaled least recently.
+	maximumCallSequences = 10000
+	callSequenceIdle     = time.Hour
+)
+
+var signalingConfiguration = struct {
+	sync.RWMutex
+	sessionRate int
+	peerRate    int
+}{sessionRate: defaultSignalingRate, peerRate: defaultSignalingPeerRate}
+
+// ConfigureSignalingLimits sets how many call signaling frames per second a
+// session, and a sender towards one recipient, may relay. Empty values keep
+// the defaults and 0 disables a limit.
+func ConfigureSignalingLimits(sessionRate, peerRate string) error {
+	parse := func(name, value string, fallback int) (int, error) {
+		if value == "" {
+			return fallback, nil
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > maximumSignalingRate {
+			return 0, fmt.Errorf("%s must be between 0 and %d", name, maximumSignalingRate)
+		}
+		return parsed, nil
+	}
+	session, err := parse("WS_SIGNALING_RATE", sessionRate, defaultSignalingRate)
+	if err != nil {
+		return err
+	}
+	peer, err := parse("WS_SIGNALING_PEER_RATE", peerRate, defaultSignalingPeerRate)
+	if err != nil {
+		return err
+	}
+	signalingConfiguration.Lock()
+	signalingConfiguration.sessionRate = session
+	signalingConfiguration.peerRate = peer
+	signalingConfiguration.Unlock()
+	return nil
+}
+
+func signalingLimits() (sessionRate, peerRate int) {
+	signalingConfiguration.RLock()
+	defer signalingConfiguration.RUnlock()
+	return signalingConfiguration.sessionRate, signalingConfiguration.peerRate
+}
+
+type signalingBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow takes one frame from the bucket, refilled at rate per second.
+func (b *signalingBucket) allow(rate int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	capacity := float64(rate * signalingBurst)
+	if b.updated.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.updated).Seconds()*float64(rate))
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (h *Hub) allowPeerSignaling(from, to int64, rate int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	h.signalingMu.Lock()
+	defer h.signalingMu.Unlock()
+	pair := typingPair{From: from, To: to}
+	bucket := h.signalingPeers[pair]
+	if bucket == nil {
+		if len(h.signalingPeers) >= maximumSignalingPeers {
+			return true
+		}
+		bucket = &signalingBucket{}
+		h.signalingPeers[pair] = bucket
+	}
+	return bucket.allow(rate, now)
+}
+
+// pruneSignalingPeers forgets buckets without frames for signalingBurst
+// seconds. Such a bucket is full again, so a fresh one behaves the same. It
+// runs with the idle sweep.
+func (h *Hub) pruneSignalingPeers(now time.Time) {
+	h.signalingMu.Lock()
+	defer h.signalingMu.Unlock()
+	for pair, bucket := range h.signalingPeers {
+		if now.Sub(bucket.updated) > signalingBurst*time.Second {
+			delete(h.signalingPeers, pair)
+		}
+	}
+}
+
+// callSequence numbers the signaling frames relayed within one call session.
+type callSequence struct {
+	relayed int64           // sequence number of the last relayed frame
+	seen    map[int64]int64 // sender -> highest client seq relayed
+	updated time.Time
+	order   *list.Element // position in Hub.callSequenceOrder
+}
+
+// sequenceSignaling assigns the next sequence number of a call session to a
+// frame from the given user, so that the receiving client can put answers
+// and ICE candidates back in order. A frame repeating a client seq the
+// sender already used in the session is a duplicate and reports false.
+// Frames without a session are not numbered.
+func (h *Hub) sequenceSignaling(sessionID string, from, clientSeq int64, now time.Time) (int64, bool) {
+	if sessionID == "" {
+		return 0, true
+	}
+	h.signalingMu.Lock()
+	defer h.signalingMu.Unlock()
+	sequence := h.callSequences[sessionID]
+	if sequence == nil {
+		if len(h.callSequences) >= maximumCallSequences {
+			h.forgetCallSequence(h.callSequenceOrder.Back().Value.(string))
+		}
+		sequence = &callSequence{seen: make(map[int64]int64, 2)}
+		sequence.order = h.callSequenceOrder.PushFront(sessionID)
+		h.callSequences[sessionID] = sequence
+	}
+	if clientSeq > 0 {
+		if clientSeq <= sequence.seen[from] {
+			return 0, false
+		}
+		sequence.seen[from] = clientSeq
+	}
+	sequence.relayed++
+	sequence.updated = now
+	h.callSequenceOrder.MoveToFront(sequence.order)
+	return sequence.relayed, true
+}
+
+// EndCallSequences stops numbering the signaling of ended call sessions.
+// Call it whenever a call session ends outside the signaling relay.
+func (h *Hub) EndCallSequences(sessionIDs ...string) {
+	h.signalingMu.Lock()
+	defer h.signalingMu.Unlock()
+	for _, sessionID := range sessionIDs {
+		h.forgetCallSequence(sessionID)
+	}
+}
+
+// forgetCallSequence drops the numbering of a call session. The caller holds
+// signalingMu.
+func (h *Hub) forgetCallSequence(sessionID string) {
+	if sequence := h.callSequences[sessionID]; sequence != nil {
+		h.callSequenceOrder.Remove(sequence.order)
+		delete(h.callSequences, sessionID)
+	}
+}
+
+// pruneCallSequences forgets call sessions without signaling for
+// callSequenceIdle, which were never ended. It runs with the idle sweep and
+// stops at the first session that is still busy.
+func (h *Hub) pruneCallSequences(now time.Time) {
+	h.signalingMu.Lock()
+	defer h.signalingMu.Unlock()
+	for oldest := h.callSequenceOrder.Back(); oldest != nil; oldest = h.callSequenceOrder.Back() {
+		sessionID := oldest.Value.(string)
+		if now.Sub(h.callSequences[sessionID].updated) <= callSequenceIdle {
+			return
+		}
+		h.forgetCallSequence(sessionID)
+	}
+}
+
+// SignalingViolations returns how many signaling frames have been dropped
+// for exceeding a limit or lacking a call session.
+func (h *Hub) SignalingViolations() int64 {
+	return h.signalingViolations.Load()
+}
+
+// allowSignaling reports whether a signaling frame from the client to the
+// given user may be relayed. Answers and ICE candidates also need an open
+// call session between the two users.
+func (c *Client) allowSignaling(eventType string, to int64, sessionID string, now time.Time) bool {
+	sessionRate, peerRate := signalingLimits()
+	if !c.signaling.allow(sessionRate, now) || !c.Hub.allowPeerSignaling(c.UserID, to, peerRate, now) {
+		c.signalingViolation(to, "rate limit exceeded")
+		return false
+	}
+	if eventType != "call_answer" && eventType != "call_ice" {
+		return true
+	}
+	open, err := db.HasOpenCall(c.UserID, to, sessionID)
+	if err != nil {
+		log.Printf("Failed to check call session between %d and %d: %v", c.UserID, to, err)
+		return false
+	}
+	if !open {
+		c.signalingViolation(to, eventType+" without an open call")
+		return false
+	}
+	return true
+}
+
+func (c *Client) signalingViolation(to int64, reason string) {
+	c.Hub.signalingViolations.Add(1)
+	c.signalingStrikes++
+	switch c.signalingStrikes {
+	case 1:
+		log.Printf("Dropped signaling from user %d to %d: %s", c.UserID, to, reason)
+	case maximumSignalingViolations:
+		log.Printf("Disconnecting user %d after %d dropped signaling frames", c.UserID, c.signalingStrikes)
+		c.abusive.Store(true)
+	}
+}
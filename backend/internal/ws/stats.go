@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// SessionStats describes one connected session for troubleshooting. It
+// carries no usernames, tokens or addresses. Buffered, Capacity and Dropped
+// describe Send; the Control fields the low-priority control buffer.
+type SessionStats struct {
+	UserID          int64 `json:"user_id"`
+	Buffered        int   `json:"buffered"`
+	Capacity        int   `json:"capacity"`
+	Dropped         int64 `json:"dropped"`
+	ControlBuffered int   `json:"control_buffered"`
+	ControlCapacity int   `json:"control_capacity"`
+	ControlDropped  int64 `json:"control_dropped"`
+	IdleSeconds     int64 `json:"idle_seconds"`
+	Batching        bool  `json:"batching"`
+}
+
+// HubStats is a point-in-time view of the hub's delivery state.
+type HubStats struct {
+	OnlineUsers         int            `json:"online_users"`
+	Sessions            []SessionStats `json:"sessions"`
+	DroppedSends        int64          `json:"dropped_sends"`
+	DroppedControl      int64          `json:"dropped_control"`
+	SlowConsumers       int64          `json:"slow_consumers"`
+	SignalingViolations int64          `json:"signaling_violations"`
+}
+
+// trySend queues data for the session without blocking and counts the frames
+// it has to drop because the buffer is full; see noteDrop.
+func (c *Client) trySend(data []byte) bool {
+	select {
+	case c.Send <- data:
+		return true
+	default:
+		c.Hub.droppedSends.Add(1)
+		c.noteDrop(c.dropped.Add(1))
+		return false
+	}
+}
+
+// tryControl queues an ephemeral control event on the low-priority buffer. A
+// full control buffer drops the event without touching Send, so control
+// chatter never costs a session a message.
+func (c *Client) tryControl(data []byte) bool {
+	select {
+	case c.control <- data:
+		return true
+	default:
+		c.controlDropped.Add(1)
+		c.Hub.droppedControl.Add(1)
+		return false
+	}
+}
+
+// send queues data on the buffer its event type belongs to.
+func (c *Client) send(eventType string, data []byte) bool {
+	if controlEvents[eventType] {
+		return c.tryControl(data)
+	}
+	return c.trySend(data)
+}
+
+// Stats snapshots every session under a single read lock, so delivery, which
+// takes the same read lock, is never blocked by it. DroppedSends counts drops
+// since the hub started, DroppedControl the control events dropped and
+// SlowConsumers the sessions disconnected for dropping too many; each
+// session's counters start when it connected.
+func (h *Hub) Stats(now time.Time) HubStats {
+	stats := HubStats{
+		Sessions:            make([]SessionStats, 0),
+		DroppedSends:        h.droppedSends.Load(),
+		DroppedControl:      h.droppedControl.Load(),
+		SlowConsumers:       h.slowConsumers.Load(),
+		SignalingViolations: h.SignalingViolations(),
+	}
+	h.mu.RLock()
+	stats.OnlineUsers = len(h.Clients)
+	for userID, sessions := range h.Clients {
+		for client := range sessions {
+			stats.Sessions = append(stats.Sessions, SessionStats{
+				UserID:          userID,
+				Buffered:        len(client.Send),
+				Capacity:        cap(client.Send),
+				Dropped:         client.dropped.Load(),
+				ControlBuffered: len(client.control),
+				ControlCapacity: cap(client.control),
+				ControlDropped:  client.controlDropped.Load(),
+				IdleSeconds:     int64(client.idleSince(now).Seconds()),
+				Batching:        client.batching.Load(),
+			})
+		}
+	}
+	h.mu.RUnlock()
+
+	slices.SortFunc(stats.Sessions, func(a, b SessionStats) int {
+		return cmp.Compare(a.UserID, b.UserID)
+	})
+	return stats
+}
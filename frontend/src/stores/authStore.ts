@@ -127,6 +127,8 @@ export const useAuthStore = create<AuthState>((set) => ({
   },
 
   logout: () => {
+    // Best effort: the request reads the token before it is removed below.
+    void api.logout().catch(() => undefined);
     resetSessionState();
     localStorage.removeItem('token');
     set({
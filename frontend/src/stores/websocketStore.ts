@@ -32,6 +32,7 @@ interface DecodedSignal {
 
 // Module-level tracking to prevent reconnect loops and stale socket interference
 let reconnectTimer: ReturnType<typeof setTimeout> | null = null;
+let stopWaitingForActivity: (() => void) | null = null;
 let reconnectAttempts = 0;
 let currentSocket: WebSocket | null = null;
 let connectionAttempt: Promise<void> | null = null;
@@ -39,6 +40,9 @@ let manualDisconnect = false;
 
 const BASE_RECONNECT_DELAY_MS = 1000;
 const MAX_RECONNECT_DELAY_MS = 10000;
+// Close code the server uses when it evicts an idle connection.
+const IDLE_CLOSE_CODE = 4000;
+const ACTIVITY_EVENTS = ['pointerdown', 'keydown', 'focus'] as const;
 
 function trimTrailingSlash(value: string) {
   return value.replace(/\/+$/, '');
@@ -185,6 +189,7 @@ function parseSignalPayload(data: unknown): DecodedSignal {
 }
 
 function clearReconnectTimer() {
+  stopWaitingForActivity?.();
   if (!reconnectTimer) return;
   clearTimeout(reconnectTimer);
   reconnectTimer = null;
@@ -215,6 +220,29 @@ function scheduleReconnect(connect: () => Promise<void>) {
   }, delay);
 }
 
+// reconnectOnActivity defers reconnecting after an idle eviction until the
+// user interacts with the page again.
+function reconnectOnActivity(connect: () => Promise<void>) {
+  clearReconnectTimer();
+
+  const onActivity = () => {
+    if (document.visibilityState !== 'visible') return;
+    stopWaitingForActivity?.();
+    void connect();
+  };
+  for (const name of ACTIVITY_EVENTS) {
+    window.addEventListener(name, onActivity);
+  }
+  document.addEventListener('visibilitychange', onActivity);
+  stopWaitingForActivity = () => {
+    for (const name of ACTIVITY_EVENTS) {
+      window.removeEventListener(name, onActivity);
+    }
+    document.removeEventListener('visibilitychange', onActivity);
+    stopWaitingForActivity = null;
+  };
+}
+
 function dispatchWindowEvent<T>(name: string, detail: T) {
   window.dispatchEvent(new CustomEvent<T>(name, { detail }));
 }
@@ -420,6 +448,10 @@ export const useWebSocketStore = create<WebSocketState>((set, get) => ({
           set({ isConnected: false, socket: null });
 
           if (manualDisconnect || !localStorage.getItem('token')) return;
+          if (event.code === IDLE_CLOSE_CODE) {
+            reconnectOnActivity(get().connect);
+            return;
+          }
           scheduleReconnect(get().connect);
         };
 
@@ -103,6 +103,9 @@ export const api = {
       true,
     ), // skip auth redirect on 401
 
+  // Revokes this device's token on the server; other devices stay signed in.
+  logout: () => fetchWithAuth('/api/logout', { method: 'POST' }, true),
+
   validateInvite: (code: string) =>
     fetchWithAuth('/api/invite/validate', {
       method: 'POST',